@@ -3,20 +3,29 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
-	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"song-recognition/db"
+	"song-recognition/jobs"
+	"song-recognition/models"
+	"song-recognition/service"
 	"song-recognition/shazam"
 	"song-recognition/spotify"
 	"song-recognition/utils"
 	"song-recognition/wav"
 	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/fatih/color"
 	socketio "github.com/googollee/go-socket.io"
@@ -33,20 +42,36 @@ const (
 
 var yellow = color.New(color.FgYellow)
 
-func find(filePath string) {
-	wavInfo, err := wav.ReadWavInfo(filePath)
+// songService implements the operations shared by the CLI, the socket.io events and the HTTP API.
+// It's set up by openDB, or by serve, with the DB client used by the whole command.
+var songService *service.Service
+
+// openDB connects to the database and sets up songService with the client.
+// It exits if the database can't be opened.
+func openDB() db.DBClient {
+	ctx := context.Background()
+
+	dbClient, err := db.NewDBClient(ctx)
 	if err != nil {
-		yellow.Println("Error reading wave info:", err)
-		return
+		yellow.Printf("Error connecting to the database: %v\n", err)
+		os.Exit(1)
 	}
 
-	samples, err := wav.WavBytesToSamples(wavInfo.Data)
+	songService = service.New(SONGS_DIR, dbClient)
+	return dbClient
+}
+
+func find(filePath string) {
+	ctx := context.Background()
+
+	reader, err := wav.OpenReader(filePath)
 	if err != nil {
-		yellow.Println("Error converting to samples:", err)
+		yellow.Println("Error reading wave info:", err)
 		return
 	}
+	defer reader.Close()
 
-	matches, searchDuration, err := shazam.FindMatches(samples, wavInfo.Duration, wavInfo.SampleRate)
+	matches, searchDuration, err := shazam.FindMatchesStream(ctx, songService.DB, reader, reader.SampleRate, reader.NumSamples())
 	if err != nil {
 		yellow.Println("Error finding matches:", err)
 		return
@@ -67,49 +92,83 @@ func find(filePath string) {
 
 	fmt.Println(msg)
 	for _, match := range topMatches {
-		fmt.Printf("\t- %s by %s, score: %.2f\n",
-			match.SongTitle, match.SongArtist, match.Score)
+		fmt.Printf("\t- %s by %s, score: %.2f, confidence: %.2f\n",
+			match.SongTitle, match.SongArtist, match.Score, match.Confidence)
 	}
 
 	fmt.Printf("\nSearch took: %s\n", searchDuration)
-	topMatch := topMatches[0]
-	fmt.Printf("\nFinal prediction: %s by %s , score: %.2f\n",
-		topMatch.SongTitle, topMatch.SongArtist, topMatch.Score)
+
+	accepted := shazam.DefaultDecisionRule().Filter(matches)
+	if len(accepted) == 0 {
+		fmt.Println("\nNo confident match found.")
+		return
+	}
+
+	topMatch := accepted[0]
+	fmt.Printf("\nFinal prediction: %s by %s , score: %.2f, confidence: %.2f\n",
+		topMatch.SongTitle, topMatch.SongArtist, topMatch.Score, topMatch.Confidence)
 }
 
 func download(spotifyURL string) {
+	ctx := context.Background()
+
 	err := utils.CreateFolder(SONGS_DIR)
 	if err != nil {
 		err := xerrors.New(err)
 		logger := utils.GetLogger()
-		ctx := context.Background()
 		logMsg := fmt.Sprintf("failed to create directory %v", SONGS_DIR)
 		logger.ErrorContext(ctx, logMsg, slog.Any("error", err))
 	}
 
 	if strings.Contains(spotifyURL, "album") {
-		_, err := spotify.DlAlbum(spotifyURL, SONGS_DIR)
+		_, err := spotify.DlAlbum(ctx, songService.DB, spotifyURL, SONGS_DIR)
 		if err != nil {
 			yellow.Println("Error: ", err)
 		}
 	}
 
 	if strings.Contains(spotifyURL, "playlist") {
-		_, err := spotify.DlPlaylist(spotifyURL, SONGS_DIR)
+		_, err := spotify.DlPlaylist(ctx, songService.DB, spotifyURL, SONGS_DIR)
 		if err != nil {
 			yellow.Println("Error: ", err)
 		}
 	}
 
 	if strings.Contains(spotifyURL, "track") {
-		_, err := spotify.DlSingleTrack(spotifyURL, SONGS_DIR)
+		_, err := spotify.DlSingleTrack(ctx, songService.DB, spotifyURL, SONGS_DIR)
 		if err != nil {
 			yellow.Println("Error: ", err)
 		}
 	}
 }
 
-func serve(protocol, port string) {
+func serve(protocol, port string, memIndex bool) {
+	ctx := context.Background()
+
+	if err := migrate(); err != nil {
+		log.Fatalf("failed to migrate the database: %v", err)
+	}
+
+	dbClient, err := db.NewDBClient(ctx)
+	if err != nil {
+		log.Fatalf("failed to connect to the database: %v", err)
+	}
+
+	if memIndex {
+		dbClient, err = loadMemIndex(ctx, dbClient)
+		if err != nil {
+			log.Fatalf("failed to load the fingerprints in memory: %v", err)
+		}
+	}
+	songService = service.New(SONGS_DIR, dbClient)
+
+	// The server only removes its own temporary files when it stops
+	tempDir, err := os.MkdirTemp("tmp", "server-")
+	if err != nil {
+		log.Fatalf("failed to create the temporary directory: %v", err)
+	}
+	utils.TempDir = tempDir
+
 	protocol = strings.ToLower(protocol)
 	var allowOriginFunc = func(r *http.Request) bool {
 		return true
@@ -126,8 +185,13 @@ func serve(protocol, port string) {
 		},
 	})
 
+	// The work of the requests, sockets and jobs is canceled once it had
+	// the time to finish on shutdown
+	workCtx, cancelWork := context.WithCancel(ctx)
+	defer cancelWork()
+
 	server.OnConnect("/", func(socket socketio.Conn) error {
-		socket.SetContext("")
+		handleConnect(workCtx, socket)
 		log.Println("CONNECTED: ", socket.ID())
 
 		return nil
@@ -135,39 +199,91 @@ func serve(protocol, port string) {
 
 	server.OnEvent("/", "totalSongs", handleTotalSongs)
 	server.OnEvent("/", "newDownload", handleSongDownload)
+	server.OnEvent("/", "jobSubscribe", handleJobSubscribe)
 	server.OnEvent("/", "newRecording", handleNewRecording)
+	server.OnEvent("/", "streamStart", handleStreamStart)
+	server.OnEvent("/", "streamChunk", handleStreamChunk)
+	server.OnEvent("/", "streamEnd", handleStreamEnd)
 
 	server.OnError("/", func(s socketio.Conn, e error) {
 		log.Println("meet error:", e)
 	})
 
 	server.OnDisconnect("/", func(s socketio.Conn, reason string) {
+		handleDisconnect(s)
 		log.Println("closed", reason)
 	})
 
+	queue := jobs.NewQueue(SONGS_DIR, dbClient)
+	queue.OnProgress = broadcastJobProgress(server)
+	songService.Queue = queue
+	go queue.Run(workCtx)
+
 	go func() {
-		if err := server.Serve(); err != nil {
+		// Serve returns io.EOF once the server is closed
+		if err := server.Serve(); err != nil && err != io.EOF {
 			log.Fatalf("socketio listen error: %s\n", err)
 		}
 	}()
-	defer server.Close()
 
-	serveHTTPS := protocol == "https"
+	signalCtx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	httpServer := newHTTPServer(workCtx, server, port)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serveHTTP(httpServer, protocol == "https")
+	}()
+
+	select {
+	case err = <-serveErr:
+		log.Printf("HTTP server error: %v", err)
+	case <-signalCtx.Done():
+		// A second signal stops the server right away
+		stop()
+		log.Println("Shutting down...")
+	}
+
+	shutdown(httpServer, server, queue, dbClient, cancelWork)
+	if err != nil {
+		os.Exit(1)
+	}
+	log.Println("Server stopped")
+}
+
+// loadMemIndex loads the fingerprints into an in-memory index, and returns
+// a client looking the recordings up in it.
+func loadMemIndex(ctx context.Context, dbClient db.DBClient) (db.DBClient, error) {
+	startTime := time.Now()
+	idx, err := db.LoadMemIndex(ctx, dbClient)
+	if err != nil {
+		return nil, err
+	}
 
-	serveHTTP(server, serveHTTPS, port)
+	log.Printf("Loaded %d fingerprint couples in memory in %v", idx.Len(), time.Since(startTime))
+	return db.NewIndexedClient(dbClient, idx), nil
 }
 
-func serveHTTP(socketServer *socketio.Server, serveHTTPS bool, port string) {
-	http.Handle("/socket.io/", socketServer)
+// newHTTPServer returns a server for the socket.io server and the API.
+// The contexts of the requests derive from baseCtx.
+func newHTTPServer(baseCtx context.Context, socketServer *socketio.Server, port string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/socket.io/", socketServer)
+	registerAPIHandlers(mux)
+
+	return &http.Server{
+		Addr:        ":" + port,
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+}
 
+// serveHTTP serves HTTP or HTTPS requests until the server is shut down.
+func serveHTTP(httpServer *http.Server, serveHTTPS bool) error {
+	var err error
 	if serveHTTPS {
-		httpsAddr := ":" + port
-		httpsServer := &http.Server{
-			Addr: httpsAddr,
-			TLSConfig: &tls.Config{
-				MinVersion: tls.VersionTLS12,
-			},
-			Handler: socketServer,
+		httpServer.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
 		}
 
 		cert_key_default := "/etc/letsencrypt/live/localport.online/privkey.pem"
@@ -176,39 +292,328 @@ func serveHTTP(socketServer *socketio.Server, serveHTTPS bool, port string) {
 		cert_key := utils.GetEnv("CERT_KEY", cert_key_default)
 		cert_file := utils.GetEnv("CERT_FILE", cert_file_default)
 		if cert_key == "" || cert_file == "" {
-			log.Fatal("Missing cert")
+			return fmt.Errorf("missing cert")
 		}
 
-		log.Printf("Starting HTTPS server on %s\n", httpsAddr)
-		if err := httpsServer.ListenAndServeTLS(cert_file, cert_key); err != nil {
-			log.Fatalf("HTTPS server ListenAndServeTLS: %v", err)
+		log.Printf("Starting HTTPS server on %s\n", httpServer.Addr)
+		err = httpServer.ListenAndServeTLS(cert_file, cert_key)
+	} else {
+		log.Printf("Starting HTTP server on %s", httpServer.Addr)
+		err = httpServer.ListenAndServe()
+	}
+
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func printJSON(data interface{}) {
+	jsonData, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		yellow.Println("Error encoding JSON:", err)
+		return
+	}
+	fmt.Println(string(jsonData))
+}
+
+func listSongs(filter service.SongFilter, asJSON bool) {
+	ctx := context.Background()
+
+	songs, err := songService.FindSongs(ctx, filter)
+	if err != nil {
+		yellow.Printf("Error: %v\n", err)
+		return
+	}
+
+	if asJSON {
+		printJSON(songs)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTITLE\tARTIST\tYOUTUBE ID\tVERSION")
+	for _, song := range songs {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\n", song.ID, song.Title, song.Artist, song.YouTubeID, song.FingerprintVersion)
+	}
+	w.Flush()
+	fmt.Printf("\n%d songs\n", len(songs))
+}
+
+func showSong(ref string, asJSON bool) {
+	ctx := context.Background()
+
+	song, err := songService.ResolveSong(ctx, ref)
+	if err != nil {
+		yellow.Printf("Error: %v\n", err)
+		return
+	}
+
+	details, err := songService.ShowSong(ctx, song.ID)
+	if err != nil {
+		yellow.Printf("Error: %v\n", err)
+		return
+	}
+
+	if asJSON {
+		printJSON(details)
+		return
+	}
+
+	filePath := details.FilePath
+	if filePath == "" {
+		filePath = "(not found in " + SONGS_DIR + ")"
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%d\n", details.ID)
+	fmt.Fprintf(w, "Title:\t%s\n", details.Title)
+	fmt.Fprintf(w, "Artist:\t%s\n", details.Artist)
+	fmt.Fprintf(w, "Artists:\t%s\n", strings.Join(details.Artists, ", "))
+	fmt.Fprintf(w, "Album:\t%s\n", details.Album)
+	fmt.Fprintf(w, "Duration:\t%s\n", time.Duration(details.Duration*float64(time.Second)).Round(time.Second))
+	fmt.Fprintf(w, "ISRC:\t%s\n", details.ISRC)
+	fmt.Fprintf(w, "YouTube ID:\t%s\n", details.YouTubeID)
+	fmt.Fprintf(w, "Spotify ID:\t%s\n", details.SpotifyID)
+	fmt.Fprintf(w, "Source:\t%s\n", details.SourceType)
+	fmt.Fprintf(w, "Source path:\t%s\n", details.SourcePath)
+	fmt.Fprintf(w, "Content hash:\t%s\n", details.ContentHash)
+	if !details.IngestedAt.IsZero() {
+		fmt.Fprintf(w, "Ingested at:\t%s\n", details.IngestedAt.Format(time.DateTime))
+	}
+	fmt.Fprintf(w, "Fingerprint version:\t%d\n", details.FingerprintVersion)
+	fmt.Fprintf(w, "Fingerprints:\t%d\n", details.Fingerprints)
+	fmt.Fprintf(w, "File:\t%s\n", filePath)
+	w.Flush()
+}
+
+// deleteSong deletes a song and its fingerprints, and its WAV file unless keepFile is set.
+func deleteSong(ref string, keepFile bool) {
+	ctx := context.Background()
+
+	song, err := songService.ResolveSong(ctx, ref)
+	if err != nil {
+		yellow.Printf("Error: %v\n", err)
+		return
+	}
+
+	if keepFile {
+		err = songService.DeleteSong(ctx, song.ID)
+	} else {
+		var filePath string
+		filePath, err = songService.DeleteSongAndFile(ctx, song.ID)
+		if err == nil && filePath != "" {
+			fmt.Printf("Removed %s\n", filePath)
 		}
 	}
+	if err != nil {
+		yellow.Printf("Error: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Deleted '%s' by '%s' (%d)\n", song.Title, song.Artist, song.ID)
+}
+
+func updateSong(ref string, update service.SongUpdate) {
+	ctx := context.Background()
+
+	song, err := songService.ResolveSong(ctx, ref)
+	if err != nil {
+		yellow.Printf("Error: %v\n", err)
+		return
+	}
 
-	log.Printf("Starting HTTP server on port %v", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatalf("HTTP server ListenAndServe: %v", err)
+	song, err = songService.UpdateSong(ctx, song.ID, update)
+	if err != nil {
+		yellow.Printf("Error: %v\n", err)
+		return
 	}
+
+	fmt.Printf("Updated song %d: '%s' by '%s' (YouTube ID: %s)\n", song.ID, song.Title, song.Artist, song.YouTubeID)
 }
 
-func erase(songsDir string) {
-	logger := utils.GetLogger()
+// migrate applies the pending schema migrations.
+func migrate() error {
 	ctx := context.Background()
 
-	// wipe db
-	dbClient, err := db.NewDBClient()
+	dbClient, err := db.OpenDBClient(ctx)
 	if err != nil {
-		msg := fmt.Sprintf("Error creating DB client: %v\n", err)
-		logger.ErrorContext(ctx, msg, slog.Any("error", err))
+		return err
 	}
+	defer dbClient.Close()
+
+	migrated, err := dbClient.Migrate(ctx)
+	for _, migration := range migrated {
+		fmt.Printf("Applied migration %d: %s\n", migration.Version, migration.Description)
+	}
+	return err
+}
 
-	err = dbClient.DeleteCollection("fingerprints")
+func migrationStatus() {
+	ctx := context.Background()
+
+	dbClient, err := db.OpenDBClient(ctx)
+	if err != nil {
+		yellow.Println("Error creating DB client:", err)
+		return
+	}
+	defer dbClient.Close()
+
+	statuses, err := dbClient.MigrationStatus(ctx)
+	if err != nil {
+		yellow.Println("Error getting migrations:", err)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tDESCRIPTION\tAPPLIED AT")
+	for _, status := range statuses {
+		appliedAt := "pending"
+		if status.Applied {
+			appliedAt = status.AppliedAt.Format(time.DateTime)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, status.Description, appliedAt)
+	}
+	w.Flush()
+}
+
+// gc deletes the fingerprints left behind by deleted songs.
+func gc(dryRun bool) {
+	ctx := context.Background()
+
+	count, err := songService.DeleteOrphanedCouples(ctx, dryRun)
+	if err != nil {
+		yellow.Printf("Error: %v\n", err)
+		return
+	}
+
+	if dryRun {
+		fmt.Printf("%d orphaned couples found\n", count)
+		return
+	}
+	fmt.Printf("%d orphaned couples deleted\n", count)
+}
+
+// checkSongIDs reports the songs whose ID is shared with the fingerprints of
+// another song, and registers them again under a new ID with repair.
+func checkSongIDs(repair bool) {
+	ctx := context.Background()
+
+	checks, unchecked, err := songService.CheckSongIDs(ctx, repair)
+	if err != nil {
+		yellow.Printf("Error: %v\n", err)
+		return
+	}
+
+	duplicates := 0
+	for _, check := range checks {
+		if !check.Duplicate() {
+			continue
+		}
+		duplicates++
+
+		fmt.Printf("Song %d ('%s' by '%s') has %d fingerprints, its file %s only %d\n",
+			check.Song.ID, check.Song.Title, check.Song.Artist, check.Stored, check.FilePath, check.Expected)
+		if check.NewID != 0 {
+			fmt.Printf("  registered again as song %d\n", check.NewID)
+		}
+	}
+
+	fmt.Printf("\nChecked %d songs, %d share their ID with another song\n", len(checks), duplicates)
+	if duplicates > 0 && !repair {
+		fmt.Println("Run db check-ids -repair to register them again under a new ID")
+	}
+	if len(unchecked) > 0 {
+		yellow.Printf("%d songs have no WAV file in %s or an outdated fingerprint version and weren't checked\n",
+			len(unchecked), SONGS_DIR)
+	}
+}
+
+func listJobs(unfinishedOnly bool) {
+	ctx := context.Background()
+
+	jobs, err := songService.ListJobs(ctx, unfinishedOnly)
+	if err != nil {
+		yellow.Println("Error listing jobs:", err)
+		return
+	}
+
+	if len(jobs) == 0 {
+		fmt.Println("No jobs")
+		return
+	}
+
+	for _, job := range jobs {
+		status := "running"
+		if job.Canceled {
+			status = "canceled"
+		} else if job.Finished() {
+			status = "finished"
+		}
+		fmt.Printf("%d\t%s\t%-8s\t%d/%d done, %d failed\t%s\n",
+			job.ID, job.CreatedAt.Format(time.DateTime), status,
+			job.Count(models.TrackDone), len(job.Tracks), job.Count(models.TrackFailed), job.Source)
+	}
+}
+
+func printJob(job models.Job) {
+	fmt.Printf("Job %d (%s)\n", job.ID, job.Source)
+	fmt.Printf("Created: %s, canceled: %v\n", job.CreatedAt.Format(time.DateTime), job.Canceled)
+
+	for _, track := range job.Tracks {
+		fmt.Printf("%4d  %-14s  '%s' by '%s'", track.Index, track.State, track.Title, track.Artist)
+		if track.Attempts > 0 {
+			fmt.Printf(" (%d attempts)", track.Attempts)
+		}
+		if track.State == models.TrackQueued && track.NextAttemptAt.After(time.Now()) {
+			fmt.Printf(" next attempt at %s", track.NextAttemptAt.Format(time.DateTime))
+		}
+		if track.Error != "" {
+			yellow.Printf(" error: %s", track.Error)
+		}
+		fmt.Println()
+	}
+}
+
+// jobCommand runs the jobs subcommands acting on a single job: status, cancel and retry.
+func jobCommand(action string, jobIDParam string) {
+	ctx := context.Background()
+
+	jobID, err := strconv.ParseUint(jobIDParam, 10, 32)
+	if err != nil {
+		yellow.Printf("Invalid job ID: %s\n", jobIDParam)
+		return
+	}
+
+	var job models.Job
+	switch action {
+	case "cancel":
+		job, err = songService.CancelJob(ctx, uint32(jobID))
+	case "retry":
+		job, err = songService.RetryJob(ctx, uint32(jobID))
+	default:
+		job, err = songService.GetJob(ctx, uint32(jobID))
+	}
+	if err != nil {
+		yellow.Printf("Error: %v\n", err)
+		return
+	}
+
+	printJob(job)
+}
+
+func erase(songsDir string) {
+	logger := utils.GetLogger()
+	ctx := context.Background()
+
+	// wipe db
+	err := songService.DB.DeleteCollection(ctx, "fingerprints")
 	if err != nil {
 		msg := fmt.Sprintf("Error deleting collection: %v\n", err)
 		logger.ErrorContext(ctx, msg, slog.Any("error", err))
 	}
 
-	err = dbClient.DeleteCollection("songs")
+	err = songService.DB.DeleteCollection(ctx, "songs")
 	if err != nil {
 		msg := fmt.Sprintf("Error deleting collection: %v\n", err)
 		logger.ErrorContext(ctx, msg, slog.Any("error", err))
@@ -240,6 +645,8 @@ func erase(songsDir string) {
 }
 
 func save(path string, force bool) {
+	ctx := context.Background()
+
 	fileInfo, err := os.Stat(path)
 	if err != nil {
 		fmt.Printf("Error stating path %v: %v\n", path, err)
@@ -254,7 +661,7 @@ func save(path string, force bool) {
 			}
 			// Process only files, skip directories
 			if !info.IsDir() {
-				err := saveSong(filePath, force)
+				err := saveSong(ctx, filePath, force)
 				if err != nil {
 					fmt.Printf("Error saving song (%v): %v\n", filePath, err)
 				}
@@ -265,58 +672,136 @@ func save(path string, force bool) {
 			fmt.Printf("Error walking the directory %v: %v\n", path, err)
 		}
 	} else {
-		err := saveSong(path, force)
+		err := saveSong(ctx, path, force)
 		if err != nil {
 			fmt.Printf("Error saving song (%v): %v\n", path, err)
 		}
 	}
 }
 
-func saveSong(filePath string, force bool) error {
-	metadata, err := wav.GetMetadata(filePath)
+func saveSong(ctx context.Context, filePath string, force bool) error {
+	_, err := songService.SaveSong(ctx, filePath, "", "", force)
+	return err
+}
+
+// reindex fingerprints the WAV files in songsDir again with the current
+// fingerprint version. Songs already fingerprinted with it are skipped, so an
+// interrupted reindex resumes where it stopped. The database is only recorded
+// as indexed with the current version once every song is; the songs that
+// can't be reindexed, e.g. because their WAV file is missing, are reported,
+// or deleted with deleteFailed.
+func reindex(songsDir string, deleteFailed bool) {
+	ctx := context.Background()
+
+	dbClient := songService.DB
+
+	version, err := shazam.IndexVersion(ctx, dbClient)
 	if err != nil {
-		return err
+		yellow.Println("Error getting fingerprint version:", err)
+		return
 	}
+	fmt.Printf("Reindexing songs from fingerprint version %d to %d...\n", version, shazam.FingerprintVersion)
 
-	durationFloat, err := strconv.ParseFloat(metadata.Format.Duration, 64)
+	reindexed, upToDate := 0, 0
+	err = filepath.Walk(songsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != ".wav" {
+			return nil
+		}
+
+		done, err := reindexSong(ctx, dbClient, path)
+		if err != nil {
+			fmt.Printf("Error reindexing song (%v): %v\n", path, err)
+			return nil
+		}
+
+		if done {
+			reindexed++
+		} else {
+			upToDate++
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to parse duration to float: %v", err)
+		yellow.Printf("Error walking through directory %s: %v\n", songsDir, err)
 	}
 
-	tags := metadata.Format.Tags
-	track := &spotify.Track{
-		Album:    tags["album"],
-		Artist:   tags["artist"],
-		Title:    tags["title"],
-		Duration: int(math.Round(durationFloat)),
+	fmt.Printf("\nReindexed %d songs, %d were up to date\n", reindexed, upToDate)
+
+	songs, err := songService.FindSongs(ctx, service.SongFilter{})
+	if err != nil {
+		yellow.Println("Error listing songs:", err)
+		return
 	}
 
-	ytID, err := spotify.GetYoutubeId(*track)
-	if err != nil && !force {
-		return fmt.Errorf("failed to get YouTube ID for song: %v", err)
+	var failed []db.Song
+	for _, song := range songs {
+		if song.FingerprintVersion != shazam.FingerprintVersion {
+			failed = append(failed, song)
+		}
 	}
 
-	if track.Title == "" {
-		return fmt.Errorf("no title found in metadata")
+	if deleteFailed {
+		var kept []db.Song
+		for _, song := range failed {
+			if err := dbClient.DeleteSongByID(ctx, song.ID); err != nil {
+				fmt.Printf("Error deleting song %d: %v\n", song.ID, err)
+				kept = append(kept, song)
+				continue
+			}
+			fmt.Printf("Deleted song %d (%s by %s)\n", song.ID, song.Title, song.Artist)
+		}
+		failed = kept
 	}
-	if track.Artist == "" {
-		return fmt.Errorf("no artist found in metadata")
+
+	if len(failed) > 0 {
+		yellow.Printf("%d songs couldn't be reindexed, the database stays on fingerprint version %d:\n", len(failed), version)
+		for _, song := range failed {
+			fmt.Printf("\t- %d: %s by %s\n", song.ID, song.Title, song.Artist)
+		}
+		fmt.Println("Save them again or delete them, e.g. with reindex -delete-failed, then run reindex again.")
+		return
+	}
+
+	err = shazam.SetIndexVersion(ctx, dbClient, shazam.FingerprintVersion)
+	if err != nil {
+		yellow.Println("Error recording fingerprint version:", err)
+		return
 	}
+	fmt.Printf("The database is indexed with fingerprint version %d\n", shazam.FingerprintVersion)
+}
 
-	err = spotify.ProcessAndSaveSong(filePath, track.Title, track.Artist, ytID)
+// reindexSong registers the song stored in the WAV file at filePath again,
+// keeping its metadata, and fingerprints it with the current version. It
+// returns false if the song already was fingerprinted with it.
+func reindexSong(ctx context.Context, dbClient db.DBClient, filePath string) (bool, error) {
+	metadata, err := wav.GetMetadata(ctx, filePath)
 	if err != nil {
-		return fmt.Errorf("failed to process or save song: %v", err)
+		return false, err
+	}
+
+	title, artist := metadata.Format.Tags["title"], metadata.Format.Tags["artist"]
+	if title == "" || artist == "" {
+		return false, fmt.Errorf("no title or artist found in metadata")
 	}
 
-	// Move song in wav format to songs directory
-	fileName := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
-	wavFile := fileName + ".wav"
-	sourcePath := filepath.Join(filepath.Dir(filePath), wavFile)
-	newFilePath := filepath.Join(SONGS_DIR, wavFile)
-	err = os.Rename(sourcePath, newFilePath)
+	song, songExists, err := dbClient.GetSongByKey(ctx, utils.GenerateSongKey(title, artist))
 	if err != nil {
-		return fmt.Errorf("failed to rename temporary file to output file: %v", err)
+		return false, err
+	}
+	if !songExists {
+		return false, fmt.Errorf("song isn't registered in the database")
+	}
+	if song.FingerprintVersion == shazam.FingerprintVersion {
+		return false, nil
 	}
 
-	return nil
+	// The database may still be on the previous version. The song is only
+	// deleted once it's fingerprinted again, so a failure doesn't lose it.
+	if _, err := spotify.ReplaceSongFile(ctx, dbClient, filePath, song); err != nil {
+		return false, err
+	}
+	return true, nil
 }
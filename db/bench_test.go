@@ -0,0 +1,75 @@
+package db
+
+import (
+	"context"
+	"math/rand"
+	"song-recognition/models"
+	"testing"
+)
+
+const (
+	benchSongs          = 10000
+	benchCouplesPerSong = 100
+	benchSongsPerBatch  = 500  // songs stored per StoreFingerprints call
+	benchQueryAddresses = 3000 // about the addresses of a 10 second recording
+)
+
+// benchmarkCatalog returns the fingerprints of benchSongs songs, in batches of
+// benchSongsPerBatch songs, and the addresses of a query: two thirds of them
+// are in the catalog, the others aren't.
+func benchmarkCatalog() ([]map[uint32][]models.Couple, []uint32) {
+	rng := rand.New(rand.NewSource(1))
+
+	var batches []map[uint32][]models.Couple
+	var stored []uint32
+	for songID := uint32(1); songID <= benchSongs; songID++ {
+		if (songID-1)%benchSongsPerBatch == 0 {
+			batches = append(batches, map[uint32][]models.Couple{})
+		}
+		batch := batches[len(batches)-1]
+
+		for i := 0; i < benchCouplesPerSong; i++ {
+			// Addresses have 32 bits, so most of them belong to a single song
+			address := rng.Uint32() | 1
+			couple := models.Couple{AnchorTimeMs: uint32(i * 100), SongID: songID}
+			batch[address] = append(batch[address], couple)
+			stored = append(stored, address)
+		}
+	}
+
+	query := make([]uint32, benchQueryAddresses)
+	for i := range query {
+		if i%3 == 2 {
+			query[i] = rng.Uint32() &^ 1 // stored addresses are all odd
+		} else {
+			query[i] = stored[rng.Intn(len(stored))]
+		}
+	}
+
+	return batches, query
+}
+
+// benchmarkGetCouples stores a catalog of 10k songs in dbClient and measures
+// the lookup of the addresses of a recording.
+func benchmarkGetCouples(b *testing.B, dbClient DBClient) {
+	ctx := context.Background()
+
+	batches, query := benchmarkCatalog()
+	for _, batch := range batches {
+		if err := dbClient.StoreFingerprints(ctx, batch); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("10k songs", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			couples, err := dbClient.GetCouples(ctx, query)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if len(couples) == 0 {
+				b.Fatal("got no couples")
+			}
+		}
+	})
+}
@@ -1,34 +1,115 @@
 package db
 
 import (
+	"context"
 	"fmt"
 	"song-recognition/models"
 	"song-recognition/utils"
+	"strconv"
+	"time"
 )
 
 type DBClient interface {
 	Close() error
-	StoreFingerprints(fingerprints map[uint32]models.Couple) error
-	GetCouples(addresses []uint32) (map[uint32][]models.Couple, error)
-	TotalSongs() (int, error)
-	RegisterSong(songTitle, songArtist, ytID string) (uint32, error)
-	GetSong(filterKey string, value interface{}) (Song, bool, error)
-	GetSongByID(songID uint32) (Song, bool, error)
-	GetSongByYTID(ytID string) (Song, bool, error)
-	GetSongByKey(key string) (Song, bool, error)
-	DeleteSongByID(songID uint32) error
-	DeleteCollection(collectionName string) error
+	StoreFingerprints(ctx context.Context, fingerprints map[uint32][]models.Couple) error
+	GetCouples(ctx context.Context, addresses []uint32) (map[uint32][]models.Couple, error)
+	ScanFingerprints(ctx context.Context, fn func(address uint32, couple models.Couple) error) error
+	TotalSongs(ctx context.Context) (int, error)
+	NextSongID(ctx context.Context) (uint32, error)
+	RegisterSong(ctx context.Context, song Song, fingerprints map[uint32][]models.Couple) error
+	ReplaceSong(ctx context.Context, oldSongID uint32, song Song, fingerprints map[uint32][]models.Couple) error
+	GetSong(ctx context.Context, filterKey string, value interface{}) (Song, bool, error)
+	GetSongByID(ctx context.Context, songID uint32) (Song, bool, error)
+	GetSongsByIDs(ctx context.Context, songIDs []uint32) (map[uint32]Song, error)
+	GetSongByYTID(ctx context.Context, ytID string) (Song, bool, error)
+	GetSongByKey(ctx context.Context, key string) (Song, bool, error)
+	ListSongs(ctx context.Context, offset, limit int) ([]Song, error)
+	UpdateSong(ctx context.Context, song Song) error
+	DeleteSongByID(ctx context.Context, songID uint32) error
+	CountFingerprints(ctx context.Context, songID uint32) (int, error)
+	CountOrphanedCouples(ctx context.Context) (int, error)
+	DeleteOrphanedCouples(ctx context.Context) (int, error)
+	DeleteCollection(ctx context.Context, collectionName string) error
+	GetMetadata(ctx context.Context, key string) (string, bool, error)
+	SetMetadata(ctx context.Context, key, value string) error
+	NextJobID(ctx context.Context) (uint32, error)
+	CreateJob(ctx context.Context, job models.Job) error
+	GetJob(ctx context.Context, jobID uint32) (models.Job, bool, error)
+	ListJobs(ctx context.Context, unfinishedOnly bool) ([]models.Job, error)
+	UpdateJobTrack(ctx context.Context, jobID uint32, track models.JobTrack) error
+	SetJobCanceled(ctx context.Context, jobID uint32, canceled bool) error
+	MigrationStatus(ctx context.Context) ([]MigrationStatus, error)
+	Migrate(ctx context.Context) ([]Migration, error)
 }
 
 type Song struct {
-	Title     string
-	Artist    string
-	YouTubeID string
+	ID                 uint32
+	Title              string
+	Artist             string
+	YouTubeID          string // empty if the song isn't on YouTube
+	FingerprintVersion int    // version of the scheme the song was fingerprinted with
+	Album              string
+	Artists            []string // all the artists, the main one first
+	Duration           float64  // in seconds
+	ISRC               string
+	SpotifyID          string // empty if the song isn't from Spotify
+	SourcePath         string // file the song was ingested from
+	ContentHash        string // hex SHA-256 of the source file
+	IngestedAt         time.Time
+	SourceType         string // SourceSpotify or SourceLocal
 }
 
-var DBtype = utils.GetEnv("DB_TYPE", "sqlite") // Can be "sqlite" or "mongo"
+// nullable returns nil for an empty external ID, which is stored as NULL:
+// external IDs are optional and only unique when present.
+func nullable(id string) interface{} {
+	if id == "" {
+		return nil
+	}
+	return id
+}
+
+// Source types of songs
+const (
+	SourceSpotify = "spotify" // downloaded from a Spotify URL
+	SourceLocal   = "local"   // saved from an audio file
+)
+
+// legacyFingerprintVersion is the fingerprint version of songs registered
+// before versions were recorded.
+const legacyFingerprintVersion = 1
+
+var DBtype = utils.GetEnv("DB_TYPE", defaultDBType) // Can be "sqlite", "mongo", "postgres" or "kv"
+
+// maxConns returns the size of the connection pools of the clients, set by
+// DB_MAX_CONNS. A server keeps a single client, shared by all its requests.
+func maxConns() int {
+	n, err := strconv.Atoi(utils.GetEnv("DB_MAX_CONNS"))
+	if err != nil || n < 1 {
+		return 10
+	}
+	return n
+}
 
-func NewDBClient() (DBClient, error) {
+// NewDBClient connects to the database configured by DB_TYPE. New databases
+// are migrated, and an error is returned if the schema of an existing one
+// isn't up to date.
+func NewDBClient(ctx context.Context) (DBClient, error) {
+	dbClient, err := OpenDBClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkMigrations(ctx, dbClient); err != nil {
+		dbClient.Close()
+		return nil, err
+	}
+
+	return dbClient, nil
+}
+
+// OpenDBClient connects to the database configured by DB_TYPE without
+// checking its schema, e.g. to migrate it.
+func OpenDBClient(ctx context.Context) (DBClient, error) {
 	switch DBtype {
 	case "mongo":
 		var (
@@ -43,11 +124,18 @@ func NewDBClient() (DBClient, error) {
 		if dbUsername == "" || dbPassword == "" {
 			dbUri = "mongodb://localhost:27017"
 		}
-		return NewMongoClient(dbUri)
+		return NewMongoClient(ctx, dbUri)
 
 	case "sqlite":
 		return NewSQLiteClient("db.sqlite3")
 
+	case "postgres":
+		dsn := utils.GetEnv("DB_DSN", "postgres://localhost:5432/song-recognition?sslmode=disable")
+		return NewPostgresClient(ctx, dsn)
+
+	case "kv":
+		return NewKVClient(utils.GetEnv("KV_DIR", "db.kv"))
+
 	default:
 		return nil, fmt.Errorf("unsupported database type: %s", DBtype)
 	}
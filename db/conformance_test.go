@@ -0,0 +1,550 @@
+package db
+
+import (
+	"context"
+	"reflect"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testDBClient checks that a DBClient behaves like the other backends.
+// newClient returns a client of a new, migrated database.
+func testDBClient(t *testing.T, newClient func(t *testing.T) DBClient) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, dbClient DBClient)
+	}{
+		{"songs", testSongs},
+		{"filter keys", testFilterKeys},
+		{"unique songs", testUniqueSongs},
+		{"list and update songs", testListAndUpdateSongs},
+		{"fingerprints", testFingerprints},
+		{"replace songs", testReplaceSongs},
+		{"orphaned couples", testOrphanedCouples},
+		{"metadata", testMetadata},
+		{"jobs", testJobs},
+		{"migrations", testMigrations},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newClient(t))
+		})
+	}
+}
+
+func TestKVClientConformance(t *testing.T) {
+	testDBClient(t, func(t *testing.T) DBClient {
+		dbClient, err := NewKVClient(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { dbClient.Close() })
+
+		if _, err := dbClient.Migrate(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return dbClient
+	})
+}
+
+func conformanceSong(id uint32, title, artist, ytID string) Song {
+	return Song{
+		ID:                 id,
+		Title:              title,
+		Artist:             artist,
+		YouTubeID:          ytID,
+		FingerprintVersion: 2,
+		Album:              "Album",
+		Artists:            []string{artist, "Featured"},
+		Duration:           183.5,
+		ISRC:               "USRC17607839",
+		SourcePath:         "/songs/" + title + ".wav",
+		ContentHash:        "0123abcd",
+		IngestedAt:         time.UnixMilli(1700000000123),
+		SourceType:         SourceLocal,
+	}
+}
+
+func registerSong(t *testing.T, dbClient DBClient, song Song, fingerprints map[uint32][]models.Couple) {
+	t.Helper()
+
+	if err := dbClient.RegisterSong(context.Background(), song, fingerprints); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertSong(t *testing.T, got Song, found bool, err error, want Song) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatalf("song %d not found", want.ID)
+	}
+	if !got.IngestedAt.Equal(want.IngestedAt) {
+		t.Fatalf("got ingestion time %v, want %v", got.IngestedAt, want.IngestedAt)
+	}
+	got.IngestedAt = want.IngestedAt
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func assertNotFound(t *testing.T, got Song, found bool, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatalf("got %+v, want no song", got)
+	}
+}
+
+func testSongs(t *testing.T, dbClient DBClient) {
+	ctx := context.Background()
+
+	id, err := dbClient.NextSongID(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	song := conformanceSong(id, "Title", "Artist", "dQw4w9WgXcQ")
+	song.SpotifyID = "4uLU6hMCjMI75M1A2tKUQC"
+	song.SourceType = SourceSpotify
+	registerSong(t, dbClient, song, map[uint32][]models.Couple{1: {{AnchorTimeMs: 10, SongID: id}}})
+
+	next, err := dbClient.NextSongID(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == id {
+		t.Fatalf("got the ID of song %d again", id)
+	}
+
+	got, found, err := dbClient.GetSongByID(ctx, id)
+	assertSong(t, got, found, err, song)
+	got, found, err = dbClient.GetSongByKey(ctx, utils.GenerateSongKey(song.Title, song.Artist))
+	assertSong(t, got, found, err, song)
+	got, found, err = dbClient.GetSongByYTID(ctx, song.YouTubeID)
+	assertSong(t, got, found, err, song)
+
+	got, found, err = dbClient.GetSongByID(ctx, id+100)
+	assertNotFound(t, got, found, err)
+	got, found, err = dbClient.GetSongByKey(ctx, "missing")
+	assertNotFound(t, got, found, err)
+	got, found, err = dbClient.GetSongByYTID(ctx, "missing")
+	assertNotFound(t, got, found, err)
+
+	// Songs without a YouTube ID can't be found by it
+	other := conformanceSong(id+1, "Other", "Artist", "")
+	registerSong(t, dbClient, other, nil)
+	got, found, err = dbClient.GetSongByYTID(ctx, "")
+	assertNotFound(t, got, found, err)
+	got, found, err = dbClient.GetSongByID(ctx, other.ID)
+	assertSong(t, got, found, err, other)
+
+	songs, err := dbClient.GetSongsByIDs(ctx, []uint32{other.ID, id + 100, id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(songs) != 2 {
+		t.Fatalf("got songs %v, want %d and %d", songs, id, other.ID)
+	}
+	assertSong(t, songs[id], true, nil, song)
+	assertSong(t, songs[other.ID], true, nil, other)
+	if songs, err := dbClient.GetSongsByIDs(ctx, nil); err != nil || len(songs) != 0 {
+		t.Fatalf("got songs %v and %v, want none", songs, err)
+	}
+
+	total, err := dbClient.TotalSongs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 {
+		t.Fatalf("got %d songs, want 2", total)
+	}
+
+	if err := dbClient.DeleteSongByID(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	got, found, err = dbClient.GetSongByID(ctx, id)
+	assertNotFound(t, got, found, err)
+	got, found, err = dbClient.GetSongByYTID(ctx, song.YouTubeID)
+	assertNotFound(t, got, found, err)
+}
+
+func testFilterKeys(t *testing.T, dbClient DBClient) {
+	ctx := context.Background()
+	song := conformanceSong(1, "Title", "Artist", "dQw4w9WgXcQ")
+	registerSong(t, dbClient, song, nil)
+
+	got, found, err := dbClient.GetSong(ctx, "id", uint32(1))
+	assertSong(t, got, found, err, song)
+	got, found, err = dbClient.GetSong(ctx, "ytID", song.YouTubeID)
+	assertSong(t, got, found, err, song)
+	got, found, err = dbClient.GetSong(ctx, "key", utils.GenerateSongKey(song.Title, song.Artist))
+	assertSong(t, got, found, err, song)
+
+	// Keys are matched exactly, parts of the known keys or anything else are rejected
+	for _, filterKey := range []string{"", "i", "d", "ytid", "ke", "title", "id | ytID", "id = id OR id", "1 = 1 --"} {
+		if _, _, err := dbClient.GetSong(ctx, filterKey, uint32(1)); err == nil {
+			t.Errorf("filter key %q: got no error", filterKey)
+		}
+	}
+}
+
+func testUniqueSongs(t *testing.T, dbClient DBClient) {
+	registerSong(t, dbClient, conformanceSong(1, "Title", "Artist", "ytID1"), nil)
+	registerSong(t, dbClient, conformanceSong(2, "Title 2", "Artist", ""), nil)
+	registerSong(t, dbClient, conformanceSong(3, "Title 3", "Artist", ""), nil)
+
+	ctx := context.Background()
+	if err := dbClient.RegisterSong(ctx, conformanceSong(4, "Title", "Artist", "ytID4"), nil); err == nil {
+		t.Fatal("registered a song with the key of another song")
+	}
+	if err := dbClient.RegisterSong(ctx, conformanceSong(5, "Title 5", "Artist", "ytID1"), nil); err == nil {
+		t.Fatal("registered a song with the YouTube ID of another song")
+	}
+
+	total, err := dbClient.TotalSongs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 {
+		t.Fatalf("got %d songs, want 3", total)
+	}
+}
+
+func testListAndUpdateSongs(t *testing.T, dbClient DBClient) {
+	ctx := context.Background()
+	for _, id := range []uint32{5, 2, 9, 7} {
+		registerSong(t, dbClient, conformanceSong(id, "Title", "Artist "+string(rune('A'+id)), ""), nil)
+	}
+
+	songIDs := func(songs []Song) []uint32 {
+		ids := []uint32{}
+		for _, song := range songs {
+			ids = append(ids, song.ID)
+		}
+		return ids
+	}
+
+	songs, err := dbClient.ListSongs(ctx, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := songIDs(songs); !reflect.DeepEqual(got, []uint32{2, 5, 7, 9}) {
+		t.Fatalf("got songs %v, want them ordered by ID", got)
+	}
+	songs, err = dbClient.ListSongs(ctx, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := songIDs(songs); !reflect.DeepEqual(got, []uint32{5, 7}) {
+		t.Fatalf("got songs %v, want 5 and 7", got)
+	}
+	songs, err = dbClient.ListSongs(ctx, 4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(songs) != 0 {
+		t.Fatalf("got songs %v past the end", songIDs(songs))
+	}
+
+	song := conformanceSong(5, "New title", "New artist", "newYTID")
+	if err := dbClient.UpdateSong(ctx, song); err != nil {
+		t.Fatal(err)
+	}
+	got, found, err := dbClient.GetSongByKey(ctx, utils.GenerateSongKey("New title", "New artist"))
+	if err != nil || !found || got.ID != 5 || got.YouTubeID != "newYTID" {
+		t.Fatalf("got %+v, %v, %v, want the updated song", got, found, err)
+	}
+	got, found, err = dbClient.GetSongByKey(ctx, utils.GenerateSongKey("Title", "Artist "+string(rune('A'+5))))
+	assertNotFound(t, got, found, err)
+
+	// The key of an updated song must stay unique
+	if err := dbClient.UpdateSong(ctx, conformanceSong(2, "New title", "New artist", "")); err == nil {
+		t.Fatal("updated a song to the key of another song")
+	}
+}
+
+func sortCouples(couples map[uint32][]models.Couple) {
+	for _, c := range couples {
+		sort.Slice(c, func(i, j int) bool {
+			if c[i].SongID != c[j].SongID {
+				return c[i].SongID < c[j].SongID
+			}
+			return c[i].AnchorTimeMs < c[j].AnchorTimeMs
+		})
+	}
+}
+
+func testFingerprints(t *testing.T, dbClient DBClient) {
+	ctx := context.Background()
+	registerSong(t, dbClient, conformanceSong(1, "One", "Artist", ""), map[uint32][]models.Couple{
+		100: {{AnchorTimeMs: 10, SongID: 1}, {AnchorTimeMs: 20, SongID: 1}},
+		200: {{AnchorTimeMs: 30, SongID: 1}},
+	})
+	registerSong(t, dbClient, conformanceSong(2, "Two", "Artist", ""), map[uint32][]models.Couple{
+		100: {{AnchorTimeMs: 40, SongID: 2}},
+		300: {{AnchorTimeMs: 1 << 31, SongID: 2}},
+	})
+
+	got, err := dbClient.GetCouples(ctx, []uint32{100, 300, 400})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sortCouples(got)
+	want := map[uint32][]models.Couple{
+		100: {{AnchorTimeMs: 10, SongID: 1}, {AnchorTimeMs: 20, SongID: 1}, {AnchorTimeMs: 40, SongID: 2}},
+		300: {{AnchorTimeMs: 1 << 31, SongID: 2}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got couples %v, want %v", got, want)
+	}
+
+	if count, err := dbClient.CountFingerprints(ctx, 1); err != nil || count != 3 {
+		t.Fatalf("got %d fingerprints and %v, want 3", count, err)
+	}
+
+	scanned := 0
+	err = dbClient.ScanFingerprints(ctx, func(address uint32, couple models.Couple) error {
+		scanned++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scanned != 5 {
+		t.Fatalf("scanned %d couples, want 5", scanned)
+	}
+
+	// The couples of a deleted song are deleted with it
+	if err := dbClient.DeleteSongByID(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	got, err = dbClient.GetCouples(ctx, []uint32{100, 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[uint32][]models.Couple{100: {{AnchorTimeMs: 40, SongID: 2}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got couples %v after deleting song 1, want %v", got, want)
+	}
+	if count, err := dbClient.CountFingerprints(ctx, 1); err != nil || count != 0 {
+		t.Fatalf("got %d fingerprints and %v for a deleted song, want 0", count, err)
+	}
+}
+
+func testReplaceSongs(t *testing.T, dbClient DBClient) {
+	ctx := context.Background()
+	registerSong(t, dbClient, conformanceSong(1, "One", "Artist", "yt1"), map[uint32][]models.Couple{
+		100: {{AnchorTimeMs: 10, SongID: 1}},
+	})
+	registerSong(t, dbClient, conformanceSong(2, "Two", "Artist", ""), nil)
+
+	// The new song can take the key and YouTube ID of the one it replaces
+	song := conformanceSong(3, "One", "Artist", "yt1")
+	err := dbClient.ReplaceSong(ctx, 1, song, map[uint32][]models.Couple{
+		100: {{AnchorTimeMs: 20, SongID: 3}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, found, err := dbClient.GetSongByID(ctx, 1)
+	assertNotFound(t, got, found, err)
+	got, found, err = dbClient.GetSongByKey(ctx, utils.GenerateSongKey("One", "Artist"))
+	assertSong(t, got, found, err, song)
+	couples, err := dbClient.GetCouples(ctx, []uint32{100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint32][]models.Couple{100: {{AnchorTimeMs: 20, SongID: 3}}}
+	if !reflect.DeepEqual(couples, want) {
+		t.Fatalf("got couples %v, want %v", couples, want)
+	}
+
+	// The replaced song is kept when the new one can't be registered
+	err = dbClient.ReplaceSong(ctx, 3, conformanceSong(4, "Two", "Artist", ""), map[uint32][]models.Couple{
+		200: {{AnchorTimeMs: 30, SongID: 4}},
+	})
+	if err == nil {
+		t.Fatal("replaced a song by one with the key of another")
+	}
+	got, found, err = dbClient.GetSongByID(ctx, 3)
+	assertSong(t, got, found, err, song)
+	couples, err = dbClient.GetCouples(ctx, []uint32{100, 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(couples, want) {
+		t.Fatalf("got couples %v after a failed replacement, want %v", couples, want)
+	}
+}
+
+func testOrphanedCouples(t *testing.T, dbClient DBClient) {
+	ctx := context.Background()
+	registerSong(t, dbClient, conformanceSong(1, "One", "Artist", ""), map[uint32][]models.Couple{
+		100: {{AnchorTimeMs: 10, SongID: 1}},
+	})
+
+	// Couples stored without their song, e.g. by an interrupted registration
+	err := dbClient.StoreFingerprints(ctx, map[uint32][]models.Couple{
+		100: {{AnchorTimeMs: 20, SongID: 2}},
+		200: {{AnchorTimeMs: 30, SongID: 2}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count, err := dbClient.CountOrphanedCouples(ctx); err != nil || count != 2 {
+		t.Fatalf("got %d orphaned couples and %v, want 2", count, err)
+	}
+	if count, err := dbClient.DeleteOrphanedCouples(ctx); err != nil || count != 2 {
+		t.Fatalf("deleted %d orphaned couples and got %v, want 2", count, err)
+	}
+	if count, err := dbClient.CountOrphanedCouples(ctx); err != nil || count != 0 {
+		t.Fatalf("got %d orphaned couples and %v after deleting them, want 0", count, err)
+	}
+
+	got, err := dbClient.GetCouples(ctx, []uint32{100, 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint32][]models.Couple{100: {{AnchorTimeMs: 10, SongID: 1}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got couples %v, want %v", got, want)
+	}
+}
+
+func testMetadata(t *testing.T, dbClient DBClient) {
+	ctx := context.Background()
+
+	if value, found, err := dbClient.GetMetadata(ctx, "key"); err != nil || found {
+		t.Fatalf("got %q, %v, %v, want no value", value, found, err)
+	}
+	for _, want := range []string{"1", "2"} {
+		if err := dbClient.SetMetadata(ctx, "key", want); err != nil {
+			t.Fatal(err)
+		}
+		if value, found, err := dbClient.GetMetadata(ctx, "key"); err != nil || !found || value != want {
+			t.Fatalf("got %q, %v, %v, want %q", value, found, err, want)
+		}
+	}
+}
+
+func testJobs(t *testing.T, dbClient DBClient) {
+	ctx := context.Background()
+	createdAt := time.UnixMilli(1700000000000)
+
+	jobs := []models.Job{
+		{ID: 2, Source: "https://open.spotify.com/album/2", CreatedAt: createdAt.Add(time.Minute), Tracks: []models.JobTrack{
+			{Index: 0, Title: "Title", Artist: "Artist", Artists: []string{"Artist"}, State: models.TrackQueued, UpdatedAt: createdAt},
+			{Index: 1, Title: "Title 2", Artist: "Artist", Artists: []string{"Artist"}, State: models.TrackQueued, UpdatedAt: createdAt},
+		}},
+		{ID: 1, Source: "https://open.spotify.com/track/1", CreatedAt: createdAt, Tracks: []models.JobTrack{
+			{Index: 0, Title: "Done", Artist: "Artist", Artists: []string{"Artist"}, State: models.TrackDone, UpdatedAt: createdAt},
+		}},
+	}
+	for _, job := range jobs {
+		if err := dbClient.CreateJob(ctx, job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	jobIDs := func(unfinishedOnly bool) []uint32 {
+		t.Helper()
+		jobs, err := dbClient.ListJobs(ctx, unfinishedOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []uint32{}
+		for _, job := range jobs {
+			ids = append(ids, job.ID)
+		}
+		return ids
+	}
+	if got := jobIDs(false); !reflect.DeepEqual(got, []uint32{1, 2}) {
+		t.Fatalf("got jobs %v, want them oldest first", got)
+	}
+	if got := jobIDs(true); !reflect.DeepEqual(got, []uint32{2}) {
+		t.Fatalf("got unfinished jobs %v, want 2", got)
+	}
+
+	track := jobs[0].Tracks[1]
+	track.State = models.TrackFailed
+	track.Error = "not found"
+	track.Attempts = 3
+	track.NextAttemptAt = createdAt.Add(time.Hour)
+	track.UpdatedAt = createdAt.Add(2 * time.Hour)
+	if err := dbClient.UpdateJobTrack(ctx, 2, track); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbClient.SetJobCanceled(ctx, 2, true); err != nil {
+		t.Fatal(err)
+	}
+
+	job, found, err := dbClient.GetJob(ctx, 2)
+	if err != nil || !found {
+		t.Fatalf("got %v, %v, want job 2", found, err)
+	}
+	if !job.Canceled || job.Source != jobs[0].Source || !job.CreatedAt.Equal(jobs[0].CreatedAt) || len(job.Tracks) != 2 {
+		t.Fatalf("got %+v, want a canceled %+v", job, jobs[0])
+	}
+	got := job.Tracks[1]
+	if got.State != track.State || got.Error != track.Error || got.Attempts != track.Attempts ||
+		!got.NextAttemptAt.Equal(track.NextAttemptAt) || !got.UpdatedAt.Equal(track.UpdatedAt) ||
+		got.Title != track.Title || !reflect.DeepEqual(got.Artists, track.Artists) {
+		t.Fatalf("got track %+v, want %+v", got, track)
+	}
+	if job.Tracks[0].State != models.TrackQueued {
+		t.Fatalf("got track %+v, want the other track unchanged", job.Tracks[0])
+	}
+
+	if _, found, err := dbClient.GetJob(ctx, 3); err != nil || found {
+		t.Fatalf("got %v, %v, want no job", found, err)
+	}
+
+	// The IDs of jobs already created are skipped
+	allocated := map[uint32]bool{}
+	for i := 0; i < 3; i++ {
+		id, err := dbClient.NextJobID(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id == 1 || id == 2 || allocated[id] {
+			t.Fatalf("got job ID %d, which is already taken", id)
+		}
+		allocated[id] = true
+	}
+}
+
+func testMigrations(t *testing.T, dbClient DBClient) {
+	ctx := context.Background()
+
+	statuses, err := dbClient.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) == 0 {
+		t.Fatal("got no migrations")
+	}
+	for _, status := range statuses {
+		if !status.Applied {
+			t.Fatalf("migration %+v isn't applied", status)
+		}
+	}
+
+	applied, err := dbClient.Migrate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 {
+		t.Fatalf("applied migrations %v again", applied)
+	}
+}
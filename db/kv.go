@@ -0,0 +1,703 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"sort"
+	"sync"
+)
+
+// The KV store is an embedded, cgo-free database kept in a directory:
+//
+//	catalog.json  songs, jobs, metadata and the list of segments
+//	*.log         changes made to the catalog since catalog.json was written
+//	              (see kv_catalog.go)
+//	*.seg         fingerprints, in immutable segment files (see kv_segment.go)
+//	LOCK          locked while a process reads or writes the store
+//
+// Each batch of fingerprints is written as a new segment; segments of the
+// same size are merged together as they accumulate, so that lookups only go
+// through a few of them. Deleted songs are recorded as tombstones, and their
+// couples are left out of the lookups until the segments holding them are
+// merged.
+
+type kvSegmentInfo struct {
+	Name    string `json:"name"`
+	Couples int    `json:"couples"`
+}
+
+// segmentLevel groups segments of about the same size: segments are merged
+// once four of them are on the same level.
+func (s kvSegmentInfo) level() int {
+	level := 0
+	for n := s.Couples / 4096; n > 0; n /= 4 {
+		level++
+	}
+	return level
+}
+
+const segmentsPerLevel = 4
+
+// kvStore is an open store, shared by the clients of a process
+type kvStore struct {
+	dir      string
+	clients  int
+	mu       sync.Mutex
+	lock     *os.File
+	catalog  *kvCatalog
+	loaded   os.FileInfo // catalog.json when it was loaded
+	logSize  int64       // size of the log when it was last applied
+	segments map[string]*segment
+}
+
+var (
+	kvStoresMu sync.Mutex
+	kvStores   = map[string]*kvStore{}
+)
+
+type KVClient struct {
+	store  *kvStore
+	closed bool // guarded by store.mu
+}
+
+var errKVClosed = errors.New("KV store is closed")
+
+// NewKVClient opens the store in dir, creating it if needed.
+func NewKVClient(dir string) (*KVClient, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	kvStoresMu.Lock()
+	defer kvStoresMu.Unlock()
+
+	if store, ok := kvStores[dir]; ok {
+		store.clients++
+		return &KVClient{store: store}, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating KV store: %v", err)
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, "LOCK"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening KV store: %v", err)
+	}
+
+	store := &kvStore{dir: dir, clients: 1, lock: lock, segments: map[string]*segment{}}
+	kvStores[dir] = store
+	return &KVClient{store: store}, nil
+}
+
+// Close releases the store once every client of the process closed it
+func (db *KVClient) Close() error {
+	store := db.store
+	store.mu.Lock()
+	closed := db.closed
+	db.closed = true
+	store.mu.Unlock()
+	if closed {
+		return nil
+	}
+
+	kvStoresMu.Lock()
+	defer kvStoresMu.Unlock()
+
+	store.clients--
+	if store.clients > 0 {
+		return nil
+	}
+	delete(kvStores, store.dir)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for name, seg := range store.segments {
+		seg.close()
+		delete(store.segments, name)
+	}
+	return store.lock.Close()
+}
+
+// view runs fn with the catalog up to date, while other processes can't
+// write to the store.
+func (db *KVClient) view(ctx context.Context, fn func(c *kvCatalog) error) error {
+	s := db.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if db.closed {
+		return errKVClosed
+	}
+
+	if err := lockFile(s.lock, false); err != nil {
+		return fmt.Errorf("error locking KV store: %v", err)
+	}
+	defer unlockFile(s.lock)
+
+	// Waiting for the locks can take a while
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := s.refresh(); err != nil {
+		return err
+	}
+	return fn(s.catalog)
+}
+
+// update runs fn with the catalog up to date and saves it if fn succeeds.
+// The catalog is reloaded from disk if fn fails, discarding its changes.
+func (db *KVClient) update(ctx context.Context, fn func(c *kvCatalog) error) error {
+	s := db.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if db.closed {
+		return errKVClosed
+	}
+
+	if err := lockFile(s.lock, true); err != nil {
+		return fmt.Errorf("error locking KV store: %v", err)
+	}
+	defer unlockFile(s.lock)
+
+	// Waiting for the locks can take a while
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := s.refresh(); err != nil {
+		return err
+	}
+
+	s.catalog.begin()
+	err := fn(s.catalog)
+	if err == nil {
+		err = s.save()
+	}
+	if err != nil {
+		// Segments written by fn are removed along with its changes
+		s.catalog = nil
+		if refreshErr := s.refresh(); refreshErr != nil {
+			return fmt.Errorf("%v (reloading the KV store failed: %v)", err, refreshErr)
+		}
+		s.removeUnusedSegments()
+		return err
+	}
+	s.catalog.changes = nil
+
+	return s.removeUnusedSegments()
+}
+
+// removeUnusedSegments unmaps and deletes the segments that were merged or
+// deleted. Other processes may still have them mapped, which keeps them
+// readable until they refresh.
+func (s *kvStore) removeUnusedSegments() error {
+	used := map[string]bool{}
+	for _, info := range s.catalog.Segments {
+		used[info.Name] = true
+	}
+
+	for name, seg := range s.segments {
+		if !used[name] {
+			seg.close()
+			delete(s.segments, name)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.seg"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !used[filepath.Base(file)] {
+			os.Remove(file)
+		}
+	}
+	return nil
+}
+
+// addSegment writes fingerprints to a new segment, counts their couples and
+// merges the segments that piled up.
+func (s *kvStore) addSegment(fingerprints map[uint32][]models.Couple) error {
+	// Couples of a deleted song must be gone before its ID is used again
+	for _, coupleList := range fingerprints {
+		if len(coupleList) > 0 && s.catalog.Tombstones[coupleList[0].SongID] {
+			if err := s.compact(); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	name := fmt.Sprintf("%08d.seg", s.catalog.NextSegment)
+	couples, err := writeSegment(filepath.Join(s.dir, name), fingerprints)
+	if err != nil {
+		return fmt.Errorf("error writing segment: %v", err)
+	}
+	s.catalog.NextSegment++
+	if couples == 0 {
+		os.Remove(filepath.Join(s.dir, name))
+		return nil
+	}
+
+	seg, err := openSegment(filepath.Join(s.dir, name), name)
+	if err != nil {
+		return err
+	}
+	s.segments[name] = seg
+	s.catalog.Segments = append(s.catalog.Segments, kvSegmentInfo{Name: name, Couples: couples})
+
+	couplesPerSong := map[uint32]int{}
+	for _, coupleList := range fingerprints {
+		for _, couple := range coupleList {
+			couplesPerSong[couple.SongID]++
+		}
+	}
+	for songID, couples := range couplesPerSong {
+		s.catalog.setCouples(songID, s.catalog.Couples[songID]+couples)
+	}
+
+	return s.mergeLevels()
+}
+
+// mergeLevels merges the segments of each level that has enough of them
+func (s *kvStore) mergeLevels() error {
+	for {
+		levels := map[int][]int{}
+		for i, info := range s.catalog.Segments {
+			levels[info.level()] = append(levels[info.level()], i)
+		}
+
+		merged := false
+		for _, indexes := range levels {
+			if len(indexes) >= segmentsPerLevel {
+				if err := s.merge(indexes, false); err != nil {
+					return err
+				}
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			return nil
+		}
+	}
+}
+
+// merge replaces the segments at the given positions by a single one
+// without the couples of deleted songs. Tombstones are cleared once all the
+// segments were merged.
+func (s *kvStore) merge(indexes []int, all bool) error {
+	segments := make([]*segment, len(indexes))
+	merging := map[int]bool{}
+	for i, index := range indexes {
+		segments[i] = s.segments[s.catalog.Segments[index].Name]
+		merging[index] = true
+	}
+
+	name := fmt.Sprintf("%08d.seg", s.catalog.NextSegment)
+	couples, err := mergeSegments(filepath.Join(s.dir, name), segments, func(songID uint32) bool {
+		return s.catalog.Tombstones[songID]
+	})
+	if err != nil {
+		return fmt.Errorf("error merging segments: %v", err)
+	}
+	s.catalog.NextSegment++
+
+	var remaining []kvSegmentInfo
+	for i, info := range s.catalog.Segments {
+		if !merging[i] {
+			remaining = append(remaining, info)
+		}
+	}
+
+	if couples > 0 {
+		seg, err := openSegment(filepath.Join(s.dir, name), name)
+		if err != nil {
+			return err
+		}
+		s.segments[name] = seg
+		remaining = append(remaining, kvSegmentInfo{Name: name, Couples: couples})
+	} else {
+		os.Remove(filepath.Join(s.dir, name))
+	}
+	s.catalog.Segments = remaining
+
+	if all {
+		for songID := range s.catalog.Tombstones {
+			s.catalog.setTombstone(songID, false)
+		}
+	}
+	return nil
+}
+
+// compact merges all the segments into one
+func (s *kvStore) compact() error {
+	indexes := make([]int, len(s.catalog.Segments))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	return s.merge(indexes, true)
+}
+
+func (db *KVClient) StoreFingerprints(ctx context.Context, fingerprints map[uint32][]models.Couple) error {
+	return db.update(ctx, func(c *kvCatalog) error {
+		return db.store.addSegment(fingerprints)
+	})
+}
+
+// GetCouples looks the addresses up in each segment, leaving out the couples
+// of deleted songs.
+func (db *KVClient) GetCouples(ctx context.Context, addresses []uint32) (map[uint32][]models.Couple, error) {
+	couples := make(map[uint32][]models.Couple)
+
+	err := db.view(ctx, func(c *kvCatalog) error {
+		for _, info := range c.Segments {
+			seg := db.store.segments[info.Name]
+			for _, address := range addresses {
+				first, end := seg.lookup(address)
+				for i := first; i < end; i++ {
+					if couple := seg.couple(i); !c.Tombstones[couple.SongID] {
+						couples[address] = append(couples[address], couple)
+					}
+				}
+			}
+		}
+		return nil
+	})
+
+	return couples, err
+}
+
+func (db *KVClient) ScanFingerprints(ctx context.Context, fn func(address uint32, couple models.Couple) error) error {
+	return db.view(ctx, func(c *kvCatalog) error {
+		for _, info := range c.Segments {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			seg := db.store.segments[info.Name]
+			for entry := 0; entry < seg.numAddresses; entry++ {
+				address, first, end := seg.entry(entry)
+				for i := first; i < end; i++ {
+					if couple := seg.couple(i); !c.Tombstones[couple.SongID] {
+						if err := fn(address, couple); err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (db *KVClient) TotalSongs(ctx context.Context) (int, error) {
+	var count int
+	err := db.view(ctx, func(c *kvCatalog) error {
+		count = len(c.Songs)
+		return nil
+	})
+	return count, err
+}
+
+// NextSongID allocates the ID of a new song from the song sequence. IDs of
+// songs or couples already stored are skipped.
+func (db *KVClient) NextSongID(ctx context.Context) (uint32, error) {
+	var songID uint32
+	err := db.update(ctx, func(c *kvCatalog) error {
+		for {
+			c.SongSequence++
+			if c.SongSequence > 1<<32-1 {
+				return fmt.Errorf("no song IDs left")
+			}
+			id := uint32(c.SongSequence)
+			if _, ok := c.Songs[id]; ok || c.Couples[id] > 0 || c.Tombstones[id] {
+				continue
+			}
+			songID = id
+			return nil
+		}
+	})
+	return songID, err
+}
+
+func songKey(song Song) string {
+	return utils.GenerateSongKey(song.Title, song.Artist)
+}
+
+// checkUnique returns an error if another song has the key or the YouTube ID of song
+func (s *kvStore) checkUnique(song Song) error {
+	if id, ok := s.catalog.byKey[songKey(song)]; ok && id != song.ID {
+		return fmt.Errorf("song with ytID or key already exists: key %q is used by song %d", songKey(song), id)
+	}
+	if id, ok := s.catalog.byYTID[song.YouTubeID]; ok && song.YouTubeID != "" && id != song.ID {
+		return fmt.Errorf("song with ytID or key already exists: ytID %q is used by song %d", song.YouTubeID, id)
+	}
+	if song.SpotifyID != "" {
+		for id, other := range s.catalog.Songs {
+			if other.SpotifyID == song.SpotifyID && id != song.ID {
+				return fmt.Errorf("song with spotifyID already exists: %q is used by song %d", song.SpotifyID, id)
+			}
+		}
+	}
+	return nil
+}
+
+// RegisterSong stores a song and its fingerprints: the song is only added to
+// the catalog once its segment is written.
+func (db *KVClient) RegisterSong(ctx context.Context, song Song, fingerprints map[uint32][]models.Couple) error {
+	return db.update(ctx, func(c *kvCatalog) error {
+		return db.store.registerSong(song, fingerprints)
+	})
+}
+
+// ReplaceSong deletes the song oldSongID with its fingerprints and registers
+// song in its place in a single update, so that the old song is kept if song
+// can't be stored.
+func (db *KVClient) ReplaceSong(ctx context.Context, oldSongID uint32, song Song, fingerprints map[uint32][]models.Couple) error {
+	return db.update(ctx, func(c *kvCatalog) error {
+		db.store.deleteSong(oldSongID)
+		return db.store.registerSong(song, fingerprints)
+	})
+}
+
+func (s *kvStore) registerSong(song Song, fingerprints map[uint32][]models.Couple) error {
+	if _, ok := s.catalog.Songs[song.ID]; ok {
+		return fmt.Errorf("song with ID %d already exists", song.ID)
+	}
+	if err := s.checkUnique(song); err != nil {
+		return err
+	}
+
+	if err := s.addSegment(fingerprints); err != nil {
+		return err
+	}
+	s.catalog.setSong(song)
+	return nil
+}
+
+// GetSong retrieves a song by filter key
+func (db *KVClient) GetSong(ctx context.Context, filterKey string, value interface{}) (Song, bool, error) {
+	var song Song
+	var songExists bool
+
+	err := db.view(ctx, func(c *kvCatalog) error {
+		var id uint32
+		switch filterKey {
+		case "id":
+			songID, ok := value.(uint32)
+			if !ok {
+				return fmt.Errorf("invalid song ID %v", value)
+			}
+			id = songID
+		case "ytID", "key":
+			str, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("invalid %s %v", filterKey, value)
+			}
+			lookup := c.byKey
+			if filterKey == "ytID" {
+				lookup = c.byYTID
+			}
+			if id, ok = lookup[str]; !ok {
+				return nil
+			}
+		default:
+			return fmt.Errorf("invalid filter key")
+		}
+
+		song, songExists = c.Songs[id]
+		return nil
+	})
+	if err != nil {
+		return Song{}, false, fmt.Errorf("failed to retrieve song: %v", err)
+	}
+
+	return song, songExists, nil
+}
+
+func (db *KVClient) GetSongByID(ctx context.Context, songID uint32) (Song, bool, error) {
+	return db.GetSong(ctx, "id", songID)
+}
+
+// GetSongsByIDs returns the songs with the given IDs that exist, by ID
+func (db *KVClient) GetSongsByIDs(ctx context.Context, songIDs []uint32) (map[uint32]Song, error) {
+	songs := make(map[uint32]Song, len(songIDs))
+	err := db.view(ctx, func(c *kvCatalog) error {
+		for _, songID := range songIDs {
+			if song, ok := c.Songs[songID]; ok {
+				songs[songID] = song
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve songs: %v", err)
+	}
+	return songs, nil
+}
+
+// GetSongByYTID returns the song with a YouTube ID. Songs without one can't
+// be found by it.
+func (db *KVClient) GetSongByYTID(ctx context.Context, ytID string) (Song, bool, error) {
+	if ytID == "" {
+		return Song{}, false, nil
+	}
+	return db.GetSong(ctx, "ytID", ytID)
+}
+
+func (db *KVClient) GetSongByKey(ctx context.Context, key string) (Song, bool, error) {
+	return db.GetSong(ctx, "key", key)
+}
+
+// ListSongs returns up to limit songs ordered by ID, skipping the first offset ones.
+func (db *KVClient) ListSongs(ctx context.Context, offset, limit int) ([]Song, error) {
+	var songs []Song
+
+	err := db.view(ctx, func(c *kvCatalog) error {
+		ids := make([]uint32, 0, len(c.Songs))
+		for id := range c.Songs {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+		for i := offset; i < len(ids) && i < offset+limit; i++ {
+			songs = append(songs, c.Songs[ids[i]])
+		}
+		return nil
+	})
+
+	return songs, err
+}
+
+// UpdateSong updates the title, artist and YouTube ID of a song
+func (db *KVClient) UpdateSong(ctx context.Context, song Song) error {
+	return db.update(ctx, func(c *kvCatalog) error {
+		stored, ok := c.Songs[song.ID]
+		if !ok {
+			return nil
+		}
+		stored.Title, stored.Artist, stored.YouTubeID = song.Title, song.Artist, song.YouTubeID
+		if err := db.store.checkUnique(stored); err != nil {
+			return err
+		}
+
+		c.setSong(stored)
+		return nil
+	})
+}
+
+// DeleteSongByID deletes a song and tombstones its couples
+func (db *KVClient) DeleteSongByID(ctx context.Context, songID uint32) error {
+	return db.update(ctx, func(c *kvCatalog) error {
+		db.store.deleteSong(songID)
+		return nil
+	})
+}
+
+func (s *kvStore) deleteSong(songID uint32) {
+	c := s.catalog
+	c.deleteSong(songID)
+	if c.Couples[songID] > 0 {
+		c.setTombstone(songID, true)
+		c.setCouples(songID, 0)
+	}
+}
+
+// CountFingerprints returns the number of fingerprints of a song
+func (db *KVClient) CountFingerprints(ctx context.Context, songID uint32) (int, error) {
+	var count int
+	err := db.view(ctx, func(c *kvCatalog) error {
+		count = c.Couples[songID]
+		return nil
+	})
+	return count, err
+}
+
+// CountOrphanedCouples returns the number of fingerprints of songs that don't exist
+func (db *KVClient) CountOrphanedCouples(ctx context.Context) (int, error) {
+	count := 0
+	err := db.view(ctx, func(c *kvCatalog) error {
+		for songID, couples := range c.Couples {
+			if _, ok := c.Songs[songID]; !ok {
+				count += couples
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+// DeleteOrphanedCouples deletes the fingerprints of songs that don't exist
+// and returns how many were deleted. All the segments are merged, which also
+// reclaims the space of the deleted songs.
+func (db *KVClient) DeleteOrphanedCouples(ctx context.Context) (int, error) {
+	deleted := 0
+	err := db.update(ctx, func(c *kvCatalog) error {
+		for songID, couples := range c.Couples {
+			if _, ok := c.Songs[songID]; !ok {
+				deleted += couples
+				c.setTombstone(songID, true)
+				c.setCouples(songID, 0)
+			}
+		}
+		return db.store.compact()
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error deleting orphaned fingerprints: %v", err)
+	}
+	return deleted, nil
+}
+
+// DeleteCollection deletes the content of a collection: fingerprints, songs,
+// metadata or jobs.
+func (db *KVClient) DeleteCollection(ctx context.Context, collectionName string) error {
+	err := db.update(ctx, func(c *kvCatalog) error {
+		switch collectionName {
+		case "fingerprints":
+			c.Segments = nil
+			c.Couples = map[uint32]int{}
+			c.Tombstones = map[uint32]bool{}
+		case "songs":
+			c.Songs = map[uint32]Song{}
+			c.reindexSongs()
+		case "metadata":
+			c.Metadata = map[string]string{}
+		case "jobs":
+			c.Jobs = map[uint32]models.Job{}
+		default:
+			return fmt.Errorf("unknown collection %s", collectionName)
+		}
+		c.rewrite = true
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting collection: %v", err)
+	}
+	return nil
+}
+
+// GetMetadata retrieves the value of a metadata record
+func (db *KVClient) GetMetadata(ctx context.Context, key string) (string, bool, error) {
+	var value string
+	var ok bool
+	err := db.view(ctx, func(c *kvCatalog) error {
+		value, ok = c.Metadata[key]
+		return nil
+	})
+	return value, ok, err
+}
+
+// SetMetadata creates or replaces a metadata record
+func (db *KVClient) SetMetadata(ctx context.Context, key, value string) error {
+	return db.update(ctx, func(c *kvCatalog) error {
+		c.setMetadata(key, value)
+		return nil
+	})
+}
@@ -0,0 +1,485 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"song-recognition/models"
+)
+
+// The catalog is kept in catalog.json and in a log of the changes made since
+// catalog.json was written. Updates append a line to the log, and the whole
+// catalog is only written again, with a new log, once the log grew larger
+// than it.
+const kvMinLogSize = 1 << 20
+
+// kvCatalog is the content of catalog.json, with the changes of its log applied
+type kvCatalog struct {
+	Migrations   map[int]int64         `json:"migrations"` // applied migrations, in Unix milliseconds
+	Songs        map[uint32]Song       `json:"songs"`
+	SongSequence int64                 `json:"songSequence"`
+	JobSequence  int64                 `json:"jobSequence"`
+	Metadata     map[string]string     `json:"metadata"`
+	Jobs         map[uint32]models.Job `json:"jobs"`
+	Segments     []kvSegmentInfo       `json:"segments"`
+	NextSegment  int                   `json:"nextSegment"`
+	Couples      map[uint32]int        `json:"couples"`    // couples stored per song, tombstones excluded
+	Tombstones   map[uint32]bool       `json:"tombstones"` // deleted songs whose couples may still be in segments
+	Log          int                   `json:"log"`        // number of the log of the changes made since
+
+	byKey   map[string]uint32
+	byYTID  map[string]uint32
+	changes *kvChange // changes of the running update, nil outside of updates
+	rewrite bool      // the running update writes the whole catalog
+}
+
+// kvChange is a line of the log: the records set by an update, and the
+// segments and sequences after it.
+type kvChange struct {
+	Songs        map[uint32]*Song      `json:"songs,omitempty"` // nil for deleted songs
+	Jobs         map[uint32]models.Job `json:"jobs,omitempty"`
+	Metadata     map[string]string     `json:"metadata,omitempty"`
+	Migrations   map[int]int64         `json:"migrations,omitempty"`
+	Couples      map[uint32]int        `json:"couples,omitempty"`    // 0 once a song has no couples left
+	Tombstones   map[uint32]bool       `json:"tombstones,omitempty"` // false for cleared tombstones
+	Segments     []kvSegmentInfo       `json:"segments"`
+	NextSegment  int                   `json:"nextSegment"`
+	SongSequence int64                 `json:"songSequence"`
+	JobSequence  int64                 `json:"jobSequence"`
+}
+
+// init creates the maps missing from a new or decoded catalog
+func (c *kvCatalog) init() {
+	if c.Migrations == nil {
+		c.Migrations = map[int]int64{}
+	}
+	if c.Songs == nil {
+		c.Songs = map[uint32]Song{}
+	}
+	if c.Metadata == nil {
+		c.Metadata = map[string]string{}
+	}
+	if c.Jobs == nil {
+		c.Jobs = map[uint32]models.Job{}
+	}
+	if c.Couples == nil {
+		c.Couples = map[uint32]int{}
+	}
+	if c.Tombstones == nil {
+		c.Tombstones = map[uint32]bool{}
+	}
+	if c.byKey == nil {
+		c.reindexSongs()
+	}
+}
+
+// reindexSongs builds the lookup tables of the songs by key and YouTube ID
+func (c *kvCatalog) reindexSongs() {
+	c.byKey = make(map[string]uint32, len(c.Songs))
+	c.byYTID = make(map[string]uint32, len(c.Songs))
+	for _, song := range c.Songs {
+		c.indexSong(song)
+	}
+}
+
+func (c *kvCatalog) indexSong(song Song) {
+	c.byKey[songKey(song)] = song.ID
+	if song.YouTubeID != "" {
+		c.byYTID[song.YouTubeID] = song.ID
+	}
+}
+
+func (c *kvCatalog) unindexSong(song Song) {
+	if c.byKey[songKey(song)] == song.ID {
+		delete(c.byKey, songKey(song))
+	}
+	if c.byYTID[song.YouTubeID] == song.ID {
+		delete(c.byYTID, song.YouTubeID)
+	}
+}
+
+func (c *kvCatalog) setSong(song Song) {
+	if stored, ok := c.Songs[song.ID]; ok {
+		c.unindexSong(stored)
+	}
+	c.Songs[song.ID] = song
+	c.indexSong(song)
+
+	if change := c.changes; change != nil {
+		if change.Songs == nil {
+			change.Songs = map[uint32]*Song{}
+		}
+		change.Songs[song.ID] = &song
+	}
+}
+
+func (c *kvCatalog) deleteSong(songID uint32) {
+	stored, ok := c.Songs[songID]
+	if !ok {
+		return
+	}
+	c.unindexSong(stored)
+	delete(c.Songs, songID)
+
+	if change := c.changes; change != nil {
+		if change.Songs == nil {
+			change.Songs = map[uint32]*Song{}
+		}
+		change.Songs[songID] = nil
+	}
+}
+
+func (c *kvCatalog) setJob(job models.Job) {
+	c.Jobs[job.ID] = job
+
+	if change := c.changes; change != nil {
+		if change.Jobs == nil {
+			change.Jobs = map[uint32]models.Job{}
+		}
+		change.Jobs[job.ID] = job
+	}
+}
+
+func (c *kvCatalog) setMetadata(key, value string) {
+	c.Metadata[key] = value
+
+	if change := c.changes; change != nil {
+		if change.Metadata == nil {
+			change.Metadata = map[string]string{}
+		}
+		change.Metadata[key] = value
+	}
+}
+
+func (c *kvCatalog) setMigration(version int, appliedAt int64) {
+	c.Migrations[version] = appliedAt
+
+	if change := c.changes; change != nil {
+		if change.Migrations == nil {
+			change.Migrations = map[int]int64{}
+		}
+		change.Migrations[version] = appliedAt
+	}
+}
+
+// setCouples sets the number of couples stored for a song
+func (c *kvCatalog) setCouples(songID uint32, couples int) {
+	if couples > 0 {
+		c.Couples[songID] = couples
+	} else {
+		delete(c.Couples, songID)
+	}
+
+	if change := c.changes; change != nil {
+		if change.Couples == nil {
+			change.Couples = map[uint32]int{}
+		}
+		change.Couples[songID] = couples
+	}
+}
+
+// setTombstone adds or clears the tombstone of a song
+func (c *kvCatalog) setTombstone(songID uint32, deleted bool) {
+	if deleted {
+		c.Tombstones[songID] = true
+	} else {
+		delete(c.Tombstones, songID)
+	}
+
+	if change := c.changes; change != nil {
+		if change.Tombstones == nil {
+			change.Tombstones = map[uint32]bool{}
+		}
+		change.Tombstones[songID] = deleted
+	}
+}
+
+// apply makes a logged change to the catalog
+func (c *kvCatalog) apply(change kvChange) {
+	for id, song := range change.Songs {
+		if song != nil {
+			c.setSong(*song)
+		} else {
+			c.deleteSong(id)
+		}
+	}
+	for _, job := range change.Jobs {
+		c.setJob(job)
+	}
+	for key, value := range change.Metadata {
+		c.setMetadata(key, value)
+	}
+	for version, appliedAt := range change.Migrations {
+		c.setMigration(version, appliedAt)
+	}
+	for songID, couples := range change.Couples {
+		c.setCouples(songID, couples)
+	}
+	for songID, deleted := range change.Tombstones {
+		c.setTombstone(songID, deleted)
+	}
+	c.Segments = change.Segments
+	c.NextSegment = change.NextSegment
+	c.SongSequence = change.SongSequence
+	c.JobSequence = change.JobSequence
+}
+
+// begin starts recording the changes of an update
+func (c *kvCatalog) begin() {
+	c.changes = &kvChange{NextSegment: c.NextSegment, SongSequence: c.SongSequence, JobSequence: c.JobSequence}
+	c.rewrite = false
+}
+
+// changed reports whether the running update changed the catalog. Segments
+// are only added or removed along with a new segment number.
+func (c *kvCatalog) changed() bool {
+	change := c.changes
+	return c.rewrite || len(change.Songs) > 0 || len(change.Jobs) > 0 || len(change.Metadata) > 0 ||
+		len(change.Migrations) > 0 || len(change.Couples) > 0 || len(change.Tombstones) > 0 ||
+		c.NextSegment != change.NextSegment || c.SongSequence != change.SongSequence ||
+		c.JobSequence != change.JobSequence
+}
+
+func (s *kvStore) catalogPath() string {
+	return filepath.Join(s.dir, "catalog.json")
+}
+
+func (s *kvStore) logPath(log int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%08d.log", log))
+}
+
+// sameFile reports whether info describes the file of loaded, unchanged
+func sameFile(info, loaded os.FileInfo) bool {
+	if info == nil || loaded == nil {
+		return info == nil && loaded == nil
+	}
+	return os.SameFile(info, loaded) && info.ModTime().Equal(loaded.ModTime()) && info.Size() == loaded.Size()
+}
+
+// refresh loads the catalog if it was written since it was last loaded,
+// applies the changes logged since, and maps its segments.
+func (s *kvStore) refresh() error {
+	info, err := os.Stat(s.catalogPath())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error reading KV store: %v", err)
+	}
+
+	catalog, logSize := s.catalog, s.logSize
+	if catalog == nil || !sameFile(info, s.loaded) {
+		catalog, logSize = &kvCatalog{}, 0
+		if info != nil {
+			data, err := os.ReadFile(s.catalogPath())
+			if err != nil {
+				return fmt.Errorf("error reading KV store: %v", err)
+			}
+			if err := json.Unmarshal(data, catalog); err != nil {
+				return fmt.Errorf("invalid KV store catalog: %v", err)
+			}
+		}
+		catalog.init()
+	}
+
+	logInfo, err := os.Stat(s.logPath(catalog.Log))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error reading KV store: %v", err)
+	}
+	if catalog == s.catalog && (logInfo == nil || logInfo.Size() == logSize) {
+		return nil
+	}
+
+	if logInfo != nil {
+		// The catalog is loaded again if applying the log fails halfway
+		logSize, err = catalog.applyLog(s.logPath(catalog.Log), logSize)
+		if err != nil {
+			s.catalog = nil
+			return err
+		}
+	}
+	if err := s.mapSegments(catalog); err != nil {
+		s.catalog = nil
+		return err
+	}
+
+	s.catalog = catalog
+	s.loaded = info
+	s.logSize = logSize
+	return nil
+}
+
+// applyLog applies the changes logged after offset, and returns the offset
+// following the last complete one. A change that isn't complete was being
+// written by a process that stopped, and is left out.
+func (c *kvCatalog) applyLog(path string, offset int64) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return offset, fmt.Errorf("error reading KV store log: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return offset, fmt.Errorf("error reading KV store log: %v", err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return offset, fmt.Errorf("error reading KV store log: %v", err)
+	}
+
+	for {
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			return offset, nil
+		}
+
+		var change kvChange
+		if err := json.Unmarshal(data[:end], &change); err != nil {
+			return offset, fmt.Errorf("invalid KV store log at offset %d: %v", offset, err)
+		}
+		c.apply(change)
+
+		data = data[end+1:]
+		offset += int64(end + 1)
+	}
+}
+
+// mapSegments maps the segments of catalog, reusing the ones already mapped
+// and unmapping the ones it doesn't have.
+func (s *kvStore) mapSegments(catalog *kvCatalog) error {
+	segments := map[string]*segment{}
+	for _, info := range catalog.Segments {
+		if seg, ok := s.segments[info.Name]; ok {
+			segments[info.Name] = seg
+			continue
+		}
+		seg, err := openSegment(filepath.Join(s.dir, info.Name), info.Name)
+		if err != nil {
+			for name, seg := range segments {
+				if _, ok := s.segments[name]; !ok {
+					seg.close()
+				}
+			}
+			return err
+		}
+		segments[info.Name] = seg
+	}
+	for name, seg := range s.segments {
+		if _, ok := segments[name]; !ok {
+			seg.close()
+		}
+	}
+
+	s.segments = segments
+	return nil
+}
+
+// save logs the changes of the running update. The whole catalog is written
+// instead when the update asks for it or once the log is larger than the
+// catalog.
+func (s *kvStore) save() error {
+	c := s.catalog
+	if !c.changed() {
+		return nil
+	}
+
+	catalogSize := int64(0)
+	if s.loaded != nil {
+		catalogSize = s.loaded.Size()
+	}
+	if c.rewrite || s.logSize > max(catalogSize, kvMinLogSize) {
+		return s.writeCatalog()
+	}
+	return s.appendLog()
+}
+
+// appendLog appends the changes of the running update to the log
+func (s *kvStore) appendLog() error {
+	change := s.catalog.changes
+	change.Segments = s.catalog.Segments
+	change.NextSegment = s.catalog.NextSegment
+	change.SongSequence = s.catalog.SongSequence
+	change.JobSequence = s.catalog.JobSequence
+
+	data, err := json.Marshal(change)
+	if err != nil {
+		return fmt.Errorf("error encoding KV store log: %v", err)
+	}
+	data = append(data, '\n')
+
+	f, err := os.OpenFile(s.logPath(s.catalog.Log), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing KV store log: %v", err)
+	}
+	// Whatever follows the last complete change was left by a process that
+	// stopped while writing it
+	err = f.Truncate(s.logSize)
+	if err == nil {
+		_, err = f.WriteAt(data, s.logSize)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing KV store log: %v", err)
+	}
+
+	s.logSize += int64(len(data))
+	return nil
+}
+
+// writeCatalog writes the catalog with a new, empty log to a temporary file
+// renamed over catalog.json, so that readers never see it half written, then
+// removes the previous log.
+func (s *kvStore) writeCatalog() error {
+	c := s.catalog
+	c.Log++
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("error encoding KV store catalog: %v", err)
+	}
+
+	tmpFile := s.catalogPath() + ".tmp"
+	f, err := os.Create(tmpFile)
+	if err != nil {
+		return fmt.Errorf("error writing KV store catalog: %v", err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile, s.catalogPath())
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return fmt.Errorf("error writing KV store catalog: %v", err)
+	}
+
+	info, err := os.Stat(s.catalogPath())
+	if err != nil {
+		return fmt.Errorf("error writing KV store catalog: %v", err)
+	}
+	s.loaded = info
+	s.logSize = 0
+
+	// Logs of previous catalogs, including ones left by a process that
+	// stopped before removing them
+	logs, err := filepath.Glob(filepath.Join(s.dir, "*.log"))
+	if err != nil {
+		return err
+	}
+	for _, log := range logs {
+		if log != s.logPath(c.Log) {
+			os.Remove(log)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"song-recognition/models"
+	"sort"
+)
+
+// NextJobID allocates the ID of a new job from the job sequence. IDs of jobs
+// already stored are skipped.
+func (db *KVClient) NextJobID(ctx context.Context) (uint32, error) {
+	var jobID uint32
+	err := db.update(ctx, func(c *kvCatalog) error {
+		for {
+			c.JobSequence++
+			if c.JobSequence > 1<<32-1 {
+				return fmt.Errorf("no job IDs left")
+			}
+			id := uint32(c.JobSequence)
+			if _, ok := c.Jobs[id]; ok {
+				continue
+			}
+			jobID = id
+			return nil
+		}
+	})
+	return jobID, err
+}
+
+func (db *KVClient) CreateJob(ctx context.Context, job models.Job) error {
+	err := db.update(ctx, func(c *kvCatalog) error {
+		if _, ok := c.Jobs[job.ID]; ok {
+			return fmt.Errorf("job %d already exists", job.ID)
+		}
+		c.setJob(job)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create job: %v", err)
+	}
+	return nil
+}
+
+func (db *KVClient) GetJob(ctx context.Context, jobID uint32) (models.Job, bool, error) {
+	var job models.Job
+	var jobExists bool
+	err := db.view(ctx, func(c *kvCatalog) error {
+		job, jobExists = c.Jobs[jobID]
+		return nil
+	})
+	if err != nil {
+		return models.Job{}, false, fmt.Errorf("failed to retrieve job: %v", err)
+	}
+	return job, jobExists, nil
+}
+
+// ListJobs returns the jobs ordered by creation time. With unfinishedOnly,
+// only the jobs with tracks left to process are returned.
+func (db *KVClient) ListJobs(ctx context.Context, unfinishedOnly bool) ([]models.Job, error) {
+	jobs := []models.Job{}
+	err := db.view(ctx, func(c *kvCatalog) error {
+		for _, job := range c.Jobs {
+			if !unfinishedOnly || !job.Finished() {
+				jobs = append(jobs, job)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %v", err)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].CreatedAt.Equal(jobs[j].CreatedAt) {
+			return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+		}
+		return jobs[i].ID < jobs[j].ID
+	})
+	return jobs, nil
+}
+
+func (db *KVClient) UpdateJobTrack(ctx context.Context, jobID uint32, track models.JobTrack) error {
+	err := db.update(ctx, func(c *kvCatalog) error {
+		job, ok := c.Jobs[jobID]
+		if !ok {
+			return nil
+		}
+
+		// Tracks of the catalog are shared with the jobs returned before
+		tracks := append([]models.JobTrack(nil), job.Tracks...)
+		for i := range tracks {
+			if tracks[i].Index == track.Index {
+				tracks[i].State = track.State
+				tracks[i].Error = track.Error
+				tracks[i].Attempts = track.Attempts
+				tracks[i].NextAttemptAt = track.NextAttemptAt
+				tracks[i].UpdatedAt = track.UpdatedAt
+			}
+		}
+		job.Tracks = tracks
+		c.setJob(job)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update job track: %v", err)
+	}
+	return nil
+}
+
+func (db *KVClient) SetJobCanceled(ctx context.Context, jobID uint32, canceled bool) error {
+	err := db.update(ctx, func(c *kvCatalog) error {
+		if job, ok := c.Jobs[jobID]; ok {
+			job.Canceled = canceled
+			c.setJob(job)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update job: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type kvMigration struct {
+	Migration
+	up func(c *kvCatalog) error
+}
+
+// kvMigrations are the migrations of the KV store catalog, in order. Applied
+// migrations must never change, new ones are appended.
+var kvMigrations = []kvMigration{
+	{
+		Migration{1, "create catalog"},
+		func(c *kvCatalog) error {
+			c.init()
+			return nil
+		},
+	},
+}
+
+func (db *KVClient) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	applied := make(map[int]time.Time)
+	err := db.view(ctx, func(c *kvCatalog) error {
+		for version, appliedAt := range c.Migrations {
+			applied[version] = fromMillis(appliedAt)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]Migration, len(kvMigrations))
+	for i, migration := range kvMigrations {
+		migrations[i] = migration.Migration
+	}
+
+	return migrationStatuses(migrations, applied), nil
+}
+
+// Migrate applies the pending migrations in order, each saved on its own,
+// and returns them.
+func (db *KVClient) Migrate(ctx context.Context) ([]Migration, error) {
+	var migrated []Migration
+	for _, migration := range kvMigrations {
+		applied := false
+		err := db.update(ctx, func(c *kvCatalog) error {
+			if _, ok := c.Migrations[migration.Version]; ok {
+				return nil
+			}
+			if err := migration.up(c); err != nil {
+				return err
+			}
+			// Migrations may change any part of the catalog
+			c.rewrite = true
+			c.Migrations[migration.Version] = toMillis(time.Now())
+			applied = true
+			return nil
+		})
+		if err != nil {
+			return migrated, fmt.Errorf("migration %d (%s) failed: %v", migration.Version, migration.Description, err)
+		}
+		if applied {
+			migrated = append(migrated, migration.Migration)
+		}
+	}
+
+	return migrated, nil
+}
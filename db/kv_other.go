@@ -0,0 +1,29 @@
+//go:build !unix
+
+package db
+
+import (
+	"io"
+	"os"
+)
+
+// mapFile reads a file in memory where memory-mapping isn't supported.
+func mapFile(f *os.File, size int) ([]byte, error) {
+	data := make([]byte, size)
+	_, err := io.ReadFull(io.NewSectionReader(f, 0, int64(size)), data)
+	return data, err
+}
+
+func unmapFile(data []byte) error {
+	return nil
+}
+
+// lockFile does nothing where advisory locks aren't supported: the store must
+// then only be opened by one process at a time.
+func lockFile(f *os.File, exclusive bool) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,326 @@
+package db
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"song-recognition/models"
+	"sort"
+)
+
+// Segment files hold fingerprints sorted by address, and are never modified
+// once written:
+//
+//	couples  numCouples × (anchorTimeMs uint32, songID uint32)
+//	index    numAddresses × (address uint32, first couple uint32)
+//	footer   numAddresses uint32, numCouples uint32, "SRFP"
+//
+// Integers are little endian. The couples of index entry i go from its first
+// couple to the first couple of entry i+1.
+const (
+	segmentMagic      = "SRFP"
+	segmentFooterSize = 12
+	coupleSize        = 8
+	indexEntrySize    = 8
+)
+
+// segment is a memory-mapped segment file
+type segment struct {
+	name         string
+	data         []byte
+	numAddresses int
+	numCouples   int
+	index        []byte
+}
+
+func openSegment(path, name string) (*segment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < segmentFooterSize {
+		return nil, fmt.Errorf("invalid segment %s", name)
+	}
+
+	data, err := mapFile(f, int(info.Size()))
+	if err != nil {
+		return nil, fmt.Errorf("error mapping segment %s: %v", name, err)
+	}
+
+	footer := data[len(data)-segmentFooterSize:]
+	seg := &segment{
+		name:         name,
+		data:         data,
+		numAddresses: int(binary.LittleEndian.Uint32(footer[0:4])),
+		numCouples:   int(binary.LittleEndian.Uint32(footer[4:8])),
+	}
+	indexStart := seg.numCouples * coupleSize
+	indexEnd := indexStart + seg.numAddresses*indexEntrySize
+	if string(footer[8:12]) != segmentMagic || indexEnd != len(data)-segmentFooterSize {
+		unmapFile(data)
+		return nil, fmt.Errorf("invalid segment %s", name)
+	}
+	seg.index = data[indexStart:indexEnd]
+
+	return seg, nil
+}
+
+func (s *segment) close() error {
+	return unmapFile(s.data)
+}
+
+// entry returns the address of index entry i and the range of its couples
+func (s *segment) entry(i int) (address uint32, first, end int) {
+	e := s.index[i*indexEntrySize:]
+	address = binary.LittleEndian.Uint32(e[0:4])
+	first = int(binary.LittleEndian.Uint32(e[4:8]))
+	end = s.numCouples
+	if i+1 < s.numAddresses {
+		end = int(binary.LittleEndian.Uint32(e[indexEntrySize+4 : indexEntrySize+8]))
+	}
+	return address, first, end
+}
+
+// lookup returns the range of the couples of an address, empty if the
+// segment doesn't have it.
+func (s *segment) lookup(address uint32) (first, end int) {
+	i := sort.Search(s.numAddresses, func(i int) bool {
+		return binary.LittleEndian.Uint32(s.index[i*indexEntrySize:]) >= address
+	})
+	if i == s.numAddresses {
+		return 0, 0
+	}
+	entryAddress, first, end := s.entry(i)
+	if entryAddress != address {
+		return 0, 0
+	}
+	return first, end
+}
+
+func (s *segment) couple(i int) models.Couple {
+	c := s.data[i*coupleSize:]
+	return models.Couple{
+		AnchorTimeMs: binary.LittleEndian.Uint32(c[0:4]),
+		SongID:       binary.LittleEndian.Uint32(c[4:8]),
+	}
+}
+
+// segmentWriter writes a segment file, address by address in ascending
+// order. The index is buffered in a temporary file and appended at the end.
+type segmentWriter struct {
+	path         string
+	file         *os.File
+	couples      *bufio.Writer
+	indexFile    *os.File
+	index        *bufio.Writer
+	numAddresses int
+	numCouples   int
+	buf          [8]byte
+}
+
+func newSegmentWriter(path string) (*segmentWriter, error) {
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	indexFile, err := os.CreateTemp("", "segment-index-")
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	return &segmentWriter{
+		path:      path,
+		file:      file,
+		couples:   bufio.NewWriter(file),
+		indexFile: indexFile,
+		index:     bufio.NewWriter(indexFile),
+	}, nil
+}
+
+func (w *segmentWriter) add(address uint32, couples []models.Couple) error {
+	if len(couples) == 0 {
+		return nil
+	}
+	if uint64(w.numCouples)+uint64(len(couples)) > math.MaxUint32 {
+		return fmt.Errorf("segment is full")
+	}
+
+	binary.LittleEndian.PutUint32(w.buf[0:4], address)
+	binary.LittleEndian.PutUint32(w.buf[4:8], uint32(w.numCouples))
+	if _, err := w.index.Write(w.buf[:]); err != nil {
+		return err
+	}
+	w.numAddresses++
+
+	for _, couple := range couples {
+		binary.LittleEndian.PutUint32(w.buf[0:4], couple.AnchorTimeMs)
+		binary.LittleEndian.PutUint32(w.buf[4:8], couple.SongID)
+		if _, err := w.couples.Write(w.buf[:]); err != nil {
+			return err
+		}
+	}
+	w.numCouples += len(couples)
+
+	return nil
+}
+
+// finish appends the index and the footer, and moves the segment in place
+func (w *segmentWriter) finish() error {
+	defer w.abort()
+
+	if err := w.index.Flush(); err != nil {
+		return err
+	}
+	if _, err := w.indexFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w.couples, w.indexFile); err != nil {
+		return err
+	}
+
+	var footer [segmentFooterSize]byte
+	binary.LittleEndian.PutUint32(footer[0:4], uint32(w.numAddresses))
+	binary.LittleEndian.PutUint32(footer[4:8], uint32(w.numCouples))
+	copy(footer[8:], segmentMagic)
+	if _, err := w.couples.Write(footer[:]); err != nil {
+		return err
+	}
+
+	if err := w.couples.Flush(); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(w.file.Name(), w.path)
+}
+
+// abort removes the temporary files, the segment is kept if it was finished
+func (w *segmentWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+	w.indexFile.Close()
+	os.Remove(w.indexFile.Name())
+}
+
+// writeSegment writes fingerprints to a new segment file in a single pass
+// and returns its number of couples.
+func writeSegment(path string, fingerprints map[uint32][]models.Couple) (int, error) {
+	addresses := make([]uint32, 0, len(fingerprints))
+	for address := range fingerprints {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i] < addresses[j] })
+
+	w, err := newSegmentWriter(path)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, address := range addresses {
+		if err := w.add(address, fingerprints[address]); err != nil {
+			w.abort()
+			return 0, err
+		}
+	}
+
+	if err := w.finish(); err != nil {
+		return 0, err
+	}
+	return w.numCouples, nil
+}
+
+// segmentCursor is the position of a merge in a segment
+type segmentCursor struct {
+	seg     *segment
+	order   int // position of the segment, to keep the couples in order
+	entry   int
+	address uint32
+}
+
+type cursorHeap []*segmentCursor
+
+func (h cursorHeap) Len() int { return len(h) }
+func (h cursorHeap) Less(i, j int) bool {
+	if h[i].address != h[j].address {
+		return h[i].address < h[j].address
+	}
+	return h[i].order < h[j].order
+}
+func (h cursorHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *cursorHeap) Push(x interface{}) { *h = append(*h, x.(*segmentCursor)) }
+func (h *cursorHeap) Pop() interface{} {
+	old := *h
+	cursor := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return cursor
+}
+
+// mergeSegments merges segments into a new segment file, leaving out the
+// couples of the dropped songs, and returns its number of couples.
+func mergeSegments(path string, segments []*segment, dropped func(songID uint32) bool) (int, error) {
+	w, err := newSegmentWriter(path)
+	if err != nil {
+		return 0, err
+	}
+
+	cursors := &cursorHeap{}
+	for i, seg := range segments {
+		if seg.numAddresses > 0 {
+			address, _, _ := seg.entry(0)
+			*cursors = append(*cursors, &segmentCursor{seg: seg, order: i, address: address})
+		}
+	}
+	heap.Init(cursors)
+
+	var couples []models.Couple
+	for cursors.Len() > 0 {
+		address := (*cursors)[0].address
+		couples = couples[:0]
+
+		for cursors.Len() > 0 && (*cursors)[0].address == address {
+			cursor := (*cursors)[0]
+			_, first, end := cursor.seg.entry(cursor.entry)
+			for i := first; i < end; i++ {
+				if couple := cursor.seg.couple(i); !dropped(couple.SongID) {
+					couples = append(couples, couple)
+				}
+			}
+
+			cursor.entry++
+			if cursor.entry < cursor.seg.numAddresses {
+				cursor.address, _, _ = cursor.seg.entry(cursor.entry)
+				heap.Fix(cursors, 0)
+			} else {
+				heap.Pop(cursors)
+			}
+		}
+
+		if err := w.add(address, couples); err != nil {
+			w.abort()
+			return 0, err
+		}
+	}
+
+	if err := w.finish(); err != nil {
+		return 0, err
+	}
+	return w.numCouples, nil
+}
@@ -0,0 +1,457 @@
+package db
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"song-recognition/models"
+	"testing"
+)
+
+func newTestKVClient(t *testing.T, dir string) *KVClient {
+	t.Helper()
+
+	dbClient, err := NewKVClient(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbClient.Close() })
+
+	if _, err := dbClient.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return dbClient
+}
+
+// segmentCouples returns the couples of a segment by address
+func segmentCouples(seg *segment) map[uint32][]models.Couple {
+	couples := map[uint32][]models.Couple{}
+	for entry := 0; entry < seg.numAddresses; entry++ {
+		address, first, end := seg.entry(entry)
+		for i := first; i < end; i++ {
+			couples[address] = append(couples[address], seg.couple(i))
+		}
+	}
+	return couples
+}
+
+func openTestSegment(t *testing.T, path string) *segment {
+	t.Helper()
+
+	seg, err := openSegment(path, filepath.Base(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { seg.close() })
+	return seg
+}
+
+func TestSegment(t *testing.T) {
+	fingerprints := map[uint32][]models.Couple{
+		7:         {{AnchorTimeMs: 1, SongID: 1}, {AnchorTimeMs: 2, SongID: 2}},
+		3:         {{AnchorTimeMs: 3, SongID: 1}},
+		1<<32 - 1: {{AnchorTimeMs: 1<<32 - 1, SongID: 1<<32 - 1}},
+	}
+
+	path := filepath.Join(t.TempDir(), "test.seg")
+	couples, err := writeSegment(path, fingerprints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if couples != 4 {
+		t.Fatalf("wrote %d couples, want 4", couples)
+	}
+
+	seg := openTestSegment(t, path)
+	if seg.numAddresses != 3 || seg.numCouples != 4 {
+		t.Fatalf("got %d addresses and %d couples, want 3 and 4", seg.numAddresses, seg.numCouples)
+	}
+
+	// Addresses are sorted
+	var addresses []uint32
+	for entry := 0; entry < seg.numAddresses; entry++ {
+		address, _, _ := seg.entry(entry)
+		addresses = append(addresses, address)
+	}
+	if want := []uint32{3, 7, 1<<32 - 1}; !reflect.DeepEqual(addresses, want) {
+		t.Fatalf("got addresses %v, want %v", addresses, want)
+	}
+	if got := segmentCouples(seg); !reflect.DeepEqual(got, fingerprints) {
+		t.Fatalf("got couples %v, want %v", got, fingerprints)
+	}
+
+	for _, address := range []uint32{0, 4, 8, 1<<32 - 2} {
+		if first, end := seg.lookup(address); first != end {
+			t.Fatalf("found couples %d to %d of address %d", first, end, address)
+		}
+	}
+	first, end := seg.lookup(7)
+	if first != 1 || end != 3 {
+		t.Fatalf("got couples %d to %d of address 7, want 1 to 3", first, end)
+	}
+}
+
+func TestSegmentInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.seg")
+	if _, err := writeSegment(path, map[uint32][]models.Couple{1: {{AnchorTimeMs: 1, SongID: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{
+		"empty":       nil,
+		"truncated":   data[:len(data)-1],
+		"bad magic":   append(data[:len(data)-4:len(data)-4], "SRFX"...),
+		"extra bytes": append([]byte{0}, data...),
+	} {
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if seg, err := openSegment(path, name); err == nil {
+			seg.close()
+			t.Errorf("%s: opened an invalid segment", name)
+		}
+	}
+}
+
+func TestMergeSegments(t *testing.T) {
+	dir := t.TempDir()
+	batches := []map[uint32][]models.Couple{
+		{1: {{AnchorTimeMs: 1, SongID: 1}}, 5: {{AnchorTimeMs: 2, SongID: 1}, {AnchorTimeMs: 3, SongID: 2}}},
+		{5: {{AnchorTimeMs: 4, SongID: 3}}, 9: {{AnchorTimeMs: 5, SongID: 2}}},
+		{},
+		{2: {{AnchorTimeMs: 6, SongID: 3}}, 5: {{AnchorTimeMs: 7, SongID: 1}}},
+	}
+
+	var segments []*segment
+	for i, batch := range batches {
+		path := filepath.Join(dir, string(rune('a'+i))+".seg")
+		if _, err := writeSegment(path, batch); err != nil {
+			t.Fatal(err)
+		}
+		segments = append(segments, openTestSegment(t, path))
+	}
+
+	// Couples of an address are kept in the order of the segments, without
+	// the ones of dropped songs
+	path := filepath.Join(dir, "merged.seg")
+	couples, err := mergeSegments(path, segments, func(songID uint32) bool { return songID == 2 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint32][]models.Couple{
+		1: {{AnchorTimeMs: 1, SongID: 1}},
+		2: {{AnchorTimeMs: 6, SongID: 3}},
+		5: {{AnchorTimeMs: 2, SongID: 1}, {AnchorTimeMs: 4, SongID: 3}, {AnchorTimeMs: 7, SongID: 1}},
+	}
+	if couples != 5 {
+		t.Fatalf("merged %d couples, want 5", couples)
+	}
+	if got := segmentCouples(openTestSegment(t, path)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got couples %v, want %v", got, want)
+	}
+}
+
+func TestKVMergesSegments(t *testing.T) {
+	dir := t.TempDir()
+	dbClient := newTestKVClient(t, dir)
+	ctx := context.Background()
+
+	want := map[uint32][]models.Couple{}
+	for songID := uint32(1); songID <= segmentsPerLevel; songID++ {
+		fingerprints := map[uint32][]models.Couple{
+			songID:       {{AnchorTimeMs: songID, SongID: songID}},
+			songID + 100: {{AnchorTimeMs: songID, SongID: songID}},
+		}
+		if err := dbClient.RegisterSong(ctx, Song{ID: songID, Title: string(rune('a' + songID))}, fingerprints); err != nil {
+			t.Fatal(err)
+		}
+		for address, couples := range fingerprints {
+			want[address] = couples
+		}
+
+		// A level is merged once it has enough segments
+		wantSegments := int(songID) % segmentsPerLevel
+		if wantSegments == 0 {
+			wantSegments = 1
+		}
+		files, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dbClient.store.catalog.Segments) != wantSegments || len(files) != wantSegments {
+			t.Fatalf("got %d segments and %d files after %d songs, want %d",
+				len(dbClient.store.catalog.Segments), len(files), songID, wantSegments)
+		}
+	}
+
+	addresses := make([]uint32, 0, len(want))
+	for address := range want {
+		addresses = append(addresses, address)
+	}
+	got, err := dbClient.GetCouples(ctx, addresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got couples %v, want %v", got, want)
+	}
+}
+
+func TestKVTombstones(t *testing.T) {
+	dir := t.TempDir()
+	dbClient := newTestKVClient(t, dir)
+	ctx := context.Background()
+
+	registerSong(t, dbClient, Song{ID: 1, Title: "One"}, map[uint32][]models.Couple{10: {{AnchorTimeMs: 1, SongID: 1}}})
+	registerSong(t, dbClient, Song{ID: 2, Title: "Two"}, map[uint32][]models.Couple{10: {{AnchorTimeMs: 2, SongID: 2}}})
+
+	if err := dbClient.DeleteSongByID(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The couples of the deleted song stay in its segment, left out of lookups
+	if !dbClient.store.catalog.Tombstones[1] || len(dbClient.store.catalog.Segments) != 2 {
+		t.Fatalf("got tombstones %v and %d segments, want song 1 tombstoned in 2 segments",
+			dbClient.store.catalog.Tombstones, len(dbClient.store.catalog.Segments))
+	}
+	assertCouples := func(want map[uint32][]models.Couple) {
+		t.Helper()
+		got, err := dbClient.GetCouples(ctx, []uint32{10, 20})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got couples %v, want %v", got, want)
+		}
+	}
+	assertCouples(map[uint32][]models.Couple{10: {{AnchorTimeMs: 2, SongID: 2}}})
+
+	// Tombstoned IDs aren't allocated again
+	id, err := dbClient.NextSongID(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == 1 || id == 2 {
+		t.Fatalf("got song ID %d, which is in use", id)
+	}
+
+	// Storing couples of a tombstoned song merges its old ones away first
+	registerSong(t, dbClient, Song{ID: 1, Title: "One again"}, map[uint32][]models.Couple{20: {{AnchorTimeMs: 3, SongID: 1}}})
+	if len(dbClient.store.catalog.Tombstones) != 0 {
+		t.Fatalf("got tombstones %v, want none", dbClient.store.catalog.Tombstones)
+	}
+	assertCouples(map[uint32][]models.Couple{
+		10: {{AnchorTimeMs: 2, SongID: 2}},
+		20: {{AnchorTimeMs: 3, SongID: 1}},
+	})
+	if count, err := dbClient.CountFingerprints(ctx, 1); err != nil || count != 1 {
+		t.Fatalf("got %d fingerprints and %v, want 1", count, err)
+	}
+}
+
+func TestKVReopen(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	dbClient := newTestKVClient(t, dir)
+	registerSong(t, dbClient, Song{ID: 1, Title: "One", YouTubeID: "yt1"}, map[uint32][]models.Couple{10: {{AnchorTimeMs: 1, SongID: 1}}})
+	registerSong(t, dbClient, Song{ID: 2, Title: "Two"}, map[uint32][]models.Couple{10: {{AnchorTimeMs: 2, SongID: 2}}})
+	if err := dbClient.UpdateSong(ctx, Song{ID: 1, Title: "Uno", YouTubeID: "yt2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbClient.DeleteSongByID(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbClient.SetMetadata(ctx, "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbClient.CreateJob(ctx, models.Job{ID: 1, Tracks: []models.JobTrack{{Index: 0, State: models.TrackQueued}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbClient.UpdateJobTrack(ctx, 1, models.JobTrack{Index: 0, State: models.TrackDone}); err != nil {
+		t.Fatal(err)
+	}
+	want := *dbClient.store.catalog
+	dbClient.Close()
+
+	// Updates are appended to the log, which is applied again on opening
+	if dbClient.store.logSize == 0 {
+		t.Fatal("nothing was logged")
+	}
+
+	dbClient = newTestKVClient(t, dir)
+	got := dbClient.store.catalog
+	if !reflect.DeepEqual(got.Songs, want.Songs) || !reflect.DeepEqual(got.byKey, want.byKey) ||
+		!reflect.DeepEqual(got.byYTID, want.byYTID) || !reflect.DeepEqual(got.Couples, want.Couples) ||
+		!reflect.DeepEqual(got.Tombstones, want.Tombstones) || !reflect.DeepEqual(got.Segments, want.Segments) ||
+		!reflect.DeepEqual(got.Metadata, want.Metadata) || got.Jobs[1].Tracks[0].State != models.TrackDone ||
+		got.SongSequence != want.SongSequence || got.NextSegment != want.NextSegment {
+		t.Fatalf("got catalog %+v after reopening, want %+v", got, want)
+	}
+}
+
+func TestKVLogTornChange(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	dbClient := newTestKVClient(t, dir)
+	if err := dbClient.SetMetadata(ctx, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	logPath := dbClient.store.logPath(dbClient.store.catalog.Log)
+	dbClient.Close()
+
+	// A process stopped while logging a change
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"metadata":{"b":`)
+	f.Close()
+
+	dbClient = newTestKVClient(t, dir)
+	if err := dbClient.SetMetadata(ctx, "c", "3"); err != nil {
+		t.Fatal(err)
+	}
+	dbClient.Close()
+
+	dbClient = newTestKVClient(t, dir)
+	for key, want := range map[string]string{"a": "1", "b": "", "c": "3"} {
+		if value, _, err := dbClient.GetMetadata(ctx, key); err != nil || value != want {
+			t.Fatalf("got %s = %q and %v, want %q", key, value, err, want)
+		}
+	}
+}
+
+func TestKVSharedStore(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	writer := newTestKVClient(t, dir)
+
+	// A store opened apart, as by another process
+	lock, err := os.OpenFile(filepath.Join(dir, "LOCK"), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := &KVClient{store: &kvStore{dir: writer.store.dir, clients: 1, lock: lock, segments: map[string]*segment{}}}
+	defer reader.Close()
+
+	for i, value := range []string{"1", "2", "3"} {
+		if i == 2 {
+			// Writes the whole catalog and starts a new log
+			if err := writer.DeleteCollection(ctx, "jobs"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.SetMetadata(ctx, "key", value); err != nil {
+			t.Fatal(err)
+		}
+		registerSong(t, writer, Song{ID: uint32(i + 1), Title: value}, map[uint32][]models.Couple{10: {{AnchorTimeMs: 1, SongID: uint32(i + 1)}}})
+
+		if got, _, err := reader.GetMetadata(ctx, "key"); err != nil || got != value {
+			t.Fatalf("got %q and %v, want %q", got, err, value)
+		}
+		couples, err := reader.GetCouples(ctx, []uint32{10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(couples[10]) != i+1 {
+			t.Fatalf("got couples %v, want %d", couples, i+1)
+		}
+	}
+
+	logs, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || logs[0] != writer.store.logPath(writer.store.catalog.Log) {
+		t.Fatalf("got logs %v, want only the current one", logs)
+	}
+}
+
+func TestKVClose(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	dbClient := newTestKVClient(t, dir)
+	other := newTestKVClient(t, dir)
+
+	if err := dbClient.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbClient.Close(); err != nil {
+		t.Fatalf("closing again: %v", err)
+	}
+	if _, _, err := dbClient.GetSongByID(ctx, 1); err == nil {
+		t.Fatal("read from a closed client")
+	}
+	if err := dbClient.SetMetadata(ctx, "key", "value"); err == nil {
+		t.Fatal("wrote to a closed client")
+	}
+
+	// Other clients of the store are still open
+	if err := other.SetMetadata(ctx, "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKVRegisterSongFailure(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	dbClient := newTestKVClient(t, dir)
+
+	// The log can't be written where its link points to
+	logPath := dbClient.store.logPath(dbClient.store.catalog.Log)
+	if err := os.Symlink(filepath.Join(dir, "missing", "log"), logPath); err != nil {
+		t.Skip(err)
+	}
+
+	err := dbClient.RegisterSong(ctx, Song{ID: 1, Title: "One"}, map[uint32][]models.Couple{10: {{AnchorTimeMs: 1, SongID: 1}}})
+	if err == nil {
+		t.Fatal("registered a song without logging it")
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("got segments %v left after the failure", files)
+	}
+	if _, found, err := dbClient.GetSongByID(ctx, 1); err != nil || found {
+		t.Fatalf("got %v and %v, want no song", found, err)
+	}
+
+	if err := os.Remove(logPath); err != nil {
+		t.Fatal(err)
+	}
+	registerSong(t, dbClient, Song{ID: 1, Title: "One"}, map[uint32][]models.Couple{10: {{AnchorTimeMs: 1, SongID: 1}}})
+	if count, err := dbClient.CountFingerprints(ctx, 1); err != nil || count != 1 {
+		t.Fatalf("got %d fingerprints and %v, want 1", count, err)
+	}
+}
+
+func TestKVCloseWhileInUse(t *testing.T) {
+	dbClient := newTestKVClient(t, t.TempDir())
+	ctx := context.Background()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			// Calls fail once the client is closed
+			dbClient.SetMetadata(ctx, "key", "value")
+			dbClient.GetCouples(ctx, []uint32{1})
+		}
+	}()
+
+	if err := dbClient.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+}
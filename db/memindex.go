@@ -0,0 +1,331 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"song-recognition/models"
+	"sort"
+	"sync"
+)
+
+// MemIndex is an in-memory copy of the fingerprints, which the server looks
+// couples up in instead of the database. It's sharded by a hash of the
+// addresses; each shard holds its addresses sorted, with their couples packed
+// in a single array.
+type MemIndex struct {
+	shards [memIndexShards]memIndexShard
+}
+
+const (
+	memIndexShardBits = 8
+	memIndexShards    = 1 << memIndexShardBits
+)
+
+type memIndexShard struct {
+	mu        sync.RWMutex
+	addresses []uint32 // sorted
+	starts    []uint32 // couples of addresses[i] are couples[starts[i]:starts[i+1]]
+	couples   []uint64 // see packCouple
+	added     map[uint32][]uint64
+	numAdded  int // couples added since the shard was built
+}
+
+// memIndexEntry is a couple with its address, while the index is loaded
+type memIndexEntry struct {
+	address uint32
+	couple  uint64
+}
+
+// shardOf returns the shard of an address: the top bits of its multiplicative
+// hash. The top bits of the address itself would be skewed, as they hold the
+// frequency of the anchor peak and peaks are picked in log-spaced bands.
+func shardOf(address uint32) int {
+	return int((address * 0x9E3779B1) >> (32 - memIndexShardBits))
+}
+
+func packCouple(couple models.Couple) uint64 {
+	return uint64(couple.AnchorTimeMs)<<32 | uint64(couple.SongID)
+}
+
+func unpackCouple(packed uint64) models.Couple {
+	return models.Couple{AnchorTimeMs: uint32(packed >> 32), SongID: uint32(packed)}
+}
+
+// LoadMemIndex loads all the fingerprints of the database into a new index.
+func LoadMemIndex(ctx context.Context, dbClient DBClient) (*MemIndex, error) {
+	var entries [memIndexShards][]memIndexEntry
+	err := dbClient.ScanFingerprints(ctx, func(address uint32, couple models.Couple) error {
+		shard := shardOf(address)
+		entries[shard] = append(entries[shard], memIndexEntry{address, packCouple(couple)})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error loading fingerprints: %v", err)
+	}
+
+	idx := &MemIndex{}
+	for i := range idx.shards {
+		idx.shards[i].build(entries[i])
+		entries[i] = nil
+	}
+	return idx, nil
+}
+
+// build replaces the content of the shard with entries
+func (s *memIndexShard) build(entries []memIndexEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].address < entries[j].address })
+
+	s.addresses = s.addresses[:0]
+	s.starts = s.starts[:0]
+	s.couples = make([]uint64, 0, len(entries))
+	for i, entry := range entries {
+		if i == 0 || entry.address != entries[i-1].address {
+			s.addresses = append(s.addresses, entry.address)
+			s.starts = append(s.starts, uint32(len(s.couples)))
+		}
+		s.couples = append(s.couples, entry.couple)
+	}
+	s.starts = append(s.starts, uint32(len(s.couples)))
+	s.added = nil
+	s.numAdded = 0
+}
+
+// rebuild merges the added couples into the sorted arrays, leaving out the
+// couples of the dropped songs. The shard must be locked.
+func (s *memIndexShard) rebuild(dropped func(songID uint32) bool) {
+	entries := make([]memIndexEntry, 0, len(s.couples)+s.numAdded)
+	s.each(func(address uint32, couple uint64) {
+		if dropped == nil || !dropped(uint32(couple)) {
+			entries = append(entries, memIndexEntry{address, couple})
+		}
+	})
+	s.build(entries)
+}
+
+// each calls fn with every couple of the shard, which must be locked
+func (s *memIndexShard) each(fn func(address uint32, couple uint64)) {
+	for i, address := range s.addresses {
+		for _, couple := range s.couples[s.starts[i]:s.starts[i+1]] {
+			fn(address, couple)
+		}
+	}
+	for address, couples := range s.added {
+		for _, couple := range couples {
+			fn(address, couple)
+		}
+	}
+}
+
+// has reports whether the shard, which must be locked for reading, holds
+// couples of a song for which dropped returns true
+func (s *memIndexShard) has(dropped func(songID uint32) bool) bool {
+	for _, couple := range s.couples {
+		if dropped(uint32(couple)) {
+			return true
+		}
+	}
+	for _, couples := range s.added {
+		for _, couple := range couples {
+			if dropped(uint32(couple)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lookup appends the couples of an address to couples. The shard must be
+// locked for reading.
+func (s *memIndexShard) lookup(address uint32, couples []models.Couple) []models.Couple {
+	i := sort.Search(len(s.addresses), func(i int) bool { return s.addresses[i] >= address })
+	if i < len(s.addresses) && s.addresses[i] == address {
+		for _, couple := range s.couples[s.starts[i]:s.starts[i+1]] {
+			couples = append(couples, unpackCouple(couple))
+		}
+	}
+	for _, couple := range s.added[address] {
+		couples = append(couples, unpackCouple(couple))
+	}
+	return couples
+}
+
+// GetCouples returns the couples of the addresses, like DBClient.GetCouples
+func (idx *MemIndex) GetCouples(addresses []uint32) map[uint32][]models.Couple {
+	couples := make(map[uint32][]models.Couple)
+	for _, address := range addresses {
+		s := &idx.shards[shardOf(address)]
+		s.mu.RLock()
+		addressCouples := s.lookup(address, nil)
+		s.mu.RUnlock()
+
+		if len(addressCouples) > 0 {
+			couples[address] = addressCouples
+		}
+	}
+	return couples
+}
+
+// Add adds fingerprints to the index. They're kept aside and merged into the
+// sorted arrays of their shard once they make up a good part of it, so that
+// adding a song doesn't rebuild the whole index.
+func (idx *MemIndex) Add(fingerprints map[uint32][]models.Couple) {
+	var byShard [memIndexShards][]uint32
+	for address := range fingerprints {
+		shard := shardOf(address)
+		byShard[shard] = append(byShard[shard], address)
+	}
+
+	for i, addresses := range byShard {
+		if len(addresses) == 0 {
+			continue
+		}
+
+		s := &idx.shards[i]
+		s.mu.Lock()
+		if s.added == nil {
+			s.added = make(map[uint32][]uint64)
+		}
+		for _, address := range addresses {
+			for _, couple := range fingerprints[address] {
+				s.added[address] = append(s.added[address], packCouple(couple))
+			}
+			s.numAdded += len(fingerprints[address])
+		}
+		if s.numAdded > len(s.couples)/8+4096 {
+			s.rebuild(nil)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// RemoveSongs removes the couples of the songs for which dropped returns true.
+// Only the shards holding some of them are rebuilt.
+func (idx *MemIndex) RemoveSongs(dropped func(songID uint32) bool) {
+	for i := range idx.shards {
+		s := &idx.shards[i]
+		s.mu.RLock()
+		found := s.has(dropped)
+		s.mu.RUnlock()
+		if !found {
+			continue
+		}
+
+		s.mu.Lock()
+		s.rebuild(dropped)
+		s.mu.Unlock()
+	}
+}
+
+// SongIDs returns the IDs of the songs with couples in the index.
+func (idx *MemIndex) SongIDs() map[uint32]bool {
+	songIDs := make(map[uint32]bool)
+	for i := range idx.shards {
+		s := &idx.shards[i]
+		s.mu.RLock()
+		s.each(func(address uint32, couple uint64) {
+			songIDs[uint32(couple)] = true
+		})
+		s.mu.RUnlock()
+	}
+	return songIDs
+}
+
+// Len returns the number of couples in the index.
+func (idx *MemIndex) Len() int {
+	total := 0
+	for i := range idx.shards {
+		s := &idx.shards[i]
+		s.mu.RLock()
+		total += len(s.couples) + s.numAdded
+		s.mu.RUnlock()
+	}
+	return total
+}
+
+// indexedClient is a DBClient serving the couple lookups from a MemIndex
+type indexedClient struct {
+	DBClient
+	index *MemIndex
+}
+
+// NewIndexedClient returns a client looking couples up in idx, and keeping
+// it up to date with the fingerprints written and deleted through it. Changes
+// made by other clients aren't seen by the index.
+func NewIndexedClient(dbClient DBClient, idx *MemIndex) DBClient {
+	return &indexedClient{dbClient, idx}
+}
+
+func (db *indexedClient) GetCouples(ctx context.Context, addresses []uint32) (map[uint32][]models.Couple, error) {
+	return db.index.GetCouples(addresses), nil
+}
+
+func (db *indexedClient) StoreFingerprints(ctx context.Context, fingerprints map[uint32][]models.Couple) error {
+	if err := db.DBClient.StoreFingerprints(ctx, fingerprints); err != nil {
+		return err
+	}
+	db.index.Add(fingerprints)
+	return nil
+}
+
+func (db *indexedClient) RegisterSong(ctx context.Context, song Song, fingerprints map[uint32][]models.Couple) error {
+	if err := db.DBClient.RegisterSong(ctx, song, fingerprints); err != nil {
+		return err
+	}
+	db.index.Add(fingerprints)
+	return nil
+}
+
+func (db *indexedClient) ReplaceSong(ctx context.Context, oldSongID uint32, song Song, fingerprints map[uint32][]models.Couple) error {
+	if err := db.DBClient.ReplaceSong(ctx, oldSongID, song, fingerprints); err != nil {
+		return err
+	}
+	db.index.RemoveSongs(func(id uint32) bool { return id == oldSongID })
+	db.index.Add(fingerprints)
+	return nil
+}
+
+func (db *indexedClient) DeleteSongByID(ctx context.Context, songID uint32) error {
+	if err := db.DBClient.DeleteSongByID(ctx, songID); err != nil {
+		return err
+	}
+	db.index.RemoveSongs(func(id uint32) bool { return id == songID })
+	return nil
+}
+
+func (db *indexedClient) DeleteOrphanedCouples(ctx context.Context) (int, error) {
+	deleted, err := db.DBClient.DeleteOrphanedCouples(ctx)
+	if err != nil {
+		return deleted, err
+	}
+
+	var songIDs []uint32
+	for songID := range db.index.SongIDs() {
+		songIDs = append(songIDs, songID)
+	}
+	songs, err := db.DBClient.GetSongsByIDs(ctx, songIDs)
+	if err != nil {
+		return deleted, err
+	}
+
+	orphaned := make(map[uint32]bool)
+	for _, songID := range songIDs {
+		if _, songExists := songs[songID]; !songExists {
+			orphaned[songID] = true
+		}
+	}
+	if len(orphaned) > 0 {
+		db.index.RemoveSongs(func(id uint32) bool { return orphaned[id] })
+	}
+
+	return deleted, nil
+}
+
+func (db *indexedClient) DeleteCollection(ctx context.Context, collectionName string) error {
+	if err := db.DBClient.DeleteCollection(ctx, collectionName); err != nil {
+		return err
+	}
+	if collectionName == "fingerprints" {
+		db.index.RemoveSongs(func(uint32) bool { return true })
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"reflect"
+	"song-recognition/models"
+	"testing"
+)
+
+func TestMemIndexRemoveSongs(t *testing.T) {
+	idx := &MemIndex{}
+
+	// Song 1 is only in the shard of first, song 2 in the shards of first and last
+	first, last := uint32(1), uint32(2)
+	for shardOf(last) == shardOf(first) {
+		last++
+	}
+	idx.Add(map[uint32][]models.Couple{
+		first: {{AnchorTimeMs: 1, SongID: 1}, {AnchorTimeMs: 2, SongID: 2}},
+		last:  {{AnchorTimeMs: 3, SongID: 2}},
+	})
+	for i := range idx.shards {
+		idx.shards[i].rebuild(nil)
+	}
+	idx.Add(map[uint32][]models.Couple{first: {{AnchorTimeMs: 4, SongID: 1}}})
+
+	lastShard := &idx.shards[shardOf(last)]
+	lastCouples := lastShard.couples
+
+	idx.RemoveSongs(func(songID uint32) bool { return songID == 1 })
+
+	want := map[uint32][]models.Couple{
+		first: {{AnchorTimeMs: 2, SongID: 2}},
+		last:  {{AnchorTimeMs: 3, SongID: 2}},
+	}
+	if got := idx.GetCouples([]uint32{first, last}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got couples %v, want %v", got, want)
+	}
+	if idx.Len() != 2 {
+		t.Fatalf("got %d couples, want 2", idx.Len())
+	}
+
+	// Shards without couples of the removed songs are left as they are
+	if &lastShard.couples[0] != &lastCouples[0] {
+		t.Fatal("rebuilt a shard without couples of the removed songs")
+	}
+}
+
+func TestShardOfSpreadsAddresses(t *testing.T) {
+	// Addresses with the same anchor frequency share their top bits
+	shards := map[int]bool{}
+	for address := uint32(0); address < 1<<16; address++ {
+		shards[shardOf(200<<23|address)] = true
+	}
+	if len(shards) != memIndexShards {
+		t.Fatalf("got addresses in %d shards, want all %d", len(shards), memIndexShards)
+	}
+}
@@ -0,0 +1,61 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Migration is a versioned change of the database schema. Each backend has
+// its own ordered list of migrations, applied once and recorded in
+// schema_migrations.
+type Migration struct {
+	Version     int
+	Description string
+}
+
+// MigrationStatus tells whether a migration was applied to the database.
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// migrationStatuses returns the status of each migration, given the times the
+// applied ones were applied at.
+func migrationStatuses(migrations []Migration, applied map[int]time.Time) []MigrationStatus {
+	statuses := make([]MigrationStatus, len(migrations))
+	for i, migration := range migrations {
+		appliedAt, ok := applied[migration.Version]
+		statuses[i] = MigrationStatus{Migration: migration, Applied: ok, AppliedAt: appliedAt}
+	}
+	return statuses
+}
+
+// checkMigrations makes sure the schema of the database is up to date.
+// Databases without any migration applied, either new or created before
+// migrations were recorded, are migrated right away. Others must be migrated
+// with the migrate command, which serve runs on start.
+func checkMigrations(ctx context.Context, dbClient DBClient) error {
+	statuses, err := dbClient.MigrationStatus(ctx)
+	if err != nil {
+		return fmt.Errorf("error checking migrations: %v", err)
+	}
+
+	pending := 0
+	for _, status := range statuses {
+		if !status.Applied {
+			pending++
+		}
+	}
+
+	if pending == 0 {
+		return nil
+	}
+	if pending == len(statuses) {
+		_, err := dbClient.Migrate(ctx)
+		return err
+	}
+
+	return fmt.Errorf("the database schema is missing %d migrations, run the migrate up command", pending)
+}
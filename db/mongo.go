@@ -2,11 +2,13 @@ package db
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	"math"
 	"song-recognition/models"
 	"song-recognition/utils"
 	"strings"
+	"sync"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -16,11 +18,17 @@ import (
 
 type MongoClient struct {
 	client *mongo.Client
+
+	// Whether the server supports transactions, detected by the first write.
+	// Errors aren't cached, the next write detects it again.
+	transactionsMu       sync.Mutex
+	transactionsDetected bool
+	transactions         bool
 }
 
-func NewMongoClient(uri string) (*MongoClient, error) {
-	clientOptions := options.Client().ApplyURI(uri)
-	client, err := mongo.Connect(context.Background(), clientOptions)
+func NewMongoClient(ctx context.Context, uri string) (*MongoClient, error) {
+	clientOptions := options.Client().ApplyURI(uri).SetMaxPoolSize(uint64(maxConns()))
+	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
 		return nil, fmt.Errorf("error connecting to MongoDB: %s", err)
 	}
@@ -34,74 +42,215 @@ func (db *MongoClient) Close() error {
 	return nil
 }
 
-func (db *MongoClient) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+func (db *MongoClient) StoreFingerprints(ctx context.Context, fingerprints map[uint32][]models.Couple) error {
+	return db.withTransaction(ctx, func(ctx context.Context) error {
+		return db.storeFingerprints(ctx, fingerprints)
+	})
+}
+
+func (db *MongoClient) storeFingerprints(ctx context.Context, fingerprints map[uint32][]models.Couple) error {
 	collection := db.client.Database("song-recognition").Collection("fingerprints")
+	if len(fingerprints) == 0 {
+		return nil
+	}
+
+	writes := make([]mongo.WriteModel, 0, len(fingerprints))
+	for address, couples := range fingerprints {
+		docCouples := make([]bson.M, len(couples))
+		for i, couple := range couples {
+			docCouples[i] = bson.M{
+				"anchorTimeMs": couple.AnchorTimeMs,
+				"songID":       couple.SongID,
+			}
+		}
 
-	for address, couple := range fingerprints {
 		filter := bson.M{"_id": address}
 		update := bson.M{
 			"$push": bson.M{
-				"couples": bson.M{
-					"anchorTimeMs": couple.AnchorTimeMs,
-					"songID":       couple.SongID,
-				},
+				"couples": bson.M{"$each": docCouples},
 			},
 		}
-		opts := options.Update().SetUpsert(true)
+		writes = append(writes, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true))
+	}
 
-		_, err := collection.UpdateOne(context.Background(), filter, update, opts)
-		if err != nil {
-			return fmt.Errorf("error upserting document: %s", err)
-		}
+	_, err := collection.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return fmt.Errorf("error upserting document: %s", err)
 	}
 
 	return nil
 }
 
-func (db *MongoClient) GetCouples(addresses []uint32) (map[uint32][]models.Couple, error) {
+// withTransaction runs fn in a transaction. Standalone servers don't support
+// transactions, fn then runs without one and its writes aren't atomic.
+func (db *MongoClient) withTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	supported, err := db.supportsTransactions(ctx)
+	if err != nil {
+		return err
+	}
+	if !supported {
+		return fn(ctx)
+	}
+
+	session, err := db.client.StartSession()
+	if err != nil {
+		return fmt.Errorf("error starting session: %v", err)
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sessionCtx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessionCtx)
+	})
+	return err
+}
+
+// supportsTransactions reports whether the server is a replica set member or
+// a mongos, the deployments that support transactions. The server is only
+// asked once.
+func (db *MongoClient) supportsTransactions(ctx context.Context) (bool, error) {
+	db.transactionsMu.Lock()
+	defer db.transactionsMu.Unlock()
+	if db.transactionsDetected {
+		return db.transactions, nil
+	}
+
+	var hello bson.M
+	err := db.client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		return false, fmt.Errorf("error getting server info: %v", err)
+	}
+
+	_, isReplicaSet := hello["setName"]
+	db.transactions = isReplicaSet || hello["msg"] == "isdbgrid"
+	db.transactionsDetected = true
+	return db.transactions, nil
+}
+
+func (db *MongoClient) GetCouples(ctx context.Context, addresses []uint32) (map[uint32][]models.Couple, error) {
 	collection := db.client.Database("song-recognition").Collection("fingerprints")
 
 	couples := make(map[uint32][]models.Couple)
+	if len(addresses) == 0 {
+		return couples, nil
+	}
+
+	// Fetch the documents of all addresses with a single cursor
+	cursor, err := collection.Find(ctx, bson.M{"_id": bson.M{"$in": addresses}})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving documents: %s", err)
+	}
+	defer cursor.Close(ctx)
 
-	for _, address := range addresses {
-		// Find the document corresponding to the address
+	for cursor.Next(ctx) {
 		var result bson.M
-		err := collection.FindOne(context.Background(), bson.M{"_id": address}).Decode(&result)
+		if err := cursor.Decode(&result); err != nil {
+			return nil, fmt.Errorf("error decoding document: %s", err)
+		}
+
+		address, docCouples, err := couplesFromDocument(result)
 		if err != nil {
-			if err == mongo.ErrNoDocuments {
-				continue
-			}
-			return nil, fmt.Errorf("error retrieving document for address %d: %s", address, err)
+			return nil, err
 		}
+		couples[address] = docCouples
+	}
 
-		// Extract couples from the document and append them to the couples map
-		var docCouples []models.Couple
-		couplesList, ok := result["couples"].(primitive.A)
-		if !ok {
-			return nil, fmt.Errorf("couples field in document for address %d is not valid", address)
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating documents: %s", err)
+	}
+
+	return couples, nil
+}
+
+func (db *MongoClient) ScanFingerprints(ctx context.Context, fn func(address uint32, couple models.Couple) error) error {
+	collection := db.client.Database("song-recognition").Collection("fingerprints")
+
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return fmt.Errorf("error retrieving documents: %s", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var result bson.M
+		if err := cursor.Decode(&result); err != nil {
+			return fmt.Errorf("error decoding document: %s", err)
 		}
 
-		for _, item := range couplesList {
-			itemMap, ok := item.(primitive.M)
-			if !ok {
-				return nil, fmt.Errorf("invalid couple format in document for address %d", address)
+		address, docCouples, err := couplesFromDocument(result)
+		if err != nil {
+			return err
+		}
+		for _, couple := range docCouples {
+			if err := fn(address, couple); err != nil {
+				return err
 			}
+		}
+	}
 
-			couple := models.Couple{
-				AnchorTimeMs: uint32(itemMap["anchorTimeMs"].(int64)),
-				SongID:       uint32(itemMap["songID"].(int64)),
-			}
-			docCouples = append(docCouples, couple)
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("error iterating documents: %s", err)
+	}
+	return nil
+}
+
+// couplesFromDocument extracts the address and couples of a fingerprints document.
+func couplesFromDocument(result bson.M) (uint32, []models.Couple, error) {
+	address, ok := uint32Field(result["_id"])
+	if !ok {
+		return 0, nil, fmt.Errorf("_id field in document is not valid: %v", result["_id"])
+	}
+
+	// Extract couples from the document
+	var docCouples []models.Couple
+	couplesList, ok := result["couples"].(primitive.A)
+	if !ok {
+		return 0, nil, fmt.Errorf("couples field in document for address %d is not valid", address)
+	}
+
+	for _, item := range couplesList {
+		itemMap, ok := item.(primitive.M)
+		if !ok {
+			return 0, nil, fmt.Errorf("invalid couple format in document for address %d", address)
 		}
-		couples[address] = docCouples
+
+		anchorTimeMs, ok := uint32Field(itemMap["anchorTimeMs"])
+		if !ok {
+			return 0, nil, fmt.Errorf("invalid anchorTimeMs in document for address %d: %v", address, itemMap["anchorTimeMs"])
+		}
+		songID, ok := uint32Field(itemMap["songID"])
+		if !ok {
+			return 0, nil, fmt.Errorf("invalid songID in document for address %d: %v", address, itemMap["songID"])
+		}
+
+		docCouples = append(docCouples, models.Couple{AnchorTimeMs: anchorTimeMs, SongID: songID})
 	}
 
-	return couples, nil
+	return address, docCouples, nil
 }
 
-func (db *MongoClient) TotalSongs() (int, error) {
+// uint32Field converts an integer field of a document to a uint32. uint32
+// values are stored as int64, but documents written by other clients may
+// hold them as int32.
+func uint32Field(value interface{}) (uint32, bool) {
+	var n int64
+	switch v := value.(type) {
+	case int64:
+		n = v
+	case int32:
+		n = int64(v)
+	default:
+		return 0, false
+	}
+
+	if n < 0 || n > math.MaxUint32 {
+		return 0, false
+	}
+	return uint32(n), true
+}
+
+func (db *MongoClient) TotalSongs(ctx context.Context) (int, error) {
 	existingSongsCollection := db.client.Database("song-recognition").Collection("songs")
-	total, err := existingSongsCollection.CountDocuments(context.Background(), bson.D{})
+	total, err := existingSongsCollection.CountDocuments(ctx, bson.D{})
 	if err != nil {
 		return 0, err
 	}
@@ -109,47 +258,157 @@ func (db *MongoClient) TotalSongs() (int, error) {
 	return int(total), nil
 }
 
-func (db *MongoClient) RegisterSong(songTitle, songArtist, ytID string) (uint32, error) {
-	existingSongsCollection := db.client.Database("song-recognition").Collection("songs")
+// NextSongID allocates the ID of a new song from the songs counter, so that no
+// two songs get the same ID. IDs already taken, e.g. random ones given before
+// the counter existed, are skipped.
+func (db *MongoClient) NextSongID(ctx context.Context) (uint32, error) {
+	return db.nextID(ctx, "songs", "song")
+}
+
+// nextID allocates an ID from the counter of a collection, skipping the IDs
+// already taken in it. kind names the records in errors.
+func (db *MongoClient) nextID(ctx context.Context, collectionName, kind string) (uint32, error) {
+	countersCollection := db.client.Database("song-recognition").Collection("counters")
+	collection := db.client.Database("song-recognition").Collection(collectionName)
+
+	updateOptions := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	for {
+		var counter struct {
+			Value int64 `bson:"value"`
+		}
+		err := countersCollection.FindOneAndUpdate(ctx,
+			bson.M{"_id": collectionName}, bson.M{"$inc": bson.M{"value": int64(1)}}, updateOptions,
+		).Decode(&counter)
+		if err != nil {
+			return 0, fmt.Errorf("error allocating %s ID: %v", kind, err)
+		}
+		if counter.Value > math.MaxUint32 {
+			return 0, fmt.Errorf("no %s IDs left", kind)
+		}
+
+		taken, err := collection.CountDocuments(ctx, bson.M{"_id": counter.Value})
+		if err != nil {
+			return 0, fmt.Errorf("error allocating %s ID: %v", kind, err)
+		}
+		if taken == 0 {
+			return uint32(counter.Value), nil
+		}
+	}
+}
+
+// RegisterSong stores a song and its fingerprints in a transaction, so that a
+// song is never saved without its fingerprints. Without transactions, the
+// song is deleted again if its fingerprints can't be stored.
+func (db *MongoClient) RegisterSong(ctx context.Context, song Song, fingerprints map[uint32][]models.Couple) error {
+	songInserted := false
+	err := db.withTransaction(ctx, func(ctx context.Context) error {
+		return db.insertSong(ctx, song, fingerprints, &songInserted)
+	})
+
+	if err != nil && songInserted {
+		// Only needed without transactions, where the song insert isn't rolled back
+		db.DeleteSongByID(ctx, song.ID)
+	}
+	return err
+}
+
+// ReplaceSong deletes the song oldSongID with its fingerprints and registers
+// song in its place in a transaction, so that the old song is kept if song
+// can't be stored. Without transactions, the old song has to be deleted
+// first, as song may share its key, so song is checked not to conflict with
+// another song beforehand.
+func (db *MongoClient) ReplaceSong(ctx context.Context, oldSongID uint32, song Song, fingerprints map[uint32][]models.Couple) error {
+	songsCollection := db.client.Database("song-recognition").Collection("songs")
 
-	// Create a compound unique index on ytID and key, if it doesn't already exist
-	indexModel := mongo.IndexModel{
-		Keys:    bson.D{{"ytID", 1}, {"key", 1}},
-		Options: options.Index().SetUnique(true),
+	conflicts := bson.A{bson.M{"key": utils.GenerateSongKey(song.Title, song.Artist)}}
+	if song.YouTubeID != "" {
+		conflicts = append(conflicts, bson.M{"ytID": song.YouTubeID})
 	}
-	_, err := existingSongsCollection.Indexes().CreateOne(context.Background(), indexModel)
+	if song.SpotifyID != "" {
+		conflicts = append(conflicts, bson.M{"spotifyID": song.SpotifyID})
+	}
+	count, err := songsCollection.CountDocuments(ctx, bson.M{"_id": bson.M{"$ne": oldSongID}, "$or": conflicts})
 	if err != nil {
-		return 0, fmt.Errorf("failed to create unique index: %v", err)
+		return fmt.Errorf("failed to check song: %v", err)
+	}
+	if count > 0 {
+		return fmt.Errorf("song with ytID or key already exists")
 	}
 
+	songInserted := false
+	err = db.withTransaction(ctx, func(ctx context.Context) error {
+		if err := db.deleteSong(ctx, oldSongID); err != nil {
+			return err
+		}
+		return db.insertSong(ctx, song, fingerprints, &songInserted)
+	})
+
+	if err != nil && songInserted {
+		db.DeleteSongByID(ctx, song.ID)
+	}
+	return err
+}
+
+// insertSong inserts a song and its fingerprints, setting songInserted once
+// the song document is inserted.
+func (db *MongoClient) insertSong(ctx context.Context, song Song, fingerprints map[uint32][]models.Couple, songInserted *bool) error {
+	existingSongsCollection := db.client.Database("song-recognition").Collection("songs")
+
 	// Attempt to insert the song with ytID and key
-	songID := utils.GenerateUniqueID()
-	key := utils.GenerateSongKey(songTitle, songArtist)
-	_, err = existingSongsCollection.InsertOne(context.Background(), bson.M{"_id": songID, "key": key, "ytID": ytID})
+	key := utils.GenerateSongKey(song.Title, song.Artist)
+	_, err := existingSongsCollection.InsertOne(ctx, bson.M{
+		"_id":                song.ID,
+		"key":                key,
+		"ytID":               nullable(song.YouTubeID),
+		"fingerprintVersion": song.FingerprintVersion,
+		"album":              song.Album,
+		"artists":            song.Artists,
+		"duration":           song.Duration,
+		"isrc":               song.ISRC,
+		"spotifyID":          nullable(song.SpotifyID),
+		"sourcePath":         song.SourcePath,
+		"contentHash":        song.ContentHash,
+		"ingestedAt":         song.IngestedAt,
+		"sourceType":         song.SourceType,
+	})
 	if err != nil {
 		if mongo.IsDuplicateKeyError(err) {
-			return 0, fmt.Errorf("song with ytID or key already exists: %v", err)
-		} else {
-			return 0, fmt.Errorf("failed to register song: %v", err)
+			return fmt.Errorf("song with ytID or key already exists: %v", err)
 		}
+		return fmt.Errorf("failed to register song: %v", err)
 	}
+	*songInserted = true
 
-	return songID, nil
+	return db.storeFingerprints(ctx, fingerprints)
 }
 
-var mongofilterKeys = "_id | ytID | key"
+// songFilterField returns the field of the song documents GetSong filters by
+// for filterKey. The field is part of the filter, so only known keys are
+// accepted, matched exactly. Songs are identified by their _id.
+func songFilterField(filterKey string) (string, error) {
+	switch filterKey {
+	case "id", "_id":
+		return "_id", nil
+	case "ytID":
+		return "ytID", nil
+	case "key":
+		return "key", nil
+	}
+	return "", fmt.Errorf("invalid filter key %q", filterKey)
+}
 
-func (db *MongoClient) GetSong(filterKey string, value interface{}) (s Song, songExists bool, e error) {
-	if !strings.Contains(mongofilterKeys, filterKey) {
-		return Song{}, false, errors.New("invalid filter key")
+func (db *MongoClient) GetSong(ctx context.Context, filterKey string, value interface{}) (s Song, songExists bool, e error) {
+	field, err := songFilterField(filterKey)
+	if err != nil {
+		return Song{}, false, err
 	}
 
 	songsCollection := db.client.Database("song-recognition").Collection("songs")
 	var song bson.M
 
-	filter := bson.M{filterKey: value}
+	filter := bson.M{field: value}
 
-	err := songsCollection.FindOne(context.Background(), filter).Decode(&song)
+	err = songsCollection.FindOne(ctx, filter).Decode(&song)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return Song{}, false, nil
@@ -157,33 +416,204 @@ func (db *MongoClient) GetSong(filterKey string, value interface{}) (s Song, son
 		return Song{}, false, fmt.Errorf("failed to retrieve song: %v", err)
 	}
 
-	ytID := song["ytID"].(string)
-	title := strings.Split(song["key"].(string), "---")[0]
-	artist := strings.Split(song["key"].(string), "---")[1]
+	result, err := songFromDocument(song)
+	if err != nil {
+		return Song{}, false, err
+	}
+	return result, true, nil
+}
+
+// GetSongsByIDs returns the songs with the given IDs that exist, by ID, with
+// a single cursor
+func (db *MongoClient) GetSongsByIDs(ctx context.Context, songIDs []uint32) (map[uint32]Song, error) {
+	songs := make(map[uint32]Song, len(songIDs))
+	if len(songIDs) == 0 {
+		return songs, nil
+	}
+
+	songsCollection := db.client.Database("song-recognition").Collection("songs")
+	cursor, err := songsCollection.Find(ctx, bson.M{"_id": bson.M{"$in": songIDs}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve songs: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var song bson.M
+		if err := cursor.Decode(&song); err != nil {
+			return nil, fmt.Errorf("failed to decode song: %v", err)
+		}
+		result, err := songFromDocument(song)
+		if err != nil {
+			return nil, err
+		}
+		songs[result.ID] = result
+	}
+
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("failed to retrieve songs: %v", err)
+	}
+
+	return songs, nil
+}
+
+func songFromDocument(song bson.M) (Song, error) {
+	id, ok := uint32Field(song["_id"])
+	if !ok {
+		return Song{}, fmt.Errorf("_id field in song document is not valid: %v", song["_id"])
+	}
+
+	key, _ := song["key"].(string)
+	title, artist, found := strings.Cut(key, "---")
+	if !found {
+		return Song{}, fmt.Errorf("key field in song document %d is not valid: %v", id, song["key"])
+	}
+
+	fingerprintVersion := legacyFingerprintVersion
+	if version, ok := song["fingerprintVersion"].(int32); ok {
+		fingerprintVersion = int(version)
+	}
+
+	// Songs registered before the metadata below was recorded lack its fields
+	var artists []string
+	if values, ok := song["artists"].(primitive.A); ok {
+		for _, value := range values {
+			if name, ok := value.(string); ok {
+				artists = append(artists, name)
+			}
+		}
+	}
 
-	songInstance := Song{title, artist, ytID}
+	var ingestedAt time.Time
+	if value, ok := song["ingestedAt"].(primitive.DateTime); ok {
+		ingestedAt = value.Time()
+	}
 
-	return songInstance, true, nil
+	duration, _ := song["duration"].(float64)
+	// Missing external IDs are null
+	stringField := func(key string) string {
+		value, _ := song[key].(string)
+		return value
+	}
+
+	return Song{
+		ID:                 id,
+		Title:              title,
+		Artist:             artist,
+		YouTubeID:          stringField("ytID"),
+		FingerprintVersion: fingerprintVersion,
+		Album:              stringField("album"),
+		Artists:            artists,
+		Duration:           duration,
+		ISRC:               stringField("isrc"),
+		SpotifyID:          stringField("spotifyID"),
+		SourcePath:         stringField("sourcePath"),
+		ContentHash:        stringField("contentHash"),
+		IngestedAt:         ingestedAt,
+		SourceType:         stringField("sourceType"),
+	}, nil
 }
 
-func (db *MongoClient) GetSongByID(songID uint32) (Song, bool, error) {
-	return db.GetSong("_id", songID)
+func (db *MongoClient) GetSongByID(ctx context.Context, songID uint32) (Song, bool, error) {
+	return db.GetSong(ctx, "id", songID)
 }
 
-func (db *MongoClient) GetSongByYTID(ytID string) (Song, bool, error) {
-	return db.GetSong("ytID", ytID)
+// GetSongByYTID returns the song with a YouTube ID. Songs without one can't
+// be found by it.
+func (db *MongoClient) GetSongByYTID(ctx context.Context, ytID string) (Song, bool, error) {
+	if ytID == "" {
+		return Song{}, false, nil
+	}
+	return db.GetSong(ctx, "ytID", ytID)
 }
 
-func (db *MongoClient) GetSongByKey(key string) (Song, bool, error) {
-	return db.GetSong("key", key)
+func (db *MongoClient) GetSongByKey(ctx context.Context, key string) (Song, bool, error) {
+	return db.GetSong(ctx, "key", key)
 }
 
-func (db *MongoClient) DeleteSongByID(songID uint32) error {
+// ListSongs returns up to limit songs ordered by ID, skipping the first offset ones.
+func (db *MongoClient) ListSongs(ctx context.Context, offset, limit int) ([]Song, error) {
 	songsCollection := db.client.Database("song-recognition").Collection("songs")
 
-	filter := bson.M{"_id": songID}
+	findOptions := options.Find().
+		SetSort(bson.M{"_id": 1}).
+		SetSkip(int64(offset)).
+		SetLimit(int64(limit))
 
-	_, err := songsCollection.DeleteOne(context.Background(), filter)
+	cursor, err := songsCollection.Find(ctx, bson.M{}, findOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list songs: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var songs []Song
+	for cursor.Next(ctx) {
+		var song bson.M
+		if err := cursor.Decode(&song); err != nil {
+			return nil, fmt.Errorf("failed to decode song: %v", err)
+		}
+		result, err := songFromDocument(song)
+		if err != nil {
+			return nil, err
+		}
+		songs = append(songs, result)
+	}
+
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list songs: %v", err)
+	}
+
+	return songs, nil
+}
+
+// UpdateSong updates the title, artist and YouTube ID of a song, which are
+// stored as its key and ytID.
+func (db *MongoClient) UpdateSong(ctx context.Context, song Song) error {
+	songsCollection := db.client.Database("song-recognition").Collection("songs")
+
+	update := bson.M{"$set": bson.M{
+		"key":  utils.GenerateSongKey(song.Title, song.Artist),
+		"ytID": nullable(song.YouTubeID),
+	}}
+
+	_, err := songsCollection.UpdateOne(ctx, bson.M{"_id": song.ID}, update)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("song with ytID or key already exists: %v", err)
+		}
+		return fmt.Errorf("failed to update song: %v", err)
+	}
+
+	return nil
+}
+
+// DeleteSongByID deletes a song and removes its couples from the fingerprints
+// in a transaction. Addresses left without couples are deleted.
+func (db *MongoClient) DeleteSongByID(ctx context.Context, songID uint32) error {
+	return db.withTransaction(ctx, func(ctx context.Context) error {
+		return db.deleteSong(ctx, songID)
+	})
+}
+
+func (db *MongoClient) deleteSong(ctx context.Context, songID uint32) error {
+	fingerprintsCollection := db.client.Database("song-recognition").Collection("fingerprints")
+
+	_, err := fingerprintsCollection.UpdateMany(ctx,
+		bson.M{"couples.songID": songID},
+		bson.M{"$pull": bson.M{"couples": bson.M{"songID": songID}}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %v", err)
+	}
+
+	_, err = fingerprintsCollection.DeleteMany(ctx, bson.M{"couples": bson.M{"$size": 0}})
+	if err != nil {
+		return fmt.Errorf("failed to delete empty fingerprints: %v", err)
+	}
+
+	songsCollection := db.client.Database("song-recognition").Collection("songs")
+
+	_, err = songsCollection.DeleteOne(ctx, bson.M{"_id": songID})
 	if err != nil {
 		return fmt.Errorf("failed to delete song: %v", err)
 	}
@@ -191,11 +621,156 @@ func (db *MongoClient) DeleteSongByID(songID uint32) error {
 	return nil
 }
 
-func (db *MongoClient) DeleteCollection(collectionName string) error {
+// CountFingerprints returns the number of couples of a song
+func (db *MongoClient) CountFingerprints(ctx context.Context, songID uint32) (int, error) {
+	fingerprintsCollection := db.client.Database("song-recognition").Collection("fingerprints")
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"couples.songID": songID}}},
+		{{Key: "$unwind", Value: "$couples"}},
+		{{Key: "$match", Value: bson.M{"couples.songID": songID}}},
+		{{Key: "$count", Value: "count"}},
+	}
+
+	cursor, err := fingerprintsCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, fmt.Errorf("error counting fingerprints: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var result struct {
+		Count int `bson:"count"`
+	}
+	if cursor.Next(ctx) {
+		if err := cursor.Decode(&result); err != nil {
+			return 0, fmt.Errorf("error counting fingerprints: %v", err)
+		}
+	}
+
+	return result.Count, cursor.Err()
+}
+
+// songIDs returns the IDs of all the songs
+func (db *MongoClient) songIDs(ctx context.Context) (bson.A, error) {
+	songsCollection := db.client.Database("song-recognition").Collection("songs")
+
+	ids, err := songsCollection.Distinct(ctx, "_id", bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list song IDs: %v", err)
+	}
+	return bson.A(ids), nil
+}
+
+// CountOrphanedCouples returns the number of couples of songs that don't exist
+func (db *MongoClient) CountOrphanedCouples(ctx context.Context) (int, error) {
+	fingerprintsCollection := db.client.Database("song-recognition").Collection("fingerprints")
+
+	songIDs, err := db.songIDs(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"couples": bson.M{"$elemMatch": bson.M{"songID": bson.M{"$nin": songIDs}}}}}},
+		{{Key: "$unwind", Value: "$couples"}},
+		{{Key: "$match", Value: bson.M{"couples.songID": bson.M{"$nin": songIDs}}}},
+		{{Key: "$count", Value: "count"}},
+	}
+
+	cursor, err := fingerprintsCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, fmt.Errorf("error counting orphaned couples: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var result struct {
+		Count int `bson:"count"`
+	}
+	if cursor.Next(ctx) {
+		if err := cursor.Decode(&result); err != nil {
+			return 0, fmt.Errorf("error counting orphaned couples: %v", err)
+		}
+	}
+
+	return result.Count, cursor.Err()
+}
+
+// DeleteOrphanedCouples removes the couples of songs that don't exist from
+// the fingerprints and returns how many were removed. Addresses left without
+// couples are deleted.
+func (db *MongoClient) DeleteOrphanedCouples(ctx context.Context) (int, error) {
+	orphanedCouples, err := db.CountOrphanedCouples(ctx)
+	if err != nil || orphanedCouples == 0 {
+		return 0, err
+	}
+
+	err = db.withTransaction(ctx, func(ctx context.Context) error {
+		fingerprintsCollection := db.client.Database("song-recognition").Collection("fingerprints")
+
+		songIDs, err := db.songIDs(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = fingerprintsCollection.UpdateMany(ctx,
+			bson.M{"couples": bson.M{"$elemMatch": bson.M{"songID": bson.M{"$nin": songIDs}}}},
+			bson.M{"$pull": bson.M{"couples": bson.M{"songID": bson.M{"$nin": songIDs}}}},
+		)
+		if err != nil {
+			return fmt.Errorf("error deleting orphaned couples: %v", err)
+		}
+
+		_, err = fingerprintsCollection.DeleteMany(ctx, bson.M{"couples": bson.M{"$size": 0}})
+		if err != nil {
+			return fmt.Errorf("failed to delete empty fingerprints: %v", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return orphanedCouples, nil
+}
+
+// DeleteCollection deletes the documents of a collection, keeping its indexes
+func (db *MongoClient) DeleteCollection(ctx context.Context, collectionName string) error {
 	collection := db.client.Database("song-recognition").Collection(collectionName)
-	err := collection.Drop(context.Background())
+	_, err := collection.DeleteMany(ctx, bson.M{})
 	if err != nil {
 		return fmt.Errorf("error deleting collection: %v", err)
 	}
 	return nil
 }
+
+func (db *MongoClient) GetMetadata(ctx context.Context, key string) (string, bool, error) {
+	metadataCollection := db.client.Database("song-recognition").Collection("metadata")
+
+	var record struct {
+		Value string `bson:"value"`
+	}
+	err := metadataCollection.FindOne(ctx, bson.M{"_id": key}).Decode(&record)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("failed to retrieve metadata: %v", err)
+	}
+
+	return record.Value, true, nil
+}
+
+func (db *MongoClient) SetMetadata(ctx context.Context, key, value string) error {
+	metadataCollection := db.client.Database("song-recognition").Collection("metadata")
+
+	filter := bson.M{"_id": key}
+	update := bson.M{"$set": bson.M{"value": value}}
+	opts := options.Update().SetUpsert(true)
+
+	_, err := metadataCollection.UpdateOne(ctx, filter, update, opts)
+	if err != nil {
+		return fmt.Errorf("failed to set metadata: %v", err)
+	}
+	return nil
+}
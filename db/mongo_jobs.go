@@ -0,0 +1,150 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"song-recognition/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// jobDocument is a job stored in the jobs collection, with its tracks embedded.
+type jobDocument struct {
+	ID        uint32             `bson:"_id"`
+	Source    string             `bson:"source"`
+	Canceled  bool               `bson:"canceled"`
+	CreatedAt time.Time          `bson:"createdAt"`
+	Tracks    []jobTrackDocument `bson:"tracks"`
+}
+
+type jobTrackDocument struct {
+	Index         int       `bson:"index"`
+	Title         string    `bson:"title"`
+	Artist        string    `bson:"artist"`
+	Album         string    `bson:"album"`
+	Artists       []string  `bson:"artists"`
+	SpotifyID     string    `bson:"spotifyID"`
+	Duration      int       `bson:"duration"`
+	State         string    `bson:"state"`
+	Error         string    `bson:"error"`
+	Attempts      int       `bson:"attempts"`
+	NextAttemptAt time.Time `bson:"nextAttemptAt"`
+	UpdatedAt     time.Time `bson:"updatedAt"`
+}
+
+func (d jobDocument) job() models.Job {
+	job := models.Job{
+		ID:        d.ID,
+		Source:    d.Source,
+		Canceled:  d.Canceled,
+		CreatedAt: d.CreatedAt,
+		Tracks:    make([]models.JobTrack, len(d.Tracks)),
+	}
+	for i, t := range d.Tracks {
+		job.Tracks[i] = models.JobTrack(t)
+	}
+	return job
+}
+
+// NextJobID allocates the ID of a new job from the jobs counter. IDs already
+// taken, e.g. random ones given before the counter existed, are skipped.
+func (db *MongoClient) NextJobID(ctx context.Context) (uint32, error) {
+	return db.nextID(ctx, "jobs", "job")
+}
+
+func (db *MongoClient) CreateJob(ctx context.Context, job models.Job) error {
+	jobsCollection := db.client.Database("song-recognition").Collection("jobs")
+
+	doc := jobDocument{
+		ID:        job.ID,
+		Source:    job.Source,
+		Canceled:  job.Canceled,
+		CreatedAt: job.CreatedAt,
+		Tracks:    make([]jobTrackDocument, len(job.Tracks)),
+	}
+	for i, t := range job.Tracks {
+		doc.Tracks[i] = jobTrackDocument(t)
+	}
+
+	_, err := jobsCollection.InsertOne(ctx, doc)
+	if err != nil {
+		return fmt.Errorf("failed to create job: %v", err)
+	}
+	return nil
+}
+
+func (db *MongoClient) GetJob(ctx context.Context, jobID uint32) (models.Job, bool, error) {
+	jobsCollection := db.client.Database("song-recognition").Collection("jobs")
+
+	var doc jobDocument
+	err := jobsCollection.FindOne(ctx, bson.M{"_id": jobID}).Decode(&doc)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return models.Job{}, false, nil
+		}
+		return models.Job{}, false, fmt.Errorf("failed to retrieve job: %v", err)
+	}
+
+	return doc.job(), true, nil
+}
+
+// ListJobs returns the jobs ordered by creation time. With unfinishedOnly,
+// only the jobs with tracks left to process are returned.
+func (db *MongoClient) ListJobs(ctx context.Context, unfinishedOnly bool) ([]models.Job, error) {
+	jobsCollection := db.client.Database("song-recognition").Collection("jobs")
+
+	filter := bson.M{}
+	if unfinishedOnly {
+		finished := bson.A{models.TrackDone, models.TrackFailed, models.TrackCanceled}
+		filter = bson.M{"tracks": bson.M{"$elemMatch": bson.M{"state": bson.M{"$nin": finished}}}}
+	}
+
+	findOptions := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := jobsCollection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	jobs := []models.Job{}
+	for cursor.Next(ctx) {
+		var doc jobDocument
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("failed to decode job: %v", err)
+		}
+		jobs = append(jobs, doc.job())
+	}
+
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %v", err)
+	}
+
+	return jobs, nil
+}
+
+func (db *MongoClient) UpdateJobTrack(ctx context.Context, jobID uint32, track models.JobTrack) error {
+	jobsCollection := db.client.Database("song-recognition").Collection("jobs")
+
+	filter := bson.M{"_id": jobID, "tracks.index": track.Index}
+	update := bson.M{"$set": bson.M{"tracks.$": jobTrackDocument(track)}}
+
+	_, err := jobsCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("failed to update job track: %v", err)
+	}
+	return nil
+}
+
+func (db *MongoClient) SetJobCanceled(ctx context.Context, jobID uint32, canceled bool) error {
+	jobsCollection := db.client.Database("song-recognition").Collection("jobs")
+
+	update := bson.M{"$set": bson.M{"canceled": canceled}}
+	_, err := jobsCollection.UpdateOne(ctx, bson.M{"_id": jobID}, update)
+	if err != nil {
+		return fmt.Errorf("failed to update job: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type mongoMigration struct {
+	Migration
+	up func(ctx context.Context, database *mongo.Database) error
+}
+
+// mongoMigrations are the migrations of the MongoDB schema, in order. Applied
+// migrations must never change, new ones are appended. Fingerprints are
+// stored by address in _id, which is always indexed.
+var mongoMigrations = []mongoMigration{
+	{
+		Migration{1, "create a unique index on songs ytID and key"},
+		func(ctx context.Context, database *mongo.Database) error {
+			indexModel := mongo.IndexModel{
+				Keys:    bson.D{{Key: "ytID", Value: 1}, {Key: "key", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			}
+			_, err := database.Collection("songs").Indexes().CreateOne(ctx, indexModel)
+			return err
+		},
+	},
+	{
+		Migration{2, "index jobs by creation time"},
+		func(ctx context.Context, database *mongo.Database) error {
+			indexModel := mongo.IndexModel{
+				Keys: bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}},
+			}
+			_, err := database.Collection("jobs").Indexes().CreateOne(ctx, indexModel)
+			return err
+		},
+	},
+	{
+		Migration{3, "make ytID and spotifyID nullable and unique only when present"},
+		func(ctx context.Context, database *mongo.Database) error {
+			songsCollection := database.Collection("songs")
+
+			if _, err := songsCollection.Indexes().DropOne(ctx, "ytID_1_key_1"); err != nil {
+				return err
+			}
+
+			for _, field := range []string{"ytID", "spotifyID"} {
+				_, err := songsCollection.UpdateMany(ctx, bson.M{field: ""}, bson.M{"$set": bson.M{field: nil}})
+				if err != nil {
+					return err
+				}
+			}
+
+			// Null IDs aren't strings, so they're left out of the partial indexes
+			indexModels := []mongo.IndexModel{
+				{
+					Keys:    bson.D{{Key: "key", Value: 1}},
+					Options: options.Index().SetUnique(true),
+				},
+				{
+					Keys: bson.D{{Key: "ytID", Value: 1}},
+					Options: options.Index().SetUnique(true).
+						SetPartialFilterExpression(bson.M{"ytID": bson.M{"$type": "string"}}),
+				},
+				{
+					Keys: bson.D{{Key: "spotifyID", Value: 1}},
+					Options: options.Index().SetUnique(true).
+						SetPartialFilterExpression(bson.M{"spotifyID": bson.M{"$type": "string"}}),
+				},
+			}
+			_, err := songsCollection.Indexes().CreateMany(ctx, indexModels)
+			return err
+		},
+	},
+}
+
+type migrationDocument struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+}
+
+func (db *MongoClient) appliedMigrations(ctx context.Context) (map[int]time.Time, error) {
+	migrationsCollection := db.client.Database("song-recognition").Collection("schema_migrations")
+
+	cursor, err := migrationsCollection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("error reading schema_migrations: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	applied := make(map[int]time.Time)
+	for cursor.Next(ctx) {
+		var doc migrationDocument
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("error reading schema_migrations: %v", err)
+		}
+		applied[doc.Version] = doc.AppliedAt
+	}
+
+	return applied, cursor.Err()
+}
+
+func (db *MongoClient) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := db.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]Migration, len(mongoMigrations))
+	for i, migration := range mongoMigrations {
+		migrations[i] = migration.Migration
+	}
+
+	return migrationStatuses(migrations, applied), nil
+}
+
+// Migrate applies the pending migrations in order and returns them. Index
+// builds can't run in transactions, a migration is recorded once it succeeded.
+func (db *MongoClient) Migrate(ctx context.Context) ([]Migration, error) {
+	database := db.client.Database("song-recognition")
+
+	applied, err := db.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrated []Migration
+	for _, migration := range mongoMigrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+
+		if err := migration.up(ctx, database); err != nil {
+			return migrated, fmt.Errorf("migration %d (%s) failed: %v", migration.Version, migration.Description, err)
+		}
+
+		doc := migrationDocument{Version: migration.Version, Description: migration.Description, AppliedAt: time.Now()}
+		if _, err := database.Collection("schema_migrations").InsertOne(ctx, doc); err != nil {
+			return migrated, fmt.Errorf("error recording migration %d: %v", migration.Version, err)
+		}
+		migrated = append(migrated, migration.Migration)
+	}
+
+	return migrated, nil
+}
@@ -0,0 +1,133 @@
+package db
+
+import (
+	"context"
+	"os"
+	"song-recognition/models"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newTestMongoClient returns a client of the server at TEST_MONGO_URI, with an
+// empty, migrated database. The song-recognition database of that server is
+// dropped, so it must be a disposable one.
+func newTestMongoClient(tb testing.TB) *MongoClient {
+	uri := os.Getenv("TEST_MONGO_URI")
+	if uri == "" {
+		tb.Skip("TEST_MONGO_URI isn't set")
+	}
+
+	ctx := context.Background()
+	dbClient, err := NewMongoClient(ctx, uri)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	drop := func() error {
+		return dbClient.client.Database("song-recognition").Drop(ctx)
+	}
+	tb.Cleanup(func() {
+		drop()
+		dbClient.Close()
+	})
+
+	if err := drop(); err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := dbClient.Migrate(ctx); err != nil {
+		tb.Fatal(err)
+	}
+	return dbClient
+}
+
+func BenchmarkMongoGetCouples(b *testing.B) {
+	benchmarkGetCouples(b, newTestMongoClient(b))
+}
+
+func TestCouplesFromDocument(t *testing.T) {
+	couple := func(anchorTimeMs, songID interface{}) primitive.M {
+		return primitive.M{"anchorTimeMs": anchorTimeMs, "songID": songID}
+	}
+
+	tests := []struct {
+		name    string
+		doc     bson.M
+		want    []models.Couple
+		wantErr bool
+	}{
+		{
+			name: "int64 fields",
+			doc:  bson.M{"_id": int64(7), "couples": primitive.A{couple(int64(100), int64(1)), couple(int64(200), int64(2))}},
+			want: []models.Couple{{AnchorTimeMs: 100, SongID: 1}, {AnchorTimeMs: 200, SongID: 2}},
+		},
+		{
+			name: "int32 fields",
+			doc:  bson.M{"_id": int32(7), "couples": primitive.A{couple(int32(100), int32(1))}},
+			want: []models.Couple{{AnchorTimeMs: 100, SongID: 1}},
+		},
+		{name: "missing _id", doc: bson.M{"couples": primitive.A{}}, wantErr: true},
+		{name: "string _id", doc: bson.M{"_id": "7", "couples": primitive.A{}}, wantErr: true},
+		{name: "negative _id", doc: bson.M{"_id": int64(-1), "couples": primitive.A{}}, wantErr: true},
+		{name: "missing couples", doc: bson.M{"_id": int64(7)}, wantErr: true},
+		{name: "invalid couple", doc: bson.M{"_id": int64(7), "couples": primitive.A{"couple"}}, wantErr: true},
+		{name: "float anchor time", doc: bson.M{"_id": int64(7), "couples": primitive.A{couple(1.5, int64(1))}}, wantErr: true},
+		{name: "missing song ID", doc: bson.M{"_id": int64(7), "couples": primitive.A{primitive.M{"anchorTimeMs": int64(1)}}}, wantErr: true},
+		{name: "song ID out of range", doc: bson.M{"_id": int64(7), "couples": primitive.A{couple(int64(1), int64(1<<32))}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address, couples, err := couplesFromDocument(tt.doc)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", couples)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if address != 7 {
+				t.Errorf("got address %d, want 7", address)
+			}
+			if len(couples) != len(tt.want) {
+				t.Fatalf("got %v, want %v", couples, tt.want)
+			}
+			for i := range couples {
+				if couples[i] != tt.want[i] {
+					t.Errorf("got %v, want %v", couples, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSongFromDocument(t *testing.T) {
+	song, err := songFromDocument(bson.M{"_id": int64(3), "key": "Title---Artist", "ytID": nil, "fingerprintVersion": int32(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if song.ID != 3 || song.Title != "Title" || song.Artist != "Artist" || song.FingerprintVersion != 2 {
+		t.Errorf("got %+v", song)
+	}
+
+	for _, doc := range []bson.M{
+		{"key": "Title---Artist"},
+		{"_id": "3", "key": "Title---Artist"},
+		{"_id": int64(3)},
+		{"_id": int64(3), "key": "Title"},
+	} {
+		if _, err := songFromDocument(doc); err == nil {
+			t.Errorf("songFromDocument(%v) succeeded, want an error", doc)
+		}
+	}
+}
+
+func TestMongoClientConformance(t *testing.T) {
+	testDBClient(t, func(t *testing.T) DBClient {
+		return newTestMongoClient(t)
+	})
+}
@@ -0,0 +1,423 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"song-recognition/models"
+	"song-recognition/utils"
+
+	"github.com/lib/pq"
+)
+
+// uniqueViolation is the PostgreSQL error code of unique constraint violations
+const uniqueViolation = "23505"
+
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == uniqueViolation
+}
+
+type PostgresClient struct {
+	db *sql.DB
+}
+
+func NewPostgresClient(ctx context.Context, dataSourceName string) (*PostgresClient, error) {
+	db, err := sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to PostgreSQL: %s", err)
+	}
+	configurePool(db)
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error connecting to PostgreSQL: %s", err)
+	}
+
+	return &PostgresClient{db: db}, nil
+}
+
+func (db *PostgresClient) Close() error {
+	if db.db != nil {
+		return db.db.Close()
+	}
+	return nil
+}
+
+func (db *PostgresClient) StoreFingerprints(ctx context.Context, fingerprints map[uint32][]models.Couple) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	if err := copyFingerprints(ctx, tx, fingerprints); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// copyFingerprints bulk loads fingerprints with COPY, which is much faster
+// than inserting them one by one.
+func copyFingerprints(ctx context.Context, tx *sql.Tx, fingerprints map[uint32][]models.Couple) error {
+	// CopyIn quotes the column names, unquoted names are folded to lower case
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("fingerprints", "address", "anchortimems", "songid"))
+	if err != nil {
+		return fmt.Errorf("error preparing statement: %s", err)
+	}
+	defer stmt.Close()
+
+	for address, couples := range fingerprints {
+		for _, couple := range couples {
+			if _, err := stmt.ExecContext(ctx, int64(address), int64(couple.AnchorTimeMs), int64(couple.SongID)); err != nil {
+				return fmt.Errorf("error copying fingerprints: %s", err)
+			}
+		}
+	}
+
+	// Flush the buffered rows
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return fmt.Errorf("error copying fingerprints: %s", err)
+	}
+
+	return nil
+}
+
+// GetCouples looks up all the addresses with a single query, passing them as
+// an array.
+func (db *PostgresClient) GetCouples(ctx context.Context, addresses []uint32) (map[uint32][]models.Couple, error) {
+	couples := make(map[uint32][]models.Couple)
+
+	values := make([]int64, len(addresses))
+	for i, address := range addresses {
+		values[i] = int64(address)
+	}
+
+	rows, err := db.db.QueryContext(ctx,
+		"SELECT address, anchorTimeMs, songID FROM fingerprints WHERE address = ANY($1)",
+		pq.Array(values),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error querying database: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var address uint32
+		var couple models.Couple
+		if err := rows.Scan(&address, &couple.AnchorTimeMs, &couple.SongID); err != nil {
+			return nil, fmt.Errorf("error scanning row: %s", err)
+		}
+		couples[address] = append(couples[address], couple)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %s", err)
+	}
+
+	return couples, nil
+}
+
+func (db *PostgresClient) ScanFingerprints(ctx context.Context, fn func(address uint32, couple models.Couple) error) error {
+	return scanFingerprints(ctx, db.db, fn)
+}
+
+func (db *PostgresClient) TotalSongs(ctx context.Context) (int, error) {
+	var count int
+	err := db.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM songs").Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting songs: %s", err)
+	}
+	return count, nil
+}
+
+// NextSongID allocates the ID of a new song from the song_ids sequence, so
+// that no two songs get the same ID. IDs already taken are skipped.
+func (db *PostgresClient) NextSongID(ctx context.Context) (uint32, error) {
+	return db.nextID(ctx, "song_ids", "songs", "song")
+}
+
+// nextID allocates an ID from sequence, skipping the IDs already taken in
+// table. kind names the records in errors.
+func (db *PostgresClient) nextID(ctx context.Context, sequence, table, kind string) (uint32, error) {
+	for {
+		var id int64
+		if err := db.db.QueryRowContext(ctx, "SELECT nextval($1)", sequence).Scan(&id); err != nil {
+			return 0, fmt.Errorf("error allocating %s ID: %v", kind, err)
+		}
+
+		var taken bool
+		err := db.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM "+table+" WHERE id = $1)", id).Scan(&taken)
+		if err != nil {
+			return 0, fmt.Errorf("error allocating %s ID: %v", kind, err)
+		}
+		if !taken {
+			return uint32(id), nil
+		}
+	}
+}
+
+// RegisterSong stores a song and its fingerprints in a single transaction,
+// so that a song is never saved without its fingerprints.
+func (db *PostgresClient) RegisterSong(ctx context.Context, song Song, fingerprints map[uint32][]models.Couple) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	if err := insertPostgresSong(ctx, tx, song, fingerprints); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ReplaceSong deletes the song oldSongID with its fingerprints and registers
+// song in its place in a single transaction, so that the old song is kept if
+// song can't be stored.
+func (db *PostgresClient) ReplaceSong(ctx context.Context, oldSongID uint32, song Song, fingerprints map[uint32][]models.Couple) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	if err := deletePostgresSong(ctx, tx, oldSongID); err != nil {
+		return err
+	}
+	if err := insertPostgresSong(ctx, tx, song, fingerprints); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func insertPostgresSong(ctx context.Context, tx *sql.Tx, song Song, fingerprints map[uint32][]models.Couple) error {
+	songKey := utils.GenerateSongKey(song.Title, song.Artist)
+	_, err := tx.ExecContext(ctx, `INSERT INTO songs (id, title, artist, ytID, key, fingerprintVersion,
+        album, artists, duration, isrc, spotifyID, sourcePath, contentHash, ingestedAt, sourceType)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)`,
+		song.ID, song.Title, song.Artist, nullable(song.YouTubeID), songKey, song.FingerprintVersion,
+		song.Album, pq.Array(song.Artists), song.Duration, song.ISRC, nullable(song.SpotifyID), song.SourcePath,
+		song.ContentHash, toMillis(song.IngestedAt), song.SourceType)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("song with ytID or key already exists: %v", err)
+		}
+		return fmt.Errorf("failed to register song: %v", err)
+	}
+
+	return copyFingerprints(ctx, tx, fingerprints)
+}
+
+// scanPostgresSong scans a row of songColumns
+func scanPostgresSong(row interface{ Scan(...interface{}) error }) (Song, error) {
+	var song Song
+	var ingestedAt int64
+	err := row.Scan(&song.ID, &song.Title, &song.Artist, &song.YouTubeID, &song.FingerprintVersion,
+		&song.Album, pq.Array(&song.Artists), &song.Duration, &song.ISRC, &song.SpotifyID, &song.SourcePath,
+		&song.ContentHash, &ingestedAt, &song.SourceType)
+	if err != nil {
+		return Song{}, err
+	}
+	song.IngestedAt = fromMillis(ingestedAt)
+
+	return song, nil
+}
+
+// GetSong retrieves a song by filter key
+func (db *PostgresClient) GetSong(ctx context.Context, filterKey string, value interface{}) (Song, bool, error) {
+	column, err := songFilterColumn(filterKey)
+	if err != nil {
+		return Song{}, false, err
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM songs WHERE %s = $1", songColumns, column)
+
+	song, err := scanPostgresSong(db.db.QueryRowContext(ctx, query, value))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Song{}, false, nil
+		}
+		return Song{}, false, fmt.Errorf("failed to retrieve song: %s", err)
+	}
+
+	return song, true, nil
+}
+
+func (db *PostgresClient) GetSongByID(ctx context.Context, songID uint32) (Song, bool, error) {
+	return db.GetSong(ctx, "id", songID)
+}
+
+// GetSongsByIDs returns the songs with the given IDs that exist, by ID, with
+// a single query
+func (db *PostgresClient) GetSongsByIDs(ctx context.Context, songIDs []uint32) (map[uint32]Song, error) {
+	values := make([]int64, len(songIDs))
+	for i, songID := range songIDs {
+		values[i] = int64(songID)
+	}
+
+	rows, err := db.db.QueryContext(ctx, "SELECT "+songColumns+" FROM songs WHERE id = ANY($1)", pq.Array(values))
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve songs: %v", err)
+	}
+	defer rows.Close()
+
+	songs := make(map[uint32]Song, len(songIDs))
+	if err := scanSongs(rows, scanPostgresSong, songs); err != nil {
+		return nil, err
+	}
+	return songs, nil
+}
+
+// GetSongByYTID returns the song with a YouTube ID. Songs without one can't
+// be found by it.
+func (db *PostgresClient) GetSongByYTID(ctx context.Context, ytID string) (Song, bool, error) {
+	if ytID == "" {
+		return Song{}, false, nil
+	}
+	return db.GetSong(ctx, "ytID", ytID)
+}
+
+func (db *PostgresClient) GetSongByKey(ctx context.Context, key string) (Song, bool, error) {
+	return db.GetSong(ctx, "key", key)
+}
+
+// ListSongs returns up to limit songs ordered by ID, skipping the first offset ones.
+func (db *PostgresClient) ListSongs(ctx context.Context, offset, limit int) ([]Song, error) {
+	rows, err := db.db.QueryContext(ctx,
+		"SELECT "+songColumns+" FROM songs ORDER BY id LIMIT $1 OFFSET $2",
+		limit, offset,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list songs: %v", err)
+	}
+	defer rows.Close()
+
+	var songs []Song
+	for rows.Next() {
+		song, err := scanPostgresSong(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan song: %v", err)
+		}
+		songs = append(songs, song)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list songs: %v", err)
+	}
+
+	return songs, nil
+}
+
+// UpdateSong updates the title, artist and YouTube ID of a song, and its key accordingly
+func (db *PostgresClient) UpdateSong(ctx context.Context, song Song) error {
+	songKey := utils.GenerateSongKey(song.Title, song.Artist)
+	_, err := db.db.ExecContext(ctx, "UPDATE songs SET title = $1, artist = $2, ytID = $3, key = $4 WHERE id = $5",
+		song.Title, song.Artist, nullable(song.YouTubeID), songKey, song.ID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("song with ytID or key already exists: %v", err)
+		}
+		return fmt.Errorf("failed to update song: %v", err)
+	}
+	return nil
+}
+
+// DeleteSongByID deletes a song and its fingerprints in a single transaction
+func (db *PostgresClient) DeleteSongByID(ctx context.Context, songID uint32) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	if err := deletePostgresSong(ctx, tx, songID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func deletePostgresSong(ctx context.Context, tx *sql.Tx, songID uint32) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM fingerprints WHERE songID = $1", songID)
+	if err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %v", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM songs WHERE id = $1", songID)
+	if err != nil {
+		return fmt.Errorf("failed to delete song: %v", err)
+	}
+
+	return nil
+}
+
+// CountFingerprints returns the number of fingerprints of a song
+func (db *PostgresClient) CountFingerprints(ctx context.Context, songID uint32) (int, error) {
+	var count int
+	err := db.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM fingerprints WHERE songID = $1", songID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting fingerprints: %v", err)
+	}
+	return count, nil
+}
+
+// CountOrphanedCouples returns the number of fingerprints of songs that don't exist
+func (db *PostgresClient) CountOrphanedCouples(ctx context.Context) (int, error) {
+	var count int
+	err := db.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM fingerprints WHERE "+orphanedCouplesCondition).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting orphaned fingerprints: %v", err)
+	}
+	return count, nil
+}
+
+// DeleteOrphanedCouples deletes the fingerprints of songs that don't exist
+// and returns how many were deleted
+func (db *PostgresClient) DeleteOrphanedCouples(ctx context.Context) (int, error) {
+	result, err := db.db.ExecContext(ctx, "DELETE FROM fingerprints WHERE "+orphanedCouplesCondition)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting orphaned fingerprints: %v", err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error deleting orphaned fingerprints: %v", err)
+	}
+	return int(deleted), nil
+}
+
+// DeleteCollection deletes the rows of a collection (table), keeping its schema
+func (db *PostgresClient) DeleteCollection(ctx context.Context, collectionName string) error {
+	_, err := db.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s", collectionName))
+	if err != nil {
+		return fmt.Errorf("error deleting collection: %v", err)
+	}
+	return nil
+}
+
+// GetMetadata retrieves the value of a metadata record
+func (db *PostgresClient) GetMetadata(ctx context.Context, key string) (string, bool, error) {
+	var value string
+	err := db.db.QueryRowContext(ctx, "SELECT value FROM metadata WHERE key = $1", key).Scan(&value)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("failed to retrieve metadata: %s", err)
+	}
+	return value, true, nil
+}
+
+// SetMetadata creates or replaces a metadata record
+func (db *PostgresClient) SetMetadata(ctx context.Context, key, value string) error {
+	_, err := db.db.ExecContext(ctx, `INSERT INTO metadata (key, value) VALUES ($1, $2)
+        ON CONFLICT (key) DO UPDATE SET value = excluded.value`, key, value)
+	if err != nil {
+		return fmt.Errorf("failed to set metadata: %v", err)
+	}
+	return nil
+}
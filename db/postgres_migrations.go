@@ -0,0 +1,184 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type postgresMigration struct {
+	Migration
+	up func(ctx context.Context, tx *sql.Tx) error
+}
+
+// postgresMigrations are the migrations of the PostgreSQL schema, in order.
+// Applied migrations must never change, new ones are appended. Unsigned
+// 32-bit values are stored as BIGINT, and times as Unix milliseconds.
+var postgresMigrations = []postgresMigration{
+	{
+		Migration{1, "create songs, fingerprints, metadata and jobs tables"},
+		func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `
+            CREATE TABLE songs (
+                id BIGINT PRIMARY KEY,
+                title TEXT NOT NULL,
+                artist TEXT NOT NULL,
+                ytID TEXT,
+                key TEXT NOT NULL UNIQUE,
+                fingerprintVersion INTEGER NOT NULL DEFAULT 1,
+                album TEXT NOT NULL DEFAULT '',
+                artists TEXT[] NOT NULL DEFAULT '{}',
+                duration DOUBLE PRECISION NOT NULL DEFAULT 0,
+                isrc TEXT NOT NULL DEFAULT '',
+                spotifyID TEXT,
+                sourcePath TEXT NOT NULL DEFAULT '',
+                contentHash TEXT NOT NULL DEFAULT '',
+                ingestedAt BIGINT NOT NULL DEFAULT 0,
+                sourceType TEXT NOT NULL DEFAULT ''
+            );
+
+            CREATE UNIQUE INDEX songs_ytID ON songs (ytID) WHERE ytID IS NOT NULL;
+            CREATE UNIQUE INDEX songs_spotifyID ON songs (spotifyID) WHERE spotifyID IS NOT NULL;
+
+            CREATE SEQUENCE song_ids MINVALUE 1 MAXVALUE 4294967295;
+
+            CREATE TABLE fingerprints (
+                address BIGINT NOT NULL,
+                anchorTimeMs BIGINT NOT NULL,
+                songID BIGINT NOT NULL
+            );
+
+            CREATE INDEX fingerprints_address ON fingerprints (address);
+            CREATE INDEX fingerprints_songID ON fingerprints (songID);
+
+            CREATE TABLE metadata (
+                key TEXT PRIMARY KEY,
+                value TEXT NOT NULL
+            );
+
+            CREATE TABLE jobs (
+                id BIGINT PRIMARY KEY,
+                source TEXT NOT NULL,
+                canceled BOOLEAN NOT NULL DEFAULT FALSE,
+                createdAt BIGINT NOT NULL
+            );
+
+            CREATE INDEX jobs_createdAt ON jobs (createdAt, id);
+
+            CREATE TABLE job_tracks (
+                jobID BIGINT NOT NULL REFERENCES jobs (id) ON DELETE CASCADE,
+                idx INTEGER NOT NULL,
+                title TEXT NOT NULL,
+                artist TEXT NOT NULL,
+                album TEXT NOT NULL,
+                artists TEXT[] NOT NULL DEFAULT '{}',
+                spotifyID TEXT NOT NULL DEFAULT '',
+                duration INTEGER NOT NULL,
+                state TEXT NOT NULL,
+                error TEXT NOT NULL DEFAULT '',
+                attempts INTEGER NOT NULL DEFAULT 0,
+                nextAttemptAt BIGINT NOT NULL DEFAULT 0,
+                updatedAt BIGINT NOT NULL,
+                PRIMARY KEY (jobID, idx)
+            );
+            `)
+			return err
+		},
+	},
+	{
+		Migration{2, "create a sequence for job IDs"},
+		func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, "CREATE SEQUENCE job_ids MINVALUE 1 MAXVALUE 4294967295")
+			return err
+		},
+	},
+}
+
+func (db *PostgresClient) appliedMigrations(ctx context.Context) (map[int]time.Time, error) {
+	_, err := db.db.ExecContext(ctx, `
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+        version INTEGER PRIMARY KEY,
+        description TEXT NOT NULL,
+        appliedAt BIGINT NOT NULL
+    );
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("error creating schema_migrations table: %v", err)
+	}
+
+	rows, err := db.db.QueryContext(ctx, "SELECT version, appliedAt FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("error reading schema_migrations: %v", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("error reading schema_migrations: %v", err)
+		}
+		applied[version] = fromMillis(appliedAt)
+	}
+
+	return applied, rows.Err()
+}
+
+func (db *PostgresClient) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := db.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]Migration, len(postgresMigrations))
+	for i, migration := range postgresMigrations {
+		migrations[i] = migration.Migration
+	}
+
+	return migrationStatuses(migrations, applied), nil
+}
+
+// Migrate applies the pending migrations in order, each in its own
+// transaction, and returns them.
+func (db *PostgresClient) Migrate(ctx context.Context) ([]Migration, error) {
+	applied, err := db.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrated []Migration
+	for _, migration := range postgresMigrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+
+		if err := db.applyMigration(ctx, migration); err != nil {
+			return migrated, fmt.Errorf("migration %d (%s) failed: %v", migration.Version, migration.Description, err)
+		}
+		migrated = append(migrated, migration.Migration)
+	}
+
+	return migrated, nil
+}
+
+func (db *PostgresClient) applyMigration(ctx context.Context, migration postgresMigration) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := migration.up(ctx, tx); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, description, appliedAt) VALUES ($1, $2, $3)",
+		migration.Version, migration.Description, toMillis(time.Now()))
+	if err != nil {
+		return fmt.Errorf("error recording migration: %v", err)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,46 @@
+package db
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+// newTestPostgresClient returns a client of the database at TEST_POSTGRES_DSN,
+// empty and migrated. Its public schema is dropped, so it must be a disposable
+// database.
+func newTestPostgresClient(tb testing.TB) *PostgresClient {
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		tb.Skip("TEST_POSTGRES_DSN isn't set")
+	}
+
+	ctx := context.Background()
+	dbClient, err := NewPostgresClient(ctx, dsn)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	drop := func() error {
+		_, err := dbClient.db.ExecContext(ctx, "DROP SCHEMA public CASCADE; CREATE SCHEMA public")
+		return err
+	}
+	tb.Cleanup(func() {
+		drop()
+		dbClient.Close()
+	})
+
+	if err := drop(); err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := dbClient.Migrate(ctx); err != nil {
+		tb.Fatal(err)
+	}
+	return dbClient
+}
+
+func TestPostgresClientConformance(t *testing.T) {
+	testDBClient(t, func(t *testing.T) DBClient {
+		return newTestPostgresClient(t)
+	})
+}
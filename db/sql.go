@@ -0,0 +1,98 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"song-recognition/models"
+	"time"
+)
+
+// Queries and encodings shared by the SQL databases, SQLite and PostgreSQL
+
+// songFilterColumn returns the column of the songs table GetSong filters by
+// for filterKey. The column is part of the query, so only known keys are
+// accepted, matched exactly.
+func songFilterColumn(filterKey string) (string, error) {
+	switch filterKey {
+	case "id":
+		return "id", nil
+	case "ytID":
+		return "ytID", nil
+	case "key":
+		return "key", nil
+	}
+	return "", fmt.Errorf("invalid filter key %q", filterKey)
+}
+
+// songColumns are the columns read by scanSong. Missing external IDs are NULL.
+const songColumns = `id, title, artist, COALESCE(ytID, ''), fingerprintVersion,
+    album, artists, duration, isrc, COALESCE(spotifyID, ''), sourcePath, contentHash, ingestedAt, sourceType`
+
+// scanSongs adds the songs of rows, read with scan, to songs by ID
+func scanSongs(rows *sql.Rows, scan func(row interface{ Scan(...interface{}) error }) (Song, error), songs map[uint32]Song) error {
+	for rows.Next() {
+		song, err := scan(rows)
+		if err != nil {
+			return fmt.Errorf("failed to scan song: %v", err)
+		}
+		songs[song.ID] = song
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to retrieve songs: %v", err)
+	}
+	return nil
+}
+
+// orphanedCouplesCondition selects the fingerprints of songs that don't exist
+const orphanedCouplesCondition = "songID NOT IN (SELECT id FROM songs)"
+
+// scanFingerprints calls fn with every couple of the fingerprints table,
+// stopping at the first error.
+func scanFingerprints(ctx context.Context, db *sql.DB, fn func(address uint32, couple models.Couple) error) error {
+	rows, err := db.QueryContext(ctx, "SELECT address, anchorTimeMs, songID FROM fingerprints")
+	if err != nil {
+		return fmt.Errorf("error querying database: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var address uint32
+		var couple models.Couple
+		if err := rows.Scan(&address, &couple.AnchorTimeMs, &couple.SongID); err != nil {
+			return fmt.Errorf("error scanning row: %s", err)
+		}
+		if err := fn(address, couple); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %s", err)
+	}
+	return nil
+}
+
+// configurePool limits the connections of a client to maxConns, keeping them
+// open between requests unless they stay idle for a while.
+func configurePool(db *sql.DB) {
+	db.SetMaxOpenConns(maxConns())
+	db.SetMaxIdleConns(maxConns())
+	db.SetConnMaxIdleTime(5 * time.Minute)
+}
+
+// Times are stored as Unix milliseconds
+func toMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+func fromMillis(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
@@ -1,8 +1,13 @@
+//go:build cgo
+
 package db
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"math"
 	"song-recognition/models"
 	"song-recognition/utils"
 	"strings"
@@ -10,58 +15,33 @@ import (
 	"github.com/mattn/go-sqlite3"
 )
 
+// defaultDBType is the database used unless DB_TYPE is set
+const defaultDBType = "sqlite"
+
 type SQLiteClient struct {
 	db *sql.DB
 }
 
+// sqliteOptions put the database in WAL mode, so that reads don't wait for
+// writes, and make writers wait for each other instead of failing. Since
+// most transactions write, they take the write lock as they begin.
+const sqliteOptions = "_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate"
+
 func NewSQLiteClient(dataSourceName string) (*SQLiteClient, error) {
-	db, err := sql.Open("sqlite3", dataSourceName)
-	if err != nil {
-		return nil, fmt.Errorf("error connecting to SQLite: %s", err)
+	separator := "?"
+	if strings.Contains(dataSourceName, "?") {
+		separator = "&"
 	}
 
-	err = createTables(db)
+	db, err := sql.Open("sqlite3", dataSourceName+separator+sqliteOptions)
 	if err != nil {
-		return nil, fmt.Errorf("error creating tables: %s", err)
+		return nil, fmt.Errorf("error connecting to SQLite: %s", err)
 	}
+	configurePool(db)
 
 	return &SQLiteClient{db: db}, nil
 }
 
-// createTables creates the required tables if they don't exist
-func createTables(db *sql.DB) error {
-	createSongsTable := `
-    CREATE TABLE IF NOT EXISTS songs (
-        id INTEGER PRIMARY KEY AUTOINCREMENT,
-        title TEXT NOT NULL,
-        artist TEXT NOT NULL,
-        ytID TEXT NOT NULL UNIQUE,
-        key TEXT NOT NULL UNIQUE
-    );
-    `
-
-	createFingerprintsTable := `
-    CREATE TABLE IF NOT EXISTS fingerprints (
-        address INTEGER NOT NULL,
-        anchorTimeMs INTEGER NOT NULL,
-        songID INTEGER NOT NULL,
-        PRIMARY KEY (address, anchorTimeMs, songID)
-    );
-    `
-
-	_, err := db.Exec(createSongsTable)
-	if err != nil {
-		return fmt.Errorf("error creating songs table: %s", err)
-	}
-
-	_, err = db.Exec(createFingerprintsTable)
-	if err != nil {
-		return fmt.Errorf("error creating fingerprints table: %s", err)
-	}
-
-	return nil
-}
-
 func (db *SQLiteClient) Close() error {
 	if db.db != nil {
 		return db.db.Close()
@@ -69,103 +49,229 @@ func (db *SQLiteClient) Close() error {
 	return nil
 }
 
-func (db *SQLiteClient) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
-	tx, err := db.db.Begin()
+func (db *SQLiteClient) StoreFingerprints(ctx context.Context, fingerprints map[uint32][]models.Couple) error {
+	tx, err := db.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("error starting transaction: %s", err)
 	}
+	defer tx.Rollback()
+
+	if err := storeFingerprints(ctx, tx, fingerprints); err != nil {
+		return err
+	}
 
-	stmt, err := tx.Prepare("INSERT OR REPLACE INTO fingerprints (address, anchorTimeMs, songID) VALUES (?, ?, ?)")
+	return tx.Commit()
+}
+
+func storeFingerprints(ctx context.Context, tx *sql.Tx, fingerprints map[uint32][]models.Couple) error {
+	stmt, err := tx.PrepareContext(ctx, "INSERT OR REPLACE INTO fingerprints (address, anchorTimeMs, songID) VALUES (?, ?, ?)")
 	if err != nil {
-		tx.Rollback()
 		return fmt.Errorf("error preparing statement: %s", err)
 	}
 	defer stmt.Close()
 
-	for address, couple := range fingerprints {
-		if _, err := stmt.Exec(address, couple.AnchorTimeMs, couple.SongID); err != nil {
-			tx.Rollback()
-			return fmt.Errorf("error executing statement: %s", err)
+	for address, couples := range fingerprints {
+		for _, couple := range couples {
+			if _, err := stmt.ExecContext(ctx, address, couple.AnchorTimeMs, couple.SongID); err != nil {
+				return fmt.Errorf("error executing statement: %s", err)
+			}
 		}
 	}
 
-	return tx.Commit()
+	return nil
 }
 
-func (db *SQLiteClient) GetCouples(addresses []uint32) (map[uint32][]models.Couple, error) {
+// maxQueryAddresses is the number of addresses or song IDs looked up per
+// query, kept well below SQLite's limit on the number of host parameters.
+const maxQueryAddresses = 500
+
+func (db *SQLiteClient) GetCouples(ctx context.Context, addresses []uint32) (map[uint32][]models.Couple, error) {
 	couples := make(map[uint32][]models.Couple)
 
-	for _, address := range addresses {
-		rows, err := db.db.Query("SELECT anchorTimeMs, songID FROM fingerprints WHERE address = ?", address)
-		if err != nil {
-			return nil, fmt.Errorf("error querying database: %s", err)
+	for start := 0; start < len(addresses); start += maxQueryAddresses {
+		end := start + maxQueryAddresses
+		if end > len(addresses) {
+			end = len(addresses)
 		}
-		defer rows.Close()
 
-		var docCouples []models.Couple
-		for rows.Next() {
-			var couple models.Couple
-			if err := rows.Scan(&couple.AnchorTimeMs, &couple.SongID); err != nil {
-				return nil, fmt.Errorf("error scanning row: %s", err)
-			}
-			docCouples = append(docCouples, couple)
+		if err := db.getCouplesBatch(ctx, addresses[start:end], couples); err != nil {
+			return nil, err
 		}
-		couples[address] = docCouples
 	}
 
 	return couples, nil
 }
 
-func (db *SQLiteClient) TotalSongs() (int, error) {
+// getCouplesBatch looks up a batch of addresses with a single query and adds their couples to couples.
+func (db *SQLiteClient) getCouplesBatch(ctx context.Context, addresses []uint32, couples map[uint32][]models.Couple) error {
+	placeholders := strings.Repeat("?, ", len(addresses)-1) + "?"
+	args := make([]interface{}, len(addresses))
+	for i, address := range addresses {
+		args[i] = address
+	}
+
+	query := fmt.Sprintf("SELECT address, anchorTimeMs, songID FROM fingerprints WHERE address IN (%s)", placeholders)
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("error querying database: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var address uint32
+		var couple models.Couple
+		if err := rows.Scan(&address, &couple.AnchorTimeMs, &couple.SongID); err != nil {
+			return fmt.Errorf("error scanning row: %s", err)
+		}
+		couples[address] = append(couples[address], couple)
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %s", err)
+	}
+
+	return nil
+}
+
+func (db *SQLiteClient) ScanFingerprints(ctx context.Context, fn func(address uint32, couple models.Couple) error) error {
+	return scanFingerprints(ctx, db.db, fn)
+}
+
+func (db *SQLiteClient) TotalSongs(ctx context.Context) (int, error) {
 	var count int
-	err := db.db.QueryRow("SELECT COUNT(*) FROM songs").Scan(&count)
+	err := db.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM songs").Scan(&count)
 	if err != nil {
 		return 0, fmt.Errorf("error counting songs: %s", err)
 	}
 	return count, nil
 }
 
-func (db *SQLiteClient) RegisterSong(songTitle, songArtist, ytID string) (uint32, error) {
-	tx, err := db.db.Begin()
+// NextSongID allocates the ID of a new song from the songs sequence, so that
+// no two songs get the same ID. IDs already taken, e.g. random ones given
+// before the sequence existed, are skipped.
+func (db *SQLiteClient) NextSongID(ctx context.Context) (uint32, error) {
+	return db.nextID(ctx, "songs", "song")
+}
+
+// nextID allocates an ID from the sequence of a table, skipping the IDs
+// already taken in it. kind names the records in errors.
+func (db *SQLiteClient) nextID(ctx context.Context, table, kind string) (uint32, error) {
+	tx, err := db.db.BeginTx(ctx, nil)
 	if err != nil {
 		return 0, fmt.Errorf("error starting transaction: %s", err)
 	}
+	defer tx.Rollback()
+
+	for {
+		var id int64
+		err := tx.QueryRowContext(ctx, "UPDATE sequences SET value = value + 1 WHERE name = ? RETURNING value", table).Scan(&id)
+		if err != nil {
+			return 0, fmt.Errorf("error allocating %s ID: %v", kind, err)
+		}
+		if id > math.MaxUint32 {
+			return 0, fmt.Errorf("no %s IDs left", kind)
+		}
+
+		var taken bool
+		err = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM "+table+" WHERE id = ?)", id).Scan(&taken)
+		if err != nil {
+			return 0, fmt.Errorf("error allocating %s ID: %v", kind, err)
+		}
+		if !taken {
+			return uint32(id), tx.Commit()
+		}
+	}
+}
 
-	stmt, err := tx.Prepare("INSERT INTO songs (id, title, artist, ytID, key) VALUES (?, ?, ?, ?, ?)")
+// RegisterSong stores a song and its fingerprints in a single transaction,
+// so that a song is never saved without its fingerprints.
+func (db *SQLiteClient) RegisterSong(ctx context.Context, song Song, fingerprints map[uint32][]models.Couple) error {
+	tx, err := db.db.BeginTx(ctx, nil)
 	if err != nil {
-		tx.Rollback()
-		return 0, fmt.Errorf("error preparing statement: %s", err)
+		return fmt.Errorf("error starting transaction: %s", err)
 	}
-	defer stmt.Close()
+	defer tx.Rollback()
 
-	songID := utils.GenerateUniqueID()
-	songKey := utils.GenerateSongKey(songTitle, songArtist)
-	if _, err := stmt.Exec(songID, songTitle, songArtist, ytID, songKey); err != nil {
-		tx.Rollback()
-		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.Code == sqlite3.ErrConstraint {
-			return 0, fmt.Errorf("song with ytID or key already exists: %v", err)
-		}
-		return 0, fmt.Errorf("failed to register song: %v", err)
+	if err := insertSong(ctx, tx, song, fingerprints); err != nil {
+		return err
 	}
 
-	return songID, tx.Commit()
+	return tx.Commit()
 }
 
-var sqlitefilterKeys = "id | ytID | key"
+// ReplaceSong deletes the song oldSongID with its fingerprints and registers
+// song in its place in a single transaction, so that the old song is kept if
+// song can't be stored.
+func (db *SQLiteClient) ReplaceSong(ctx context.Context, oldSongID uint32, song Song, fingerprints map[uint32][]models.Couple) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	if err := deleteSong(ctx, tx, oldSongID); err != nil {
+		return err
+	}
+	if err := insertSong(ctx, tx, song, fingerprints); err != nil {
+		return err
+	}
 
-// GetSong retrieves a song by filter key
-func (s *SQLiteClient) GetSong(filterKey string, value interface{}) (Song, bool, error) {
+	return tx.Commit()
+}
 
-	if !strings.Contains(sqlitefilterKeys, filterKey) {
-		return Song{}, false, fmt.Errorf("invalid filter key")
+func insertSong(ctx context.Context, tx *sql.Tx, song Song, fingerprints map[uint32][]models.Couple) error {
+	artists, err := json.Marshal(song.Artists)
+	if err != nil {
+		return fmt.Errorf("failed to encode artists: %v", err)
 	}
 
-	query := fmt.Sprintf("SELECT title, artist, ytID FROM songs WHERE %s = ?", filterKey)
+	songKey := utils.GenerateSongKey(song.Title, song.Artist)
+	_, err = tx.ExecContext(ctx, `INSERT INTO songs (id, title, artist, ytID, key, fingerprintVersion,
+        album, artists, duration, isrc, spotifyID, sourcePath, contentHash, ingestedAt, sourceType)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		song.ID, song.Title, song.Artist, nullable(song.YouTubeID), songKey, song.FingerprintVersion,
+		song.Album, string(artists), song.Duration, song.ISRC, nullable(song.SpotifyID), song.SourcePath,
+		song.ContentHash, toMillis(song.IngestedAt), song.SourceType)
+	if err != nil {
+		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.Code == sqlite3.ErrConstraint {
+			return fmt.Errorf("song with ytID or key already exists: %v", err)
+		}
+		return fmt.Errorf("failed to register song: %v", err)
+	}
 
-	row := s.db.QueryRow(query, value)
+	return storeFingerprints(ctx, tx, fingerprints)
+}
 
+// scanSong scans a row of songColumns
+func scanSong(row interface{ Scan(...interface{}) error }) (Song, error) {
 	var song Song
-	err := row.Scan(&song.Title, &song.Artist, &song.YouTubeID)
+	var artists string
+	var ingestedAt int64
+	err := row.Scan(&song.ID, &song.Title, &song.Artist, &song.YouTubeID, &song.FingerprintVersion,
+		&song.Album, &artists, &song.Duration, &song.ISRC, &song.SpotifyID, &song.SourcePath,
+		&song.ContentHash, &ingestedAt, &song.SourceType)
+	if err != nil {
+		return Song{}, err
+	}
+
+	if err := json.Unmarshal([]byte(artists), &song.Artists); err != nil {
+		return Song{}, fmt.Errorf("invalid artists %q: %v", artists, err)
+	}
+	song.IngestedAt = fromMillis(ingestedAt)
+
+	return song, nil
+}
+
+// GetSong retrieves a song by filter key
+func (s *SQLiteClient) GetSong(ctx context.Context, filterKey string, value interface{}) (Song, bool, error) {
+	column, err := songFilterColumn(filterKey)
+	if err != nil {
+		return Song{}, false, err
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM songs WHERE %s = ?", songColumns, column)
+
+	song, err := scanSong(s.db.QueryRowContext(ctx, query, value))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return Song{}, false, nil
@@ -176,32 +282,183 @@ func (s *SQLiteClient) GetSong(filterKey string, value interface{}) (Song, bool,
 	return song, true, nil
 }
 
-func (db *SQLiteClient) GetSongByID(songID uint32) (Song, bool, error) {
-	return db.GetSong("id", songID)
+func (db *SQLiteClient) GetSongByID(ctx context.Context, songID uint32) (Song, bool, error) {
+	return db.GetSong(ctx, "id", songID)
+}
+
+// GetSongsByIDs returns the songs with the given IDs that exist, by ID
+func (db *SQLiteClient) GetSongsByIDs(ctx context.Context, songIDs []uint32) (map[uint32]Song, error) {
+	songs := make(map[uint32]Song, len(songIDs))
+
+	for start := 0; start < len(songIDs); start += maxQueryAddresses {
+		end := min(start+maxQueryAddresses, len(songIDs))
+
+		batch := songIDs[start:end]
+		placeholders := strings.Repeat("?, ", len(batch)-1) + "?"
+		args := make([]interface{}, len(batch))
+		for i, songID := range batch {
+			args[i] = songID
+		}
+
+		rows, err := db.db.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM songs WHERE id IN (%s)", songColumns, placeholders), args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve songs: %v", err)
+		}
+		err = scanSongs(rows, scanSong, songs)
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return songs, nil
+}
+
+// GetSongByYTID returns the song with a YouTube ID. Songs without one can't
+// be found by it.
+func (db *SQLiteClient) GetSongByYTID(ctx context.Context, ytID string) (Song, bool, error) {
+	if ytID == "" {
+		return Song{}, false, nil
+	}
+	return db.GetSong(ctx, "ytID", ytID)
+}
+
+func (db *SQLiteClient) GetSongByKey(ctx context.Context, key string) (Song, bool, error) {
+	return db.GetSong(ctx, "key", key)
+}
+
+// ListSongs returns up to limit songs ordered by ID, skipping the first offset ones.
+func (db *SQLiteClient) ListSongs(ctx context.Context, offset, limit int) ([]Song, error) {
+	rows, err := db.db.QueryContext(ctx,
+		"SELECT "+songColumns+" FROM songs ORDER BY id LIMIT ? OFFSET ?",
+		limit, offset,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list songs: %v", err)
+	}
+	defer rows.Close()
+
+	var songs []Song
+	for rows.Next() {
+		song, err := scanSong(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan song: %v", err)
+		}
+		songs = append(songs, song)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list songs: %v", err)
+	}
+
+	return songs, nil
 }
 
-func (db *SQLiteClient) GetSongByYTID(ytID string) (Song, bool, error) {
-	return db.GetSong("ytID", ytID)
+// UpdateSong updates the title, artist and YouTube ID of a song, and its key accordingly
+func (db *SQLiteClient) UpdateSong(ctx context.Context, song Song) error {
+	songKey := utils.GenerateSongKey(song.Title, song.Artist)
+	_, err := db.db.ExecContext(ctx, "UPDATE songs SET title = ?, artist = ?, ytID = ?, key = ? WHERE id = ?",
+		song.Title, song.Artist, nullable(song.YouTubeID), songKey, song.ID)
+	if err != nil {
+		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.Code == sqlite3.ErrConstraint {
+			return fmt.Errorf("song with ytID or key already exists: %v", err)
+		}
+		return fmt.Errorf("failed to update song: %v", err)
+	}
+	return nil
 }
 
-func (db *SQLiteClient) GetSongByKey(key string) (Song, bool, error) {
-	return db.GetSong("key", key)
+// DeleteSongByID deletes a song and its fingerprints in a single transaction
+func (db *SQLiteClient) DeleteSongByID(ctx context.Context, songID uint32) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	if err := deleteSong(ctx, tx, songID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-// DeleteSongByID deletes a song by ID
-func (db *SQLiteClient) DeleteSongByID(songID uint32) error {
-	_, err := db.db.Exec("DELETE FROM songs WHERE id = ?", songID)
+func deleteSong(ctx context.Context, tx *sql.Tx, songID uint32) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM fingerprints WHERE songID = ?", songID)
+	if err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %v", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM songs WHERE id = ?", songID)
 	if err != nil {
 		return fmt.Errorf("failed to delete song: %v", err)
 	}
+
 	return nil
 }
 
-// DeleteCollection deletes a collection (table) from the database
-func (db *SQLiteClient) DeleteCollection(collectionName string) error {
-	_, err := db.db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", collectionName))
+// CountFingerprints returns the number of fingerprints of a song
+func (db *SQLiteClient) CountFingerprints(ctx context.Context, songID uint32) (int, error) {
+	var count int
+	err := db.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM fingerprints WHERE songID = ?", songID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting fingerprints: %v", err)
+	}
+	return count, nil
+}
+
+// CountOrphanedCouples returns the number of fingerprints of songs that don't exist
+func (db *SQLiteClient) CountOrphanedCouples(ctx context.Context) (int, error) {
+	var count int
+	err := db.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM fingerprints WHERE "+orphanedCouplesCondition).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting orphaned fingerprints: %v", err)
+	}
+	return count, nil
+}
+
+// DeleteOrphanedCouples deletes the fingerprints of songs that don't exist
+// and returns how many were deleted
+func (db *SQLiteClient) DeleteOrphanedCouples(ctx context.Context) (int, error) {
+	result, err := db.db.ExecContext(ctx, "DELETE FROM fingerprints WHERE "+orphanedCouplesCondition)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting orphaned fingerprints: %v", err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error deleting orphaned fingerprints: %v", err)
+	}
+	return int(deleted), nil
+}
+
+// DeleteCollection deletes the rows of a collection (table), keeping its schema
+func (db *SQLiteClient) DeleteCollection(ctx context.Context, collectionName string) error {
+	_, err := db.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s", collectionName))
 	if err != nil {
 		return fmt.Errorf("error deleting collection: %v", err)
 	}
 	return nil
 }
+
+// GetMetadata retrieves the value of a metadata record
+func (db *SQLiteClient) GetMetadata(ctx context.Context, key string) (string, bool, error) {
+	var value string
+	err := db.db.QueryRowContext(ctx, "SELECT value FROM metadata WHERE key = ?", key).Scan(&value)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("failed to retrieve metadata: %s", err)
+	}
+	return value, true, nil
+}
+
+// SetMetadata creates or replaces a metadata record
+func (db *SQLiteClient) SetMetadata(ctx context.Context, key, value string) error {
+	_, err := db.db.ExecContext(ctx, "INSERT OR REPLACE INTO metadata (key, value) VALUES (?, ?)", key, value)
+	if err != nil {
+		return fmt.Errorf("failed to set metadata: %v", err)
+	}
+	return nil
+}
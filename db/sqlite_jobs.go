@@ -0,0 +1,170 @@
+//go:build cgo
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"song-recognition/models"
+)
+
+// NextJobID allocates the ID of a new job from the jobs sequence. IDs already
+// taken, e.g. random ones given before the sequence existed, are skipped.
+func (db *SQLiteClient) NextJobID(ctx context.Context) (uint32, error) {
+	return db.nextID(ctx, "jobs", "job")
+}
+
+func (db *SQLiteClient) CreateJob(ctx context.Context, job models.Job) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO jobs (id, source, canceled, createdAt) VALUES (?, ?, ?, ?)",
+		job.ID, job.Source, job.Canceled, toMillis(job.CreatedAt))
+	if err != nil {
+		return fmt.Errorf("failed to create job: %v", err)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO job_tracks
+        (jobID, idx, title, artist, album, artists, spotifyID, duration, state, error, attempts, nextAttemptAt, updatedAt)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("error preparing statement: %v", err)
+	}
+	defer stmt.Close()
+
+	for _, track := range job.Tracks {
+		artists, err := json.Marshal(track.Artists)
+		if err != nil {
+			return fmt.Errorf("failed to encode artists: %v", err)
+		}
+
+		_, err = stmt.ExecContext(ctx, job.ID, track.Index, track.Title, track.Artist, track.Album, string(artists), track.SpotifyID,
+			track.Duration, track.State, track.Error, track.Attempts, toMillis(track.NextAttemptAt), toMillis(track.UpdatedAt))
+		if err != nil {
+			return fmt.Errorf("failed to create job track: %v", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (db *SQLiteClient) GetJob(ctx context.Context, jobID uint32) (models.Job, bool, error) {
+	var job models.Job
+	var createdAt int64
+
+	err := db.db.QueryRowContext(ctx, "SELECT id, source, canceled, createdAt FROM jobs WHERE id = ?", jobID).
+		Scan(&job.ID, &job.Source, &job.Canceled, &createdAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return models.Job{}, false, nil
+		}
+		return models.Job{}, false, fmt.Errorf("failed to retrieve job: %v", err)
+	}
+	job.CreatedAt = fromMillis(createdAt)
+
+	job.Tracks, err = db.getJobTracks(ctx, jobID)
+	if err != nil {
+		return models.Job{}, false, err
+	}
+
+	return job, true, nil
+}
+
+func (db *SQLiteClient) getJobTracks(ctx context.Context, jobID uint32) ([]models.JobTrack, error) {
+	rows, err := db.db.QueryContext(ctx, `SELECT idx, title, artist, album, artists, spotifyID, duration,
+        state, error, attempts, nextAttemptAt, updatedAt
+        FROM job_tracks WHERE jobID = ? ORDER BY idx`, jobID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve job tracks: %v", err)
+	}
+	defer rows.Close()
+
+	var tracks []models.JobTrack
+	for rows.Next() {
+		var track models.JobTrack
+		var artists string
+		var nextAttemptAt, updatedAt int64
+		err := rows.Scan(&track.Index, &track.Title, &track.Artist, &track.Album, &artists, &track.SpotifyID,
+			&track.Duration, &track.State, &track.Error, &track.Attempts, &nextAttemptAt, &updatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan job track: %v", err)
+		}
+		if err := json.Unmarshal([]byte(artists), &track.Artists); err != nil {
+			return nil, fmt.Errorf("invalid artists %q: %v", artists, err)
+		}
+		track.NextAttemptAt = fromMillis(nextAttemptAt)
+		track.UpdatedAt = fromMillis(updatedAt)
+		tracks = append(tracks, track)
+	}
+
+	return tracks, rows.Err()
+}
+
+// ListJobs returns the jobs ordered by creation time. With unfinishedOnly,
+// only the jobs with tracks left to process are returned.
+func (db *SQLiteClient) ListJobs(ctx context.Context, unfinishedOnly bool) ([]models.Job, error) {
+	query := "SELECT id FROM jobs ORDER BY createdAt, id"
+	var args []interface{}
+	if unfinishedOnly {
+		query = `SELECT id FROM jobs WHERE EXISTS (
+            SELECT 1 FROM job_tracks WHERE jobID = jobs.id AND state NOT IN (?, ?, ?)
+        ) ORDER BY createdAt, id`
+		args = []interface{}{models.TrackDone, models.TrackFailed, models.TrackCanceled}
+	}
+
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %v", err)
+	}
+
+	var jobIDs []uint32
+	for rows.Next() {
+		var jobID uint32
+		if err := rows.Scan(&jobID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan job: %v", err)
+		}
+		jobIDs = append(jobIDs, jobID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %v", err)
+	}
+
+	jobs := make([]models.Job, 0, len(jobIDs))
+	for _, jobID := range jobIDs {
+		job, jobExists, err := db.GetJob(ctx, jobID)
+		if err != nil {
+			return nil, err
+		}
+		if jobExists {
+			jobs = append(jobs, job)
+		}
+	}
+
+	return jobs, nil
+}
+
+func (db *SQLiteClient) UpdateJobTrack(ctx context.Context, jobID uint32, track models.JobTrack) error {
+	_, err := db.db.ExecContext(ctx, `UPDATE job_tracks SET state = ?, error = ?, attempts = ?, nextAttemptAt = ?, updatedAt = ?
+        WHERE jobID = ? AND idx = ?`,
+		track.State, track.Error, track.Attempts, toMillis(track.NextAttemptAt), toMillis(track.UpdatedAt),
+		jobID, track.Index)
+	if err != nil {
+		return fmt.Errorf("failed to update job track: %v", err)
+	}
+	return nil
+}
+
+func (db *SQLiteClient) SetJobCanceled(ctx context.Context, jobID uint32, canceled bool) error {
+	_, err := db.db.ExecContext(ctx, "UPDATE jobs SET canceled = ? WHERE id = ?", canceled, jobID)
+	if err != nil {
+		return fmt.Errorf("failed to update job: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+//go:build cgo
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type sqliteMigration struct {
+	Migration
+	up func(ctx context.Context, tx *sql.Tx) error
+}
+
+// sqliteMigrations are the migrations of the SQLite schema, in order. Applied
+// migrations must never change, new ones are appended.
+var sqliteMigrations = []sqliteMigration{
+	{
+		Migration{1, "create songs, fingerprints and metadata tables"},
+		func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `
+            CREATE TABLE IF NOT EXISTS songs (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                title TEXT NOT NULL,
+                artist TEXT NOT NULL,
+                ytID TEXT NOT NULL UNIQUE,
+                key TEXT NOT NULL UNIQUE
+            );
+
+            CREATE TABLE IF NOT EXISTS fingerprints (
+                address INTEGER NOT NULL,
+                anchorTimeMs INTEGER NOT NULL,
+                songID INTEGER NOT NULL,
+                PRIMARY KEY (address, anchorTimeMs, songID)
+            );
+
+            CREATE TABLE IF NOT EXISTS metadata (
+                key TEXT PRIMARY KEY,
+                value TEXT NOT NULL
+            );
+            `)
+			return err
+		},
+	},
+	{
+		Migration{2, "add fingerprintVersion to songs"},
+		func(ctx context.Context, tx *sql.Tx) error {
+			// Databases created before migrations were recorded may have the column
+			return addColumnIfMissing(ctx, tx, "songs", "fingerprintVersion", "INTEGER NOT NULL DEFAULT 1")
+		},
+	},
+	{
+		Migration{3, "create jobs and job_tracks tables"},
+		func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `
+            CREATE TABLE IF NOT EXISTS jobs (
+                id INTEGER PRIMARY KEY,
+                source TEXT NOT NULL,
+                canceled INTEGER NOT NULL DEFAULT 0,
+                createdAt INTEGER NOT NULL
+            );
+
+            CREATE TABLE IF NOT EXISTS job_tracks (
+                jobID INTEGER NOT NULL,
+                idx INTEGER NOT NULL,
+                title TEXT NOT NULL,
+                artist TEXT NOT NULL,
+                album TEXT NOT NULL,
+                duration INTEGER NOT NULL,
+                state TEXT NOT NULL,
+                error TEXT NOT NULL DEFAULT '',
+                attempts INTEGER NOT NULL DEFAULT 0,
+                nextAttemptAt INTEGER NOT NULL DEFAULT 0,
+                updatedAt INTEGER NOT NULL,
+                PRIMARY KEY (jobID, idx)
+            );
+            `)
+			return err
+		},
+	},
+	{
+		Migration{4, "index fingerprints by address"},
+		func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS fingerprints_address ON fingerprints (address)")
+			return err
+		},
+	},
+	{
+		Migration{5, "add album, artists, duration, ISRC, Spotify ID and source columns to songs"},
+		func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `
+            ALTER TABLE songs ADD COLUMN album TEXT NOT NULL DEFAULT '';
+            ALTER TABLE songs ADD COLUMN artists TEXT NOT NULL DEFAULT '[]';
+            ALTER TABLE songs ADD COLUMN duration REAL NOT NULL DEFAULT 0;
+            ALTER TABLE songs ADD COLUMN isrc TEXT NOT NULL DEFAULT '';
+            ALTER TABLE songs ADD COLUMN spotifyID TEXT NOT NULL DEFAULT '';
+            ALTER TABLE songs ADD COLUMN sourcePath TEXT NOT NULL DEFAULT '';
+            ALTER TABLE songs ADD COLUMN contentHash TEXT NOT NULL DEFAULT '';
+            ALTER TABLE songs ADD COLUMN ingestedAt INTEGER NOT NULL DEFAULT 0;
+            ALTER TABLE songs ADD COLUMN sourceType TEXT NOT NULL DEFAULT '';
+            `)
+			return err
+		},
+	},
+	{
+		Migration{6, "add Spotify ID and artists to job_tracks"},
+		func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `
+            ALTER TABLE job_tracks ADD COLUMN spotifyID TEXT NOT NULL DEFAULT '';
+            ALTER TABLE job_tracks ADD COLUMN artists TEXT NOT NULL DEFAULT '[]';
+            `)
+			return err
+		},
+	},
+	{
+		Migration{7, "make ytID and spotifyID nullable and unique only when present"},
+		func(ctx context.Context, tx *sql.Tx) error {
+			// SQLite can't drop a constraint, the table is rebuilt instead
+			_, err := tx.ExecContext(ctx, `
+            CREATE TABLE songs_new (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                title TEXT NOT NULL,
+                artist TEXT NOT NULL,
+                ytID TEXT,
+                key TEXT NOT NULL UNIQUE,
+                fingerprintVersion INTEGER NOT NULL DEFAULT 1,
+                album TEXT NOT NULL DEFAULT '',
+                artists TEXT NOT NULL DEFAULT '[]',
+                duration REAL NOT NULL DEFAULT 0,
+                isrc TEXT NOT NULL DEFAULT '',
+                spotifyID TEXT,
+                sourcePath TEXT NOT NULL DEFAULT '',
+                contentHash TEXT NOT NULL DEFAULT '',
+                ingestedAt INTEGER NOT NULL DEFAULT 0,
+                sourceType TEXT NOT NULL DEFAULT ''
+            );
+
+            INSERT INTO songs_new
+            SELECT id, title, artist, NULLIF(ytID, ''), key, fingerprintVersion, album, artists,
+                duration, isrc, NULLIF(spotifyID, ''), sourcePath, contentHash, ingestedAt, sourceType
+            FROM songs;
+
+            DROP TABLE songs;
+            ALTER TABLE songs_new RENAME TO songs;
+
+            CREATE UNIQUE INDEX songs_ytID ON songs (ytID) WHERE ytID IS NOT NULL;
+            CREATE UNIQUE INDEX songs_spotifyID ON songs (spotifyID) WHERE spotifyID IS NOT NULL;
+            `)
+			return err
+		},
+	},
+	{
+		Migration{8, "create sequences table for song IDs"},
+		func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `
+            CREATE TABLE IF NOT EXISTS sequences (
+                name TEXT PRIMARY KEY,
+                value INTEGER NOT NULL
+            );
+
+            INSERT OR IGNORE INTO sequences (name, value) VALUES ('songs', 0);
+            `)
+			return err
+		},
+	},
+	{
+		Migration{9, "add a sequence for job IDs"},
+		func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO sequences (name, value) VALUES ('jobs', 0)")
+			return err
+		},
+	},
+}
+
+// addColumnIfMissing adds a column to an existing table unless it's already there
+func addColumnIfMissing(ctx context.Context, tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, colType    string
+			defaultValue     sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+func (db *SQLiteClient) appliedMigrations(ctx context.Context) (map[int]time.Time, error) {
+	_, err := db.db.ExecContext(ctx, `
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+        version INTEGER PRIMARY KEY,
+        description TEXT NOT NULL,
+        appliedAt INTEGER NOT NULL
+    );
+    `)
+	if err != nil {
+		return nil, fmt.Errorf("error creating schema_migrations table: %v", err)
+	}
+
+	rows, err := db.db.QueryContext(ctx, "SELECT version, appliedAt FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("error reading schema_migrations: %v", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("error reading schema_migrations: %v", err)
+		}
+		applied[version] = fromMillis(appliedAt)
+	}
+
+	return applied, rows.Err()
+}
+
+func (db *SQLiteClient) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := db.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]Migration, len(sqliteMigrations))
+	for i, migration := range sqliteMigrations {
+		migrations[i] = migration.Migration
+	}
+
+	return migrationStatuses(migrations, applied), nil
+}
+
+// Migrate applies the pending migrations in order, each in its own
+// transaction, and returns them.
+func (db *SQLiteClient) Migrate(ctx context.Context) ([]Migration, error) {
+	applied, err := db.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrated []Migration
+	for _, migration := range sqliteMigrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+
+		if err := db.applyMigration(ctx, migration); err != nil {
+			return migrated, fmt.Errorf("migration %d (%s) failed: %v", migration.Version, migration.Description, err)
+		}
+		migrated = append(migrated, migration.Migration)
+	}
+
+	return migrated, nil
+}
+
+func (db *SQLiteClient) applyMigration(ctx context.Context, migration sqliteMigration) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := migration.up(ctx, tx); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, description, appliedAt) VALUES (?, ?, ?)",
+		migration.Version, migration.Description, toMillis(time.Now()))
+	if err != nil {
+		return fmt.Errorf("error recording migration: %v", err)
+	}
+
+	return tx.Commit()
+}
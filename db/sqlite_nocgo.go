@@ -0,0 +1,17 @@
+//go:build !cgo
+
+package db
+
+import "fmt"
+
+// defaultDBType is the database used unless DB_TYPE is set. SQLite needs cgo,
+// builds without it use the KV store.
+const defaultDBType = "kv"
+
+type SQLiteClient struct {
+	DBClient
+}
+
+func NewSQLiteClient(dataSourceName string) (*SQLiteClient, error) {
+	return nil, fmt.Errorf("SQLite isn't supported by builds without cgo, use DB_TYPE=kv instead")
+}
@@ -0,0 +1,33 @@
+//go:build cgo
+
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+// newTestSQLiteClient returns a client of a new, migrated SQLite database.
+func newTestSQLiteClient(tb testing.TB) *SQLiteClient {
+	dbClient, err := NewSQLiteClient(filepath.Join(tb.TempDir(), "db.sqlite3"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { dbClient.Close() })
+
+	if _, err := dbClient.Migrate(context.Background()); err != nil {
+		tb.Fatal(err)
+	}
+	return dbClient
+}
+
+func BenchmarkSQLiteGetCouples(b *testing.B) {
+	benchmarkGetCouples(b, newTestSQLiteClient(b))
+}
+
+func TestSQLiteClientConformance(t *testing.T) {
+	testDBClient(t, func(t *testing.T) DBClient {
+		return newTestSQLiteClient(t)
+	})
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/service"
+	"song-recognition/shazam"
+	"song-recognition/utils"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+const (
+	maxUploadSize   = 200 << 20 // bytes
+	maxSampleSize   = 10 << 20  // bytes, of the recordings to recognize
+	defaultPageSize = 50
+)
+
+// Error codes of the HTTP layer, in addition to the service ones
+const (
+	codeMethodNotAllowed = "method_not_allowed"
+	codeTimeout          = "timeout"
+	codeShuttingDown     = "shutting_down"
+)
+
+// apiError is the body of error responses.
+type apiError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func registerAPIHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/recognize", withTimeout(handleAPIRecognize))
+	mux.HandleFunc("/api/v1/songs", withTimeout(handleAPISongs))
+	mux.HandleFunc("/api/v1/songs/", withTimeout(handleAPISong))
+	mux.HandleFunc("/api/v1/ingest", withTimeout(handleAPIIngest))
+	mux.HandleFunc("/api/v1/jobs", withTimeout(handleAPIJobs))
+	mux.HandleFunc("/api/v1/jobs/", withTimeout(handleAPIJob))
+	mux.HandleFunc("/api/v1/stats", withTimeout(handleAPIStats))
+}
+
+// envSeconds returns the duration set in seconds by the environment variable
+// key, or fallback seconds if it isn't set to a positive number.
+func envSeconds(key string, fallback int) time.Duration {
+	seconds, err := strconv.Atoi(utils.GetEnv(key))
+	if err != nil || seconds < 1 {
+		seconds = fallback
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// requestTimeout is the deadline of the API requests and of the socket
+// events, set in seconds by REQUEST_TIMEOUT_SECONDS.
+func requestTimeout() time.Duration {
+	return envSeconds("REQUEST_TIMEOUT_SECONDS", 60)
+}
+
+// withTimeout cancels the context of the requests after the request timeout.
+// Their context is also canceled when the client goes away. Requests are
+// tracked in apiRequests, and refused once the server shuts down.
+func withTimeout(handler http.HandlerFunc) http.HandlerFunc {
+	timeout := requestTimeout()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !apiRequests.Add() {
+			writeAPIError(w, http.StatusServiceUnavailable, codeShuttingDown, "the server is shutting down")
+			return
+		}
+		defer apiRequests.Done()
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logger := utils.GetLogger()
+		err := xerrors.New(err)
+		logger.ErrorContext(context.Background(), "failed to write response.", slog.Any("error", err))
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	var body apiError
+	body.Error.Code = code
+	body.Error.Message = message
+	writeJSON(w, status, body)
+}
+
+// writeServiceError writes an error returned by the service layer, with the
+// HTTP status matching its code. Errors of requests that timed out are
+// reported as such, whatever the service returned.
+func writeServiceError(w http.ResponseWriter, r *http.Request, err error) {
+	switch r.Context().Err() {
+	case context.DeadlineExceeded:
+		writeAPIError(w, http.StatusGatewayTimeout, codeTimeout, "the request timed out")
+		return
+	case context.Canceled:
+		return // the client went away
+	}
+
+	code := service.ErrorCode(err)
+
+	status := http.StatusInternalServerError
+	switch code {
+	case service.CodeInvalidRequest:
+		status = http.StatusBadRequest
+	case service.CodeNotFound:
+		status = http.StatusNotFound
+	case service.CodeAlreadyExists:
+		status = http.StatusConflict
+	case service.CodeUpstream:
+		status = http.StatusBadGateway
+	}
+
+	if status == http.StatusInternalServerError || status == http.StatusBadGateway {
+		logServiceError(err)
+	}
+
+	writeAPIError(w, status, code, service.ErrorMessage(err))
+}
+
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAPIError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed,
+		fmt.Sprintf("method %s not allowed", r.Method))
+	return false
+}
+
+// queryInt returns the integer query parameter key, or fallback if it isn't set.
+func queryInt(r *http.Request, key string, fallback int) (int, error) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return fallback, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %q", key, value)
+	}
+	return n, nil
+}
+
+// saveUpload saves the file of a multipart form field to the temporary directory.
+// The caller must remove the returned file.
+func saveUpload(r *http.Request, field string) (string, error) {
+	file, header, err := r.FormFile(field)
+	if err != nil {
+		return "", fmt.Errorf("missing %s file: %v", field, err)
+	}
+	defer file.Close()
+
+	return copyUpload(file, header)
+}
+
+func copyUpload(file multipart.File, header *multipart.FileHeader) (string, error) {
+	tmpFile, err := os.CreateTemp(utils.TempDir, "upload-*"+filepath.Ext(header.Filename))
+	if err != nil {
+		return "", err
+	}
+	defer tmpFile.Close()
+
+	if _, err := io.Copy(tmpFile, file); err != nil {
+		os.Remove(tmpFile.Name())
+		return "", err
+	}
+
+	return tmpFile.Name(), nil
+}
+
+// apiSong is a song in the API responses. The file it was ingested from is
+// internal to the server and left out.
+type apiSong struct {
+	ID                 uint32    `json:"id"`
+	Title              string    `json:"title"`
+	Artist             string    `json:"artist"`
+	YouTubeID          string    `json:"youtubeID"`
+	FingerprintVersion int       `json:"fingerprintVersion"`
+	Album              string    `json:"album"`
+	Artists            []string  `json:"artists"`
+	Duration           float64   `json:"duration"` // in seconds
+	ISRC               string    `json:"isrc"`
+	SpotifyID          string    `json:"spotifyID"`
+	ContentHash        string    `json:"contentHash"`
+	IngestedAt         time.Time `json:"ingestedAt"`
+	SourceType         string    `json:"sourceType"`
+}
+
+func newAPISong(song db.Song) apiSong {
+	return apiSong{
+		ID:                 song.ID,
+		Title:              song.Title,
+		Artist:             song.Artist,
+		YouTubeID:          song.YouTubeID,
+		FingerprintVersion: song.FingerprintVersion,
+		Album:              song.Album,
+		Artists:            song.Artists,
+		Duration:           song.Duration,
+		ISRC:               song.ISRC,
+		SpotifyID:          song.SpotifyID,
+		ContentHash:        song.ContentHash,
+		IngestedAt:         song.IngestedAt,
+		SourceType:         song.SourceType,
+	}
+}
+
+// apiMatch is a match in the API responses.
+type apiMatch struct {
+	SongID      uint32    `json:"songID"`
+	SongTitle   string    `json:"songTitle"`
+	SongArtist  string    `json:"songArtist"`
+	YouTubeID   string    `json:"youtubeID"`
+	Album       string    `json:"album"`
+	Artists     []string  `json:"artists"`
+	Duration    float64   `json:"duration"` // in seconds
+	ISRC        string    `json:"isrc"`
+	SpotifyID   string    `json:"spotifyID"`
+	ContentHash string    `json:"contentHash"`
+	IngestedAt  time.Time `json:"ingestedAt"`
+	SourceType  string    `json:"sourceType"`
+	Timestamp   uint32    `json:"timestamp"` // in milliseconds
+	Score       float64   `json:"score"`
+	Confidence  float64   `json:"confidence"`
+}
+
+func newAPIMatches(matches []shazam.Match) []apiMatch {
+	apiMatches := make([]apiMatch, 0, len(matches))
+	for _, match := range matches {
+		apiMatches = append(apiMatches, apiMatch{
+			SongID:      match.SongID,
+			SongTitle:   match.SongTitle,
+			SongArtist:  match.SongArtist,
+			YouTubeID:   match.YouTubeID,
+			Album:       match.Album,
+			Artists:     match.Artists,
+			Duration:    match.Duration,
+			ISRC:        match.ISRC,
+			SpotifyID:   match.SpotifyID,
+			ContentHash: match.ContentHash,
+			IngestedAt:  match.IngestedAt,
+			SourceType:  match.SourceType,
+			Timestamp:   match.Timestamp,
+			Score:       match.Score,
+			Confidence:  match.Confidence,
+		})
+	}
+	return apiMatches
+}
+
+type recognizeResponse struct {
+	Matches []apiMatch `json:"matches"`
+}
+
+// handleAPIRecognize recognizes either an audio file uploaded as the audio field
+// of a multipart form, or raw little-endian PCM described by the sampleRate,
+// channels and bitsPerSample query parameters (44100 Hz, mono, 16 bits by default).
+// Recordings are limited to maxSampleSize bytes, the PCM being decoded as it is read.
+func handleAPIRecognize(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSampleSize)
+
+	var matches []shazam.Match
+	var err error
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		filePath, uploadErr := saveUpload(r, "audio")
+		if uploadErr != nil {
+			writeAPIError(w, http.StatusBadRequest, service.CodeInvalidRequest, uploadErr.Error())
+			return
+		}
+		defer os.Remove(filePath)
+
+		matches, err = songService.RecognizeFile(r.Context(), filePath)
+	} else {
+		sampleRate, qErr := queryInt(r, "sampleRate", 44100)
+		channels, cErr := queryInt(r, "channels", 1)
+		bitsPerSample, bErr := queryInt(r, "bitsPerSample", 16)
+		for _, e := range []error{qErr, cErr, bErr} {
+			if e != nil {
+				writeAPIError(w, http.StatusBadRequest, service.CodeInvalidRequest, e.Error())
+				return
+			}
+		}
+
+		matches, err = songService.RecognizePCM(r.Context(), r.Body, sampleRate, channels, bitsPerSample)
+	}
+
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, recognizeResponse{Matches: newAPIMatches(matches)})
+}
+
+type songsResponse struct {
+	Songs  []apiSong `json:"songs"`
+	Total  int       `json:"total"`
+	Offset int       `json:"offset"`
+	Limit  int       `json:"limit"`
+}
+
+// handleAPISongs lists songs, paginated with the offset and limit query parameters.
+func handleAPISongs(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, service.CodeInvalidRequest, err.Error())
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultPageSize)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, service.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	page, err := songService.ListSongs(r.Context(), offset, limit)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+
+	songs := make([]apiSong, 0, len(page.Songs))
+	for _, song := range page.Songs {
+		songs = append(songs, newAPISong(song))
+	}
+	writeJSON(w, http.StatusOK, songsResponse{Songs: songs, Total: page.Total, Offset: page.Offset, Limit: page.Limit})
+}
+
+// handleAPISong gets or deletes the song /api/v1/songs/{id}.
+func handleAPISong(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+
+	idParam := strings.TrimPrefix(r.URL.Path, "/api/v1/songs/")
+	songID, err := strconv.ParseUint(idParam, 10, 32)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, service.CodeInvalidRequest, fmt.Sprintf("invalid song ID: %q", idParam))
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := songService.DeleteSong(r.Context(), uint32(songID)); err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	song, err := songService.GetSong(r.Context(), uint32(songID))
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAPISong(song))
+}
+
+type ingestRequest struct {
+	SpotifyURL string `json:"spotifyURL"`
+}
+
+type songResponse struct {
+	Song apiSong `json:"song"`
+}
+
+type jobResponse struct {
+	Job models.Job `json:"job"`
+}
+
+// handleAPIIngest queues a job downloading the songs of a Spotify URL sent as
+// JSON, or saves an audio file uploaded as the audio field of a multipart form.
+// Uploaded files may come with title and artist fields, their tags are used
+// otherwise; they are saved without a YouTube ID unless requireYouTubeID is set.
+func handleAPIIngest(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		filePath, err := saveUpload(r, "audio")
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, service.CodeInvalidRequest, err.Error())
+			return
+		}
+		defer os.Remove(filePath)
+
+		force := r.FormValue("requireYouTubeID") != "true"
+		song, err := songService.SaveSong(r.Context(), filePath, r.FormValue("title"), r.FormValue("artist"), force)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, songResponse{Song: newAPISong(song)})
+		return
+	}
+
+	var request ingestRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.SpotifyURL == "" {
+		writeAPIError(w, http.StatusBadRequest, service.CodeInvalidRequest,
+			"expected a JSON body with a spotifyURL or a multipart form with an audio file")
+		return
+	}
+
+	job, err := songService.EnqueueSpotify(r.Context(), request.SpotifyURL)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, jobResponse{Job: job})
+}
+
+type jobsResponse struct {
+	Jobs []models.Job `json:"jobs"`
+}
+
+// handleAPIJobs lists the ingestion jobs, only the unfinished ones if the
+// unfinished query parameter is true.
+func handleAPIJobs(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	jobs, err := songService.ListJobs(r.Context(), r.URL.Query().Get("unfinished") == "true")
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, jobsResponse{Jobs: jobs})
+}
+
+// handleAPIJob gets the job /api/v1/jobs/{id}, or cancels or retries it with
+// POST /api/v1/jobs/{id}/cancel and /api/v1/jobs/{id}/retry.
+func handleAPIJob(w http.ResponseWriter, r *http.Request) {
+	idParam, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/jobs/"), "/")
+
+	switch action {
+	case "":
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+	case "cancel", "retry":
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+	default:
+		writeAPIError(w, http.StatusNotFound, service.CodeNotFound, fmt.Sprintf("unknown job action: %q", action))
+		return
+	}
+
+	jobID, err := strconv.ParseUint(idParam, 10, 32)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, service.CodeInvalidRequest, fmt.Sprintf("invalid job ID: %q", idParam))
+		return
+	}
+
+	var job models.Job
+	switch action {
+	case "cancel":
+		job, err = songService.CancelJob(r.Context(), uint32(jobID))
+	case "retry":
+		job, err = songService.RetryJob(r.Context(), uint32(jobID))
+	default:
+		job, err = songService.GetJob(r.Context(), uint32(jobID))
+	}
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, jobResponse{Job: job})
+}
+
+func handleAPIStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	stats, err := songService.Stats(r.Context())
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
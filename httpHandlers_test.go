@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"song-recognition/db"
+	"song-recognition/service"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAPI serves the API with songService backed by an empty KV store.
+// The working directory is a temporary directory, where uploads are saved.
+func newTestAPI(t *testing.T) (*http.ServeMux, db.DBClient) {
+	t.Helper()
+
+	dir := t.TempDir()
+	dbClient, err := db.NewKVClient(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbClient.Close() })
+	if _, err := dbClient.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := songService
+	songService = service.New(filepath.Join(dir, "songs"), dbClient)
+	t.Cleanup(func() { songService = previous })
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	if err := os.Mkdir("tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	registerAPIHandlers(mux)
+	return mux, dbClient
+}
+
+// multipartBody returns a multipart form with the file content as field.
+func multipartBody(t *testing.T, field, fileName string, content []byte) (*bytes.Buffer, string) {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if field != "" {
+		part, err := form.CreateFormFile(field, fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(content)
+	}
+	if err := form.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &body, form.FormDataContentType()
+}
+
+// doRequest sends a request to mux and decodes the JSON response into out, if not nil.
+func doRequest(t *testing.T, mux http.Handler, r *http.Request, wantStatus int, out interface{}) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+
+	if w.Code != wantStatus {
+		t.Fatalf("%s %s: got status %d, want %d: %s", r.Method, r.URL, w.Code, wantStatus, w.Body)
+	}
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: invalid JSON response %q: %v", r.Method, r.URL, w.Body, err)
+		}
+	}
+}
+
+func TestAPIRecognize(t *testing.T) {
+	mux, _ := newTestAPI(t)
+
+	// An empty database has no match for a second of silence
+	pcm := make([]byte, 44100*2)
+	var response recognizeResponse
+	doRequest(t, mux, httptest.NewRequest(http.MethodPost, "/api/v1/recognize", bytes.NewReader(pcm)), http.StatusOK, &response)
+	if response.Matches == nil || len(response.Matches) != 0 {
+		t.Fatalf("got matches %v, want an empty list", response.Matches)
+	}
+}
+
+func TestAPIRecognizeErrors(t *testing.T) {
+	mux, _ := newTestAPI(t)
+
+	invalidWAV := []byte("RIFF\x04\x00\x00\x00WAVE")
+
+	tests := []struct {
+		name       string
+		request    func() *http.Request
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "GET",
+			request:    func() *http.Request { return httptest.NewRequest(http.MethodGet, "/api/v1/recognize", nil) },
+			wantStatus: http.StatusMethodNotAllowed,
+			wantCode:   codeMethodNotAllowed,
+		},
+		{
+			name: "form without audio",
+			request: func() *http.Request {
+				body, contentType := multipartBody(t, "", "", nil)
+				r := httptest.NewRequest(http.MethodPost, "/api/v1/recognize", body)
+				r.Header.Set("Content-Type", contentType)
+				return r
+			},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   service.CodeInvalidRequest,
+		},
+		{
+			name: "invalid audio file",
+			request: func() *http.Request {
+				body, contentType := multipartBody(t, "audio", "recording.wav", invalidWAV)
+				r := httptest.NewRequest(http.MethodPost, "/api/v1/recognize", body)
+				r.Header.Set("Content-Type", contentType)
+				return r
+			},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   service.CodeInvalidRequest,
+		},
+		{
+			name: "invalid query parameter",
+			request: func() *http.Request {
+				return httptest.NewRequest(http.MethodPost, "/api/v1/recognize?sampleRate=fast", strings.NewReader("\x00\x00"))
+			},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   service.CodeInvalidRequest,
+		},
+		{
+			name: "invalid sample rate",
+			request: func() *http.Request {
+				return httptest.NewRequest(http.MethodPost, "/api/v1/recognize?sampleRate=0", strings.NewReader("\x00\x00"))
+			},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   service.CodeInvalidRequest,
+		},
+		{
+			name: "incomplete PCM sample",
+			request: func() *http.Request {
+				return httptest.NewRequest(http.MethodPost, "/api/v1/recognize", strings.NewReader("\x00\x00\x00"))
+			},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   service.CodeInvalidRequest,
+		},
+		{
+			name: "recording too large",
+			request: func() *http.Request {
+				return httptest.NewRequest(http.MethodPost, "/api/v1/recognize", bytes.NewReader(make([]byte, maxSampleSize+2)))
+			},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   service.CodeInvalidRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var response apiError
+			doRequest(t, mux, tt.request(), tt.wantStatus, &response)
+			if response.Error.Code != tt.wantCode || response.Error.Message == "" {
+				t.Fatalf("got error %+v, want code %s", response.Error, tt.wantCode)
+			}
+		})
+	}
+
+	// Uploads are removed once recognized
+	entries, err := os.ReadDir("tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("got %d files left in tmp", len(entries))
+	}
+}
+
+func TestAPISong(t *testing.T) {
+	mux, dbClient := newTestAPI(t)
+
+	song := db.Song{ID: 7, Title: "Title", Artist: "Artist", SourcePath: "/server/songs/title.wav", IngestedAt: time.Now()}
+	if err := dbClient.RegisterSong(context.Background(), song, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Songs are sent with camelCase fields, without the path of their file
+	var got map[string]interface{}
+	doRequest(t, mux, httptest.NewRequest(http.MethodGet, "/api/v1/songs/7", nil), http.StatusOK, &got)
+	if got["id"] != 7.0 || got["title"] != "Title" || got["artist"] != "Artist" {
+		t.Fatalf("got %v, want song 7", got)
+	}
+	for key, value := range got {
+		if value == song.SourcePath {
+			t.Fatalf("got the source path of the song in %q", key)
+		}
+	}
+
+	var page songsResponse
+	doRequest(t, mux, httptest.NewRequest(http.MethodGet, "/api/v1/songs", nil), http.StatusOK, &page)
+	if len(page.Songs) != 1 || page.Songs[0].ID != 7 || page.Total != 1 {
+		t.Fatalf("got %+v, want a single song", page)
+	}
+
+	doRequest(t, mux, httptest.NewRequest(http.MethodDelete, "/api/v1/songs/7", nil), http.StatusNoContent, nil)
+	doRequest(t, mux, httptest.NewRequest(http.MethodGet, "/api/v1/songs/7", nil), http.StatusNotFound, nil)
+	doRequest(t, mux, httptest.NewRequest(http.MethodGet, "/api/v1/songs/seven", nil), http.StatusBadRequest, nil)
+	doRequest(t, mux, httptest.NewRequest(http.MethodGet, "/api/v1/songs?limit=many", nil), http.StatusBadRequest, nil)
+	doRequest(t, mux, httptest.NewRequest(http.MethodPut, "/api/v1/songs/7", nil), http.StatusMethodNotAllowed, nil)
+}
+
+func TestAPIJob(t *testing.T) {
+	mux, _ := newTestAPI(t)
+
+	doRequest(t, mux, httptest.NewRequest(http.MethodGet, "/api/v1/jobs/1", nil), http.StatusNotFound, nil)
+	doRequest(t, mux, httptest.NewRequest(http.MethodGet, "/api/v1/jobs/one", nil), http.StatusBadRequest, nil)
+	doRequest(t, mux, httptest.NewRequest(http.MethodPost, "/api/v1/jobs/1/pause", nil), http.StatusNotFound, nil)
+	doRequest(t, mux, httptest.NewRequest(http.MethodGet, "/api/v1/jobs/1/cancel", nil), http.StatusMethodNotAllowed, nil)
+
+	var response jobsResponse
+	doRequest(t, mux, httptest.NewRequest(http.MethodGet, "/api/v1/jobs", nil), http.StatusOK, &response)
+	if len(response.Jobs) != 0 {
+		t.Fatalf("got jobs %+v, want none", response.Jobs)
+	}
+}
+
+func TestAPIIngestErrors(t *testing.T) {
+	mux, _ := newTestAPI(t)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/ingest", strings.NewReader(`{"spotifyURL": ""}`))
+	doRequest(t, mux, r, http.StatusBadRequest, nil)
+
+	r = httptest.NewRequest(http.MethodPost, "/api/v1/ingest", strings.NewReader(`{"spotifyURL": "https://example.com"}`))
+	doRequest(t, mux, r, http.StatusBadRequest, nil)
+}
+
+func TestWriteServiceError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		ctxErr     bool
+		wantStatus int
+		wantCode   string
+	}{
+		{"invalid request", &service.Error{Code: service.CodeInvalidRequest, Message: "bad"}, false, http.StatusBadRequest, service.CodeInvalidRequest},
+		{"not found", &service.Error{Code: service.CodeNotFound, Message: "missing"}, false, http.StatusNotFound, service.CodeNotFound},
+		{"already exists", &service.Error{Code: service.CodeAlreadyExists, Message: "dup"}, false, http.StatusConflict, service.CodeAlreadyExists},
+		{"upstream", &service.Error{Code: service.CodeUpstream, Message: "down"}, false, http.StatusBadGateway, service.CodeUpstream},
+		{"internal", &service.Error{Code: service.CodeInternal, Message: "oops"}, false, http.StatusInternalServerError, service.CodeInternal},
+		{"not a service error", context.Canceled, false, http.StatusInternalServerError, service.CodeInternal},
+		{"timed out", &service.Error{Code: service.CodeInvalidRequest, Message: "bad"}, true, http.StatusGatewayTimeout, codeTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.ctxErr {
+				ctx, cancel := context.WithDeadline(r.Context(), time.Now())
+				defer cancel()
+				r = r.WithContext(ctx)
+			}
+
+			w := httptest.NewRecorder()
+			writeServiceError(w, r, tt.err)
+
+			var response apiError
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != tt.wantStatus || response.Error.Code != tt.wantCode {
+				t.Fatalf("got %d %+v, want %d %s", w.Code, response.Error, tt.wantStatus, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,382 @@
+// Package jobs processes the ingestion jobs stored in the DB: the tracks of a
+// job are downloaded from YouTube and fingerprinted in the background, by a
+// limited number of workers, and retried with backoff when they fail.
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/spotify"
+	"song-recognition/utils"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mdobak/go-xerrors"
+)
+
+const pollInterval = 5 * time.Second
+
+// ProgressFunc receives a track of a job each time its state changes.
+type ProgressFunc func(job models.Job, track models.JobTrack)
+
+// trackRef identifies a track of a job.
+type trackRef struct {
+	jobID uint32
+	index int
+}
+
+// Queue runs the tracks of the unfinished jobs.
+type Queue struct {
+	SongsDir    string
+	DB          db.DBClient
+	Workers     int           // number of tracks processed at the same time
+	MaxAttempts int           // attempts before a track fails
+	Backoff     time.Duration // delay before the first retry, doubled on each attempt
+	Timeout     time.Duration // deadline of an attempt, after which it fails
+	OnProgress  ProgressFunc
+
+	notify   chan struct{}
+	mu       sync.Mutex
+	inFlight map[trackRef]bool
+	workers  sync.WaitGroup     // tracks being processed
+	closing  chan struct{}      // closed by Shutdown
+	cancel   context.CancelFunc // cancels the tracks being processed
+}
+
+// NewQueue returns a queue configured by the JOB_WORKERS, JOB_MAX_ATTEMPTS,
+// JOB_BACKOFF_SECONDS and JOB_TIMEOUT_SECONDS environment variables.
+func NewQueue(songsDir string, dbClient db.DBClient) *Queue {
+	return &Queue{
+		SongsDir:    songsDir,
+		DB:          dbClient,
+		Workers:     envInt("JOB_WORKERS", 4),
+		MaxAttempts: envInt("JOB_MAX_ATTEMPTS", 3),
+		Backoff:     time.Duration(envInt("JOB_BACKOFF_SECONDS", 30)) * time.Second,
+		Timeout:     time.Duration(envInt("JOB_TIMEOUT_SECONDS", 600)) * time.Second,
+		notify:      make(chan struct{}, 1),
+		inFlight:    make(map[trackRef]bool),
+		closing:     make(chan struct{}),
+	}
+}
+
+func envInt(key string, fallback int) int {
+	n, err := strconv.Atoi(utils.GetEnv(key))
+	if err != nil || n < 1 {
+		return fallback
+	}
+	return n
+}
+
+// Notify wakes the queue up, e.g. after a job was created or retried. Without
+// it, new tracks are picked up at the next poll.
+func (q *Queue) Notify() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run processes the queued tracks until ctx is done, which cancels the tracks
+// in progress, or Shutdown is called. Tracks left in progress by a previous
+// run are queued again first.
+func (q *Queue) Run(ctx context.Context) {
+	logger := utils.GetLogger()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	q.mu.Lock()
+	q.cancel = cancel
+	q.mu.Unlock()
+
+	if err := q.requeueInterrupted(ctx); err != nil {
+		logger.ErrorContext(ctx, "failed to requeue interrupted tracks", slog.Any("error", xerrors.New(err)))
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := q.dispatch(ctx); err != nil {
+			logger.ErrorContext(ctx, "failed to dispatch job tracks", slog.Any("error", xerrors.New(err)))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-q.notify:
+		case <-ctx.Done():
+			return
+		case <-q.closing:
+			// Returning would cancel the tracks in progress, which Shutdown
+			// waits for and cancels once its deadline is over
+			<-ctx.Done()
+			return
+		}
+	}
+}
+
+// Shutdown stops dispatching tracks and waits for the tracks in progress. If
+// ctx is done first, they're canceled and left in progress, to be queued
+// again on the next run, and ctx's error is returned.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	select {
+	case <-q.closing:
+	default:
+		close(q.closing)
+	}
+	cancel := q.cancel
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		if cancel != nil {
+			cancel()
+		}
+		<-done
+		return ctx.Err()
+	}
+}
+
+// InFlight reports whether a track is being processed by a worker.
+func (q *Queue) InFlight(jobID uint32, index int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.inFlight[trackRef{jobID, index}]
+}
+
+// requeueInterrupted queues the tracks left in progress by a previous run
+// again. Those of canceled jobs are marked canceled, which their worker
+// would have done at its next step.
+func (q *Queue) requeueInterrupted(ctx context.Context) error {
+	jobs, err := q.DB.ListJobs(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		for _, track := range job.Tracks {
+			if !track.InProgress() {
+				continue
+			}
+			track.State = models.TrackQueued
+			if job.Canceled {
+				track.State = models.TrackCanceled
+			}
+			track.UpdatedAt = time.Now()
+			if err := q.DB.UpdateJobTrack(ctx, job.ID, track); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// dispatch starts a worker for each runnable track, as long as workers are free.
+func (q *Queue) dispatch(ctx context.Context) error {
+	jobs, err := q.DB.ListJobs(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	select {
+	case <-q.closing:
+		return nil
+	default:
+	}
+
+	for _, job := range jobs {
+		if job.Canceled {
+			continue
+		}
+		for _, track := range job.Tracks {
+			if len(q.inFlight) >= q.Workers {
+				return nil
+			}
+
+			ref := trackRef{job.ID, track.Index}
+			if track.State != models.TrackQueued || track.NextAttemptAt.After(now) || q.inFlight[ref] {
+				continue
+			}
+
+			q.inFlight[ref] = true
+			q.workers.Add(1)
+			go func(jobID uint32, track models.JobTrack) {
+				defer q.workers.Done()
+				q.process(ctx, jobID, track)
+
+				q.mu.Lock()
+				delete(q.inFlight, ref)
+				q.mu.Unlock()
+				q.Notify()
+			}(job.ID, track)
+		}
+	}
+
+	return nil
+}
+
+// errCanceled stops the processing of a track whose job was canceled.
+var errCanceled = fmt.Errorf("job canceled")
+
+func (q *Queue) process(ctx context.Context, jobID uint32, track models.JobTrack) {
+	logger := utils.GetLogger()
+
+	trackCtx, cancel := context.WithTimeout(ctx, q.Timeout)
+	err := q.runTrack(trackCtx, jobID, &track)
+	cancel()
+
+	// The track is left in progress, it's queued again on the next run
+	if ctx.Err() != nil {
+		return
+	}
+
+	switch {
+	case err == errCanceled:
+		track.Error = ""
+		err = q.setState(ctx, jobID, &track, models.TrackCanceled)
+	case err != nil:
+		logMessage := fmt.Sprintf("'%s' by '%s' failed", track.Title, track.Artist)
+		logger.ErrorContext(ctx, logMessage, slog.Any("error", xerrors.New(err)))
+		err = q.fail(ctx, jobID, &track, err)
+	default:
+		track.Error = ""
+		err = q.setState(ctx, jobID, &track, models.TrackDone)
+	}
+
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to update job track", slog.Any("error", xerrors.New(err)))
+	}
+}
+
+// runTrack downloads and fingerprints a track, checking between the steps
+// that its job wasn't canceled.
+func (q *Queue) runTrack(ctx context.Context, jobID uint32, track *models.JobTrack) error {
+	spotifyTrack := spotify.Track{
+		Title:    track.Title,
+		Artist:   track.Artist,
+		Album:    track.Album,
+		Artists:  track.Artists,
+		Duration: track.Duration,
+		ID:       track.SpotifyID,
+	}
+
+	_, songExists, err := q.DB.GetSongByKey(ctx, utils.GenerateSongKey(track.Title, track.Artist))
+	if err != nil {
+		return err
+	}
+	if songExists {
+		return nil
+	}
+
+	if err := q.advance(ctx, jobID, track, models.TrackResolving); err != nil {
+		return err
+	}
+	ytID, err := spotify.ResolveYouTubeID(ctx, q.DB, spotifyTrack)
+	if err != nil {
+		return err
+	}
+
+	if err := q.advance(ctx, jobID, track, models.TrackDownloading); err != nil {
+		return err
+	}
+	filePath, err := spotify.DownloadTrack(ctx, spotifyTrack, ytID, q.SongsDir)
+	if err != nil {
+		return err
+	}
+
+	if err := q.advance(ctx, jobID, track, models.TrackFingerprinting); err != nil {
+		utils.DeleteFile(filePath)
+		return err
+	}
+	if err := spotify.SaveTrack(ctx, q.DB, spotifyTrack, filePath, ytID); err != nil {
+		utils.DeleteFile(filePath)
+		return err
+	}
+	return nil
+}
+
+// advance moves a track to its next state, unless its job was canceled.
+func (q *Queue) advance(ctx context.Context, jobID uint32, track *models.JobTrack, state string) error {
+	canceled, err := q.jobCanceled(ctx, jobID)
+	if err != nil {
+		return err
+	}
+	if canceled {
+		return errCanceled
+	}
+
+	return q.setState(ctx, jobID, track, state)
+}
+
+func (q *Queue) jobCanceled(ctx context.Context, jobID uint32) (bool, error) {
+	job, jobExists, err := q.DB.GetJob(ctx, jobID)
+	if err != nil {
+		return false, err
+	}
+	return !jobExists || job.Canceled, nil
+}
+
+// fail queues a failed track again after a backoff, or marks it failed once
+// it ran out of attempts. Tracks of jobs canceled while they were processed
+// are marked canceled instead of being queued again.
+func (q *Queue) fail(ctx context.Context, jobID uint32, track *models.JobTrack, cause error) error {
+	track.Attempts++
+	track.Error = cause.Error()
+
+	if track.Attempts >= q.MaxAttempts {
+		return q.setState(ctx, jobID, track, models.TrackFailed)
+	}
+
+	canceled, err := q.jobCanceled(ctx, jobID)
+	if err != nil {
+		return err
+	}
+	if canceled {
+		return q.setState(ctx, jobID, track, models.TrackCanceled)
+	}
+
+	backoff := q.Backoff * time.Duration(math.Pow(2, float64(track.Attempts-1)))
+	track.NextAttemptAt = time.Now().Add(backoff)
+	return q.setState(ctx, jobID, track, models.TrackQueued)
+}
+
+func (q *Queue) setState(ctx context.Context, jobID uint32, track *models.JobTrack, state string) error {
+	track.State = state
+	track.UpdatedAt = time.Now()
+
+	if err := q.DB.UpdateJobTrack(ctx, jobID, *track); err != nil {
+		return err
+	}
+
+	if q.OnProgress != nil {
+		job, jobExists, err := q.DB.GetJob(ctx, jobID)
+		if err != nil {
+			return err
+		}
+		if jobExists {
+			q.OnProgress(job, *track)
+		}
+	}
+
+	return nil
+}
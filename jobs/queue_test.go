@@ -0,0 +1,145 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"song-recognition/db"
+	"song-recognition/models"
+	"testing"
+	"time"
+)
+
+func newTestQueue(t *testing.T) *Queue {
+	t.Helper()
+
+	dbClient, err := db.NewKVClient(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbClient.Close() })
+
+	q := NewQueue(t.TempDir(), dbClient)
+	q.MaxAttempts = 3
+	q.Backoff = time.Minute
+	return q
+}
+
+func createJob(t *testing.T, q *Queue, jobID uint32, canceled bool, states ...string) {
+	t.Helper()
+
+	job := models.Job{ID: jobID, Canceled: canceled, CreatedAt: time.Now()}
+	for i, state := range states {
+		job.Tracks = append(job.Tracks, models.JobTrack{Index: i, Title: "Title", Artist: "Artist", State: state})
+	}
+	if err := q.DB.CreateJob(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func trackStates(t *testing.T, q *Queue, jobID uint32) []string {
+	t.Helper()
+
+	job, _, err := q.DB.GetJob(context.Background(), jobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var states []string
+	for _, track := range job.Tracks {
+		states = append(states, track.State)
+	}
+	return states
+}
+
+func assertStates(t *testing.T, got []string, want ...string) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("got states %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got states %v, want %v", got, want)
+		}
+	}
+}
+
+func TestRequeueInterrupted(t *testing.T) {
+	q := newTestQueue(t)
+	createJob(t, q, 1, false, models.TrackDownloading, models.TrackQueued, models.TrackDone, models.TrackFingerprinting)
+	createJob(t, q, 2, true, models.TrackResolving, models.TrackCanceled)
+
+	if err := q.requeueInterrupted(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	assertStates(t, trackStates(t, q, 1), models.TrackQueued, models.TrackQueued, models.TrackDone, models.TrackQueued)
+	// Tracks of canceled jobs are never dispatched, they mustn't stay queued
+	assertStates(t, trackStates(t, q, 2), models.TrackCanceled, models.TrackCanceled)
+}
+
+func TestFail(t *testing.T) {
+	q := newTestQueue(t)
+	ctx := context.Background()
+	createJob(t, q, 1, false, models.TrackDownloading)
+	createJob(t, q, 2, true, models.TrackDownloading)
+
+	// Queued again after a backoff
+	track := models.JobTrack{Index: 0, Title: "Title", Artist: "Artist", State: models.TrackDownloading}
+	if err := q.fail(ctx, 1, &track, errors.New("network error")); err != nil {
+		t.Fatal(err)
+	}
+	if track.State != models.TrackQueued || track.Attempts != 1 || time.Until(track.NextAttemptAt) < 59*time.Second {
+		t.Fatalf("got %+v, want a track queued again in a minute", track)
+	}
+
+	// The backoff doubles, until the attempts run out
+	track.State = models.TrackDownloading
+	if err := q.fail(ctx, 1, &track, errors.New("network error")); err != nil {
+		t.Fatal(err)
+	}
+	if track.State != models.TrackQueued || time.Until(track.NextAttemptAt) < 119*time.Second {
+		t.Fatalf("got %+v, want a track queued again in two minutes", track)
+	}
+	if err := q.fail(ctx, 1, &track, errors.New("network error")); err != nil {
+		t.Fatal(err)
+	}
+	assertStates(t, trackStates(t, q, 1), models.TrackFailed)
+
+	// Tracks of jobs canceled while they were processed aren't queued again
+	track = models.JobTrack{Index: 0, Title: "Title", Artist: "Artist", State: models.TrackDownloading}
+	if err := q.fail(ctx, 2, &track, errors.New("network error")); err != nil {
+		t.Fatal(err)
+	}
+	assertStates(t, trackStates(t, q, 2), models.TrackCanceled)
+}
+
+func TestAdvanceStopsCanceledJobs(t *testing.T) {
+	q := newTestQueue(t)
+	ctx := context.Background()
+	createJob(t, q, 1, false, models.TrackQueued)
+
+	track := models.JobTrack{Index: 0, State: models.TrackQueued}
+	if err := q.advance(ctx, 1, &track, models.TrackResolving); err != nil {
+		t.Fatal(err)
+	}
+	assertStates(t, trackStates(t, q, 1), models.TrackResolving)
+
+	if err := q.DB.SetJobCanceled(ctx, 1, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.advance(ctx, 1, &track, models.TrackDownloading); err != errCanceled {
+		t.Fatalf("got %v, want errCanceled", err)
+	}
+	if err := q.advance(ctx, 7, &track, models.TrackDownloading); err != errCanceled {
+		t.Fatalf("got %v for a deleted job, want errCanceled", err)
+	}
+}
+
+func TestInFlight(t *testing.T) {
+	q := newTestQueue(t)
+	q.inFlight[trackRef{1, 2}] = true
+
+	if !q.InFlight(1, 2) || q.InFlight(1, 1) || q.InFlight(2, 2) {
+		t.Fatal("got the wrong tracks in flight")
+	}
+}
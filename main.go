@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"song-recognition/service"
 	"song-recognition/utils"
+	"strings"
 
 	"github.com/mdobak/go-xerrors"
 )
@@ -30,10 +32,18 @@ func main() {
 	}
 
 	if len(os.Args) < 2 {
-		fmt.Println("Expected 'find', 'download', 'erase', 'save', or 'serve' subcommands")
+		fmt.Println("Expected 'find', 'download', 'erase', 'save', 'reindex', 'songs', 'jobs', 'db', 'migrate', or 'serve' subcommands")
 		os.Exit(1)
 	}
 
+	// serve migrates the database before connecting, and migrate doesn't
+	// need an up to date schema
+	switch os.Args[1] {
+	case "find", "download", "erase", "reindex", "save", "songs", "db", "jobs":
+		dbClient := openDB()
+		defer dbClient.Close()
+	}
+
 	switch os.Args[1] {
 	case "find":
 		if len(os.Args) < 3 {
@@ -53,10 +63,16 @@ func main() {
 		serveCmd := flag.NewFlagSet("serve", flag.ExitOnError)
 		protocol := serveCmd.String("proto", "http", "Protocol to use (http or https)")
 		port := serveCmd.String("p", "5005", "Port to use")
+		memIndex := serveCmd.Bool("mem-index", false, "load the fingerprints in memory to look up recordings")
 		serveCmd.Parse(os.Args[2:])
-		serve(*protocol, *port)
+		serve(*protocol, *port, *memIndex)
 	case "erase":
 		erase(SONGS_DIR)
+	case "reindex":
+		reindexCmd := flag.NewFlagSet("reindex", flag.ExitOnError)
+		deleteFailed := reindexCmd.Bool("delete-failed", false, "delete the songs that can't be reindexed")
+		reindexCmd.Parse(os.Args[2:])
+		reindex(SONGS_DIR, *deleteFailed)
 	case "save":
 		indexCmd := flag.NewFlagSet("save", flag.ExitOnError)
 		force := indexCmd.Bool("force", false, "save song with or without YouTube ID")
@@ -68,8 +84,155 @@ func main() {
 		}
 		filePath := indexCmd.Arg(0)
 		save(filePath, *force)
+	case "songs":
+		songsCommand(os.Args[2:])
+	case "migrate":
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: main.go migrate up|status")
+			os.Exit(1)
+		}
+		switch os.Args[2] {
+		case "up":
+			if err := migrate(); err != nil {
+				yellow.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		case "status":
+			migrationStatus()
+		default:
+			fmt.Println("Usage: main.go migrate up|status")
+			os.Exit(1)
+		}
+	case "db":
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: main.go db gc [-dry-run] | check-ids [-repair]")
+			os.Exit(1)
+		}
+		switch os.Args[2] {
+		case "gc":
+			gcCmd := flag.NewFlagSet("db gc", flag.ExitOnError)
+			dryRun := gcCmd.Bool("dry-run", false, "only count the orphaned couples")
+			gcCmd.Parse(os.Args[3:])
+			gc(*dryRun)
+		case "check-ids":
+			checkCmd := flag.NewFlagSet("db check-ids", flag.ExitOnError)
+			repair := checkCmd.Bool("repair", false, "register the songs sharing their ID again under a new ID")
+			checkCmd.Parse(os.Args[3:])
+			checkSongIDs(*repair)
+		default:
+			fmt.Println("Expected 'gc' or 'check-ids' db subcommands")
+			os.Exit(1)
+		}
+	case "jobs":
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: main.go jobs list [-unfinished] | status <job_id> | cancel <job_id> | retry <job_id>")
+			os.Exit(1)
+		}
+		switch os.Args[2] {
+		case "list":
+			listCmd := flag.NewFlagSet("jobs list", flag.ExitOnError)
+			unfinished := listCmd.Bool("unfinished", false, "only list jobs with tracks left to process")
+			listCmd.Parse(os.Args[3:])
+			listJobs(*unfinished)
+		case "status", "cancel", "retry":
+			if len(os.Args) < 4 {
+				fmt.Printf("Usage: main.go jobs %s <job_id>\n", os.Args[2])
+				os.Exit(1)
+			}
+			jobCommand(os.Args[2], os.Args[3])
+		default:
+			fmt.Println("Expected 'list', 'status', 'cancel', or 'retry' jobs subcommands")
+			os.Exit(1)
+		}
+	default:
+		fmt.Println("Expected 'find', 'download', 'erase', 'save', 'reindex', 'songs', 'jobs', 'db', 'migrate', or 'serve' subcommands")
+		os.Exit(1)
+	}
+}
+
+const songsUsage = `Usage:
+  main.go songs list [-search <text>] [-artist <artist>] [-sort id|title|artist] [-desc] [-limit <n>] [-json]
+  main.go songs show [-json] <song_id|song_key>
+  main.go songs delete [-keep-file] <song_id|song_key>
+  main.go songs update <song_id|song_key> [-title <title>] [-artist <artist>] [-ytid <youtube_id>]`
+
+func songsCommand(args []string) {
+	if len(args) < 1 {
+		fmt.Println(songsUsage)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "list":
+		listCmd := flag.NewFlagSet("songs list", flag.ExitOnError)
+		var filter service.SongFilter
+		listCmd.StringVar(&filter.Search, "search", "", "only list songs whose title or artist contains this text")
+		listCmd.StringVar(&filter.Artist, "artist", "", "only list songs of this artist")
+		listCmd.StringVar(&filter.SortBy, "sort", service.SortByID, "sort songs by id, title or artist")
+		listCmd.BoolVar(&filter.Desc, "desc", false, "sort in descending order")
+		listCmd.IntVar(&filter.Limit, "limit", 0, "maximum number of songs to list")
+		asJSON := listCmd.Bool("json", false, "print songs as JSON")
+		listCmd.Parse(args[1:])
+		listSongs(filter, *asJSON)
+
+	case "show":
+		showCmd := flag.NewFlagSet("songs show", flag.ExitOnError)
+		asJSON := showCmd.Bool("json", false, "print the song as JSON")
+		ref := parseWithArg(showCmd, args[1:])
+		if ref == "" {
+			fmt.Println(songsUsage)
+			os.Exit(1)
+		}
+		showSong(ref, *asJSON)
+
+	case "delete":
+		deleteCmd := flag.NewFlagSet("songs delete", flag.ExitOnError)
+		keepFile := deleteCmd.Bool("keep-file", false, "keep the WAV file of the song")
+		ref := parseWithArg(deleteCmd, args[1:])
+		if ref == "" {
+			fmt.Println(songsUsage)
+			os.Exit(1)
+		}
+		deleteSong(ref, *keepFile)
+
+	case "update":
+		updateCmd := flag.NewFlagSet("songs update", flag.ExitOnError)
+		title := updateCmd.String("title", "", "new title")
+		artist := updateCmd.String("artist", "", "new artist")
+		ytID := updateCmd.String("ytid", "", "new YouTube ID")
+		ref := parseWithArg(updateCmd, args[1:])
+
+		var update service.SongUpdate
+		updateCmd.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "title":
+				update.Title = title
+			case "artist":
+				update.Artist = artist
+			case "ytid":
+				update.YouTubeID = ytID
+			}
+		})
+		if ref == "" || (update.Title == nil && update.Artist == nil && update.YouTubeID == nil) {
+			fmt.Println(songsUsage)
+			os.Exit(1)
+		}
+		updateSong(ref, update)
+
 	default:
-		fmt.Println("Expected 'find', 'download', 'erase', 'save', or 'serve' subcommands")
+		fmt.Println(songsUsage)
 		os.Exit(1)
 	}
 }
+
+// parseWithArg parses the flags of a subcommand taking a single argument,
+// which may come before or after the flags, and returns the argument.
+func parseWithArg(flagSet *flag.FlagSet, args []string) string {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		flagSet.Parse(args[1:])
+		return args[0]
+	}
+
+	flagSet.Parse(args)
+	return flagSet.Arg(0)
+}
@@ -0,0 +1,73 @@
+package models
+
+import "time"
+
+// States of a track of an ingestion job. A track goes through the states in
+// this order; failed attempts go back to queued until the retries run out.
+const (
+	TrackQueued         = "queued"
+	TrackResolving      = "resolving" // looking up the YouTube ID
+	TrackDownloading    = "downloading"
+	TrackFingerprinting = "fingerprinting"
+	TrackDone           = "done"
+	TrackFailed         = "failed"
+	TrackCanceled       = "canceled"
+)
+
+// Job is an ingestion job: the tracks of a Spotify track, album or playlist
+// URL, downloaded and fingerprinted in the background.
+type Job struct {
+	ID        uint32     `json:"id"`
+	Source    string     `json:"source"` // the Spotify URL
+	Canceled  bool       `json:"canceled"`
+	CreatedAt time.Time  `json:"createdAt"`
+	Tracks    []JobTrack `json:"tracks"`
+}
+
+// JobTrack is a track of an ingestion job.
+type JobTrack struct {
+	Index         int       `json:"index"` // position of the track in the job
+	Title         string    `json:"title"`
+	Artist        string    `json:"artist"`
+	Album         string    `json:"album"`
+	Artists       []string  `json:"artists"`
+	SpotifyID     string    `json:"spotifyID"`
+	Duration      int       `json:"duration"` // in seconds
+	State         string    `json:"state"`
+	Error         string    `json:"error,omitempty"` // reason of the last failure
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt time.Time `json:"nextAttemptAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+// Finished reports whether the track won't be processed anymore.
+func (t JobTrack) Finished() bool {
+	return t.State == TrackDone || t.State == TrackFailed || t.State == TrackCanceled
+}
+
+// InProgress reports whether a worker was processing the track when it was
+// last updated.
+func (t JobTrack) InProgress() bool {
+	return t.State == TrackResolving || t.State == TrackDownloading || t.State == TrackFingerprinting
+}
+
+// Finished reports whether every track of the job is finished.
+func (j Job) Finished() bool {
+	for _, track := range j.Tracks {
+		if !track.Finished() {
+			return false
+		}
+	}
+	return true
+}
+
+// Count returns the number of tracks of the job in the given state.
+func (j Job) Count(state string) int {
+	count := 0
+	for _, track := range j.Tracks {
+		if track.State == state {
+			count++
+		}
+	}
+	return count
+}
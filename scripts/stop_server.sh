@@ -1,13 +1,29 @@
 #!/usr/bin/env bash
 
-HTTP_PID=$(sudo lsof -t -i:5005)
-HTTPS_PID=$(sudo lsof -t -i:4443)
+# The server shuts down gracefully on SIGTERM, within SHUTDOWN_TIMEOUT_SECONDS
+# (30 by default). It is only killed if it's still running after that.
+WAIT_SECONDS=40
 
+PIDS=$(sudo lsof -t -i:5005 -i:4443 | sort -u)
 
-if [ -n "$HTTP_PID" ]; then
-  sudo kill -9 $HTTP_PID
+if [ -z "$PIDS" ]; then
+  exit 0
 fi
 
-if [ -n "$HTTPS_PID" ]; then
-  sudo kill -9 $HTTPS_PID
-fi
+sudo kill -TERM $PIDS
+
+for _ in $(seq $WAIT_SECONDS); do
+  RUNNING=""
+  for PID in $PIDS; do
+    if sudo kill -0 $PID 2>/dev/null; then
+      RUNNING="$RUNNING $PID"
+    fi
+  done
+
+  if [ -z "$RUNNING" ]; then
+    exit 0
+  fi
+  sleep 1
+done
+
+sudo kill -9 $RUNNING
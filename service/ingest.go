@@ -0,0 +1,182 @@
+package service
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/spotify"
+	"song-recognition/utils"
+	"song-recognition/wav"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// spotifyError wraps an error of the Spotify API. Short errors are meant for
+// users (e.g. "invalid playlist URL"), longer ones are replaced by message.
+func spotifyError(err error, message string) *Error {
+	if len(err.Error()) <= 25 {
+		return newError(CodeUpstream, err, "%s", err.Error())
+	}
+	return newError(CodeUpstream, err, "%s", message)
+}
+
+// EnqueueSpotify creates a job downloading, fingerprinting and saving the songs
+// of a Spotify track, album or playlist URL. The job is processed in the
+// background by the queue of the server.
+func (s *Service) EnqueueSpotify(ctx context.Context, spotifyURL string) (models.Job, error) {
+	var tracks []spotify.Track
+
+	switch {
+	case strings.Contains(spotifyURL, "album"):
+		tracksInAlbum, err := spotify.AlbumInfo(ctx, spotifyURL)
+		if err != nil {
+			return models.Job{}, spotifyError(err, "error getting album info")
+		}
+		tracks = tracksInAlbum
+
+	case strings.Contains(spotifyURL, "playlist"):
+		tracksInPL, err := spotify.PlaylistInfo(ctx, spotifyURL)
+		if err != nil {
+			return models.Job{}, spotifyError(err, "error getting playlist info")
+		}
+		tracks = tracksInPL
+
+	case strings.Contains(spotifyURL, "track"):
+		trackInfo, err := spotify.TrackInfo(ctx, spotifyURL)
+		if err != nil {
+			return models.Job{}, spotifyError(err, "error getting track info")
+		}
+
+		// check if track already exist
+		song, songExists, err := s.DB.GetSongByKey(ctx, utils.GenerateSongKey(trackInfo.Title, trackInfo.Artist))
+		if err != nil {
+			return models.Job{}, newError(CodeInternal, err, "failed to get song by key")
+		}
+		if songExists {
+			return models.Job{}, newError(CodeAlreadyExists, nil,
+				"'%s' by '%s' already exists in the database (https://www.youtube.com/watch?v=%s)",
+				song.Title, song.Artist, song.YouTubeID)
+		}
+		tracks = []spotify.Track{*trackInfo}
+
+	default:
+		return models.Job{}, newError(CodeInvalidRequest, nil, "not a Spotify track, album or playlist URL")
+	}
+
+	if len(tracks) == 0 {
+		return models.Job{}, newError(CodeInvalidRequest, nil, "no tracks found")
+	}
+
+	jobID, err := s.DB.NextJobID(ctx)
+	if err != nil {
+		return models.Job{}, newError(CodeInternal, err, "failed to allocate job ID")
+	}
+
+	job := models.Job{
+		ID:        jobID,
+		Source:    spotifyURL,
+		CreatedAt: time.Now(),
+		Tracks:    make([]models.JobTrack, len(tracks)),
+	}
+	for i, track := range tracks {
+		job.Tracks[i] = models.JobTrack{
+			Index:     i,
+			Title:     track.Title,
+			Artist:    track.Artist,
+			Album:     track.Album,
+			Artists:   track.Artists,
+			SpotifyID: track.ID,
+			Duration:  track.Duration,
+			State:     models.TrackQueued,
+			UpdatedAt: job.CreatedAt,
+		}
+	}
+
+	if err := s.DB.CreateJob(ctx, job); err != nil {
+		return models.Job{}, newError(CodeInternal, err, "failed to create job")
+	}
+
+	if s.Queue != nil {
+		s.Queue.Notify()
+	}
+
+	return job, nil
+}
+
+// SaveSong fingerprints and saves an audio file, then moves it in WAV format
+// to the songs directory. The title and artist are read from the file's tags,
+// unless they are given. Unless force is set, songs without a YouTube ID
+// aren't saved. The saved song is returned.
+func (s *Service) SaveSong(ctx context.Context, filePath, title, artist string, force bool) (db.Song, error) {
+	metadata, err := wav.GetMetadata(ctx, filePath)
+	if err != nil {
+		return db.Song{}, newError(CodeInvalidRequest, err, "failed to read metadata")
+	}
+
+	durationFloat, err := strconv.ParseFloat(metadata.Format.Duration, 64)
+	if err != nil {
+		return db.Song{}, newError(CodeInvalidRequest, err, "failed to parse duration to float")
+	}
+
+	tags := metadata.Format.Tags
+	track := &spotify.Track{
+		Album:    tags["album"],
+		Artist:   tags["artist"],
+		Title:    tags["title"],
+		Duration: int(math.Round(durationFloat)),
+	}
+	if title != "" {
+		track.Title = title
+	}
+	if artist != "" {
+		track.Artist = artist
+	}
+
+	if track.Title == "" {
+		return db.Song{}, newError(CodeInvalidRequest, nil, "no title found in metadata")
+	}
+	if track.Artist == "" {
+		return db.Song{}, newError(CodeInvalidRequest, nil, "no artist found in metadata")
+	}
+
+	ytID, err := spotify.GetYoutubeId(ctx, *track)
+	if err != nil && !force {
+		return db.Song{}, newError(CodeUpstream, err, "failed to get YouTube ID for song")
+	}
+
+	song, err := spotify.ProcessAndSaveSong(ctx, s.DB, filePath, db.Song{
+		Title:      track.Title,
+		Artist:     track.Artist,
+		YouTubeID:  ytID,
+		Album:      track.Album,
+		Duration:   durationFloat,
+		ISRC:       tags["isrc"],
+		SourceType: db.SourceLocal,
+	})
+	if err != nil {
+		return db.Song{}, newError(CodeInternal, err, "failed to process or save song")
+	}
+
+	// Move song in wav format to songs directory
+	fileName := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+	wavFile := fileName + ".wav"
+	sourcePath := filepath.Join(filepath.Dir(filePath), wavFile)
+
+	// The title and artist may not come from the tags, reindex needs them in the WAV file
+	err = wav.WriteTags(sourcePath, map[string]string{"title": track.Title, "artist": track.Artist, "album": track.Album})
+	if err != nil {
+		return db.Song{}, newError(CodeInternal, err, "failed to tag song")
+	}
+
+	newFilePath := filepath.Join(s.SongsDir, wavFile)
+	err = os.Rename(sourcePath, newFilePath)
+	if err != nil {
+		return db.Song{}, newError(CodeInternal, err, "failed to rename temporary file to output file")
+	}
+
+	return song, nil
+}
@@ -0,0 +1,122 @@
+package service
+
+import (
+	"context"
+	"song-recognition/models"
+	"time"
+)
+
+// ListJobs returns the ingestion jobs, oldest first. With unfinishedOnly, only
+// the jobs with tracks left to process are returned.
+func (s *Service) ListJobs(ctx context.Context, unfinishedOnly bool) ([]models.Job, error) {
+	jobs, err := s.DB.ListJobs(ctx, unfinishedOnly)
+	if err != nil {
+		return nil, newError(CodeInternal, err, "failed to list jobs")
+	}
+
+	return jobs, nil
+}
+
+func (s *Service) GetJob(ctx context.Context, jobID uint32) (models.Job, error) {
+	job, jobExists, err := s.DB.GetJob(ctx, jobID)
+	if err != nil {
+		return models.Job{}, newError(CodeInternal, err, "failed to get job")
+	}
+	if !jobExists {
+		return models.Job{}, newError(CodeNotFound, nil, "job %d not found", jobID)
+	}
+
+	return job, nil
+}
+
+// processing reports whether a track is being processed. Such a track is
+// marked canceled by its worker, at its next step, when its job is canceled.
+func (s *Service) processing(jobID uint32, track models.JobTrack) bool {
+	if s.Queue != nil {
+		return s.Queue.InFlight(jobID, track.Index)
+	}
+	// The tracks are processed by another program
+	return track.InProgress()
+}
+
+// CancelJob cancels the tracks of a job that aren't finished. A track being
+// processed stops after its current step, and is marked canceled then.
+func (s *Service) CancelJob(ctx context.Context, jobID uint32) (models.Job, error) {
+	job, err := s.GetJob(ctx, jobID)
+	if err != nil {
+		return models.Job{}, err
+	}
+
+	if err := s.DB.SetJobCanceled(ctx, jobID, true); err != nil {
+		return models.Job{}, newError(CodeInternal, err, "failed to cancel job")
+	}
+
+	job.Canceled = true
+	for i, track := range job.Tracks {
+		if track.Finished() || s.processing(jobID, track) {
+			continue
+		}
+		track.State = models.TrackCanceled
+		track.UpdatedAt = time.Now()
+		if err := s.DB.UpdateJobTrack(ctx, jobID, track); err != nil {
+			return models.Job{}, newError(CodeInternal, err, "failed to cancel job")
+		}
+		job.Tracks[i] = track
+	}
+
+	return job, nil
+}
+
+// RetryJob queues the failed and canceled tracks of a job again, with their
+// attempts reset. Tracks still being processed aren't queued, so that they
+// can't be processed twice, the retry is refused if there are only such tracks.
+func (s *Service) RetryJob(ctx context.Context, jobID uint32) (models.Job, error) {
+	job, err := s.GetJob(ctx, jobID)
+	if err != nil {
+		return models.Job{}, err
+	}
+
+	if job.Count(models.TrackFailed)+job.Count(models.TrackCanceled) == 0 {
+		return models.Job{}, newError(CodeInvalidRequest, nil, "job %d has no failed or canceled tracks", jobID)
+	}
+
+	retriable := func(track models.JobTrack) bool {
+		return (track.State == models.TrackFailed || track.State == models.TrackCanceled) && !s.processing(jobID, track)
+	}
+	count := 0
+	for _, track := range job.Tracks {
+		if retriable(track) {
+			count++
+		}
+	}
+	if count == 0 {
+		return models.Job{}, newError(CodeInvalidRequest, nil,
+			"the tracks of job %d are still being stopped, retry once they are", jobID)
+	}
+
+	if err := s.DB.SetJobCanceled(ctx, jobID, false); err != nil {
+		return models.Job{}, newError(CodeInternal, err, "failed to retry job")
+	}
+
+	job.Canceled = false
+	for i, track := range job.Tracks {
+		if !retriable(track) {
+			continue
+		}
+		track.State = models.TrackQueued
+		track.Error = ""
+		track.Attempts = 0
+		track.NextAttemptAt = time.Time{}
+		track.UpdatedAt = time.Now()
+		if err := s.DB.UpdateJobTrack(ctx, jobID, track); err != nil {
+			return models.Job{}, newError(CodeInternal, err, "failed to retry job")
+		}
+		job.Tracks[i] = track
+	}
+
+	if s.Queue != nil {
+		s.Queue.Notify()
+	}
+
+	return job, nil
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"context"
+	"song-recognition/db"
+	"song-recognition/models"
+	"testing"
+	"time"
+)
+
+func newTestService(t *testing.T) *Service {
+	t.Helper()
+
+	dbClient, err := db.NewKVClient(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbClient.Close() })
+
+	return New(t.TempDir(), dbClient)
+}
+
+func TestCancelAndRetryJob(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+
+	job := models.Job{ID: 1, CreatedAt: time.Now(), Tracks: []models.JobTrack{
+		{Index: 0, State: models.TrackDone},
+		{Index: 1, State: models.TrackQueued},
+		{Index: 2, State: models.TrackDownloading}, // being processed by the worker of another program
+		{Index: 3, State: models.TrackFailed, Attempts: 3, Error: "not found"},
+	}}
+	if err := s.DB.CreateJob(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := s.CancelJob(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantStates := []string{models.TrackDone, models.TrackCanceled, models.TrackDownloading, models.TrackFailed}
+	assertTrackStates(t, job, wantStates...)
+	assertStoredTrackStates(t, s, 1, wantStates...)
+
+	// The track being processed isn't queued again, its worker still runs
+	job, err = s.RetryJob(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantStates = []string{models.TrackDone, models.TrackQueued, models.TrackDownloading, models.TrackQueued}
+	assertTrackStates(t, job, wantStates...)
+	assertStoredTrackStates(t, s, 1, wantStates...)
+	if job.Canceled || job.Tracks[3].Attempts != 0 || job.Tracks[3].Error != "" {
+		t.Fatalf("got %+v, want a job no longer canceled with the attempts reset", job)
+	}
+
+	if _, err := s.RetryJob(ctx, 1); ErrorCode(err) != CodeInvalidRequest {
+		t.Fatalf("got %v, want an invalid request without failed or canceled tracks", err)
+	}
+	if _, err := s.CancelJob(ctx, 2); ErrorCode(err) != CodeNotFound {
+		t.Fatalf("got %v, want a missing job", err)
+	}
+}
+
+func assertTrackStates(t *testing.T, job models.Job, want ...string) {
+	t.Helper()
+
+	for i, track := range job.Tracks {
+		if track.State != want[i] {
+			t.Fatalf("track %d: got state %s, want %s", i, track.State, want[i])
+		}
+	}
+}
+
+func assertStoredTrackStates(t *testing.T, s *Service, jobID uint32, want ...string) {
+	t.Helper()
+
+	job, err := s.GetJob(context.Background(), jobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTrackStates(t, job, want...)
+}
@@ -0,0 +1,294 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"song-recognition/db"
+	"song-recognition/spotify"
+	"song-recognition/utils"
+	"song-recognition/wav"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Fields songs can be sorted by
+const (
+	SortByID     = "id"
+	SortByTitle  = "title"
+	SortByArtist = "artist"
+)
+
+// SongFilter selects and orders the songs returned by FindSongs.
+type SongFilter struct {
+	Search string // case-insensitive text contained in the title or the artist
+	Artist string // case-insensitive artist
+	SortBy string // one of the SortBy constants, SortByID by default
+	Desc   bool
+	Limit  int // no limit if 0
+}
+
+// SongDetails is a song with the information shown to curators.
+type SongDetails struct {
+	db.Song
+	Fingerprints int    `json:"fingerprints"`
+	FilePath     string `json:"filePath,omitempty"` // WAV file in the songs directory, if found
+}
+
+// SongUpdate holds the fields of a song to change; nil fields are kept.
+type SongUpdate struct {
+	Title     *string
+	Artist    *string
+	YouTubeID *string
+}
+
+// FindSongs returns the songs matching a filter.
+func (s *Service) FindSongs(ctx context.Context, filter SongFilter) ([]db.Song, error) {
+	sortBy := filter.SortBy
+	if sortBy == "" {
+		sortBy = SortByID
+	}
+	if sortBy != SortByID && sortBy != SortByTitle && sortBy != SortByArtist {
+		return nil, newError(CodeInvalidRequest, nil, "can't sort songs by %q", sortBy)
+	}
+
+	search := strings.ToLower(filter.Search)
+	artist := strings.ToLower(filter.Artist)
+
+	songs := []db.Song{}
+	for offset := 0; ; offset += MaxPageSize {
+		page, err := s.DB.ListSongs(ctx, offset, MaxPageSize)
+		if err != nil {
+			return nil, newError(CodeInternal, err, "error listing songs")
+		}
+
+		for _, song := range page {
+			if artist != "" && strings.ToLower(song.Artist) != artist {
+				continue
+			}
+			if search != "" && !strings.Contains(strings.ToLower(song.Title), search) &&
+				!strings.Contains(strings.ToLower(song.Artist), search) {
+				continue
+			}
+			songs = append(songs, song)
+		}
+
+		if len(page) < MaxPageSize {
+			break
+		}
+	}
+
+	sort.SliceStable(songs, func(i, j int) bool {
+		a, b := songs[i], songs[j]
+		if filter.Desc {
+			a, b = b, a
+		}
+		switch sortBy {
+		case SortByTitle:
+			return strings.ToLower(a.Title) < strings.ToLower(b.Title)
+		case SortByArtist:
+			return strings.ToLower(a.Artist) < strings.ToLower(b.Artist)
+		}
+		return a.ID < b.ID
+	})
+
+	if filter.Limit > 0 && len(songs) > filter.Limit {
+		songs = songs[:filter.Limit]
+	}
+
+	return songs, nil
+}
+
+// ResolveSong returns the song identified by ref, either its ID or its key
+// ("title---artist").
+func (s *Service) ResolveSong(ctx context.Context, ref string) (db.Song, error) {
+	if songID, err := strconv.ParseUint(ref, 10, 32); err == nil {
+		return s.GetSong(ctx, uint32(songID))
+	}
+
+	song, songExists, err := s.DB.GetSongByKey(ctx, ref)
+	if err != nil {
+		return db.Song{}, newError(CodeInternal, err, "error getting song")
+	}
+	if !songExists {
+		return db.Song{}, newError(CodeNotFound, nil, "song %q doesn't exist", ref)
+	}
+
+	return song, nil
+}
+
+// ShowSong returns a song with its number of fingerprints and its WAV file.
+func (s *Service) ShowSong(ctx context.Context, songID uint32) (SongDetails, error) {
+	song, err := s.GetSong(ctx, songID)
+	if err != nil {
+		return SongDetails{}, err
+	}
+
+	fingerprints, err := s.DB.CountFingerprints(ctx, songID)
+	if err != nil {
+		return SongDetails{}, newError(CodeInternal, err, "error counting fingerprints")
+	}
+
+	filePath, err := s.SongFile(ctx, song)
+	if err != nil {
+		return SongDetails{}, err
+	}
+
+	return SongDetails{Song: song, Fingerprints: fingerprints, FilePath: filePath}, nil
+}
+
+// SongFile returns the WAV file of a song in the songs directory, found by
+// its title and artist tags like reindex does. It returns "" if there is none.
+func (s *Service) SongFile(ctx context.Context, song db.Song) (string, error) {
+	// The file is usually the one the song was ingested from or named after
+	// it, the songs directory is only scanned if it isn't.
+	for _, path := range s.songFileCandidates(song) {
+		if isSongFile(ctx, path, song) {
+			return path, nil
+		}
+	}
+
+	var songFile string
+	err := filepath.Walk(s.SongsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != ".wav" {
+			return nil
+		}
+
+		if isSongFile(ctx, path, song) {
+			songFile = path
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return "", newError(CodeInternal, err, "error looking for the song file")
+	}
+
+	return songFile, nil
+}
+
+// songFileCandidates returns the paths the WAV file of a song is likely at:
+// its source path if it's in the songs directory, the WAV file with the name
+// of its source in the songs directory, and the file named after the song
+// like downloads are.
+func (s *Service) songFileCandidates(song db.Song) []string {
+	var candidates []string
+	if song.SourcePath != "" {
+		songsDir, err := filepath.Abs(s.SongsDir)
+		if err != nil {
+			songsDir = s.SongsDir
+		}
+		if rel, err := filepath.Rel(songsDir, song.SourcePath); err == nil && filepath.IsLocal(rel) {
+			candidates = append(candidates, filepath.Join(s.SongsDir, rel))
+		}
+		// Uploads are moved to the songs directory as WAV files
+		name := strings.TrimSuffix(filepath.Base(song.SourcePath), filepath.Ext(song.SourcePath))
+		candidates = append(candidates, filepath.Join(s.SongsDir, name+".wav"))
+	}
+	return append(candidates, filepath.Join(s.SongsDir, spotify.TrackFileName(song.Title, song.Artist)+".wav"))
+}
+
+// isSongFile reports whether path is a WAV file tagged with the title and
+// artist of song.
+func isSongFile(ctx context.Context, path string, song db.Song) bool {
+	if filepath.Ext(path) != ".wav" {
+		return false
+	}
+	metadata, err := wav.GetMetadata(ctx, path)
+	if err != nil {
+		return false
+	}
+	return metadata.Format.Tags["title"] == song.Title && metadata.Format.Tags["artist"] == song.Artist
+}
+
+// UpdateSong changes the title, artist or YouTube ID of a song. The tags of
+// its WAV file are updated too, so that reindex still finds the song.
+func (s *Service) UpdateSong(ctx context.Context, songID uint32, update SongUpdate) (db.Song, error) {
+	song, err := s.GetSong(ctx, songID)
+	if err != nil {
+		return db.Song{}, err
+	}
+
+	filePath, err := s.SongFile(ctx, song)
+	if err != nil {
+		return db.Song{}, err
+	}
+
+	if update.Title != nil {
+		song.Title = *update.Title
+	}
+	if update.Artist != nil {
+		song.Artist = *update.Artist
+	}
+	if update.YouTubeID != nil {
+		song.YouTubeID = *update.YouTubeID
+	}
+	if song.Title == "" || song.Artist == "" {
+		return db.Song{}, newError(CodeInvalidRequest, nil, "title and artist can't be empty")
+	}
+
+	other, songExists, err := s.DB.GetSongByKey(ctx, utils.GenerateSongKey(song.Title, song.Artist))
+	if err != nil {
+		return db.Song{}, newError(CodeInternal, err, "error getting song")
+	}
+	if songExists && other.ID != song.ID {
+		return db.Song{}, newError(CodeAlreadyExists, nil, "'%s' by '%s' already exists (song %d)",
+			song.Title, song.Artist, other.ID)
+	}
+
+	other, songExists, err = s.DB.GetSongByYTID(ctx, song.YouTubeID)
+	if err != nil {
+		return db.Song{}, newError(CodeInternal, err, "error getting song")
+	}
+	if songExists && other.ID != song.ID {
+		return db.Song{}, newError(CodeAlreadyExists, nil, "YouTube ID %s is already used by song %d",
+			song.YouTubeID, other.ID)
+	}
+
+	if err := s.DB.UpdateSong(ctx, song); err != nil {
+		return db.Song{}, newError(CodeInternal, err, "error updating song")
+	}
+
+	if filePath != "" {
+		tags := map[string]string{}
+		if metadata, err := wav.GetMetadata(ctx, filePath); err == nil && metadata.Format.Tags != nil {
+			tags = metadata.Format.Tags
+		}
+		tags["title"], tags["artist"] = song.Title, song.Artist
+
+		if err := wav.WriteTags(filePath, tags); err != nil {
+			return db.Song{}, newError(CodeInternal, err, "song updated but its file %s couldn't be tagged", filePath)
+		}
+	}
+
+	return song, nil
+}
+
+// DeleteSongAndFile deletes a song, its fingerprints and its WAV file.
+func (s *Service) DeleteSongAndFile(ctx context.Context, songID uint32) (string, error) {
+	song, err := s.GetSong(ctx, songID)
+	if err != nil {
+		return "", err
+	}
+
+	filePath, err := s.SongFile(ctx, song)
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.DeleteSong(ctx, songID); err != nil {
+		return "", err
+	}
+
+	if filePath != "" {
+		if err := os.Remove(filePath); err != nil {
+			return "", newError(CodeInternal, err, "song deleted but its file %s couldn't be removed", filePath)
+		}
+	}
+
+	return filePath, nil
+}
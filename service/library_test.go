@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"song-recognition/db"
+	"song-recognition/wav"
+	"testing"
+)
+
+func writeTaggedWav(t *testing.T, path, title, artist string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := wav.WriteWavFile(path, make([]byte, 4410), 44100, 1, 16); err != nil {
+		t.Fatal(err)
+	}
+	if err := wav.WriteTags(path, map[string]string{"title": title, "artist": artist}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSongFile(t *testing.T) {
+	ctx := context.Background()
+	s := newTestService(t)
+
+	named := filepath.Join(s.SongsDir, "Title - Artist.wav")
+	writeTaggedWav(t, named, "Title", "Artist")
+	uploaded := filepath.Join(s.SongsDir, "upload.wav")
+	writeTaggedWav(t, uploaded, "Uploaded", "Artist")
+	nested := filepath.Join(s.SongsDir, "album", "track.wav")
+	writeTaggedWav(t, nested, "Nested", "Artist")
+	// Named after a song, but tagged with another one
+	writeTaggedWav(t, filepath.Join(s.SongsDir, "Renamed - Artist.wav"), "Other", "Artist")
+
+	tests := []struct {
+		name string
+		song db.Song
+		want string
+	}{
+		{"named after the song", db.Song{Title: "Title", Artist: "Artist"}, named},
+		{"named after the source", db.Song{Title: "Uploaded", Artist: "Artist", SourcePath: "/tmp/upload.m4a"}, uploaded},
+		{"source in the songs directory", db.Song{Title: "Nested", Artist: "Artist", SourcePath: nested}, nested},
+		{"found by scanning", db.Song{Title: "Nested", Artist: "Artist"}, nested},
+		{"tagged with another song", db.Song{Title: "Renamed", Artist: "Artist"}, ""},
+		{"missing", db.Song{Title: "Missing", Artist: "Artist"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.SongFile(ctx, tt.song)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
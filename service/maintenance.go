@@ -0,0 +1,157 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"song-recognition/db"
+	"song-recognition/shazam"
+	"song-recognition/spotify"
+	"song-recognition/utils"
+	"song-recognition/wav"
+)
+
+// DeleteOrphanedCouples removes the fingerprint couples pointing at songs
+// that don't exist and returns how many there were. With dryRun, they are
+// only counted.
+func (s *Service) DeleteOrphanedCouples(ctx context.Context, dryRun bool) (int, error) {
+	if dryRun {
+		count, err := s.DB.CountOrphanedCouples(ctx)
+		if err != nil {
+			return 0, newError(CodeInternal, err, "error counting orphaned couples")
+		}
+		return count, nil
+	}
+
+	deleted, err := s.DB.DeleteOrphanedCouples(ctx)
+	if err != nil {
+		return 0, newError(CodeInternal, err, "error deleting orphaned couples")
+	}
+	return deleted, nil
+}
+
+// SongIDCheck compares the fingerprints stored under the ID of a song with
+// the ones of its WAV file. Songs used to get random IDs, and the
+// fingerprints of a song given the ID of another were stored before its
+// registration failed, so that both songs' fingerprints share the ID.
+type SongIDCheck struct {
+	Song     db.Song
+	FilePath string
+	Stored   int    // fingerprints stored under the song's ID
+	Expected int    // fingerprints of the song's WAV file
+	NewID    uint32 // ID of the song once repaired, 0 if it wasn't
+}
+
+// Duplicate tells whether fingerprints of another song share the song's ID.
+func (c SongIDCheck) Duplicate() bool {
+	return c.Stored > c.Expected
+}
+
+// CheckSongIDs checks the songs whose WAV file is in the songs directory and
+// were fingerprinted with the current version; the other songs are returned
+// as unchecked. With repair, songs sharing their ID are registered again
+// under a new ID, which deletes the fingerprints of the other song.
+func (s *Service) CheckSongIDs(ctx context.Context, repair bool) (checks []SongIDCheck, unchecked []db.Song, err error) {
+	songs, err := s.FindSongs(ctx, SongFilter{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files, err := s.songFiles(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, song := range songs {
+		filePath, ok := files[utils.GenerateSongKey(song.Title, song.Artist)]
+		if !ok || song.FingerprintVersion != shazam.FingerprintVersion {
+			unchecked = append(unchecked, song)
+			continue
+		}
+
+		check := SongIDCheck{Song: song, FilePath: filePath}
+
+		check.Stored, err = s.DB.CountFingerprints(ctx, song.ID)
+		if err != nil {
+			return nil, nil, newError(CodeInternal, err, "error counting fingerprints")
+		}
+
+		check.Expected, err = countFingerprints(ctx, filePath, song.ID)
+		if err != nil {
+			return nil, nil, newError(CodeInternal, err, "error fingerprinting %s", filePath)
+		}
+
+		if repair && check.Duplicate() {
+			check.NewID, err = reregisterSong(ctx, s.DB, song, filePath)
+			if err != nil {
+				return nil, nil, newError(CodeInternal, err, "error repairing song %d", song.ID)
+			}
+		}
+
+		checks = append(checks, check)
+	}
+
+	return checks, unchecked, nil
+}
+
+// songFiles returns the WAV files in the songs directory by song key, read
+// from their title and artist tags.
+func (s *Service) songFiles(ctx context.Context) (map[string]string, error) {
+	files := map[string]string{}
+
+	err := filepath.Walk(s.SongsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != ".wav" {
+			return nil
+		}
+
+		metadata, err := wav.GetMetadata(ctx, path)
+		if err != nil {
+			return nil
+		}
+		title, artist := metadata.Format.Tags["title"], metadata.Format.Tags["artist"]
+		if title != "" && artist != "" {
+			files[utils.GenerateSongKey(title, artist)] = path
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, newError(CodeInternal, err, "error looking for song files")
+	}
+
+	return files, nil
+}
+
+// countFingerprints returns the number of couples of a WAV file
+func countFingerprints(ctx context.Context, filePath string, songID uint32) (int, error) {
+	reader, err := wav.OpenReader(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	fingerprints, err := shazam.FingerprintStream(ctx, reader, reader.SampleRate, reader.NumSamples(), songID)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, couples := range fingerprints {
+		count += len(couples)
+	}
+	return count, nil
+}
+
+// reregisterSong saves a song again from its WAV file under a new ID, which
+// deletes all the fingerprints stored under its old ID. The song is only
+// deleted once it's registered under the new ID.
+func reregisterSong(ctx context.Context, dbClient db.DBClient, song db.Song, filePath string) (uint32, error) {
+	// Songs fingerprinted with different versions can't be matched together
+	if err := shazam.CheckIndexVersion(ctx, dbClient); err != nil {
+		return 0, err
+	}
+
+	return spotify.ReplaceSongFile(ctx, dbClient, filePath, song)
+}
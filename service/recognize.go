@@ -0,0 +1,84 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"song-recognition/models"
+	"song-recognition/shazam"
+	"song-recognition/utils"
+	"song-recognition/wav"
+)
+
+// maxMatches is the number of matches reported for a recognition
+const maxMatches = 10
+
+// acceptedMatches returns the best matches satisfying the decision rule.
+func acceptedMatches(matches []shazam.Match) []shazam.Match {
+	accepted := shazam.DefaultDecisionRule().Filter(matches)
+	if len(accepted) > maxMatches {
+		accepted = accepted[:maxMatches]
+	}
+	return accepted
+}
+
+// RecognizeRecording recognizes a recording sent by the client, as base64 PCM.
+func (s *Service) RecognizeRecording(ctx context.Context, recData *models.RecordData) ([]shazam.Match, error) {
+	samples, err := utils.ProcessRecording(ctx, recData, true)
+	if err != nil {
+		// Recordings can't be processed once ctx is done, they aren't invalid
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if errors.Is(err, utils.ErrInvalidRecording) {
+			return nil, newError(CodeInvalidRequest, err, "invalid recording")
+		}
+		return nil, newError(CodeInternal, err, "failed to process recording")
+	}
+
+	matches, _, err := shazam.FindMatches(ctx, s.DB, samples, recData.Duration, recData.SampleRate)
+	if err != nil {
+		return nil, newError(CodeInternal, err, "failed to get matches")
+	}
+
+	return acceptedMatches(matches), nil
+}
+
+// RecognizePCM recognizes raw little-endian PCM audio read from r.
+func (s *Service) RecognizePCM(ctx context.Context, r io.Reader, sampleRate, channels, bitsPerSample int) ([]shazam.Match, error) {
+	if sampleRate < 1 {
+		return nil, newError(CodeInvalidRequest, nil, "invalid sample rate: %d", sampleRate)
+	}
+
+	samples, err := wav.ReadPCMSamples(r, bitsPerSample, channels)
+	if err != nil {
+		return nil, newError(CodeInvalidRequest, err, "invalid PCM audio")
+	}
+
+	duration := float64(len(samples)) / float64(sampleRate)
+	matches, _, err := shazam.FindMatches(ctx, s.DB, samples, duration, sampleRate)
+	if err != nil {
+		return nil, newError(CodeInternal, err, "failed to get matches")
+	}
+
+	return acceptedMatches(matches), nil
+}
+
+// RecognizeFile recognizes an audio file in any format wav.DecodeFile supports.
+func (s *Service) RecognizeFile(ctx context.Context, filePath string) ([]shazam.Match, error) {
+	audio, err := wav.DecodeFile(ctx, filePath)
+	if errors.Is(err, wav.ErrUnsupportedFormat) || errors.Is(err, wav.ErrInvalidAudio) {
+		return nil, newError(CodeInvalidRequest, err, "unsupported or invalid audio file")
+	}
+	if err != nil {
+		// ffmpeg missing, failing to read the upload...
+		return nil, newError(CodeInternal, err, "failed to decode audio")
+	}
+
+	matches, _, err := shazam.FindMatches(ctx, s.DB, audio.Mono(), audio.Duration(), audio.SampleRate)
+	if err != nil {
+		return nil, newError(CodeInternal, err, "failed to get matches")
+	}
+
+	return acceptedMatches(matches), nil
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"testing"
+)
+
+func TestRecognizeFileErrorCodes(t *testing.T) {
+	t.Setenv("PATH", "") // no ffmpeg
+	dir := t.TempDir()
+	s := New(dir, nil)
+
+	tests := []struct {
+		name     string
+		content  []byte // nil for a missing file
+		wantCode string
+	}{
+		{"invalid WAV", []byte("RIFF\x04\x00\x00\x00WAVE"), CodeInvalidRequest},
+		{"missing file", nil, CodeInternal},
+		{"format that needs ffmpeg", []byte("not audio at all"), CodeInternal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filePath := filepath.Join(dir, tt.name)
+			if tt.content != nil {
+				if err := os.WriteFile(filePath, tt.content, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err := s.RecognizeFile(context.Background(), filePath)
+			if code := ErrorCode(err); code != tt.wantCode {
+				t.Fatalf("got %v with code %s, want code %s", err, code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestRecognizeRecordingErrors(t *testing.T) {
+	tempDir := utils.TempDir
+	t.Cleanup(func() { utils.TempDir = tempDir })
+	s := New(t.TempDir(), nil)
+
+	audio := base64.StdEncoding.EncodeToString(make([]byte, 4410*2))
+	recording := func(audio string, channels, sampleSize int) *models.RecordData {
+		return &models.RecordData{Audio: audio, SampleRate: 44100, Channels: channels, SampleSize: sampleSize}
+	}
+
+	tests := []struct {
+		name      string
+		recording *models.RecordData
+		tempDir   string
+		wantCode  string
+	}{
+		{"invalid base64", recording("not base64!", 1, 16), t.TempDir(), CodeInvalidRequest},
+		{"no channels", recording(audio, 0, 16), t.TempDir(), CodeInvalidRequest},
+		{"unsupported sample size", recording(audio, 1, 12), t.TempDir(), CodeInvalidRequest},
+		{"incomplete frame", recording(base64.StdEncoding.EncodeToString([]byte{1, 2, 3}), 1, 16), t.TempDir(), CodeInvalidRequest},
+		{"temporary directory missing", recording(audio, 1, 16), filepath.Join(t.TempDir(), "missing"), CodeInternal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			utils.TempDir = tt.tempDir
+
+			_, err := s.RecognizeRecording(context.Background(), tt.recording)
+			if code := ErrorCode(err); err == nil || code != tt.wantCode {
+				t.Fatalf("got %v with code %s, want code %s", err, code, tt.wantCode)
+			}
+		})
+	}
+
+	// Recordings processed after ctx is done fail with its error
+	utils.TempDir = t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.RecognizeRecording(ctx, recording(audio, 1, 16)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,72 @@
+// Package service implements the operations exposed by the socket.io events,
+// the HTTP API and the CLI, so that every interface behaves the same way.
+package service
+
+import (
+	"errors"
+	"fmt"
+	"song-recognition/db"
+	"song-recognition/jobs"
+)
+
+// Error codes returned to clients. Every error returned by the service is an
+// *Error with one of these codes.
+const (
+	CodeInvalidRequest = "invalid_request"
+	CodeNotFound       = "not_found"
+	CodeAlreadyExists  = "already_exists"
+	CodeUpstream       = "upstream_error" // Spotify or YouTube failed
+	CodeInternal       = "internal_error"
+)
+
+// Error is an error with a code and a message that can be shown to clients.
+// Err holds the underlying error, which is only meant to be logged.
+type Error struct {
+	Code    string
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func newError(code string, err error, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...), Err: err}
+}
+
+// ErrorCode returns the code of a service error, or CodeInternal for other errors.
+func ErrorCode(err error) string {
+	var serviceErr *Error
+	if errors.As(err, &serviceErr) {
+		return serviceErr.Code
+	}
+	return CodeInternal
+}
+
+// ErrorMessage returns the message of a service error that can be shown to clients.
+func ErrorMessage(err error) string {
+	var serviceErr *Error
+	if errors.As(err, &serviceErr) {
+		return serviceErr.Message
+	}
+	return "internal error"
+}
+
+// Service holds the configuration and the DB client shared by the operations.
+type Service struct {
+	SongsDir string      // where downloaded and saved songs are stored
+	DB       db.DBClient // closed by the owner of the service
+	Queue    *jobs.Queue // processes the jobs, nil if they are processed by another program
+}
+
+func New(songsDir string, dbClient db.DBClient) *Service {
+	return &Service{SongsDir: songsDir, DB: dbClient}
+}
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"song-recognition/db"
+	"song-recognition/shazam"
+)
+
+// MaxPageSize is the largest number of songs ListSongs returns at once
+const MaxPageSize = 500
+
+// Page is a page of songs.
+type Page struct {
+	Songs  []db.Song `json:"songs"`
+	Total  int       `json:"total"`
+	Offset int       `json:"offset"`
+	Limit  int       `json:"limit"`
+}
+
+// Stats describes the contents of the database.
+type Stats struct {
+	TotalSongs         int `json:"totalSongs"`
+	IndexVersion       int `json:"indexVersion"`       // fingerprint version of the stored songs
+	FingerprintVersion int `json:"fingerprintVersion"` // fingerprint version of this build
+}
+
+func (s *Service) TotalSongs(ctx context.Context) (int, error) {
+	total, err := s.DB.TotalSongs(ctx)
+	if err != nil {
+		return 0, newError(CodeInternal, err, "error getting total songs")
+	}
+
+	return total, nil
+}
+
+// ListSongs returns up to limit songs ordered by ID, starting at offset.
+func (s *Service) ListSongs(ctx context.Context, offset, limit int) (Page, error) {
+	if offset < 0 || limit < 1 || limit > MaxPageSize {
+		return Page{}, newError(CodeInvalidRequest, nil,
+			"offset must be positive and limit between 1 and %d", MaxPageSize)
+	}
+
+	total, err := s.DB.TotalSongs(ctx)
+	if err != nil {
+		return Page{}, newError(CodeInternal, err, "error getting total songs")
+	}
+
+	songs, err := s.DB.ListSongs(ctx, offset, limit)
+	if err != nil {
+		return Page{}, newError(CodeInternal, err, "error listing songs")
+	}
+	if songs == nil {
+		songs = []db.Song{}
+	}
+
+	return Page{Songs: songs, Total: total, Offset: offset, Limit: limit}, nil
+}
+
+func (s *Service) GetSong(ctx context.Context, songID uint32) (db.Song, error) {
+	song, songExists, err := s.DB.GetSongByID(ctx, songID)
+	if err != nil {
+		return db.Song{}, newError(CodeInternal, err, "error getting song")
+	}
+	if !songExists {
+		return db.Song{}, newError(CodeNotFound, nil, "song %d doesn't exist", songID)
+	}
+
+	return song, nil
+}
+
+func (s *Service) DeleteSong(ctx context.Context, songID uint32) error {
+	_, songExists, err := s.DB.GetSongByID(ctx, songID)
+	if err != nil {
+		return newError(CodeInternal, err, "error getting song")
+	}
+	if !songExists {
+		return newError(CodeNotFound, nil, "song %d doesn't exist", songID)
+	}
+
+	if err := s.DB.DeleteSongByID(ctx, songID); err != nil {
+		return newError(CodeInternal, err, "error deleting song")
+	}
+
+	return nil
+}
+
+func (s *Service) Stats(ctx context.Context) (Stats, error) {
+	total, err := s.DB.TotalSongs(ctx)
+	if err != nil {
+		return Stats{}, newError(CodeInternal, err, "error getting total songs")
+	}
+
+	indexVersion, err := shazam.IndexVersion(ctx, s.DB)
+	if err != nil {
+		return Stats{}, newError(CodeInternal, err, "error getting index version")
+	}
+
+	return Stats{
+		TotalSongs:         total,
+		IndexVersion:       indexVersion,
+		FingerprintVersion: shazam.FingerprintVersion,
+	}, nil
+}
@@ -0,0 +1,86 @@
+package shazam
+
+import (
+	"song-recognition/utils"
+	"strconv"
+)
+
+// fullConfidenceCoverage is the fraction of the sample hashes that must be
+// aligned with a song for its score alone to be considered conclusive.
+const fullConfidenceCoverage = 0.05
+
+// DecisionRule decides whether a match is good enough to be reported,
+// so that noise or unknown songs result in "no match" rather than in
+// whatever song happens to share the most hashes with the sample.
+type DecisionRule struct {
+	MinScore      float64 // minimum number of aligned hashes
+	MinConfidence float64 // minimum confidence, between 0 and 1
+}
+
+// DefaultDecisionRule returns the decision rule configured with the
+// MATCH_MIN_SCORE and MATCH_MIN_CONFIDENCE environment variables.
+func DefaultDecisionRule() DecisionRule {
+	return DecisionRule{
+		MinScore:      envFloat("MATCH_MIN_SCORE", 10),
+		MinConfidence: envFloat("MATCH_MIN_CONFIDENCE", 0.25),
+	}
+}
+
+func envFloat(key string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(utils.GetEnv(key), 64)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// Accept reports whether the match satisfies the rule.
+func (r DecisionRule) Accept(match Match) bool {
+	return match.Score >= r.MinScore && match.Confidence >= r.MinConfidence
+}
+
+// Filter returns the matches that satisfy the rule, keeping their order.
+// It returns nil when no match does.
+func (r DecisionRule) Filter(matches []Match) []Match {
+	var accepted []Match
+	for _, match := range matches {
+		if r.Accept(match) {
+			accepted = append(accepted, match)
+		}
+	}
+	return accepted
+}
+
+// setConfidences sets the confidence of matches ranked by score.
+// The confidence of the top match combines how much of the sample it
+// explains (its score relative to the number of sample hashes) with its lead
+// over the runner-up. A song that only just beats the runner-up, or whose
+// hashes are a tiny fraction of the sample, gets a confidence close to 0, as
+// do songs tied for the top score. The other matches are not conclusive and
+// get a confidence of 0, so that only the top match can ever be accepted.
+func setConfidences(matches []Match, numSampleHashes int) {
+	for i := range matches {
+		matches[i].Confidence = 0
+	}
+	if numSampleHashes == 0 || len(matches) == 0 || matches[0].Score <= 0 {
+		return
+	}
+
+	top := matches[0].Score
+	var runnerUp float64
+	if len(matches) > 1 {
+		runnerUp = matches[1].Score
+	}
+
+	margin := (top - runnerUp) / top
+	if margin < 0 {
+		margin = 0
+	}
+
+	coverage := top / float64(numSampleHashes) / fullConfidenceCoverage
+	if coverage > 1 {
+		coverage = 1
+	}
+
+	matches[0].Confidence = margin * coverage
+}
@@ -0,0 +1,97 @@
+package shazam
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSetConfidences(t *testing.T) {
+	tests := []struct {
+		name            string
+		scores          []float64
+		numSampleHashes int
+		want            []float64
+	}{
+		{"single full coverage match", []float64{100}, 1000, []float64{1}},
+		{"single partial coverage match", []float64{25}, 1000, []float64{0.5}},
+		{"lead over the runner-up", []float64{100, 50}, 1000, []float64{0.5, 0}},
+		{"only the top match", []float64{100, 80, 20}, 1000, []float64{0.2, 0, 0}},
+		{"ties", []float64{100, 100, 50}, 1000, []float64{0, 0, 0}},
+		{"zero score", []float64{100, 0}, 1000, []float64{1, 0}},
+		{"no sample hashes", []float64{100, 50}, 0, []float64{0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matches := make([]Match, len(tt.scores))
+			for i, score := range tt.scores {
+				matches[i].Score = score
+			}
+
+			setConfidences(matches, tt.numSampleHashes)
+
+			for i, match := range matches {
+				if math.Abs(match.Confidence-tt.want[i]) > 1e-9 {
+					t.Errorf("match %d: got a confidence of %v, want %v", i, match.Confidence, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDecisionRuleFilter(t *testing.T) {
+	rule := DecisionRule{MinScore: 10, MinConfidence: 0.25}
+
+	matches := []Match{
+		{SongID: 1, Score: 100, Confidence: 0.8},
+		{SongID: 2, Score: 5, Confidence: 0.9},  // too few hashes
+		{SongID: 3, Score: 50, Confidence: 0.1}, // too close to the next match
+		{SongID: 4, Score: 40, Confidence: 0.25},
+	}
+
+	got := rule.Filter(matches)
+	if len(got) != 2 || got[0].SongID != 1 || got[1].SongID != 4 {
+		t.Fatalf("got %+v, want songs 1 and 4", got)
+	}
+
+	if got := rule.Filter(matches[1:3]); got != nil {
+		t.Fatalf("got %+v, want nil", got)
+	}
+}
+
+func TestDecisionRuleAcceptsOnlyTheTopMatch(t *testing.T) {
+	matches := []Match{{SongID: 1, Score: 100}, {SongID: 2, Score: 80}, {SongID: 3, Score: 20}}
+	setConfidences(matches, 1000)
+
+	if got := DefaultDecisionRule().Filter(matches); got != nil {
+		t.Fatalf("got %+v, want no match when the top match barely leads", got)
+	}
+
+	matches = []Match{{SongID: 1, Score: 100}, {SongID: 2, Score: 20}, {SongID: 3, Score: 5}}
+	setConfidences(matches, 1000)
+
+	got := DefaultDecisionRule().Filter(matches)
+	if len(got) != 1 || got[0].SongID != 1 {
+		t.Fatalf("got %+v, want only song 1", got)
+	}
+}
+
+func TestDecisionRuleRejectsNoise(t *testing.T) {
+	// Noise shares a few hashes with many songs, none of them standing out
+	matches := []Match{{Score: 4}, {Score: 4}, {Score: 3}, {Score: 2}}
+	setConfidences(matches, 2000)
+
+	if got := DefaultDecisionRule().Filter(matches); got != nil {
+		t.Fatalf("got %+v, want no match", got)
+	}
+}
+
+func TestDefaultDecisionRule(t *testing.T) {
+	t.Setenv("MATCH_MIN_SCORE", "20")
+	t.Setenv("MATCH_MIN_CONFIDENCE", "invalid")
+
+	rule := DefaultDecisionRule()
+	if rule.MinScore != 20 || rule.MinConfidence != 0.25 {
+		t.Fatalf("got %+v, want a minimum score of 20 and the default confidence", rule)
+	}
+}
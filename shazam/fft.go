@@ -1,45 +1,143 @@
 package shazam
 
 import (
+	"fmt"
 	"math"
+	"math/bits"
 )
 
-// Fft performs the Fast Fourier Transform on the input signal.
-func FFT(input []float64) []complex128 {
-	// Convert input to complex128
-	complexArray := make([]complex128, len(input))
-	for i, v := range input {
-		complexArray[i] = complex(v, 0)
+// FFTPlan holds the precomputed twiddle factors and bit-reversal table for
+// real-input transforms of a fixed size. A plan is created once and reused
+// for every window, so transforms don't allocate or call math.Sincos.
+// A plan isn't safe for concurrent use.
+type FFTPlan struct {
+	n        int
+	half     int
+	bitrev   []int        // bit-reversal permutation of the half-size transform
+	twiddles []complex128 // exp(-2πik/half) for the half-size complex transform
+	unpack   []complex128 // exp(-2πik/n) used to split the half-size result
+}
+
+// NewFFTPlan creates a plan for transforms of n real samples. n must be a power of two.
+func NewFFTPlan(n int) (*FFTPlan, error) {
+	if n < 2 || n&(n-1) != 0 {
+		return nil, fmt.Errorf("FFT size must be a power of two greater than 1, got %d", n)
+	}
+
+	half := n / 2
+	p := &FFTPlan{
+		n:        n,
+		half:     half,
+		bitrev:   make([]int, half),
+		twiddles: make([]complex128, half/2),
+		unpack:   make([]complex128, half+1),
+	}
+
+	logHalf := bits.TrailingZeros(uint(half))
+	for i := range p.bitrev {
+		if logHalf > 0 {
+			p.bitrev[i] = int(bits.Reverse(uint(i)) >> (bits.UintSize - logHalf))
+		}
 	}
 
-	fftResult := make([]complex128, len(complexArray))
-	copy(fftResult, complexArray) // Copy input to result buffer
-	return recursiveFFT(fftResult)
+	for k := range p.twiddles {
+		sin, cos := math.Sincos(-2 * math.Pi * float64(k) / float64(half))
+		p.twiddles[k] = complex(cos, sin)
+	}
+
+	for k := range p.unpack {
+		sin, cos := math.Sincos(-2 * math.Pi * float64(k) / float64(n))
+		p.unpack[k] = complex(cos, sin)
+	}
+
+	return p, nil
 }
 
-// recursiveFFT performs the recursive FFT algorithm.
-func recursiveFFT(complexArray []complex128) []complex128 {
-	N := len(complexArray)
-	if N <= 1 {
-		return complexArray
+// Size returns the number of real samples the plan transforms.
+func (p *FFTPlan) Size() int {
+	return p.n
+}
+
+// Transform computes the FFT of input and writes the full n-bin spectrum to out.
+// input and out must both have the plan's size.
+//
+// The n real samples are packed into n/2 complex values, transformed in place
+// with an iterative radix-2 FFT, and the result is split back into the
+// spectrum of the real signal.
+func (p *FFTPlan) Transform(input []float64, out []complex128) {
+	if len(input) != p.n || len(out) != p.n {
+		panic(fmt.Sprintf("FFT plan of size %d used with input of %d and output of %d", p.n, len(input), len(out)))
+	}
+
+	half := p.half
+	z := out[:half]
+
+	// Pack even samples as real parts and odd samples as imaginary parts,
+	// in bit-reversed order
+	for i, j := range p.bitrev {
+		z[j] = complex(input[2*i], input[2*i+1])
+	}
+
+	// Iterative radix-2 butterflies
+	for size := 2; size <= half; size <<= 1 {
+		step := half / size
+		for start := 0; start < half; start += size {
+			for k := 0; k < size/2; k++ {
+				t := p.twiddles[k*step] * z[start+k+size/2]
+				z[start+k+size/2] = z[start+k] - t
+				z[start+k] += t
+			}
+		}
+	}
+
+	// Split the half-size transform into the spectrum of the real signal:
+	// X[k] = (Z[k] + conj(Z[half-k]))/2 - i*W^k*(Z[k] - conj(Z[half-k]))/2
+	z0 := z[0]
+	out[0] = complex(real(z0)+imag(z0), 0)
+	out[half] = complex(real(z0)-imag(z0), 0)
+
+	for k := 1; k <= half/2; k++ {
+		a, b := z[k], z[half-k]
+		out[k] = p.split(a, b, k)
+		out[half-k] = p.split(b, a, half-k)
 	}
 
-	even := make([]complex128, N/2)
-	odd := make([]complex128, N/2)
-	for i := 0; i < N/2; i++ {
-		even[i] = complexArray[2*i]
-		odd[i] = complexArray[2*i+1]
+	// The spectrum of a real signal is conjugate symmetric
+	for k := 1; k < half; k++ {
+		out[p.n-k] = complex(real(out[k]), -imag(out[k]))
 	}
+}
+
+// split returns X[k] given Z[k] and Z[half-k].
+func (p *FFTPlan) split(zk, zMirror complex128, k int) complex128 {
+	mirrorConj := complex(real(zMirror), -imag(zMirror))
+	even := (zk + mirrorConj) / 2
+	odd := (zk - mirrorConj) / 2
+	return even + complex(0, -1)*p.unpack[k]*odd
+}
 
-	even = recursiveFFT(even)
-	odd = recursiveFFT(odd)
+// FFT performs the Fast Fourier Transform on the input signal.
+// Inputs whose length isn't a power of two are zero-padded to the next one,
+// and to at least 2 samples. An empty input has an empty spectrum.
+// Use an FFTPlan directly to transform many windows of the same size.
+func FFT(input []float64) []complex128 {
+	if len(input) == 0 {
+		return []complex128{}
+	}
+
+	n := 2
+	for n < len(input) {
+		n <<= 1
+	}
 
-	fftResult := make([]complex128, N)
-	for k := 0; k < N/2; k++ {
-		t := complex(math.Cos(-2*math.Pi*float64(k)/float64(N)), math.Sin(-2*math.Pi*float64(k)/float64(N)))
-		fftResult[k] = even[k] + t*odd[k]
-		fftResult[k+N/2] = even[k] - t*odd[k]
+	padded := input
+	if len(input) != n {
+		padded = make([]float64, n)
+		copy(padded, input)
 	}
 
-	return fftResult
+	plan, _ := NewFFTPlan(n)
+	result := make([]complex128, n)
+	plan.Transform(padded, result)
+	return result
 }
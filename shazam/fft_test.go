@@ -0,0 +1,176 @@
+package shazam
+
+import (
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"testing"
+)
+
+// dft is the reference O(n²) discrete Fourier transform.
+func dft(input []float64) []complex128 {
+	n := len(input)
+	out := make([]complex128, n)
+	for k := range out {
+		var sum complex128
+		for t, x := range input {
+			angle := -2 * math.Pi * float64(k*t%n) / float64(n)
+			sum += complex(x*math.Cos(angle), x*math.Sin(angle))
+		}
+		out[k] = sum
+	}
+	return out
+}
+
+// recursiveFFT is the recursive FFT that FFTPlan replaced, kept as a
+// reference for power-of-two sizes.
+func recursiveFFT(complexArray []complex128) []complex128 {
+	N := len(complexArray)
+	if N <= 1 {
+		return complexArray
+	}
+
+	even := make([]complex128, N/2)
+	odd := make([]complex128, N/2)
+	for i := 0; i < N/2; i++ {
+		even[i] = complexArray[2*i]
+		odd[i] = complexArray[2*i+1]
+	}
+
+	even = recursiveFFT(even)
+	odd = recursiveFFT(odd)
+
+	fftResult := make([]complex128, N)
+	for k := 0; k < N/2; k++ {
+		t := complex(math.Cos(-2*math.Pi*float64(k)/float64(N)), math.Sin(-2*math.Pi*float64(k)/float64(N)))
+		fftResult[k] = even[k] + t*odd[k]
+		fftResult[k+N/2] = even[k] - t*odd[k]
+	}
+
+	return fftResult
+}
+
+func randomSamples(n int, seed int64) []float64 {
+	rng := rand.New(rand.NewSource(seed))
+	samples := make([]float64, n)
+	for i := range samples {
+		samples[i] = rng.Float64()*2 - 1
+	}
+	return samples
+}
+
+func assertSpectrum(t *testing.T, got, want []complex128) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d bins, want %d", len(got), len(want))
+	}
+	for k := range want {
+		if diff := cmplx.Abs(got[k] - want[k]); diff > 1e-9*float64(len(want)) {
+			t.Fatalf("bin %d: got %v, want %v", k, got[k], want[k])
+		}
+	}
+}
+
+func TestFFT(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		paddedLen int
+	}{
+		{"empty", 0, 0},
+		{"one sample", 1, 2},
+		{"two samples", 2, 2},
+		{"power of two", 8, 8},
+		{"window", freqBinSize, freqBinSize},
+		{"padded", 5, 8},
+		{"padded window", freqBinSize - hopSize, freqBinSize},
+		{"one past a power of two", 513, 1024},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := randomSamples(tt.size, int64(tt.size))
+
+			padded := make([]float64, tt.paddedLen)
+			copy(padded, input)
+
+			assertSpectrum(t, FFT(input), dft(padded))
+		})
+	}
+}
+
+func TestFFTMatchesRecursiveFFT(t *testing.T) {
+	for size := 2; size <= 4096; size <<= 1 {
+		input := randomSamples(size, int64(size))
+
+		complexInput := make([]complex128, size)
+		for i, x := range input {
+			complexInput[i] = complex(x, 0)
+		}
+
+		assertSpectrum(t, FFT(input), recursiveFFT(complexInput))
+	}
+}
+
+func TestFFTPlanReuse(t *testing.T) {
+	plan, err := NewFFTPlan(freqBinSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := make([]complex128, freqBinSize)
+	for seed := int64(0); seed < 3; seed++ {
+		input := randomSamples(freqBinSize, seed)
+		plan.Transform(input, out)
+		assertSpectrum(t, out, dft(input))
+	}
+}
+
+func TestNewFFTPlanRejectsInvalidSizes(t *testing.T) {
+	for _, size := range []int{-2, 0, 1, 3, 1000} {
+		if _, err := NewFFTPlan(size); err == nil {
+			t.Errorf("NewFFTPlan(%d) succeeded, want an error", size)
+		}
+	}
+}
+
+func BenchmarkFFT(b *testing.B) {
+	input := randomSamples(freqBinSize, 1)
+
+	b.Run("plan", func(b *testing.B) {
+		plan, err := NewFFTPlan(freqBinSize)
+		if err != nil {
+			b.Fatal(err)
+		}
+		out := make([]complex128, freqBinSize)
+
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			plan.Transform(input, out)
+		}
+	})
+
+	b.Run("recursive", func(b *testing.B) {
+		complexInput := make([]complex128, freqBinSize)
+		for i, x := range input {
+			complexInput[i] = complex(x, 0)
+		}
+
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			recursiveFFT(complexInput)
+		}
+	})
+}
+
+func BenchmarkSpectrogram(b *testing.B) {
+	samples := testSignal(10)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Spectrogram(samples, testSampleRate); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
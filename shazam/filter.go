@@ -21,15 +21,13 @@ func NewLowPassFilter(cutoffFrequency, sampleRate float64) *LowPassFilter {
 	}
 }
 
-// Filter processes the input signal through the low-pass filter
+// Filter processes the input signal through the low-pass filter.
+// The filter keeps its previous output between calls, so a signal can be
+// filtered in consecutive chunks with the same result as filtering it at once.
 func (lpf *LowPassFilter) Filter(input []float64) []float64 {
 	filtered := make([]float64, len(input))
 	for i, x := range input {
-		if i == 0 {
-			filtered[i] = x * lpf.alpha
-		} else {
-			filtered[i] = lpf.alpha*x + (1-lpf.alpha)*lpf.yPrev
-		}
+		filtered[i] = lpf.alpha*x + (1-lpf.alpha)*lpf.yPrev
 		lpf.yPrev = filtered[i]
 	}
 	return filtered
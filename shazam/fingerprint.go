@@ -1,21 +1,31 @@
 package shazam
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"song-recognition/models"
 )
 
 const (
 	maxFreqBits    = 9
 	maxDeltaBits   = 14
+	deltaStepMs    = 10 // resolution of the delta time stored in an address
 	targetZoneSize = 5
+
+	freqMask  = 1<<maxFreqBits - 1
+	deltaMask = 1<<maxDeltaBits - 1
 )
 
-// Fingerprint generates fingerprints from a list of peaks and stores them in an array.
-// The fingerprints are encoded using a 32-bit integer format and stored in an array.
+// Fingerprint generates fingerprints from a list of peaks and stores them in a map.
+// The fingerprints are encoded using a 32-bit integer format.
 // Each fingerprint consists of an address and a couple.
 // The address is a hash. The couple contains the anchor time and the song ID.
-func Fingerprint(peaks []Peak, songID uint32) map[uint32]models.Couple {
-	fingerprints := map[uint32]models.Couple{}
+// The same address can occur several times in a song (e.g. in a repeated chorus),
+// so every address maps to all of its couples, in order of anchor time.
+func Fingerprint(peaks []Peak, songID uint32) map[uint32][]models.Couple {
+	fingerprints := map[uint32][]models.Couple{}
 
 	for i, anchor := range peaks {
 		for j := i + 1; j < len(peaks) && j <= i+targetZoneSize; j++ {
@@ -24,24 +34,134 @@ func Fingerprint(peaks []Peak, songID uint32) map[uint32]models.Couple {
 			address := createAddress(anchor, target)
 			anchorTimeMs := uint32(anchor.Time * 1000)
 
-			fingerprints[address] = models.Couple{anchorTimeMs, songID}
+			couple := models.Couple{AnchorTimeMs: anchorTimeMs, SongID: songID}
+			fingerprints[address] = append(fingerprints[address], couple)
 		}
 	}
 
 	return fingerprints
 }
 
+// SampleReader reads mono samples incrementally, e.g. a wav.Reader.
+// ReadSamples returns io.EOF once every sample has been read.
+type SampleReader interface {
+	ReadSamples(buf []float64) (int, error)
+}
+
+// readChunkSize is the number of samples FingerprintStream reads at a time
+const readChunkSize = 1 << 16
+
+// FingerprintStream fingerprints the numSamples mono samples read from r window
+// by window, so the whole signal is never held in memory. The fingerprints are
+// the ones Fingerprint returns for the peaks of the whole signal. Reading stops
+// with ctx's error once ctx is done.
+func FingerprintStream(ctx context.Context, r SampleReader, sampleRate, numSamples int, songID uint32) (map[uint32][]models.Couple, error) {
+	spectrogram, err := newSpectrogramStream(sampleRate, numSamples)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprints := map[uint32][]models.Couple{}
+	if spectrogram.numWindows == 0 {
+		return fingerprints, nil
+	}
+
+	// Same bin duration as ExtractPeaks for the whole signal
+	audioDuration := float64(numSamples) / float64(sampleRate)
+	binDuration := audioDuration / float64(spectrogram.numWindows)
+
+	var zone targetZone
+	addCouple := func(anchor, target Peak) {
+		address := createAddress(anchor, target)
+		couple := models.Couple{AnchorTimeMs: uint32(anchor.Time * 1000), SongID: songID}
+		fingerprints[address] = append(fingerprints[address], couple)
+	}
+	addFrame := func(frameIdx int, bin []complex128) {
+		for _, peak := range binPeaks(bin, frameIdx, binDuration) {
+			zone.add(peak, addCouple)
+		}
+	}
+
+	buf := make([]float64, readChunkSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		n, err := r.ReadSamples(buf)
+		if n > 0 {
+			spectrogram.write(buf[:n], addFrame)
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read samples: %v", err)
+		}
+	}
+	spectrogram.flush(addFrame)
+
+	return fingerprints, nil
+}
+
+// targetZone pairs every peak with the peaks preceding it within the target
+// zone, which yields the same pairs as Fingerprint without keeping every peak.
+type targetZone struct {
+	peaks []Peak
+}
+
+func (z *targetZone) add(target Peak, pair func(anchor, target Peak)) {
+	for _, anchor := range z.peaks {
+		pair(anchor, target)
+	}
+
+	z.peaks = append(z.peaks, target)
+	if len(z.peaks) > targetZoneSize {
+		z.peaks = z.peaks[1:]
+	}
+}
+
 // createAddress generates a unique address for a pair of anchor and target points.
-// The address is a 32-bit integer where certain bits represent the frequency of
+// The address is a 32-bit integer where certain bits represent the frequency bin of
 // the anchor and target points, and other bits represent the time difference (delta time)
 // between them. This function combines these components into a single address (a hash).
 func createAddress(anchor, target Peak) uint32 {
-	anchorFreq := int(real(anchor.Freq))
-	targetFreq := int(real(target.Freq))
-	deltaMs := uint32((target.Time - anchor.Time) * 1000)
+	deltaMs := (target.Time - anchor.Time) * 1000
+	if deltaMs < 0 {
+		deltaMs = 0
+	}
 
-	// Combine the frequency of the anchor, target, and delta time into a 32-bit address
-	address := uint32(anchorFreq<<23) | uint32(targetFreq<<14) | deltaMs
+	return encodeAddress(anchor.FreqBin, target.FreqBin, uint32(deltaMs))
+}
 
-	return address
+// encodeAddress packs the frequency bins and delta time into fixed fields:
+//
+//	bits 31-23: anchor frequency bin (maxFreqBits)
+//	bits 22-14: target frequency bin (maxFreqBits)
+//	bits 13-0:  delta time in steps of deltaStepMs (maxDeltaBits)
+//
+// Values too large for their field are clamped to the field's maximum,
+// so they never overflow into the neighbouring fields.
+func encodeAddress(anchorBin, targetBin int, deltaMs uint32) uint32 {
+	delta := deltaMs / deltaStepMs
+
+	return clampField(uint32(anchorBin), freqMask)<<(maxFreqBits+maxDeltaBits) |
+		clampField(uint32(targetBin), freqMask)<<maxDeltaBits |
+		clampField(delta, deltaMask)
+}
+
+// decodeAddress unpacks an address built by encodeAddress. The delta time
+// is rounded down to a multiple of deltaStepMs.
+func decodeAddress(address uint32) (anchorBin, targetBin int, deltaMs uint32) {
+	anchorBin = int(address >> (maxFreqBits + maxDeltaBits) & freqMask)
+	targetBin = int(address >> maxDeltaBits & freqMask)
+	deltaMs = (address & deltaMask) * deltaStepMs
+	return anchorBin, targetBin, deltaMs
+}
+
+func clampField(value, mask uint32) uint32 {
+	if value > mask {
+		return mask
+	}
+	return value
 }
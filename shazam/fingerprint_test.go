@@ -0,0 +1,134 @@
+package shazam
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeAddress(t *testing.T) {
+	const maxDeltaMs = deltaMask * deltaStepMs
+
+	tests := []struct {
+		name                   string
+		anchorBin, targetBin   int
+		deltaMs                uint32
+		wantAnchor, wantTarget int
+		wantDeltaMs            uint32
+	}{
+		{"zero", 0, 0, 0, 0, 0, 0},
+		{"typical", 37, 210, 1234, 37, 210, 1230},
+		{"delta rounded down", 1, 2, 19, 1, 2, 10},
+		{"largest bins", 511, 511, 0, 511, 511, 0},
+		{"anchor bin clamped", 512, 3, 100, 511, 3, 100},
+		{"target bin clamped", 3, 512, 100, 3, 511, 100},
+		{"bins far out of range", 1 << 20, 1 << 20, 100, 511, 511, 100},
+		{"largest delta", 5, 6, maxDeltaMs, 5, 6, maxDeltaMs},
+		{"delta one step over", 5, 6, maxDeltaMs + deltaStepMs, 5, 6, maxDeltaMs},
+		{"delta far out of range", 5, 6, 1 << 31, 5, 6, maxDeltaMs},
+		{"every field at its maximum", 511, 511, maxDeltaMs, 511, 511, maxDeltaMs},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := encodeAddress(tt.anchorBin, tt.targetBin, tt.deltaMs)
+
+			anchorBin, targetBin, deltaMs := decodeAddress(address)
+			if anchorBin != tt.wantAnchor || targetBin != tt.wantTarget || deltaMs != tt.wantDeltaMs {
+				t.Fatalf("got (%d, %d, %d), want (%d, %d, %d)",
+					anchorBin, targetBin, deltaMs, tt.wantAnchor, tt.wantTarget, tt.wantDeltaMs)
+			}
+		})
+	}
+}
+
+func TestEncodeAddressFieldsDontOverlap(t *testing.T) {
+	// A field at its maximum leaves the other fields at zero
+	fields := []uint32{
+		encodeAddress(1<<20, 0, 0),
+		encodeAddress(0, 1<<20, 0),
+		encodeAddress(0, 0, 1<<31),
+	}
+
+	var all uint32
+	for i, field := range fields {
+		if field == 0 {
+			t.Fatalf("field %d is empty", i)
+		}
+		if all&field != 0 {
+			t.Fatalf("field %d (%032b) overlaps the previous fields (%032b)", i, field, all)
+		}
+		all |= field
+	}
+
+	if all != 1<<32-1 {
+		t.Fatalf("the fields cover %032b, want every bit", all)
+	}
+}
+
+func TestCreateAddress(t *testing.T) {
+	anchor := Peak{Time: 1.5, Freq: complex(1e6, 0), FreqBin: 42}
+	target := Peak{Time: 1.75, Freq: complex(-3, 4), FreqBin: 300}
+
+	anchorBin, targetBin, deltaMs := decodeAddress(createAddress(anchor, target))
+	if anchorBin != 42 || targetBin != 300 || deltaMs != 250 {
+		t.Fatalf("got (%d, %d, %d), want (42, 300, 250)", anchorBin, targetBin, deltaMs)
+	}
+
+	// Targets are never before their anchor, but the delta can't go negative
+	if _, _, deltaMs := decodeAddress(createAddress(target, anchor)); deltaMs != 0 {
+		t.Fatalf("got a delta of %dms for a target before its anchor, want 0", deltaMs)
+	}
+}
+
+// sliceReader reads samples in chunks of varying sizes.
+type sliceReader struct {
+	samples []float64
+	reads   int
+}
+
+func (r *sliceReader) ReadSamples(buf []float64) (int, error) {
+	if len(r.samples) == 0 {
+		return 0, io.EOF
+	}
+
+	sizes := []int{1, 4095, 17, len(buf)}
+	n := copy(buf[:min(len(buf), sizes[r.reads%len(sizes)])], r.samples)
+	r.samples = r.samples[n:]
+	r.reads++
+	return n, nil
+}
+
+func TestFingerprintStreamMatchesFingerprint(t *testing.T) {
+	for _, seconds := range []float64{0, 0.01, 3, 10.5} {
+		samples := testSignal(seconds)
+
+		spectrogram, err := Spectrogram(samples, testSampleRate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := Fingerprint(ExtractPeaks(spectrogram, seconds), 7)
+
+		got, err := FingerprintStream(context.Background(), &sliceReader{samples: samples}, testSampleRate, len(samples), 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%vs: got %d addresses, want the %d addresses of Fingerprint", seconds, len(got), len(want))
+		}
+	}
+}
+
+func TestFingerprintStreamStopsWhenCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	samples := testSignal(1)
+	_, err := FingerprintStream(ctx, &sliceReader{samples: samples}, testSampleRate, len(samples), 7)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+}
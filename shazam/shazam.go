@@ -1,27 +1,41 @@
 package shazam
 
 import (
+	"context"
 	"fmt"
-	"math"
 	"song-recognition/db"
+	"song-recognition/models"
 	"song-recognition/utils"
 	"sort"
 	"time"
 )
 
+// Match is a song sharing hashes with a sample, with the song's metadata. The
+// path the song was ingested from is left out, it's only meaningful on the
+// server.
 type Match struct {
-	SongID     uint32
-	SongTitle  string
-	SongArtist string
-	YouTubeID  string
-	Timestamp  uint32
-	Score      float64
+	SongID      uint32
+	SongTitle   string
+	SongArtist  string
+	YouTubeID   string
+	Album       string
+	Artists     []string
+	Duration    float64 // in seconds
+	ISRC        string
+	SpotifyID   string
+	ContentHash string
+	IngestedAt  time.Time
+	SourceType  string
+	Timestamp   uint32  // position in the song, in milliseconds, where the sample starts
+	Score       float64 // number of sample hashes aligned with the song
+	Confidence  float64 // between 0 and 1, see setConfidences
 }
 
-// FindMatches processes the audio samples and finds matches in the database
-func FindMatches(audioSamples []float64, audioDuration float64, sampleRate int) ([]Match, time.Duration, error) {
+// FindMatches processes the audio samples and finds matches in the database.
+// Every song sharing hashes with the sample is returned, ranked by score;
+// use a DecisionRule to tell whether the best of them is actually a match.
+func FindMatches(ctx context.Context, dbClient db.DBClient, audioSamples []float64, audioDuration float64, sampleRate int) ([]Match, time.Duration, error) {
 	startTime := time.Now()
-	logger := utils.GetLogger()
 
 	spectrogram, err := Spectrogram(audioSamples, sampleRate)
 	if err != nil {
@@ -31,51 +45,103 @@ func FindMatches(audioSamples []float64, audioDuration float64, sampleRate int)
 	peaks := ExtractPeaks(spectrogram, audioDuration)
 	fingerprints := Fingerprint(peaks, utils.GenerateUniqueID())
 
+	matches, err := lookupMatches(ctx, dbClient, fingerprints)
+	return matches, time.Since(startTime), err
+}
+
+// FindMatchesStream finds the matches of numSamples mono samples read from r.
+// Unlike FindMatches, the samples are fingerprinted window by window, so
+// recordings of any length can be looked up with bounded memory.
+func FindMatchesStream(ctx context.Context, dbClient db.DBClient, r SampleReader, sampleRate, numSamples int) ([]Match, time.Duration, error) {
+	startTime := time.Now()
+
+	fingerprints, err := FingerprintStream(ctx, r, sampleRate, numSamples, utils.GenerateUniqueID())
+	if err != nil {
+		return nil, time.Since(startTime), fmt.Errorf("failed to fingerprint samples: %v", err)
+	}
+
+	matches, err := lookupMatches(ctx, dbClient, fingerprints)
+	return matches, time.Since(startTime), err
+}
+
+// lookupMatches looks up the couples of the sample fingerprints and ranks the songs they belong to.
+func lookupMatches(ctx context.Context, dbClient db.DBClient, fingerprints map[uint32][]models.Couple) ([]Match, error) {
 	addresses := make([]uint32, 0, len(fingerprints))
 	for address := range fingerprints {
 		addresses = append(addresses, address)
 	}
 
-	db, err := db.NewDBClient()
-	if err != nil {
-		return nil, time.Since(startTime), err
+	if err := CheckIndexVersion(ctx, dbClient); err != nil {
+		return nil, err
 	}
-	defer db.Close()
 
-	m, err := db.GetCouples(addresses)
+	m, err := dbClient.GetCouples(ctx, addresses)
 	if err != nil {
-		return nil, time.Since(startTime), err
+		return nil, err
 	}
 
+	return rankMatches(ctx, dbClient, fingerprints, m)
+}
+
+// rankMatches scores the songs referenced by couples against the sample fingerprints
+// and returns them ordered from the best to the worst match.
+func rankMatches(ctx context.Context, dbClient db.DBClient, fingerprints map[uint32][]models.Couple, couples map[uint32][]models.Couple) ([]Match, error) {
+	logger := utils.GetLogger()
+
 	matches := map[uint32][][2]uint32{} // songID -> [(sampleTime, dbTime)]
-	timestamps := map[uint32][]uint32{}
 
-	for address, couples := range m {
-		for _, couple := range couples {
-			matches[couple.SongID] = append(matches[couple.SongID], [2]uint32{fingerprints[address].AnchorTimeMs, couple.AnchorTimeMs})
-			timestamps[couple.SongID] = append(timestamps[couple.SongID], couple.AnchorTimeMs)
+	for address, addressCouples := range couples {
+		for _, sample := range fingerprints[address] {
+			for _, couple := range addressCouples {
+				matches[couple.SongID] = append(matches[couple.SongID], [2]uint32{sample.AnchorTimeMs, couple.AnchorTimeMs})
+			}
 		}
 	}
 
 	scores := analyzeRelativeTiming(matches)
 
+	songIDs := make([]uint32, 0, len(scores))
+	for songID := range scores {
+		songIDs = append(songIDs, songID)
+	}
+	songs, err := dbClient.GetSongsByIDs(ctx, songIDs)
+	if err != nil {
+		// Songs can't be looked up once ctx is done, they aren't missing
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, fmt.Errorf("failed to get matched songs: %v", err)
+	}
+
 	var matchList []Match
-	for songID, points := range scores {
-		song, songExists, err := db.GetSongByID(songID)
+	for songID, result := range scores {
+		song, songExists := songs[songID]
 		if !songExists {
 			logger.Info(fmt.Sprintf("song with ID (%v) doesn't exist", songID))
 			continue
 		}
-		if err != nil {
-			logger.Info(fmt.Sprintf("failed to get song by ID (%v): %v", songID, err))
+		if song.FingerprintVersion != FingerprintVersion {
+			logger.Info(fmt.Sprintf("song with ID (%v) was fingerprinted with version %d, skipping it",
+				songID, song.FingerprintVersion))
 			continue
 		}
 
-		sort.Slice(timestamps[songID], func(i, j int) bool {
-			return timestamps[songID][i] < timestamps[songID][j]
-		})
-
-		match := Match{songID, song.Title, song.Artist, song.YouTubeID, timestamps[songID][0], points}
+		match := Match{
+			SongID:      songID,
+			SongTitle:   song.Title,
+			SongArtist:  song.Artist,
+			YouTubeID:   song.YouTubeID,
+			Album:       song.Album,
+			Artists:     song.Artists,
+			Duration:    song.Duration,
+			ISRC:        song.ISRC,
+			SpotifyID:   song.SpotifyID,
+			ContentHash: song.ContentHash,
+			IngestedAt:  song.IngestedAt,
+			SourceType:  song.SourceType,
+			Timestamp:   result.offsetMs,
+			Score:       result.score,
+		}
 		matchList = append(matchList, match)
 	}
 
@@ -83,24 +149,58 @@ func FindMatches(audioSamples []float64, audioDuration float64, sampleRate int)
 		return matchList[i].Score > matchList[j].Score
 	})
 
-	return matchList, time.Since(startTime), nil
+	numSampleHashes := 0
+	for _, sampleCouples := range fingerprints {
+		numSampleHashes += len(sampleCouples)
+	}
+	setConfidences(matchList, numSampleHashes)
+
+	return matchList, nil
 }
 
-// AnalyzeRelativeTiming checks for consistent relative timing and returns a score
-func analyzeRelativeTiming(matches map[uint32][][2]uint32) map[uint32]float64 {
-	scores := make(map[uint32]float64)
+// offsetBinMs is the width of the bins of the offset histogram, i.e. the
+// tolerance on the time alignment between the sample and a song.
+const offsetBinMs = 100
+
+type timingScore struct {
+	score    float64
+	offsetMs uint32 // position in the song where the sample starts
+}
+
+// analyzeRelativeTiming checks for consistent relative timing and returns a score.
+// The offsets (dbTime - sampleTime) of the matched couples of each song are binned
+// into a histogram. When the sample comes from the song, most offsets fall into
+// the same bin, so the song is scored by the height of its tallest bin: the number
+// of hashes aligned on the same offset. The winning offset is the average of the
+// offsets in that bin.
+func analyzeRelativeTiming(matches map[uint32][][2]uint32) map[uint32]timingScore {
+	scores := make(map[uint32]timingScore)
 	for songID, times := range matches {
-		count := 0
-		for i := 0; i < len(times); i++ {
-			for j := i + 1; j < len(times); j++ {
-				sampleDiff := math.Abs(float64(times[i][0] - times[j][0]))
-				dbDiff := math.Abs(float64(times[i][1] - times[j][1]))
-				if math.Abs(sampleDiff-dbDiff) < 100 { // Allow some tolerance
-					count++
-				}
+		counts := make(map[int64]int)
+		sums := make(map[int64]int64)
+
+		var bestBin int64
+		bestCount := 0
+		for _, t := range times {
+			offset := int64(t[1]) - int64(t[0])
+			bin := offset / offsetBinMs
+			if offset < 0 && offset%offsetBinMs != 0 {
+				bin-- // floor division, so bins are all the same width
+			}
+
+			counts[bin]++
+			sums[bin] += offset
+			if counts[bin] > bestCount || (counts[bin] == bestCount && bin < bestBin) {
+				bestBin, bestCount = bin, counts[bin]
 			}
 		}
-		scores[songID] = float64(count)
+
+		offset := sums[bestBin] / int64(bestCount)
+		if offset < 0 {
+			offset = 0
+		}
+
+		scores[songID] = timingScore{score: float64(bestCount), offsetMs: uint32(offset)}
 	}
 	return scores
 }
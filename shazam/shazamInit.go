@@ -1,6 +1,7 @@
 package shazam
 
 import (
+	"context"
 	"fmt"
 	"song-recognition/db"
 	"song-recognition/models"
@@ -17,7 +18,7 @@ type Match1 struct {
 	Coherency  float64
 }
 
-func Search(audioSamples []float64, audioDuration float64, sampleRate int) ([]Match1, error) {
+func Search(ctx context.Context, dbClient db.DBClient, audioSamples []float64, audioDuration float64, sampleRate int) ([]Match1, error) {
 	spectrogram, err := Spectrogram(audioSamples, sampleRate)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get spectrogram of samples: %v", err)
@@ -31,13 +32,7 @@ func Search(audioSamples []float64, audioDuration float64, sampleRate int) ([]Ma
 		addresses = append(addresses, address)
 	}
 
-	db, err := db.NewDBClient()
-	if err != nil {
-		return nil, err
-	}
-	defer db.Close()
-
-	couples, err := db.GetCouples(addresses)
+	couples, err := dbClient.GetCouples(ctx, addresses)
 	if err != nil {
 		return nil, err
 	}
@@ -48,7 +43,7 @@ func Search(audioSamples []float64, audioDuration float64, sampleRate int) ([]Ma
 
 	var matchList []Match1
 	for songID, coherency := range matches {
-		song, songExists, err := db.GetSongByID(songID)
+		song, songExists, err := dbClient.GetSongByID(ctx, songID)
 		if err != nil || !songExists {
 			return nil, err
 		}
@@ -98,17 +93,19 @@ func targetZones(m map[uint32][]models.Couple) map[uint32][]uint32 {
 	return targetZones
 }
 
-func timeCoherency(record map[uint32]models.Couple, songs map[uint32][]uint32) map[uint32]int {
+func timeCoherency(record map[uint32][]models.Couple, songs map[uint32][]uint32) map[uint32]int {
 	// var threshold float64
 	matches := make(map[uint32]int)
 
 	for songID, songAnchorTimes := range songs {
 		deltas := make(map[float64]int)
 		for _, songAnchorTime := range songAnchorTimes {
-			for _, recordAnchor := range record {
-				recordAnchorTimeMs := float64(recordAnchor.AnchorTimeMs)
-				delta := recordAnchorTimeMs - float64(songAnchorTime)
-				deltas[delta]++
+			for _, recordAnchors := range record {
+				for _, recordAnchor := range recordAnchors {
+					recordAnchorTimeMs := float64(recordAnchor.AnchorTimeMs)
+					delta := recordAnchorTimeMs - float64(songAnchorTime)
+					deltas[delta]++
+				}
 			}
 		}
 
@@ -0,0 +1,103 @@
+package shazam
+
+import (
+	"context"
+	"song-recognition/db"
+	"song-recognition/models"
+	"testing"
+)
+
+// countingClient counts the song lookups made through it
+type countingClient struct {
+	db.DBClient
+	byID, byIDs int
+}
+
+func (c *countingClient) GetSongByID(ctx context.Context, songID uint32) (db.Song, bool, error) {
+	c.byID++
+	return c.DBClient.GetSongByID(ctx, songID)
+}
+
+func (c *countingClient) GetSongsByIDs(ctx context.Context, songIDs []uint32) (map[uint32]db.Song, error) {
+	c.byIDs++
+	return c.DBClient.GetSongsByIDs(ctx, songIDs)
+}
+
+func TestRankMatchesLoadsSongsAtOnce(t *testing.T) {
+	ctx := context.Background()
+	kv, err := db.NewKVClient(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	for _, song := range []db.Song{
+		{ID: 1, Title: "One", FingerprintVersion: FingerprintVersion},
+		{ID: 2, Title: "Two", FingerprintVersion: FingerprintVersion},
+		{ID: 3, Title: "Old", FingerprintVersion: FingerprintVersion - 1},
+	} {
+		if err := kv.RegisterSong(ctx, song, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Song 1 has 3 couples aligned with the sample, song 2 has 2, song 3 was
+	// fingerprinted with another version and song 4 doesn't exist
+	fingerprints := map[uint32][]models.Couple{}
+	couples := map[uint32][]models.Couple{}
+	for address := uint32(0); address < 3; address++ {
+		fingerprints[address] = []models.Couple{{AnchorTimeMs: address * 1000}}
+		couples[address] = []models.Couple{
+			{AnchorTimeMs: address*1000 + 5000, SongID: 1},
+			{AnchorTimeMs: address*1000 + 500, SongID: 3},
+			{AnchorTimeMs: address * 1000, SongID: 4},
+		}
+		if address < 2 {
+			couples[address] = append(couples[address], models.Couple{AnchorTimeMs: address*1000 + 2000, SongID: 2})
+		}
+	}
+
+	dbClient := &countingClient{DBClient: kv}
+	matches, err := rankMatches(ctx, dbClient, fingerprints, couples)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(matches) != 2 || matches[0].SongID != 1 || matches[1].SongID != 2 {
+		t.Fatalf("got matches %+v, want songs 1 and 2", matches)
+	}
+	if matches[0].SongTitle != "One" || matches[0].Score != 3 || matches[0].Timestamp != 5000 {
+		t.Fatalf("got match %+v, want song 1 at 5s with a score of 3", matches[0])
+	}
+	if dbClient.byIDs != 1 || dbClient.byID != 0 {
+		t.Fatalf("looked songs up %d times by ID and %d times in a batch, want a single batch", dbClient.byID, dbClient.byIDs)
+	}
+}
+
+func TestAnalyzeRelativeTimingBinsNegativeOffsets(t *testing.T) {
+	tests := []struct {
+		name      string
+		offsets   []int64
+		wantScore float64
+	}{
+		{"positive offsets", []int64{100, 150, 199, 200}, 3},
+		{"negative offsets", []int64{-1, -50, -99, -101}, 3},
+		{"exact negative multiple", []int64{-100, -60, -30, -101}, 3},
+		{"zero", []int64{0, 99, -1}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var times [][2]uint32
+			for _, offset := range tt.offsets {
+				// Sample times start late enough for every offset to be reachable
+				sampleTime := uint32(10000)
+				times = append(times, [2]uint32{sampleTime, uint32(int64(sampleTime) + offset)})
+			}
+
+			scores := analyzeRelativeTiming(map[uint32][][2]uint32{1: times})
+			if got := scores[1].score; got != tt.wantScore {
+				t.Fatalf("got a score of %v, want %v", got, tt.wantScore)
+			}
+		})
+	}
+}
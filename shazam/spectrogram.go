@@ -2,7 +2,6 @@ package shazam
 
 import (
 	"errors"
-	"fmt"
 	"math"
 	"math/cmplx"
 )
@@ -15,43 +14,212 @@ const (
 )
 
 func Spectrogram(samples []float64, sampleRate int) ([][]complex128, error) {
-	lpf := NewLowPassFilter(maxFreq, float64(sampleRate))
-	filteredSamples := lpf.Filter(samples)
+	stream, err := newSpectrogramStream(sampleRate, len(samples))
+	if err != nil {
+		return nil, err
+	}
+
+	// All frames share a single backing array
+	spectrogram := make([][]complex128, stream.numWindows)
+	bins := make([]complex128, stream.numWindows*freqBinSize)
+
+	store := func(frameIdx int, bin []complex128) {
+		spectrogram[frameIdx] = bins[frameIdx*freqBinSize : (frameIdx+1)*freqBinSize]
+		copy(spectrogram[frameIdx], bin)
+	}
+	stream.write(samples, store)
+	stream.flush(store)
+
+	return spectrogram, nil
+}
+
+// spectrogramStream computes spectrogram frames as samples are written, with
+// the same results as Spectrogram for the whole signal. When the length of the
+// signal, or its maximum length, is known, frames are computed as soon as their
+// samples are available and only the samples of upcoming frames are kept, so
+// memory stays bounded.
+type spectrogramStream struct {
+	ratio      int
+	lpf        *LowPassFilter
+	stft       *stft
+	bin        []complex128 // reused for every frame
+	numWindows int          // frames of the whole signal, or -1 if its length isn't known
+	neededEnd  int          // downsampled samples read by the frames, or -1 if unbounded
+
+	pending     []float64 // filtered samples waiting to be downsampled
+	downsampled []float64 // downsampled samples still needed by upcoming frames
+	dsOffset    int       // index of downsampled[0] in the whole downsampled signal
+	dsTotal     int       // samples downsampled so far, including the ones not kept
+	numFrames   int       // frames computed so far
+}
+
+// newSpectrogramStream creates a stream for numSamples samples sampled at sampleRate.
+// numSamples is -1 if the length of the signal isn't known, frames are then
+// computed as the signal grows.
+func newSpectrogramStream(sampleRate, numSamples int) (*spectrogramStream, error) {
+	targetSampleRate := sampleRate / dspRatio
+	if targetSampleRate <= 0 {
+		return nil, errors.New("couldn't downsample audio samples: sample rates must be positive")
+	}
 
-	downsampledSamples, err := Downsample(filteredSamples, sampleRate, sampleRate/dspRatio)
+	stft, err := newSTFT()
 	if err != nil {
-		return nil, fmt.Errorf("couldn't downsample audio samples: %v", err)
+		return nil, err
+	}
+
+	s := &spectrogramStream{
+		ratio:      sampleRate / targetSampleRate,
+		lpf:        NewLowPassFilter(maxFreq, float64(sampleRate)),
+		stft:       stft,
+		bin:        make([]complex128, freqBinSize),
+		numWindows: -1,
+		neededEnd:  -1,
+	}
+
+	if numSamples >= 0 {
+		s.numWindows = s.windows(numSamples)
+		s.neededEnd = framesEnd(s.numWindows)
+	}
+
+	return s, nil
+}
+
+// limit bounds the samples kept by a stream whose length isn't known to the
+// ones read by the frames of a signal of maxSamples samples. Samples written
+// past maxSamples are never read.
+func (s *spectrogramStream) limit(maxSamples int) {
+	s.neededEnd = framesEnd(s.windows(maxSamples))
+}
+
+// windows returns the number of frames of a signal of numSamples samples.
+func (s *spectrogramStream) windows(numSamples int) int {
+	numDownsampled := (numSamples + s.ratio - 1) / s.ratio
+	return numDownsampled / (freqBinSize - hopSize)
+}
+
+// framesEnd returns the number of downsampled samples read by numWindows frames.
+func framesEnd(numWindows int) int {
+	if numWindows <= 0 {
+		return 0
+	}
+	return (numWindows-1)*hopSize + freqBinSize
+}
+
+// write filters and downsamples samples, then calls emit with every frame
+// they complete. emit must not retain bin.
+func (s *spectrogramStream) write(samples []float64, emit func(frameIdx int, bin []complex128)) {
+	s.pending = append(s.pending, s.lpf.Filter(samples)...)
+
+	// Downsample complete groups only, the rest waits for the next samples
+	groups := len(s.pending) / s.ratio
+	for g := 0; g < groups; g++ {
+		s.appendDownsampled(s.pending[g*s.ratio : (g+1)*s.ratio])
+	}
+	s.pending = append(s.pending[:0], s.pending[groups*s.ratio:]...)
+
+	s.computeFrames(false, emit)
+}
+
+// flush downsamples the last incomplete group of samples and computes the
+// remaining frames, zero-padding the ones running past the end of the signal.
+func (s *spectrogramStream) flush(emit func(frameIdx int, bin []complex128)) {
+	if len(s.pending) > 0 {
+		s.appendDownsampled(s.pending)
+		s.pending = s.pending[:0]
+	}
+
+	s.computeFrames(true, emit)
+}
+
+// appendDownsampled appends the average of group to the downsampled samples.
+func (s *spectrogramStream) appendDownsampled(group []float64) {
+	s.dsTotal++
+
+	// Samples past the last frame are never read
+	if s.neededEnd >= 0 && s.dsOffset+len(s.downsampled) >= s.neededEnd {
+		return
 	}
 
-	numOfWindows := len(downsampledSamples) / (freqBinSize - hopSize)
-	spectrogram := make([][]complex128, numOfWindows)
+	sum := 0.0
+	for _, sample := range group {
+		sum += sample
+	}
+	s.downsampled = append(s.downsampled, sum/float64(len(group)))
+}
 
-	// Apply Hamming window function
+func (s *spectrogramStream) computeFrames(final bool, emit func(frameIdx int, bin []complex128)) {
+	for {
+		if s.numWindows >= 0 && s.numFrames >= s.numWindows {
+			break
+		}
+		if s.numWindows < 0 && s.numFrames >= s.dsTotal/(freqBinSize-hopSize) {
+			break
+		}
+
+		start := s.numFrames*hopSize - s.dsOffset
+		if start+freqBinSize > len(s.downsampled) && !final {
+			break
+		}
+
+		s.stft.frame(s.downsampled[start:], 0, s.bin)
+		emit(s.numFrames, s.bin)
+		s.numFrames++
+	}
+
+	// Drop the samples no upcoming frame will read
+	consumed := s.numFrames*hopSize - s.dsOffset
+	if consumed > len(s.downsampled) {
+		consumed = len(s.downsampled)
+	}
+	if consumed > 0 {
+		s.downsampled = append(s.downsampled[:0], s.downsampled[consumed:]...)
+		s.dsOffset += consumed
+	}
+}
+
+// stft computes spectrogram frames, reusing the same FFT plan, Hamming window
+// and scratch buffer for every frame.
+type stft struct {
+	plan   *FFTPlan
+	window []float64
+	buf    []float64
+}
+
+func newSTFT() (*stft, error) {
+	plan, err := NewFFTPlan(freqBinSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hamming window function
 	window := make([]float64, freqBinSize)
 	for i := range window {
 		window[i] = 0.54 - 0.46*math.Cos(2*math.Pi*float64(i)/(float64(freqBinSize)-1))
 	}
 
-	// Perform STFT
-	for i := 0; i < numOfWindows; i++ {
-		start := i * hopSize
-		end := start + freqBinSize
-		if end > len(downsampledSamples) {
-			end = len(downsampledSamples)
-		}
+	return &stft{plan: plan, window: window, buf: make([]float64, freqBinSize)}, nil
+}
 
-		bin := make([]float64, freqBinSize)
-		copy(bin, downsampledSamples[start:end])
+// frame computes the FFT of the i-th frame of the downsampled samples into out.
+// Frames that run past the end of the samples are zero-padded.
+func (s *stft) frame(downsampledSamples []float64, i int, out []complex128) {
+	start := i * hopSize
+	end := start + freqBinSize
+	if end > len(downsampledSamples) {
+		end = len(downsampledSamples)
+	}
 
-		// Apply Hamming window
-		for j := range window {
-			bin[j] *= window[j]
-		}
+	n := copy(s.buf, downsampledSamples[start:end])
+	for j := n; j < len(s.buf); j++ {
+		s.buf[j] = 0
+	}
 
-		spectrogram[i] = FFT(bin)
+	// Apply Hamming window
+	for j := range s.window {
+		s.buf[j] *= s.window[j]
 	}
 
-	return spectrogram, nil
+	s.plan.Transform(s.buf, out)
 }
 
 // Downsample downsamples the input audio from originalSampleRate to targetSampleRate
@@ -87,8 +255,9 @@ func Downsample(input []float64, originalSampleRate, targetSampleRate int) ([]fl
 }
 
 type Peak struct {
-	Time float64
-	Freq complex128
+	Time    float64
+	Freq    complex128
+	FreqBin int // index of the frequency bin in the spectrogram frame
 }
 
 // ExtractPeaks analyzes a spectrogram and extracts significant peaks in the frequency domain over time.
@@ -97,6 +266,19 @@ func ExtractPeaks(spectrogram [][]complex128, audioDuration float64) []Peak {
 		return []Peak{}
 	}
 
+	var peaks []Peak
+	binDuration := audioDuration / float64(len(spectrogram))
+
+	for binIdx, bin := range spectrogram {
+		peaks = append(peaks, binPeaks(bin, binIdx, binDuration)...)
+	}
+
+	return peaks
+}
+
+// binPeaks extracts the peaks of a single spectrogram frame. binIdx is the
+// position of the frame in the spectrogram and binDuration the time each frame spans.
+func binPeaks(bin []complex128, binIdx int, binDuration float64) []Peak {
 	type maxies struct {
 		maxMag  float64
 		maxFreq complex128
@@ -106,51 +288,47 @@ func ExtractPeaks(spectrogram [][]complex128, audioDuration float64) []Peak {
 	bands := []struct{ min, max int }{{0, 10}, {10, 20}, {20, 40}, {40, 80}, {80, 160}, {160, 512}}
 
 	var peaks []Peak
-	binDuration := audioDuration / float64(len(spectrogram))
+	var maxMags []float64
+	var maxFreqs []complex128
+	var freqIndices []float64
 
-	for binIdx, bin := range spectrogram {
-		var maxMags []float64
-		var maxFreqs []complex128
-		var freqIndices []float64
-
-		binBandMaxies := []maxies{}
-		for _, band := range bands {
-			var maxx maxies
-			var maxMag float64
-			for idx, freq := range bin[band.min:band.max] {
-				magnitude := cmplx.Abs(freq)
-				if magnitude > maxMag {
-					maxMag = magnitude
-					freqIdx := band.min + idx
-					maxx = maxies{magnitude, freq, freqIdx}
-				}
+	binBandMaxies := []maxies{}
+	for _, band := range bands {
+		var maxx maxies
+		var maxMag float64
+		for idx, freq := range bin[band.min:band.max] {
+			magnitude := cmplx.Abs(freq)
+			if magnitude > maxMag {
+				maxMag = magnitude
+				freqIdx := band.min + idx
+				maxx = maxies{magnitude, freq, freqIdx}
 			}
-			binBandMaxies = append(binBandMaxies, maxx)
 		}
+		binBandMaxies = append(binBandMaxies, maxx)
+	}
 
-		for _, value := range binBandMaxies {
-			maxMags = append(maxMags, value.maxMag)
-			maxFreqs = append(maxFreqs, value.maxFreq)
-			freqIndices = append(freqIndices, float64(value.freqIdx))
-		}
+	for _, value := range binBandMaxies {
+		maxMags = append(maxMags, value.maxMag)
+		maxFreqs = append(maxFreqs, value.maxFreq)
+		freqIndices = append(freqIndices, float64(value.freqIdx))
+	}
 
-		// Calculate the average magnitude
-		var maxMagsSum float64
-		for _, max := range maxMags {
-			maxMagsSum += max
-		}
-		avg := maxMagsSum / float64(len(maxFreqs)) // * coefficient
+	// Calculate the average magnitude
+	var maxMagsSum float64
+	for _, max := range maxMags {
+		maxMagsSum += max
+	}
+	avg := maxMagsSum / float64(len(maxFreqs)) // * coefficient
 
-		// Add peaks that exceed the average magnitude
-		for i, value := range maxMags {
-			if value > avg {
-				peakTimeInBin := freqIndices[i] * binDuration / float64(len(bin))
+	// Add peaks that exceed the average magnitude
+	for i, value := range maxMags {
+		if value > avg {
+			peakTimeInBin := freqIndices[i] * binDuration / float64(len(bin))
 
-				// Calculate the absolute time of the peak
-				peakTime := float64(binIdx)*binDuration + peakTimeInBin
+			// Calculate the absolute time of the peak
+			peakTime := float64(binIdx)*binDuration + peakTimeInBin
 
-				peaks = append(peaks, Peak{Time: peakTime, Freq: maxFreqs[i]})
-			}
+			peaks = append(peaks, Peak{Time: peakTime, Freq: maxFreqs[i], FreqBin: int(freqIndices[i])})
 		}
 	}
 
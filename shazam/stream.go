@@ -0,0 +1,166 @@
+package shazam
+
+import (
+	"context"
+	"errors"
+	"song-recognition/db"
+	"song-recognition/models"
+	"sync"
+)
+
+const (
+	minStreamDuration   = 2.0  // seconds of audio needed before matching is attempted
+	streamMatchInterval = 1.0  // seconds of new audio between two matching attempts
+	maxStreamDuration   = 60.0 // seconds of audio a session accepts
+)
+
+// ErrStreamTooLong is returned when samples are written past the maximum
+// duration of a session.
+var ErrStreamTooLong = errors.New("the stream is longer than the maximum duration")
+
+// StreamSession fingerprints audio incrementally as it is received, so that
+// matches can be looked up while a recording is still in progress.
+// Frames are computed once, as soon as enough samples are available for them.
+// Since the total duration isn't known up front, peaks are timed using the
+// nominal duration of a frame rather than audioDuration / len(spectrogram).
+// A session accepts up to maxStreamDuration seconds of audio, so the memory
+// it holds is bounded. It is safe for concurrent use: samples can be written
+// while matches are looked up.
+type StreamSession struct {
+	mu          sync.Mutex
+	sampleRate  int
+	binDuration float64
+	spectrogram *spectrogramStream
+	zone        targetZone
+	numSamples  int // samples received so far
+	maxSamples  int
+
+	fingerprints map[uint32][]models.Couple
+	couples      map[uint32][]models.Couple // DB couples of addresses already looked up
+	newAddresses []uint32                   // addresses not looked up yet
+
+	lastMatchDuration float64
+}
+
+// NewStreamSession creates a session for audio sampled at sampleRate.
+func NewStreamSession(sampleRate int) (*StreamSession, error) {
+	spectrogram, err := newSpectrogramStream(sampleRate, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	maxSamples := int(maxStreamDuration * float64(sampleRate))
+	spectrogram.limit(maxSamples)
+
+	return &StreamSession{
+		sampleRate:   sampleRate,
+		maxSamples:   maxSamples,
+		binDuration:  float64(freqBinSize-hopSize) * dspRatio / float64(sampleRate),
+		spectrogram:  spectrogram,
+		fingerprints: map[uint32][]models.Couple{},
+		couples:      map[uint32][]models.Couple{},
+	}, nil
+}
+
+// Duration returns the length in seconds of the audio received so far.
+func (s *StreamSession) Duration() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.duration()
+}
+
+func (s *StreamSession) duration() float64 {
+	return float64(s.numSamples) / float64(s.sampleRate)
+}
+
+// Write appends mono samples to the session and fingerprints every
+// spectrogram frame they complete. Samples that would take the session past
+// its maximum duration are rejected with ErrStreamTooLong.
+func (s *StreamSession) Write(samples []float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.numSamples+len(samples) > s.maxSamples {
+		return ErrStreamTooLong
+	}
+
+	s.numSamples += len(samples)
+	s.spectrogram.write(samples, func(frameIdx int, bin []complex128) {
+		for _, peak := range binPeaks(bin, frameIdx, s.binDuration) {
+			s.zone.add(peak, s.addCouple)
+		}
+	})
+	return nil
+}
+
+func (s *StreamSession) addCouple(anchor, target Peak) {
+	address := createAddress(anchor, target)
+	if _, seen := s.fingerprints[address]; !seen {
+		if _, lookedUp := s.couples[address]; !lookedUp {
+			s.newAddresses = append(s.newAddresses, address)
+		}
+	}
+	couple := models.Couple{AnchorTimeMs: uint32(anchor.Time * 1000)}
+	s.fingerprints[address] = append(s.fingerprints[address], couple)
+}
+
+// ShouldMatch reports whether enough new audio has been received since the
+// last call to Matches to make another matching attempt worthwhile.
+func (s *StreamSession) ShouldMatch() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	duration := s.duration()
+	return duration >= minStreamDuration && duration-s.lastMatchDuration >= streamMatchInterval
+}
+
+// Matches looks up the fingerprints that haven't been queried yet and ranks
+// the songs matching the audio received so far. The session isn't locked
+// during the lookups, so samples keep being written meanwhile.
+func (s *StreamSession) Matches(ctx context.Context, dbClient db.DBClient) ([]Match, error) {
+	s.mu.Lock()
+	s.lastMatchDuration = s.duration()
+	newAddresses := s.newAddresses
+	s.newAddresses = nil
+	s.mu.Unlock()
+
+	if err := CheckIndexVersion(ctx, dbClient); err != nil {
+		s.requeue(newAddresses)
+		return nil, err
+	}
+
+	var m map[uint32][]models.Couple
+	if len(newAddresses) > 0 {
+		var err error
+		m, err = dbClient.GetCouples(ctx, newAddresses)
+		if err != nil {
+			s.requeue(newAddresses)
+			return nil, err
+		}
+	}
+
+	// Only the fingerprints looked up so far are ranked. Written samples only
+	// ever append to the couples of an address, so the copied slices keep the
+	// couples known at this point.
+	s.mu.Lock()
+	for _, address := range newAddresses {
+		s.couples[address] = m[address]
+	}
+	fingerprints := make(map[uint32][]models.Couple, len(s.couples))
+	couples := make(map[uint32][]models.Couple, len(s.couples))
+	for address, dbCouples := range s.couples {
+		fingerprints[address] = s.fingerprints[address]
+		couples[address] = dbCouples
+	}
+	s.mu.Unlock()
+
+	return rankMatches(ctx, dbClient, fingerprints, couples)
+}
+
+// requeue puts back addresses whose lookup failed, to be looked up by the
+// next call to Matches.
+func (s *StreamSession) requeue(addresses []uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.newAddresses = append(addresses, s.newAddresses...)
+}
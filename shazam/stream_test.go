@@ -0,0 +1,169 @@
+package shazam
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"song-recognition/db"
+	"testing"
+)
+
+const testSampleRate = 44100
+
+// testSignal returns seconds of a deterministic mix of tones and noise.
+func testSignal(seconds float64) []float64 {
+	rng := rand.New(rand.NewSource(1))
+	samples := make([]float64, int(seconds*testSampleRate))
+	for i := range samples {
+		t := float64(i) / testSampleRate
+		tone := 440 + 220*math.Floor(t*4) // the pitch changes every 250ms
+		samples[i] = 0.5*math.Sin(2*math.Pi*tone*t) + 0.25*math.Sin(2*math.Pi*1.5*tone*t) + 0.1*(rng.Float64()*2-1)
+	}
+	return samples
+}
+
+// writeChunks writes samples to write in chunks of varying sizes.
+func writeChunks(samples []float64, write func([]float64) error) error {
+	sizes := []int{1, 4095, 17, 8192, 333}
+	for i := 0; len(samples) > 0; i++ {
+		n := sizes[i%len(sizes)]
+		if n > len(samples) {
+			n = len(samples)
+		}
+		if err := write(samples[:n]); err != nil {
+			return err
+		}
+		samples = samples[n:]
+	}
+	return nil
+}
+
+func TestSpectrogramStreamMatchesSpectrogram(t *testing.T) {
+	samples := testSignal(5)
+
+	want, err := Spectrogram(samples, testSampleRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream, err := newSpectrogramStream(testSampleRate, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.limit(len(samples))
+
+	var got [][]complex128
+	err = writeChunks(samples, func(chunk []float64) error {
+		stream.write(chunk, func(frameIdx int, bin []complex128) {
+			if frameIdx != len(got) {
+				t.Fatalf("got frame %d, want %d", frameIdx, len(got))
+			}
+			got = append(got, append([]complex128(nil), bin...))
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Frames running past the end of the signal are only computed on flush
+	if len(got) == 0 || len(got) > len(want) {
+		t.Fatalf("got %d frames, want between 1 and %d", len(got), len(want))
+	}
+	for i := range got {
+		for j := range got[i] {
+			if got[i][j] != want[i][j] {
+				t.Fatalf("frame %d, bin %d: got %v, want %v", i, j, got[i][j], want[i][j])
+			}
+		}
+	}
+}
+
+func TestStreamSessionRejectsSamplesPastMaxDuration(t *testing.T) {
+	session, err := NewStreamSession(testSampleRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := make([]float64, testSampleRate)
+	for i := 0; i < int(maxStreamDuration); i++ {
+		if err := session.Write(second); err != nil {
+			t.Fatalf("second %d: %v", i, err)
+		}
+	}
+
+	if err := session.Write(second[:1]); !errors.Is(err, ErrStreamTooLong) {
+		t.Fatalf("got %v, want ErrStreamTooLong", err)
+	}
+	if session.Duration() != maxStreamDuration {
+		t.Fatalf("got a duration of %vs, want %vs", session.Duration(), maxStreamDuration)
+	}
+}
+
+func TestStreamSessionMemoryIsBounded(t *testing.T) {
+	session, err := NewStreamSession(testSampleRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	maxKept := framesEnd(session.spectrogram.windows(session.maxSamples))
+	err = writeChunks(testSignal(maxStreamDuration), func(chunk []float64) error {
+		if err := session.Write(chunk); err != nil {
+			return err
+		}
+		if kept := len(session.spectrogram.downsampled); kept > maxKept {
+			t.Fatalf("kept %d downsampled samples, want at most %d", kept, maxKept)
+		}
+		if pending := len(session.spectrogram.pending); pending >= session.spectrogram.ratio {
+			t.Fatalf("kept %d pending samples, want less than %d", pending, session.spectrogram.ratio)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(session.fingerprints) == 0 {
+		t.Fatal("got no fingerprints")
+	}
+}
+
+func TestStreamSessionWritesWhileMatching(t *testing.T) {
+	ctx := context.Background()
+	kv, err := db.NewKVClient(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	session, err := NewStreamSession(testSampleRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- writeChunks(testSignal(10), session.Write)
+	}()
+	for writing := true; writing; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			writing = false
+		default:
+			if _, err := session.Matches(ctx, kv); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if _, err := session.Matches(ctx, kv); err != nil {
+		t.Fatal(err)
+	}
+	if len(session.newAddresses) != 0 || len(session.couples) != len(session.fingerprints) {
+		t.Fatalf("looked up %d of %d addresses, want all of them", len(session.couples), len(session.fingerprints))
+	}
+}
@@ -0,0 +1,72 @@
+package shazam
+
+import (
+	"context"
+	"fmt"
+	"song-recognition/db"
+	"strconv"
+)
+
+// FingerprintVersion identifies the fingerprinting scheme. Fingerprints of
+// different schemes can't be matched against each other, so it must be bumped
+// whenever a change affects the addresses or anchor times produced: the
+// spectrogram parameters (dspRatio, freqBinSize, hopSize, maxFreq), the peak
+// bands in binPeaks, the target zone or the address layout of createAddress.
+//
+// Version 1 is the scheme used before versions were recorded.
+const FingerprintVersion = 2
+
+// fingerprintVersionKey is the metadata record holding the fingerprint
+// version of the songs indexed in the database.
+const fingerprintVersionKey = "fingerprintVersion"
+
+// IndexVersion returns the fingerprint version the database is indexed with.
+// Databases holding songs but no version record were indexed with version 1,
+// and empty databases are considered indexed with the current version.
+func IndexVersion(ctx context.Context, dbClient db.DBClient) (int, error) {
+	value, exists, err := dbClient.GetMetadata(ctx, fingerprintVersionKey)
+	if err != nil {
+		return 0, err
+	}
+
+	if exists {
+		version, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid fingerprint version %q: %v", value, err)
+		}
+		return version, nil
+	}
+
+	totalSongs, err := dbClient.TotalSongs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if totalSongs > 0 {
+		return 1, nil
+	}
+
+	return FingerprintVersion, nil
+}
+
+// CheckIndexVersion returns an error if the database is indexed with
+// another fingerprint version than the current one.
+func CheckIndexVersion(ctx context.Context, dbClient db.DBClient) error {
+	version, err := IndexVersion(ctx, dbClient)
+	if err != nil {
+		return fmt.Errorf("failed to get fingerprint version of the database: %v", err)
+	}
+
+	if version != FingerprintVersion {
+		return fmt.Errorf(
+			"the database is indexed with fingerprint version %d but version %d is in use, run the reindex command",
+			version, FingerprintVersion,
+		)
+	}
+
+	return nil
+}
+
+// SetIndexVersion records the fingerprint version the database is indexed with.
+func SetIndexVersion(ctx context.Context, dbClient db.DBClient, version int) error {
+	return dbClient.SetMetadata(ctx, fingerprintVersionKey, strconv.Itoa(version))
+}
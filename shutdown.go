@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"song-recognition/db"
+	"song-recognition/jobs"
+	"song-recognition/utils"
+	"sync"
+	"time"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// shutdownTimeout is the time given to the work in progress to finish when
+// the server is stopped, set in seconds by SHUTDOWN_TIMEOUT_SECONDS.
+func shutdownTimeout() time.Duration {
+	return envSeconds("SHUTDOWN_TIMEOUT_SECONDS", 30)
+}
+
+// taskGroup tracks the work handlers run in the background, so that the
+// server can wait for it before stopping.
+type taskGroup struct {
+	mu     sync.Mutex
+	wg     sync.WaitGroup
+	closed bool
+}
+
+// Go runs task in a goroutine and reports whether it did: once the group is
+// closed, tasks are refused.
+func (g *taskGroup) Go(task func()) bool {
+	if !g.Add() {
+		return false
+	}
+
+	go func() {
+		defer g.Done()
+		task()
+	}()
+	return true
+}
+
+// Add adds a task the caller runs itself, and reports whether it did. The
+// caller must call Done once the task is over.
+func (g *taskGroup) Add() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		return false
+	}
+	g.wg.Add(1)
+	return true
+}
+
+// Done ends a task added with Add.
+func (g *taskGroup) Done() {
+	g.wg.Done()
+}
+
+// Wait closes the group and waits for its tasks, or until ctx is done.
+func (g *taskGroup) Wait(ctx context.Context) error {
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// recognitions are the recognitions the socket handlers run in the background.
+var recognitions taskGroup
+
+// apiRequests are the API requests being handled.
+var apiRequests taskGroup
+
+// workStopTimeout is the time given to the canceled work to return before
+// the DB is closed.
+const workStopTimeout = 5 * time.Second
+
+// socketFlushDelay is the time given to the sockets to send their last events
+// before they're closed: emitting an event only queues it.
+const socketFlushDelay = 500 * time.Millisecond
+
+// shutdown stops the server gracefully. It stops accepting connections, then
+// waits for the API requests, the recognitions of the sockets and the tracks
+// being ingested, at most for the shutdown timeout, before canceling the
+// work left with cancelWork. Interrupted tracks are queued again on the next
+// start. The DB is closed once the canceled work returned, and the temporary
+// files of the process are removed.
+func shutdown(httpServer *http.Server, socketServer *socketio.Server, queue *jobs.Queue, dbClient db.DBClient, cancelWork context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout())
+	defer cancel()
+
+	queueDone := make(chan error, 1)
+	go func() {
+		queueDone <- queue.Shutdown(ctx)
+	}()
+
+	httpDone := make(chan error, 1)
+	go func() {
+		httpDone <- httpServer.Shutdown(ctx)
+	}()
+
+	if err := recognitions.Wait(ctx); err != nil {
+		log.Printf("Canceling the recognitions in progress: %v", err)
+	}
+
+	// Sockets, and the long-polling requests of their connections, would
+	// keep the HTTP server from shutting down
+	time.Sleep(socketFlushDelay)
+	closeSockets()
+	socketServer.Close()
+
+	if err := <-httpDone; err != nil {
+		log.Printf("Closing the HTTP connections left: %v", err)
+		httpServer.Close()
+	}
+
+	if err := <-queueDone; err != nil {
+		log.Printf("Canceled the tracks in progress, they'll be queued again on the next start: %v", err)
+	}
+
+	cancelWork()
+
+	// The work canceled, and the handlers of the connections closed above,
+	// may still be using the DB
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), workStopTimeout)
+	defer stopCancel()
+	if err := recognitions.Wait(stopCtx); err != nil {
+		log.Printf("Recognitions still running after being canceled: %v", err)
+	}
+	if err := apiRequests.Wait(stopCtx); err != nil {
+		log.Printf("API requests still running after being canceled: %v", err)
+	}
+
+	if err := dbClient.Close(); err != nil {
+		log.Printf("Error closing the database: %v", err)
+	}
+
+	if err := removeTempFiles(utils.TempDir); err != nil {
+		log.Printf("Error removing temporary files: %v", err)
+	}
+}
+
+// removeTempFiles removes dir, where recordings and uploads are stored while
+// they're processed.
+func removeTempFiles(dir string) error {
+	return os.RemoveAll(dir)
+}
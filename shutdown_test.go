@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTaskGroup(t *testing.T) {
+	var g taskGroup
+
+	release := make(chan struct{})
+	if !g.Go(func() { <-release }) {
+		t.Fatal("refused a task before being closed")
+	}
+	if !g.Add() {
+		t.Fatal("refused a task before being closed")
+	}
+
+	// Waiting is bounded by ctx, and closes the group
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := g.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want the tasks still running", err)
+	}
+	if g.Add() || g.Go(func() {}) {
+		t.Fatal("accepted a task once closed")
+	}
+
+	close(release)
+	g.Done()
+	if err := g.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithTimeoutRefusesRequestsOnShutdown(t *testing.T) {
+	t.Cleanup(func() { apiRequests = taskGroup{} })
+
+	handled := 0
+	handler := withTimeout(func(w http.ResponseWriter, r *http.Request) {
+		handled++
+	})
+
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if err := apiRequests.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusServiceUnavailable || handled != 1 {
+		t.Fatalf("got status %d after %d requests during shutdown, want %d", w.Code, handled, http.StatusServiceUnavailable)
+	}
+}
+
+func TestRemoveTempFiles(t *testing.T) {
+	tmp := t.TempDir()
+	dir, err := os.MkdirTemp(tmp, "server-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(tmp, "upload-other.wav")
+	for _, path := range []string{filepath.Join(dir, "upload-1.wav"), other} {
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := removeTempFiles(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files of other processes are kept
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("got %v, want the directory removed", err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Fatal(err)
+	}
+}
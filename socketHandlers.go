@@ -2,15 +2,20 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
-	"song-recognition/db"
+	"song-recognition/jobs"
 	"song-recognition/models"
+	"song-recognition/service"
 	"song-recognition/shazam"
-	"song-recognition/spotify"
 	"song-recognition/utils"
-	"strings"
+	"song-recognition/wav"
+	"strconv"
+	"sync"
+	"sync/atomic"
 
 	socketio "github.com/googollee/go-socket.io"
 	"github.com/mdobak/go-xerrors"
@@ -29,156 +34,258 @@ func downloadStatus(statusType, message string) string {
 	return string(jsonData)
 }
 
-func handleTotalSongs(socket socketio.Conn) {
+// logServiceError logs an error returned by the service layer.
+func logServiceError(err error) {
 	logger := utils.GetLogger()
 	ctx := context.Background()
+	logger.ErrorContext(ctx, service.ErrorMessage(err), slog.Any("error", xerrors.New(err)))
+}
 
-	db, err := db.NewDBClient()
-	if err != nil {
-		err := xerrors.New(err)
-		logger.ErrorContext(ctx, "error connecting to DB", slog.Any("error", err))
-		return
+// socketState is the context of a socket connection. ctx is canceled when the
+// socket disconnects, which stops the work still running for it.
+type socketState struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	stream *streamState // nil when the socket isn't streaming a recording
+}
+
+func getSocketState(socket socketio.Conn) (*socketState, bool) {
+	state, ok := socket.Context().(*socketState)
+	return state, ok
+}
+
+// connectedSockets holds the connected sockets by ID.
+var connectedSockets sync.Map
+
+// handleConnect gives the socket a context derived from ctx.
+func handleConnect(ctx context.Context, socket socketio.Conn) {
+	socketCtx, cancel := context.WithCancel(ctx)
+	socket.SetContext(&socketState{ctx: socketCtx, cancel: cancel})
+	connectedSockets.Store(socket.ID(), socket)
+}
+
+// handleDisconnect cancels the work still running for the socket.
+func handleDisconnect(socket socketio.Conn) {
+	connectedSockets.Delete(socket.ID())
+	if state, ok := getSocketState(socket); ok {
+		state.cancel()
+	}
+	socket.SetContext("")
+}
+
+// closeSockets disconnects the connected sockets.
+func closeSockets() {
+	connectedSockets.Range(func(_, socket interface{}) bool {
+		socket.(socketio.Conn).Close()
+		return true
+	})
+}
+
+// requestContext returns the context of a request sent by a socket, canceled
+// when the socket disconnects or the request times out.
+func requestContext(socket socketio.Conn) (context.Context, context.CancelFunc) {
+	ctx := context.Background()
+	if state, ok := getSocketState(socket); ok {
+		ctx = state.ctx
 	}
-	defer db.Close()
+	return context.WithTimeout(ctx, requestTimeout())
+}
+
+func handleTotalSongs(socket socketio.Conn) {
+	ctx, cancel := requestContext(socket)
+	defer cancel()
 
-	totalSongs, err := db.TotalSongs()
+	totalSongs, err := songService.TotalSongs(ctx)
 	if err != nil {
-		err := xerrors.New(err)
-		logger.ErrorContext(ctx, "Log error getting total songs", slog.Any("error", err))
+		logServiceError(err)
 		return
 	}
 
 	socket.Emit("totalSongs", totalSongs)
 }
 
+// jobRoom is the socket.io room receiving the progress of a job.
+func jobRoom(jobID uint32) string {
+	return fmt.Sprintf("job-%d", jobID)
+}
+
+func marshalEvent(data interface{}) (string, bool) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		logger := utils.GetLogger()
+		err := xerrors.New(err)
+		logger.ErrorContext(context.Background(), "failed to marshal data.", slog.Any("error", err))
+		return "", false
+	}
+	return string(jsonData), true
+}
+
+// handleSongDownload queues a job for a Spotify URL and subscribes the socket
+// to its progress.
 func handleSongDownload(socket socketio.Conn, spotifyURL string) {
-	logger := utils.GetLogger()
-	ctx := context.Background()
+	ctx, cancel := requestContext(socket)
+	defer cancel()
 
-	// Handle album download
-	if strings.Contains(spotifyURL, "album") {
-		tracksInAlbum, err := spotify.AlbumInfo(spotifyURL)
-		if err != nil {
-			fmt.Println("log error: ", err)
-			if len(err.Error()) <= 25 {
-				socket.Emit("downloadStatus", downloadStatus("error", err.Error()))
-				logger.Info(err.Error())
-			} else {
-				err := xerrors.New(err)
-				logger.ErrorContext(ctx, "error getting album info", slog.Any("error", err))
-			}
-			return
-		}
+	job, err := songService.EnqueueSpotify(ctx, spotifyURL)
+	if err != nil {
+		socket.Emit("downloadStatus", downloadStatus("error", service.ErrorMessage(err)))
+		logServiceError(err)
+		return
+	}
 
-		statusMsg := fmt.Sprintf("%v songs found in album.", len(tracksInAlbum))
-		socket.Emit("downloadStatus", downloadStatus("info", statusMsg))
+	socket.Join(jobRoom(job.ID))
+	socket.Emit("downloadStatus", downloadStatus("info", fmt.Sprintf("%d songs queued for download.", len(job.Tracks))))
+	if data, ok := marshalEvent(job); ok {
+		socket.Emit("jobCreated", data)
+	}
+}
 
-		totalTracksDownloaded, err := spotify.DlAlbum(spotifyURL, SONGS_DIR)
-		if err != nil {
-			socket.Emit("downloadStatus", downloadStatus("error", "Couldn't to download album."))
+// handleJobSubscribe subscribes the socket to the progress of a job and emits
+// its current status.
+func handleJobSubscribe(socket socketio.Conn, jobIDParam string) {
+	jobID, err := strconv.ParseUint(jobIDParam, 10, 32)
+	if err != nil {
+		socket.Emit("downloadStatus", downloadStatus("error", "invalid job ID"))
+		return
+	}
 
-			err := xerrors.New(err)
-			logger.ErrorContext(ctx, "failed to download album.", slog.Any("error", err))
-			return
-		}
+	ctx, cancel := requestContext(socket)
+	defer cancel()
+
+	job, err := songService.GetJob(ctx, uint32(jobID))
+	if err != nil {
+		socket.Emit("downloadStatus", downloadStatus("error", service.ErrorMessage(err)))
+		logServiceError(err)
+		return
+	}
 
-		statusMsg = fmt.Sprintf("%d songs downloaded from album", totalTracksDownloaded)
-		socket.Emit("downloadStatus", downloadStatus("success", statusMsg))
+	socket.Join(jobRoom(job.ID))
+	if data, ok := marshalEvent(job); ok {
+		socket.Emit("jobStatus", data)
 	}
+}
 
-	// Handle playlist download
-	if strings.Contains(spotifyURL, "playlist") {
-		tracksInPL, err := spotify.PlaylistInfo(spotifyURL)
-		if err != nil {
-			if len(err.Error()) <= 25 {
-				socket.Emit("downloadStatus", downloadStatus("error", err.Error()))
-				logger.Info(err.Error())
-			} else {
-				err := xerrors.New(err)
-				logger.ErrorContext(ctx, "error getting album info", slog.Any("error", err))
+// jobProgress is the payload of jobProgress events.
+type jobProgress struct {
+	JobID    uint32          `json:"jobID"`
+	Track    models.JobTrack `json:"track"`
+	Finished int             `json:"finished"` // tracks done, failed or canceled
+	Total    int             `json:"total"`
+}
+
+// broadcastJobProgress sends the progress of the queue's jobs to their rooms:
+// a jobProgress event on each track state change, then a jobStatus event and
+// a summary once the job is finished.
+func broadcastJobProgress(server *socketio.Server) jobs.ProgressFunc {
+	return func(job models.Job, track models.JobTrack) {
+		room := jobRoom(job.ID)
+
+		finished := 0
+		for _, t := range job.Tracks {
+			if t.Finished() {
+				finished++
 			}
-			return
 		}
 
-		statusMsg := fmt.Sprintf("%v songs found in playlist.", len(tracksInPL))
-		socket.Emit("downloadStatus", downloadStatus("info", statusMsg))
-
-		totalTracksDownloaded, err := spotify.DlPlaylist(spotifyURL, SONGS_DIR)
-		if err != nil {
-			socket.Emit("downloadStatus", downloadStatus("error", "Couldn't download playlist."))
+		progress := jobProgress{JobID: job.ID, Track: track, Finished: finished, Total: len(job.Tracks)}
+		if data, ok := marshalEvent(progress); ok {
+			server.BroadcastToRoom("/", room, "jobProgress", data)
+		}
 
-			err := xerrors.New(err)
-			logger.ErrorContext(ctx, "failed to download playlist.", slog.Any("error", err))
+		if !job.Finished() {
 			return
 		}
 
-		statusMsg = fmt.Sprintf("%d songs downloaded from playlist.", totalTracksDownloaded)
-		socket.Emit("downloadStatus", downloadStatus("success", statusMsg))
+		if data, ok := marshalEvent(job); ok {
+			server.BroadcastToRoom("/", room, "jobStatus", data)
+		}
+
+		done, failed := job.Count(models.TrackDone), job.Count(models.TrackFailed)
+		statusType := "success"
+		if done == 0 {
+			statusType = "error"
+		}
+		message := fmt.Sprintf("%d songs downloaded, %d failed.", done, failed)
+		server.BroadcastToRoom("/", room, "downloadStatus", downloadStatus(statusType, message))
 	}
+}
 
-	// Handle track download
-	if strings.Contains(spotifyURL, "track") {
-		trackInfo, err := spotify.TrackInfo(spotifyURL)
-		if err != nil {
-			if len(err.Error()) <= 25 {
-				socket.Emit("downloadStatus", downloadStatus("error", err.Error()))
-				logger.Info(err.Error())
-			} else {
-				err := xerrors.New(err)
-				logger.ErrorContext(ctx, "error getting album info", slog.Any("error", err))
-			}
+func handleNewRecording(socket socketio.Conn, recordData string) {
+	logger := utils.GetLogger()
+	ctx, cancel := requestContext(socket)
+
+	var recData models.RecordData
+	if err := json.Unmarshal([]byte(recordData), &recData); err != nil {
+		cancel()
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "Failed to unmarshal record data.", slog.Any("error", err))
+		return
+	}
+
+	// The disconnection of the socket is only handled once this handler
+	// returns, so the recognition runs in the background to be canceled by it
+	started := recognitions.Go(func() {
+		defer cancel()
+
+		matches, err := songService.RecognizeRecording(ctx, &recData)
+		if errors.Is(ctx.Err(), context.Canceled) {
 			return
 		}
-
-		// check if track already exist
-		db, err := db.NewDBClient()
 		if err != nil {
-			fmt.Errorf("Log - error connecting to DB: %d", err)
+			logServiceError(err)
 		}
-		defer db.Close()
 
-		song, songExists, err := db.GetSongByKey(utils.GenerateSongKey(trackInfo.Title, trackInfo.Artist))
-		if err == nil {
-			if songExists {
-				statusMsg := fmt.Sprintf(
-					"'%s' by '%s' already exists in the database (https://www.youtube.com/watch?v=%s)",
-					song.Title, song.Artist, song.YouTubeID)
+		emitMatches(socket, "matches", matches)
+	})
+	if !started {
+		cancel() // the server is shutting down
+	}
+}
 
-				socket.Emit("downloadStatus", downloadStatus("error", statusMsg))
-				return
-			}
-		} else {
-			err := xerrors.New(err)
-			logger.ErrorContext(ctx, "failed to get song by key.", slog.Any("error", err))
-		}
+// streamState holds the recognition session of a socket that streams a recording.
+type streamState struct {
+	session    *shazam.StreamSession
+	channels   int
+	sampleSize int
+	matching   atomic.Bool // whether partial matches are being looked up
+	reportedID uint32      // song last sent in a partialMatches event, set while matching
+}
 
-		totalDownloads, err := spotify.DlSingleTrack(spotifyURL, SONGS_DIR)
-		if err != nil {
-			if len(err.Error()) <= 25 {
-				socket.Emit("downloadStatus", downloadStatus("error", err.Error()))
-				logger.Info(err.Error())
-			} else {
-				err := xerrors.New(err)
-				logger.ErrorContext(ctx, "error getting album info", slog.Any("error", err))
-			}
-			return
-		}
+func getStreamState(socket socketio.Conn) (*streamState, bool) {
+	state, ok := getSocketState(socket)
+	if !ok || state.stream == nil {
+		return nil, false
+	}
+	return state.stream, true
+}
 
-		statusMsg := ""
-		if totalDownloads != 1 {
-			statusMsg = fmt.Sprintf("'%s' by '%s' failed to download", trackInfo.Title, trackInfo.Artist)
-			socket.Emit("downloadStatus", downloadStatus("error", statusMsg))
-		} else {
-			statusMsg = fmt.Sprintf("'%s' by '%s' was downloaded", trackInfo.Title, trackInfo.Artist)
-			socket.Emit("downloadStatus", downloadStatus("success", statusMsg))
-		}
+func emitMatches(socket socketio.Conn, event string, matches []shazam.Match) {
+	if len(matches) > 10 {
+		matches = matches[:10]
+	}
+
+	jsonData, err := json.Marshal(matches)
+	if err != nil {
+		logger := utils.GetLogger()
+		err := xerrors.New(err)
+		logger.ErrorContext(context.Background(), "failed to marshal matches.", slog.Any("error", err))
+		return
 	}
+
+	socket.Emit(event, string(jsonData))
 }
 
-func handleNewRecording(socket socketio.Conn, recordData string) {
+// handleStreamStart starts a streaming recognition session. recordData describes
+// the format of the PCM chunks that will follow; its audio field is ignored.
+func handleStreamStart(socket socketio.Conn, recordData string) {
 	logger := utils.GetLogger()
 	ctx := context.Background()
 
+	state, ok := getSocketState(socket)
+	if !ok {
+		return
+	}
+
 	var recData models.RecordData
 	if err := json.Unmarshal([]byte(recordData), &recData); err != nil {
 		err := xerrors.New(err)
@@ -186,29 +293,123 @@ func handleNewRecording(socket socketio.Conn, recordData string) {
 		return
 	}
 
-	samples, err := utils.ProcessRecording(&recData, true)
+	session, err := shazam.NewStreamSession(recData.SampleRate)
 	if err != nil {
 		err := xerrors.New(err)
-		logger.ErrorContext(ctx, "Failed to process recording.", slog.Any("error", err))
+		logger.ErrorContext(ctx, "Failed to start stream session.", slog.Any("error", err))
 		return
 	}
 
-	matches, _, err := shazam.FindMatches(samples, recData.Duration, recData.SampleRate)
-	if err != nil {
+	state.stream = &streamState{
+		session:    session,
+		channels:   recData.Channels,
+		sampleSize: recData.SampleSize,
+	}
+}
+
+// handleStreamChunk appends a base64 encoded PCM chunk to the socket's session and
+// emits partialMatches as soon as a song satisfies the decision rule. Matches are
+// looked up in the background, one lookup at a time, while chunks keep coming.
+// A chunk past the maximum duration of the session ends the stream, as
+// handleStreamEnd does.
+func handleStreamChunk(socket socketio.Conn, recordData string) {
+	logger := utils.GetLogger()
+	ctx := context.Background()
+
+	state, ok := getStreamState(socket)
+	if !ok {
+		logger.Info("received stream chunk without a stream session")
+		return
+	}
+
+	var recData models.RecordData
+	if err := json.Unmarshal([]byte(recordData), &recData); err != nil {
 		err := xerrors.New(err)
-		logger.ErrorContext(ctx, "failed to get matches.", slog.Any("error", err))
+		logger.ErrorContext(ctx, "Failed to unmarshal record data.", slog.Any("error", err))
+		return
 	}
 
-	jsonData, err := json.Marshal(matches)
-	if len(matches) > 10 {
-		jsonData, _ = json.Marshal(matches[:10])
+	pcm, err := base64.StdEncoding.DecodeString(recData.Audio)
+	if err != nil {
+		err := xerrors.New(err)
+		logger.ErrorContext(ctx, "Failed to decode audio chunk.", slog.Any("error", err))
+		return
 	}
 
+	samples, err := wav.PCMBytesToSamples(pcm, state.sampleSize, state.channels)
 	if err != nil {
 		err := xerrors.New(err)
-		logger.ErrorContext(ctx, "failed to marshal matches.", slog.Any("error", err))
+		logger.ErrorContext(ctx, "Failed to convert audio chunk.", slog.Any("error", err))
+		return
+	}
+
+	if err := state.session.Write(samples); err != nil {
+		logger.Info(fmt.Sprintf("rejected stream chunk, ending the stream: %v", err))
+		handleStreamEnd(socket)
 		return
 	}
+	if !state.session.ShouldMatch() || !state.matching.CompareAndSwap(false, true) {
+		return
+	}
+
+	ctx, cancel := requestContext(socket)
+	started := recognitions.Go(func() {
+		defer cancel()
+		defer state.matching.Store(false)
+
+		matches, err := state.session.Matches(ctx, songService.DB)
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return
+		}
+		if err != nil {
+			err := xerrors.New(err)
+			logger.ErrorContext(ctx, "failed to get matches.", slog.Any("error", err))
+			return
+		}
 
-	socket.Emit("matches", string(jsonData))
+		accepted := shazam.DefaultDecisionRule().Filter(matches)
+		if len(accepted) > 0 && accepted[0].SongID != state.reportedID {
+			state.reportedID = accepted[0].SongID
+			emitMatches(socket, "partialMatches", accepted)
+		}
+	})
+	if !started {
+		cancel() // the server is shutting down
+		state.matching.Store(false)
+	}
+}
+
+// handleStreamEnd closes the socket's session and runs a final match over the
+// whole stream in the background, like handleNewRecording, emitted as matches.
+func handleStreamEnd(socket socketio.Conn) {
+	logger := utils.GetLogger()
+
+	state, ok := getStreamState(socket)
+	if !ok {
+		logger.Info("received stream end without a stream session")
+		return
+	}
+	if socketState, ok := getSocketState(socket); ok {
+		socketState.stream = nil
+	}
+
+	ctx, cancel := requestContext(socket)
+	started := recognitions.Go(func() {
+		defer cancel()
+
+		matches, err := state.session.Matches(ctx, songService.DB)
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return
+		}
+		if err != nil {
+			err := xerrors.New(err)
+			logger.ErrorContext(ctx, "failed to get matches.", slog.Any("error", err))
+			return
+		}
+
+		emitMatches(socket, "matches", shazam.DefaultDecisionRule().Filter(matches))
+	})
+	if !started {
+		cancel() // the server is shutting down
+	}
 }
@@ -7,10 +7,10 @@ import (
 	"io"
 	"log/slog"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
 	"song-recognition/db"
+	"song-recognition/models"
 	"song-recognition/shazam"
 	"song-recognition/utils"
 	"song-recognition/wav"
@@ -27,8 +27,8 @@ const DELETE_SONG_FILE = false
 
 var yellow = color.New(color.FgYellow)
 
-func DlSingleTrack(url, savePath string) (int, error) {
-	trackInfo, err := TrackInfo(url)
+func DlSingleTrack(ctx context.Context, dbClient db.DBClient, url, savePath string) (int, error) {
+	trackInfo, err := TrackInfo(ctx, url)
 	if err != nil {
 		return 0, err
 	}
@@ -38,7 +38,7 @@ func DlSingleTrack(url, savePath string) (int, error) {
 	track := []Track{*trackInfo}
 
 	fmt.Println("Now, downloading track...")
-	totalTracksDownloaded, err := dlTrack(track, savePath)
+	totalTracksDownloaded, err := dlTrack(ctx, dbClient, track, savePath)
 	if err != nil {
 		return 0, err
 	}
@@ -46,15 +46,15 @@ func DlSingleTrack(url, savePath string) (int, error) {
 	return totalTracksDownloaded, nil
 }
 
-func DlPlaylist(url, savePath string) (int, error) {
-	tracks, err := PlaylistInfo(url)
+func DlPlaylist(ctx context.Context, dbClient db.DBClient, url, savePath string) (int, error) {
+	tracks, err := PlaylistInfo(ctx, url)
 	if err != nil {
 		return 0, err
 	}
 
 	time.Sleep(1 * time.Second)
 	fmt.Println("Now, downloading playlist...")
-	totalTracksDownloaded, err := dlTrack(tracks, savePath)
+	totalTracksDownloaded, err := dlTrack(ctx, dbClient, tracks, savePath)
 	if err != nil {
 		return 0, err
 	}
@@ -62,15 +62,15 @@ func DlPlaylist(url, savePath string) (int, error) {
 	return totalTracksDownloaded, nil
 }
 
-func DlAlbum(url, savePath string) (int, error) {
-	tracks, err := AlbumInfo(url)
+func DlAlbum(ctx context.Context, dbClient db.DBClient, url, savePath string) (int, error) {
+	tracks, err := AlbumInfo(ctx, url)
 	if err != nil {
 		return 0, err
 	}
 
 	time.Sleep(1 * time.Second)
 	fmt.Println("Now, downloading album...")
-	totalTracksDownloaded, err := dlTrack(tracks, savePath)
+	totalTracksDownloaded, err := dlTrack(ctx, dbClient, tracks, savePath)
 	if err != nil {
 		return 0, err
 	}
@@ -78,23 +78,14 @@ func DlAlbum(url, savePath string) (int, error) {
 	return totalTracksDownloaded, nil
 }
 
-func dlTrack(tracks []Track, path string) (int, error) {
+func dlTrack(ctx context.Context, dbClient db.DBClient, tracks []Track, path string) (int, error) {
 	var wg sync.WaitGroup
-	var downloadedTracks []string
 	var totalTracks int
 	logger := utils.GetLogger()
 	results := make(chan int, len(tracks))
 	numCPUs := runtime.NumCPU()
 	semaphore := make(chan struct{}, numCPUs)
 
-	ctx := context.Background()
-
-	db, err := db.NewDBClient()
-	if err != nil {
-		return 0, err
-	}
-	defer db.Close()
-
 	for _, t := range tracks {
 		wg.Add(1)
 		go func(track Track) {
@@ -110,10 +101,11 @@ func dlTrack(tracks []Track, path string) (int, error) {
 				Artists:  track.Artists,
 				Duration: track.Duration,
 				Title:    track.Title,
+				ID:       track.ID,
 			}
 
 			// check if song exists
-			keyExists, err := SongKeyExists(utils.GenerateSongKey(trackCopy.Title, trackCopy.Artist))
+			keyExists, err := SongKeyExists(ctx, dbClient, utils.GenerateSongKey(trackCopy.Title, trackCopy.Artist))
 			if err != nil {
 				err := xerrors.New(err)
 				logger.ErrorContext(ctx, "error checking song existence", slog.Any("error", err))
@@ -124,48 +116,28 @@ func dlTrack(tracks []Track, path string) (int, error) {
 				return
 			}
 
-			ytID, err := getYTID(trackCopy)
+			ytID, err := getYTID(ctx, dbClient, trackCopy)
 			if ytID == "" || err != nil {
 				logMessage := fmt.Sprintf("'%s' by '%s' could not be downloaded", trackCopy.Title, trackCopy.Artist)
 				logger.ErrorContext(ctx, logMessage, slog.Any("error", xerrors.New(err)))
 				return
 			}
 
-			trackCopy.Title, trackCopy.Artist = correctFilename(trackCopy.Title, trackCopy.Artist)
-			fileName := fmt.Sprintf("%s - %s", trackCopy.Title, trackCopy.Artist)
-			filePath := filepath.Join(path, fileName+".m4a")
-
-			err = downloadYTaudio(ytID, path, filePath)
+			filePath, err := DownloadTrack(ctx, *trackCopy, ytID, path)
 			if err != nil {
 				logMessage := fmt.Sprintf("'%s' by '%s' could not be downloaded", trackCopy.Title, trackCopy.Artist)
 				logger.ErrorContext(ctx, logMessage, slog.Any("error", xerrors.New(err)))
 				return
 			}
 
-			err = ProcessAndSaveSong(filePath, trackCopy.Title, trackCopy.Artist, ytID)
+			err = SaveTrack(ctx, dbClient, *trackCopy, filePath, ytID)
 			if err != nil {
 				logMessage := fmt.Sprintf("Failed to process song ('%s' by '%s')", trackCopy.Title, trackCopy.Artist)
 				logger.ErrorContext(ctx, logMessage, slog.Any("error", xerrors.New(err)))
 				return
 			}
 
-			utils.DeleteFile(filepath.Join(path, fileName+".m4a"))
-
-			wavFilePath := filepath.Join(path, fileName+".wav")
-
-			if err := addTags(wavFilePath, *trackCopy); err != nil {
-				logMessage := fmt.Sprintf("Error adding tags: %s", filePath+".wav")
-				logger.ErrorContext(ctx, logMessage, slog.Any("error", xerrors.New(err)))
-
-				return
-			}
-
-			if DELETE_SONG_FILE {
-				utils.DeleteFile(wavFilePath)
-			}
-
 			fmt.Printf("'%s' by '%s' was downloaded\n", track.Title, track.Artist)
-			downloadedTracks = append(downloadedTracks, fmt.Sprintf("%s, %s", track.Title, track.Artist))
 			results <- 1
 		}(t)
 	}
@@ -184,8 +156,72 @@ func dlTrack(tracks []Track, path string) (int, error) {
 
 }
 
+// ResolveYouTubeID finds the YouTube video of a track. Videos already used
+// by a saved song are rejected.
+func ResolveYouTubeID(ctx context.Context, dbClient db.DBClient, track Track) (string, error) {
+	ytID, err := getYTID(ctx, dbClient, &track)
+	if err != nil {
+		return "", err
+	}
+	if ytID == "" {
+		return "", fmt.Errorf("no YouTube video found for '%s' by '%s'", track.Title, track.Artist)
+	}
+	return ytID, nil
+}
+
+// DownloadTrack downloads the audio of a track's YouTube video to savePath
+// and returns the path of the downloaded file.
+func DownloadTrack(ctx context.Context, track Track, ytID, savePath string) (string, error) {
+	filePath := filepath.Join(savePath, TrackFileName(track.Title, track.Artist)+".m4a")
+
+	if err := downloadYTaudio(ctx, ytID, savePath, filePath); err != nil {
+		return "", err
+	}
+
+	return filePath, nil
+}
+
+// TrackFileName returns the name, without extension, of the files of a track
+// downloaded by DownloadTrack.
+func TrackFileName(title, artist string) string {
+	title, artist = correctFilename(title, artist)
+	return fmt.Sprintf("%s - %s", title, artist)
+}
+
+// SaveTrack fingerprints and saves a track downloaded by DownloadTrack, then
+// replaces the downloaded file by a tagged WAV file.
+func SaveTrack(ctx context.Context, dbClient db.DBClient, track Track, filePath, ytID string) error {
+	track.Title, track.Artist = correctFilename(track.Title, track.Artist)
+
+	_, err := ProcessAndSaveSong(ctx, dbClient, filePath, db.Song{
+		Title:      track.Title,
+		Artist:     track.Artist,
+		YouTubeID:  ytID,
+		Album:      track.Album,
+		Artists:    track.Artists,
+		SpotifyID:  track.ID,
+		SourceType: db.SourceSpotify,
+	})
+	if err != nil {
+		return err
+	}
+
+	utils.DeleteFile(filePath)
+
+	wavFilePath := strings.TrimSuffix(filePath, filepath.Ext(filePath)) + ".wav"
+	if err := addTags(wavFilePath, track); err != nil {
+		return err
+	}
+
+	if DELETE_SONG_FILE {
+		utils.DeleteFile(wavFilePath)
+	}
+
+	return nil
+}
+
 /* github.com/kkdai/youtube */
-func downloadYTaudio(id, path, filePath string) error {
+func downloadYTaudio(ctx context.Context, id, path, filePath string) error {
 	dir, err := os.Stat(path)
 	if err != nil {
 		panic(err)
@@ -196,7 +232,7 @@ func downloadYTaudio(id, path, filePath string) error {
 	}
 
 	client := youtube.Client{}
-	video, err := client.GetVideo(id)
+	video, err := client.GetVideoContext(ctx, id)
 	if err != nil {
 		return err
 	}
@@ -217,111 +253,165 @@ func downloadYTaudio(id, path, filePath string) error {
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 
 	for fileSize == 0 {
-		stream, _, err := client.GetStream(video, &formats[0])
+		stream, _, err := client.GetStreamContext(ctx, video, &formats[0])
 		if err != nil {
+			os.Remove(filePath)
 			return err
 		}
 
-		if _, err = io.Copy(file, stream); err != nil {
+		_, err = io.Copy(file, stream)
+		stream.Close()
+		if err != nil {
+			// Don't leave a partial file behind, e.g. when the download was canceled
+			os.Remove(filePath)
 			return err
 		}
 
 		fileSize, _ = GetFileSize(filePath)
 	}
-	defer file.Close()
 
 	return nil
 }
 
 func addTags(file string, track Track) error {
-	// Create a temporary file name by appending "2" before the extension
-	tempFile := file
-	index := strings.Index(file, ".wav")
-	if index != -1 {
-		baseName := tempFile[:index]       // Filename without extension ('/path/to/title - artist')
-		tempFile = baseName + "2" + ".wav" // Temporary filename ('/path/to/title - artist2.wav')
-	}
-
-	// Execute FFmpeg command to add metadata tags
-	cmd := exec.Command(
-		"ffmpeg",
-		"-i", file, // Input file path
-		"-c", "copy",
-		"-metadata", fmt.Sprintf("album_artist=%s", track.Artist),
-		"-metadata", fmt.Sprintf("title=%s", track.Title),
-		"-metadata", fmt.Sprintf("artist=%s", track.Artist),
-		"-metadata", fmt.Sprintf("album=%s", track.Album),
-		tempFile, // Output file path (temporary)
-	)
-
-	out, err := cmd.CombinedOutput()
+	err := wav.WriteTags(file, map[string]string{
+		"title":  track.Title,
+		"artist": track.Artist,
+		"album":  track.Album,
+	})
 	if err != nil {
-		return fmt.Errorf("failed to add tags: %v, output: %s", err, string(out))
+		return fmt.Errorf("failed to add tags: %v", err)
 	}
 
-	// Rename the temporary file to the original filename
-	if err := os.Rename(tempFile, file); err != nil {
-		return fmt.Errorf("failed to rename file: %v", err)
+	return nil
+}
+
+// ProcessAndSaveSong fingerprints an audio file and registers it with the
+// metadata of song. Its ID, allocated by the DB, and fingerprint version are
+// assigned here; its duration, content hash, source path, ingestion time and
+// source type are filled in when they're not set. The registered song is
+// returned.
+func ProcessAndSaveSong(ctx context.Context, dbClient db.DBClient, songFilePath string, song db.Song) (db.Song, error) {
+	// Songs fingerprinted with different versions can't be matched together
+	if err := shazam.CheckIndexVersion(ctx, dbClient); err != nil {
+		return db.Song{}, err
 	}
 
-	return nil
+	song, err := RegisterSongFile(ctx, dbClient, songFilePath, song)
+	if err != nil {
+		return db.Song{}, err
+	}
+
+	err = shazam.SetIndexVersion(ctx, dbClient, shazam.FingerprintVersion)
+	if err != nil {
+		return db.Song{}, fmt.Errorf("error recording fingerprint version: %v", err)
+	}
+
+	return song, nil
 }
 
-func ProcessAndSaveSong(songFilePath, songTitle, songArtist, ytID string) error {
-	dbclient, err := db.NewDBClient()
+// RegisterSongFile fingerprints and registers a song like ProcessAndSaveSong,
+// without checking or recording the fingerprint version of the database, so
+// that songs can be reindexed while the database is on another version.
+func RegisterSongFile(ctx context.Context, dbClient db.DBClient, songFilePath string, song db.Song) (db.Song, error) {
+	song, fingerprints, err := fingerprintSongFile(ctx, dbClient, songFilePath, song)
 	if err != nil {
-		return err
+		return db.Song{}, err
 	}
-	defer dbclient.Close()
 
-	wavFilePath, err := wav.ConvertToWAV(songFilePath, 1)
+	err = dbClient.RegisterSong(ctx, song, fingerprints)
 	if err != nil {
-		return err
+		return db.Song{}, err
 	}
 
-	wavInfo, err := wav.ReadWavInfo(wavFilePath)
+	fmt.Printf("Fingerprint for %v by %v saved in DB successfully\n", song.Title, song.Artist)
+	return song, nil
+}
+
+// ReplaceSongFile fingerprints a song file like RegisterSongFile and replaces
+// song with it under a new ID, which is returned. song is only deleted once
+// the file is fingerprinted and registered in its place.
+func ReplaceSongFile(ctx context.Context, dbClient db.DBClient, songFilePath string, song db.Song) (uint32, error) {
+	oldSongID := song.ID
+	song, fingerprints, err := fingerprintSongFile(ctx, dbClient, songFilePath, song)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	samples, err := wav.WavBytesToSamples(wavInfo.Data)
+	err = dbClient.ReplaceSong(ctx, oldSongID, song, fingerprints)
 	if err != nil {
-		return fmt.Errorf("error converting wav bytes to float64: %v", err)
+		return 0, err
+	}
+
+	fmt.Printf("Fingerprint for %v by %v replaced in DB successfully\n", song.Title, song.Artist)
+	return song.ID, nil
+}
+
+// fingerprintSongFile fingerprints a song file under a new song ID and fills
+// in the details of song that aren't set.
+func fingerprintSongFile(ctx context.Context, dbClient db.DBClient, songFilePath string, song db.Song) (db.Song, map[uint32][]models.Couple, error) {
+	var err error
+	if song.ContentHash == "" {
+		song.ContentHash, err = utils.HashFile(songFilePath)
+		if err != nil {
+			return db.Song{}, nil, fmt.Errorf("error hashing song: %v", err)
+		}
+	}
+	if song.SourcePath == "" {
+		song.SourcePath, err = filepath.Abs(songFilePath)
+		if err != nil {
+			return db.Song{}, nil, err
+		}
 	}
 
-	spectro, err := shazam.Spectrogram(samples, wavInfo.SampleRate)
+	wavFilePath, err := wav.ConvertToWAV(ctx, songFilePath, 1)
 	if err != nil {
-		return fmt.Errorf("error creating spectrogram: %v", err)
+		return db.Song{}, nil, err
 	}
 
-	songID, err := dbclient.RegisterSong(songTitle, songArtist, ytID)
+	reader, err := wav.OpenReader(wavFilePath)
 	if err != nil {
-		return err
+		return db.Song{}, nil, err
 	}
+	defer reader.Close()
 
-	peaks := shazam.ExtractPeaks(spectro, wavInfo.Duration)
-	fingerprints := shazam.Fingerprint(peaks, songID)
+	song.ID, err = dbClient.NextSongID(ctx)
+	if err != nil {
+		return db.Song{}, nil, err
+	}
+	song.FingerprintVersion = shazam.FingerprintVersion
+	if song.Duration == 0 {
+		song.Duration = reader.Duration()
+	}
+	if len(song.Artists) == 0 {
+		song.Artists = []string{song.Artist}
+	}
+	if song.IngestedAt.IsZero() {
+		song.IngestedAt = time.Now()
+	}
+	if song.SourceType == "" {
+		song.SourceType = db.SourceLocal
+	}
 
-	err = dbclient.StoreFingerprints(fingerprints)
+	fingerprints, err := shazam.FingerprintStream(ctx, reader, reader.SampleRate, reader.NumSamples(), song.ID)
 	if err != nil {
-		dbclient.DeleteSongByID(songID)
-		return fmt.Errorf("error to storing fingerpring: %v", err)
+		return db.Song{}, nil, fmt.Errorf("error fingerprinting song: %v", err)
 	}
 
-	fmt.Printf("Fingerprint for %v by %v saved in DB successfully\n", songTitle, songArtist)
-	return nil
+	return song, fingerprints, nil
 }
 
-func getYTID(trackCopy *Track) (string, error) {
-	ytID, err := GetYoutubeId(*trackCopy)
+func getYTID(ctx context.Context, dbClient db.DBClient, trackCopy *Track) (string, error) {
+	ytID, err := GetYoutubeId(ctx, *trackCopy)
 	if ytID == "" || err != nil {
 		return "", err
 	}
 
 	// Check if YouTube ID exists
-	ytidExists, err := YtIDExists(ytID)
+	ytidExists, err := YtIDExists(ctx, dbClient, ytID)
 	if err != nil {
 		return "", fmt.Errorf("error checking YT ID existence: %v", err)
 	}
@@ -331,12 +421,12 @@ func getYTID(trackCopy *Track) (string, error) {
 		fmt.Println("WARN: ", logMessage)
 		slog.Warn(logMessage)
 
-		ytID, err = GetYoutubeId(*trackCopy)
+		ytID, err = GetYoutubeId(ctx, *trackCopy)
 		if ytID == "" || err != nil {
 			return "", err
 		}
 
-		ytidExists, err = YtIDExists(ytID)
+		ytidExists, err = YtIDExists(ctx, dbClient, ytID)
 		if err != nil {
 			return "", fmt.Errorf("error checking YT ID existence: %v", err)
 		}
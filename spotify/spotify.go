@@ -1,6 +1,7 @@
 package spotify
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -22,6 +23,7 @@ type Track struct {
 	Title, Artist, Album string
 	Artists              []string
 	Duration             int
+	ID                   string // Spotify track ID
 }
 
 const (
@@ -34,8 +36,13 @@ const (
 	albumEndPath        = `{"persistedQuery":{"version":1,"sha256Hash":"46ae954ef2d2fe7732b4b2b4022157b2e18b7ea84f70591ceb164e4de1b5d5d3"}}`
 )
 
-func accessToken() (string, error) {
-	resp, err := http.Get(tokenEndpoint)
+func accessToken(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", tokenEndpoint, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -51,13 +58,13 @@ func accessToken() (string, error) {
 }
 
 /* requests to playlist/track endpoints */
-func request(endpoint string) (int, string, error) {
-	req, err := http.NewRequest("GET", endpoint, nil)
+func request(ctx context.Context, endpoint string) (int, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
 	if err != nil {
 		return 0, "", fmt.Errorf("error on making the request")
 	}
 
-	bearer, err := accessToken()
+	bearer, err := accessToken(ctx)
 	if err != nil {
 		return 0, "", fmt.Errorf("failed to get access token: %w", err)
 	}
@@ -88,7 +95,7 @@ func isValidPattern(url, pattern string) bool {
 	return match
 }
 
-func TrackInfo(url string) (*Track, error) {
+func TrackInfo(ctx context.Context, url string) (*Track, error) {
 	trackPattern := `^https:\/\/open\.spotify\.com\/track\/[a-zA-Z0-9]{22}\?si=[a-zA-Z0-9]{16}$`
 	if !isValidPattern(url, trackPattern) {
 		return nil, errors.New("invalid track url")
@@ -98,7 +105,7 @@ func TrackInfo(url string) (*Track, error) {
 	endpointQuery := EncodeParam(fmt.Sprintf(`{"uri":"spotify:track:%s"}`, id))
 	endpoint := trackInitialPath + endpointQuery + "&extensions=" + EncodeParam(trackEndPath)
 
-	statusCode, jsonResponse, err := request(endpoint)
+	statusCode, jsonResponse, err := request(ctx, endpoint)
 	if err != nil {
 		return nil, fmt.Errorf("error on getting track info: %w", err)
 	}
@@ -132,12 +139,13 @@ func TrackInfo(url string) (*Track, error) {
 		Artists:  allArtists,
 		Duration: durationInSeconds,
 		Album:    gjson.Get(jsonResponse, "data.trackUnion.albumOfTrack.name").String(),
+		ID:       id,
 	}
 
 	return track.buildTrack(), nil
 }
 
-func PlaylistInfo(url string) ([]Track, error) {
+func PlaylistInfo(ctx context.Context, url string) ([]Track, error) {
 	playlistPattern := `^https:\/\/open\.spotify\.com\/playlist\/[a-zA-Z0-9]{22}\?si=[a-zA-Z0-9]{16}$`
 	if !isValidPattern(url, playlistPattern) {
 		return nil, errors.New("invalid playlist url")
@@ -145,7 +153,7 @@ func PlaylistInfo(url string) ([]Track, error) {
 
 	totalCount := "data.playlistV2.content.totalCount"
 	itemsArray := "data.playlistV2.content.items"
-	tracks, err := resourceInfo(url, "playlist", totalCount, itemsArray)
+	tracks, err := resourceInfo(ctx, url, "playlist", totalCount, itemsArray)
 	if err != nil {
 		return nil, err
 	}
@@ -153,7 +161,7 @@ func PlaylistInfo(url string) ([]Track, error) {
 	return tracks, nil
 }
 
-func AlbumInfo(url string) ([]Track, error) {
+func AlbumInfo(ctx context.Context, url string) ([]Track, error) {
 	albumPattern := `^https:\/\/open\.spotify\.com\/album\/[a-zA-Z0-9-]{22}\?si=[a-zA-Z0-9_-]{22}$`
 	if !isValidPattern(url, albumPattern) {
 		return nil, errors.New("invalid album url")
@@ -161,7 +169,7 @@ func AlbumInfo(url string) ([]Track, error) {
 
 	totalCount := "data.albumUnion.discs.items.0.tracks.totalCount"
 	itemsArray := "data.albumUnion.discs.items"
-	tracks, err := resourceInfo(url, "album", totalCount, itemsArray)
+	tracks, err := resourceInfo(ctx, url, "album", totalCount, itemsArray)
 	if err != nil {
 		return nil, err
 	}
@@ -170,10 +178,10 @@ func AlbumInfo(url string) ([]Track, error) {
 }
 
 /* returns playlist/album slice of tracks */
-func resourceInfo(url, resourceType, totalCount, itemList string) ([]Track, error) {
+func resourceInfo(ctx context.Context, url, resourceType, totalCount, itemList string) ([]Track, error) {
 	id := getID(url)
 	eConf := ResourceEndpoint{Limit: 400, Offset: 0}
-	jsonResponse, err := jsonList(resourceType, id, eConf.Offset, eConf.Limit)
+	jsonResponse, err := jsonList(ctx, resourceType, id, eConf.Offset, eConf.Limit)
 	if err != nil {
 		return nil, err
 	}
@@ -195,7 +203,7 @@ func resourceInfo(url, resourceType, totalCount, itemList string) ([]Track, erro
 	for i := 1; i < int(eConf.Requests); i++ {
 		eConf.pagination()
 
-		jsonResponse, err := jsonList(resourceType, id, eConf.Offset, eConf.Limit)
+		jsonResponse, err := jsonList(ctx, resourceType, id, eConf.Offset, eConf.Limit)
 		if err != nil {
 			return nil, err
 		}
@@ -207,7 +215,7 @@ func resourceInfo(url, resourceType, totalCount, itemList string) ([]Track, erro
 }
 
 /* gets JSON respond from playlist/album endpoints */
-func jsonList(resourceType, id string, offset, limit int64) (string, error) {
+func jsonList(ctx context.Context, resourceType, id string, offset, limit int64) (string, error) {
 	var endpointQuery string
 	var endpoint string
 	if resourceType == "playlist" {
@@ -218,7 +226,7 @@ func jsonList(resourceType, id string, offset, limit int64) (string, error) {
 		endpoint = albumInitialPath + endpointQuery + "&extensions=" + EncodeParam(albumEndPath)
 	}
 
-	statusCode, jsonResponse, err := request(endpoint)
+	statusCode, jsonResponse, err := request(ctx, endpoint)
 	if err != nil {
 		return "", fmt.Errorf("error getting tracks: %w", err)
 	}
@@ -237,6 +245,7 @@ func (t *Track) buildTrack() *Track {
 		Artists:  t.Artists,
 		Duration: t.Duration,
 		Album:    t.Album,
+		ID:       t.ID,
 	}
 
 	return track
@@ -253,6 +262,8 @@ func proccessItems(jsonResponse, resourceType string) []Track {
 	artistName := map[bool]string{true: "itemV2.data.artists.items.0.profile.name", false: "track.artists.items.0.profile.name"}[resourceType == "playlist"]
 	albumName := map[bool]string{true: "itemV2.data.albumOfTrack.name", false: "data.albumUnion.name"}[resourceType == "playlist"]
 	duration := map[bool]string{true: "itemV2.data.trackDuration.totalMilliseconds", false: "track.duration.totalMilliseconds"}[resourceType == "playlist"]
+	artistItems := map[bool]string{true: "itemV2.data.artists.items", false: "track.artists.items"}[resourceType == "playlist"]
+	trackURI := map[bool]string{true: "itemV2.data.uri", false: "track.uri"}[resourceType == "playlist"]
 
 	var tracks []Track
 	items := gjson.Get(jsonResponse, itemList).Array()
@@ -260,11 +271,20 @@ func proccessItems(jsonResponse, resourceType string) []Track {
 	for _, item := range items {
 		durationInSeconds := int(item.Get(duration).Int()) / 1000
 
+		var allArtists []string
+		for _, artist := range item.Get(artistItems).Array() {
+			if name := artist.Get("profile.name").String(); name != "" {
+				allArtists = append(allArtists, name)
+			}
+		}
+
 		track := &Track{
 			Title:    item.Get(songTitle).String(),
 			Artist:   item.Get(artistName).String(),
+			Artists:  allArtists,
 			Duration: durationInSeconds,
 			Album:    map[bool]string{true: item.Get(albumName).String(), false: gjson.Get(jsonResponse, albumName).String()}[resourceType == "playlist"],
+			ID:       strings.TrimPrefix(item.Get(trackURI).String(), "spotify:track:"),
 		}
 		tracks = append(tracks, *track.buildTrack())
 	}
@@ -1,14 +1,15 @@
 package spotify
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
 	"song-recognition/db"
+	"song-recognition/wav"
 	"strings"
 )
 
@@ -39,14 +40,8 @@ func GetFileSize(file string) (int64, error) {
 	return size, nil
 }
 
-func SongKeyExists(key string) (bool, error) {
-	db, err := db.NewDBClient()
-	if err != nil {
-		return false, err
-	}
-	defer db.Close()
-
-	_, songExists, err := db.GetSongByKey(key)
+func SongKeyExists(ctx context.Context, dbClient db.DBClient, key string) (bool, error) {
+	_, songExists, err := dbClient.GetSongByKey(ctx, key)
 	if err != nil {
 		return false, err
 	}
@@ -54,14 +49,8 @@ func SongKeyExists(key string) (bool, error) {
 	return songExists, nil
 }
 
-func YtIDExists(ytID string) (bool, error) {
-	db, err := db.NewDBClient()
-	if err != nil {
-		return false, err
-	}
-	defer db.Close()
-
-	_, songExits, err := db.GetSongByYTID(ytID)
+func YtIDExists(ctx context.Context, dbClient db.DBClient, ytID string) (bool, error) {
+	_, songExits, err := dbClient.GetSongByYTID(ctx, ytID)
 	if err != nil {
 		return false, err
 	}
@@ -85,29 +74,25 @@ func correctFilename(title, artist string) (string, string) {
 	return title, artist
 }
 
-func convertStereoToMono(stereoFilePath string) ([]byte, error) {
+func convertStereoToMono(ctx context.Context, stereoFilePath string) ([]byte, error) {
 	fileExt := filepath.Ext(stereoFilePath)
 	monoFilePath := strings.TrimSuffix(stereoFilePath, fileExt) + "_mono" + fileExt
 	defer os.Remove(monoFilePath)
 
-	// Check the number of channels in the stereo audio
-	cmd := exec.Command("ffprobe", "-v", "error", "-show_entries", "stream=channels", "-of", "default=noprint_wrappers=1:nokey=1", stereoFilePath)
-	output, err := cmd.CombinedOutput()
+	audio, err := wav.DecodeFile(ctx, stereoFilePath)
 	if err != nil {
-		return nil, fmt.Errorf("error getting number of channels: %v, %v", err, string(output))
+		return nil, fmt.Errorf("error decoding stereo file: %v", err)
 	}
-	channels := strings.TrimSpace(string(output))
 
 	audioBytes, err := ioutil.ReadFile(stereoFilePath)
 	if err != nil {
 		return nil, fmt.Errorf("error reading stereo file: %v", err)
 	}
 
-	if channels != "1" {
-		// Convert stereo to mono and downsample by 44100/2
-		cmd = exec.Command("ffmpeg", "-i", stereoFilePath, "-af", "pan=mono|c0=c0", monoFilePath)
-		// cmd = exec.Command("ffmpeg", "-i", stereoFilePath, "-af", "pan=mono|c0=c0", "-ar", "22050", monoFilePath)
-		if err := cmd.Run(); err != nil {
+	if audio.Channels != 1 {
+		mono := audio.WithChannels(1)
+		err = wav.WriteWavFile(monoFilePath, wav.SamplesToPCM16(mono.Samples), mono.SampleRate, 1, 16)
+		if err != nil {
 			return nil, fmt.Errorf("error converting stereo to mono: %v", err)
 		}
 
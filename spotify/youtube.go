@@ -77,12 +77,12 @@ func convertStringDurationToSeconds(durationStr string) int {
 }
 
 // GetYoutubeId takes the query as string and returns the search results video ID's
-func GetYoutubeId(track Track) (string, error) {
+func GetYoutubeId(ctx context.Context, track Track) (string, error) {
 	songDurationInSeconds := track.Duration
 	// searchQuery := fmt.Sprintf("'%s' %s %s", track.Title, track.Artist, track.Album)
 	searchQuery := fmt.Sprintf("'%s' %s", track.Title, track.Artist)
 
-	searchResults, err := ytSearch(searchQuery, 10)
+	searchResults, err := ytSearch(ctx, searchQuery, 10)
 	if err != nil {
 		return "", err
 	}
@@ -109,14 +109,14 @@ func getContent(data []byte, index int) []byte {
 	return contents
 }
 
-func ytSearch(searchTerm string, limit int) (results []*SearchResult, err error) {
+func ytSearch(ctx context.Context, searchTerm string, limit int) (results []*SearchResult, err error) {
 	ytSearchUrl := fmt.Sprintf(
 		"https://www.youtube.com/results?search_query=%s", url.QueryEscape(searchTerm),
 	)
 
 	// fmt.Println("Search URL: ", ytSearchUrl)
 
-	req, err := http.NewRequest("GET", ytSearchUrl, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", ytSearchUrl, nil)
 	if err != nil {
 		return nil, errors.New("cannot get youtube page")
 	}
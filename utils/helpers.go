@@ -2,19 +2,27 @@ package utils
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"song-recognition/models"
 	"song-recognition/wav"
-	"strings"
 	"time"
 
 	"github.com/mdobak/go-xerrors"
 )
 
+// TempDir is the directory recordings and uploads are written to while
+// they're processed. The server uses a directory of its own in it.
+var TempDir = "tmp"
+
 func DeleteFile(filePath string) error {
 	if _, err := os.Stat(filePath); err == nil {
 		if err := os.RemoveAll(filePath); err != nil {
@@ -24,6 +32,22 @@ func DeleteFile(filePath string) error {
 	return nil
 }
 
+// HashFile returns the hex encoded SHA-256 of the content of a file.
+func HashFile(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
 func CreateFolder(folderPath string) error {
 	err := os.MkdirAll(folderPath, 0755)
 	if err != nil {
@@ -73,10 +97,20 @@ func FloatsToBytes(data []float64, bitsPerSample int) ([]byte, error) {
 	return byteData, nil
 }
 
-func ProcessRecording(recData *models.RecordData, saveRecording bool) ([]float64, error) {
+// ErrInvalidRecording is returned by ProcessRecording for recordings that
+// can't be decoded or whose format is invalid.
+var ErrInvalidRecording = errors.New("invalid recording")
+
+// ProcessRecording converts a recording sent by a client, as base64 PCM, to
+// mono samples. Recordings that can't be decoded are rejected with
+// ErrInvalidRecording; other errors come from processing valid recordings.
+func ProcessRecording(ctx context.Context, recData *models.RecordData, saveRecording bool) ([]float64, error) {
 	decodedAudioData, err := base64.StdEncoding.DecodeString(recData.Audio)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRecording, err)
+	}
+	if err := checkRecordingFormat(recData, len(decodedAudioData)); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRecording, err)
 	}
 
 	now := time.Now()
@@ -84,24 +118,32 @@ func ProcessRecording(recData *models.RecordData, saveRecording bool) ([]float64
 		now.Second(), now.Minute(), now.Hour(),
 		now.Day(), now.Month(), now.Year(),
 	)
-	filePath := "tmp/" + fileName
+	filePath := filepath.Join(TempDir, fileName)
 
 	err = wav.WriteWavFile(filePath, decodedAudioData, recData.SampleRate, recData.Channels, recData.SampleSize)
 	if err != nil {
 		return nil, err
 	}
+	defer DeleteFile(filePath)
 
-	reformatedWavFile, err := wav.ReformatWAV(filePath, 1)
+	reformatedWavFile, err := wav.ReformatWAV(ctx, filePath, 1)
 	if err != nil {
 		return nil, err
 	}
 
-	wavInfo, _ := wav.ReadWavInfo(reformatedWavFile)
-	samples, _ := wav.WavBytesToSamples(wavInfo.Data)
+	wavInfo, err := wav.ReadWavInfo(reformatedWavFile)
+	if err != nil {
+		DeleteFile(reformatedWavFile)
+		return nil, err
+	}
+	samples, err := wav.WavBytesToSamples(wavInfo.Data, wavInfo.SampleFormat)
+	if err != nil {
+		DeleteFile(reformatedWavFile)
+		return nil, err
+	}
 
 	if saveRecording {
 		logger := GetLogger()
-		ctx := context.Background()
 
 		err := CreateFolder("recordings")
 		if err != nil {
@@ -109,15 +151,33 @@ func ProcessRecording(recData *models.RecordData, saveRecording bool) ([]float64
 			logger.ErrorContext(ctx, "Failed create folder.", slog.Any("error", err))
 		}
 
-		newFilePath := strings.Replace(reformatedWavFile, "tmp/", "recordings/", 1)
+		newFilePath := filepath.Join("recordings", filepath.Base(reformatedWavFile))
 		err = os.Rename(reformatedWavFile, newFilePath)
 		if err != nil {
 			logger.ErrorContext(ctx, "Failed to move file.", slog.Any("error", err))
 		}
 	}
 
-	DeleteFile(fileName)
 	DeleteFile(reformatedWavFile)
 
 	return samples, nil
 }
+
+// checkRecordingFormat checks the format of a recording of size bytes.
+func checkRecordingFormat(recData *models.RecordData, size int) error {
+	if recData.SampleRate < 1 {
+		return fmt.Errorf("invalid sample rate: %d", recData.SampleRate)
+	}
+	if recData.Channels < 1 {
+		return fmt.Errorf("invalid number of channels: %d", recData.Channels)
+	}
+	switch recData.SampleSize {
+	case 8, 16, 24, 32:
+	default:
+		return fmt.Errorf("unsupported sample size: %d bits", recData.SampleSize)
+	}
+	if frameSize := recData.Channels * recData.SampleSize / 8; size%frameSize != 0 {
+		return fmt.Errorf("%d bytes of audio aren't whole frames of %d bytes", size, frameSize)
+	}
+	return nil
+}
@@ -3,14 +3,13 @@ package utils
 import (
 	"math/rand"
 	"os"
-	"time"
 )
 
+// GenerateUniqueID returns a random ID. It isn't guaranteed to be unique,
+// song and job IDs are allocated by the DB instead.
 func GenerateUniqueID() uint32 {
-	rand.Seed(time.Now().UnixNano())
-	randomNumber := rand.Uint32()
-
-	return randomNumber
+	// The global source is seeded randomly and safe for concurrent use
+	return rand.Uint32()
 }
 
 func GenerateSongKey(songTitle, songArtist string) string {
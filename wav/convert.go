@@ -1,15 +1,24 @@
 package wav
 
 import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 )
 
+// targetSampleRate is the sample rate of the WAV files ConvertToWAV and ReformatWAV write.
+const targetSampleRate = 44100
+
 // ConvertToWAV converts an input audio file to WAV format with specified channels.
-func ConvertToWAV(inputFilePath string, channels int) (wavFilePath string, err error) {
+// The tags of the input file are kept.
+func ConvertToWAV(ctx context.Context, inputFilePath string, channels int) (wavFilePath string, err error) {
 	_, err = os.Stat(inputFilePath)
 	if err != nil {
 		return "", fmt.Errorf("input file does not exist: %v", err)
@@ -22,24 +31,24 @@ func ConvertToWAV(inputFilePath string, channels int) (wavFilePath string, err e
 	fileExt := filepath.Ext(inputFilePath)
 	outputFile := strings.TrimSuffix(inputFilePath, fileExt) + ".wav"
 
-	// Output file may already exists. If it does FFmpeg will fail as
-	// it cannot edit existing files in-place. Use a temporary file.
+	// Files already in the target format are kept as they are
+	if outputFile == inputFilePath && isTargetWAV(inputFilePath, channels) {
+		return outputFile, nil
+	}
+
+	var tags map[string]string
+	if metadata, err := GetMetadata(ctx, inputFilePath); err == nil {
+		tags = metadata.Format.Tags
+	}
+
+	// Output file may be the input file. Use a temporary file
+	// so the input isn't truncated before it is decoded.
 	tmpFile := filepath.Join(filepath.Dir(outputFile), "tmp_"+filepath.Base(outputFile))
 	defer os.Remove(tmpFile)
 
-	cmd := exec.Command(
-		"ffmpeg",
-		"-y",
-		"-i", inputFilePath,
-		"-c", "pcm_s16le",
-		"-ar", "44100",
-		"-ac", fmt.Sprint(channels),
-		tmpFile,
-	)
-
-	output, err := cmd.CombinedOutput()
+	err = encodeWAV(ctx, inputFilePath, tmpFile, channels, tags)
 	if err != nil {
-		return "", fmt.Errorf("failed to convert to WAV: %v, output %v", err, string(output))
+		return "", fmt.Errorf("failed to convert to WAV: %v", err)
 	}
 
 	// Rename the temporary file to the output file
@@ -51,7 +60,7 @@ func ConvertToWAV(inputFilePath string, channels int) (wavFilePath string, err e
 	return outputFile, nil
 }
 
-func ReformatWAV(inputFilePath string, channels int) (reformatedFilePath string, errr error) {
+func ReformatWAV(ctx context.Context, inputFilePath string, channels int) (reformatedFilePath string, errr error) {
 	if channels < 1 || channels > 2 {
 		channels = 1
 	}
@@ -59,20 +68,187 @@ func ReformatWAV(inputFilePath string, channels int) (reformatedFilePath string,
 	fileExt := filepath.Ext(inputFilePath)
 	outputFile := strings.TrimSuffix(inputFilePath, fileExt) + "rfm.wav"
 
-	cmd := exec.Command(
-		"ffmpeg",
-		"-y",
-		"-i", inputFilePath,
-		"-c", "pcm_s16le",
-		"-ar", "44100",
-		"-ac", fmt.Sprint(channels),
-		outputFile,
-	)
-
-	output, err := cmd.CombinedOutput()
+	err := encodeWAV(ctx, inputFilePath, outputFile, channels, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to convert to WAV: %v, output %v", err, string(output))
+		return "", fmt.Errorf("failed to convert to WAV: %v", err)
 	}
 
 	return outputFile, nil
 }
+
+// isTargetWAV reports whether a file is a 16-bit PCM WAV file sampled at
+// 44.1 kHz with the given channels, the format encodeWAV writes.
+func isTargetWAV(filePath string, channels int) bool {
+	reader, err := OpenReader(filePath)
+	if err != nil {
+		return false
+	}
+	defer reader.Close()
+
+	return reader.AudioFormat == formatPCM && reader.BitsPerSample == 16 &&
+		reader.SampleRate == targetSampleRate && reader.Channels == channels
+}
+
+// encodeWAV decodes an audio file and writes it as a 16-bit PCM WAV file
+// sampled at 44.1 kHz, with the given channels and tags. The file is
+// converted chunk by chunk, it is never entirely held in memory.
+func encodeWAV(ctx context.Context, inputFilePath, outputFilePath string, channels int, tags map[string]string) error {
+	stream, err := openStream(ctx, inputFilePath)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	f, err := os.Create(outputFilePath)
+	if err != nil {
+		return err
+	}
+
+	err = convertStream(ctx, stream, f, channels, tags)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// convertStream writes the audio of stream to f, see encodeWAV.
+func convertStream(ctx context.Context, stream Stream, f io.WriteSeeker, channels int, tags map[string]string) error {
+	w, err := newWavWriter(f, targetSampleRate, channels)
+	if err != nil {
+		return err
+	}
+
+	r := newResampler(channels, stream.SampleRate(), targetSampleRate)
+	buf := make([]float64, decodeChunkFrames*stream.Channels())
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n, err := stream.Read(buf)
+		if n > 0 {
+			if err := w.write(r.write(remix(buf[:n], stream.Channels(), channels))); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			return err
+		}
+	}
+
+	if err := w.write(r.flush()); err != nil {
+		return err
+	}
+	return w.close(encodeInfoTags(tags))
+}
+
+// wavWriter writes a 16-bit PCM WAV file incrementally. The sizes of the
+// header are written once every sample has been written.
+type wavWriter struct {
+	f          io.WriteSeeker
+	w          *bufio.Writer
+	sampleRate int
+	channels   int
+	dataSize   int64
+}
+
+func newWavWriter(f io.WriteSeeker, sampleRate, channels int) (*wavWriter, error) {
+	w := &wavWriter{f: f, w: bufio.NewWriter(f), sampleRate: sampleRate, channels: channels}
+	// Placeholder header, rewritten by close
+	if err := writeWavHeader(w.w, 0, sampleRate, channels, 16, formatPCM, 0); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// write appends interleaved samples to the data chunk.
+func (w *wavWriter) write(samples []float64) error {
+	data := SamplesToPCM16(samples)
+	if w.dataSize+int64(len(data)) > math.MaxUint32-maxHeaderChunkSize {
+		return errors.New("WAV data exceeds the 4 GiB limit of the format")
+	}
+	w.dataSize += int64(len(data))
+	_, err := w.w.Write(data)
+	return err
+}
+
+// close ends the data chunk, appends the trailer chunks and writes the header.
+func (w *wavWriter) close(trailer []byte) error {
+	if w.dataSize%2 != 0 {
+		if err := w.w.WriteByte(0); err != nil {
+			return err
+		}
+	}
+	if _, err := w.w.Write(trailer); err != nil {
+		return err
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return writeWavHeader(w.f, int(w.dataSize), w.sampleRate, w.channels, 16, formatPCM, len(trailer))
+}
+
+// Resample returns the audio resampled to sampleRate. Audio is low-pass
+// filtered before it is downsampled, so that frequencies above the new
+// Nyquist frequency don't alias, and samples are linearly interpolated.
+func (a *Audio) Resample(sampleRate int) *Audio {
+	if a.SampleRate == sampleRate || len(a.Samples) == 0 {
+		return a
+	}
+
+	r := newResampler(a.Channels, a.SampleRate, sampleRate)
+	out := append(r.write(a.Samples), r.flush()...)
+
+	return &Audio{Samples: out, Channels: a.Channels, SampleRate: sampleRate}
+}
+
+// WithChannels returns the audio with the given number of channels, 1 or 2.
+// Audio is down-mixed to mono by averaging, mono audio is duplicated to stereo.
+func (a *Audio) WithChannels(channels int) *Audio {
+	if a.Channels == channels {
+		return a
+	}
+	return &Audio{Samples: remix(a.Samples, a.Channels, channels), Channels: channels, SampleRate: a.SampleRate}
+}
+
+// remix converts interleaved samples from one number of channels to another, see WithChannels.
+func remix(samples []float64, from, to int) []float64 {
+	if from == to {
+		return samples
+	}
+
+	mono := downmix(samples, from)
+	if to == 1 {
+		return mono
+	}
+
+	out := make([]float64, len(mono)*to)
+	for i, sample := range mono {
+		for ch := 0; ch < to; ch++ {
+			out[i*to+ch] = sample
+		}
+	}
+	return out
+}
+
+// SamplesToPCM16 converts samples in the range [-1, 1] to little-endian 16-bit PCM.
+// Samples outside of the range are clipped.
+func SamplesToPCM16(samples []float64) []byte {
+	data := make([]byte, len(samples)*2)
+	for i, sample := range samples {
+		value := math.Round(sample * 32768)
+		value = math.Max(-32768, math.Min(32767, value))
+		binary.LittleEndian.PutUint16(data[i*2:], uint16(int16(value)))
+	}
+	return data
+}
@@ -0,0 +1,79 @@
+package wav
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+)
+
+func TestConvertToWAV(t *testing.T) {
+	tags := map[string]string{"title": "Title", "artist": "Artist"}
+	samples := tone(440, 48000, 48000, 2)
+	var data []byte
+	for _, sample := range samples {
+		data = append(data, float32s(float32(sample))...)
+	}
+
+	filePath := writeTestFile(t, "song.wav", riff(
+		fmtChunk(formatFloat, 2, 48000, 32, 0),
+		chunk("data", data),
+		infoChunk(tags),
+	))
+
+	wavFilePath, err := ConvertToWAV(context.Background(), filePath, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wavFilePath != filePath {
+		t.Fatalf("got %s, want %s", wavFilePath, filePath)
+	}
+
+	info, err := ReadWavInfo(wavFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := SampleFormat{AudioFormat: formatPCM, Channels: 1, SampleRate: targetSampleRate, BitsPerSample: 16}
+	if info.SampleFormat != want {
+		t.Fatalf("got format %+v, want %+v", info.SampleFormat, want)
+	}
+	assertTags(t, info.Tags, tags)
+
+	// Same result as converting the whole audio at once
+	audio := (&Audio{Samples: samples, Channels: 2, SampleRate: 48000}).WithChannels(1).Resample(targetSampleRate)
+	if !bytes.Equal(info.Data, SamplesToPCM16(audio.Samples)) {
+		t.Fatalf("got %d bytes of data, want the %d bytes of the whole audio", len(info.Data), len(audio.Samples)*2)
+	}
+}
+
+func TestConvertToWAVKeepsTargetFormat(t *testing.T) {
+	file := riff(fmtChunk(formatPCM, 1, targetSampleRate, 16, 0), chunk("data", pcm16(1, 2, 3)), chunk("junk", []byte{1}))
+	filePath := writeTestFile(t, "song.wav", file)
+
+	wavFilePath, err := ConvertToWAV(context.Background(), filePath, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(wavFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, file) {
+		t.Fatal("a file already in the target format was rewritten")
+	}
+
+	// A stereo file isn't in the target format for mono
+	stereoPath := writeTestFile(t, "stereo.wav", riff(fmtChunk(formatPCM, 2, targetSampleRate, 16, 0), chunk("data", pcm16(1, 3))))
+	if _, err := ConvertToWAV(context.Background(), stereoPath, 1); err != nil {
+		t.Fatal(err)
+	}
+	info, err := ReadWavInfo(stereoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Channels != 1 || !bytes.Equal(info.Data, pcm16(2)) {
+		t.Fatalf("got %d channels and data %v, want a mono frame", info.Channels, info.Data)
+	}
+}
@@ -0,0 +1,470 @@
+package wav
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+var (
+	// ErrUnsupportedFormat is returned by decoders for audio they can't decode.
+	ErrUnsupportedFormat = errors.New("unsupported audio format")
+	// ErrInvalidAudio is returned for files in a supported format that can't
+	// be decoded, e.g. truncated or corrupt files.
+	ErrInvalidAudio = errors.New("invalid audio data")
+	// ErrNoFFmpeg is returned for the formats no native decoder supports when
+	// ffmpeg isn't installed.
+	ErrNoFFmpeg = errors.New("ffmpeg isn't installed")
+)
+
+// Audio holds decoded audio as interleaved samples in the range [-1, 1].
+type Audio struct {
+	Samples    []float64
+	Channels   int
+	SampleRate int
+}
+
+// Duration returns the length of the audio in seconds.
+func (a *Audio) Duration() float64 {
+	return float64(len(a.Samples)/a.Channels) / float64(a.SampleRate)
+}
+
+// Mono returns the samples down-mixed to a single channel.
+func (a *Audio) Mono() []float64 {
+	return downmix(a.Samples, a.Channels)
+}
+
+// Info describes an audio file without decoding it.
+type Info struct {
+	Format     string
+	Channels   int
+	SampleRate int
+	Duration   float64
+	Tags       map[string]string // keyed like ffprobe tags: title, artist, album...
+}
+
+// Stream reads decoded audio incrementally, so that files of any length can
+// be processed with bounded memory.
+type Stream interface {
+	Channels() int
+	SampleRate() int
+	// Read reads up to len(buf) interleaved samples in the range [-1, 1], a
+	// whole number of frames. buf must hold at least one frame. It returns
+	// io.EOF once every sample has been read.
+	Read(buf []float64) (int, error)
+}
+
+// Decoder decodes an audio format natively. Decoders are tried in the order
+// they were registered, the first one detecting a file's format decodes it.
+type Decoder interface {
+	// Detect reports whether header, the first bytes of a file, belong to the decoder's format.
+	Detect(header []byte) bool
+	Open(r io.ReadSeeker) (Stream, error)
+	Probe(r io.ReadSeeker) (*Info, error)
+}
+
+// headerSize is the number of bytes passed to Decoder.Detect
+const headerSize = 16
+
+var decoders []Decoder
+
+// RegisterDecoder adds a native decoder. Decoders registered later are only
+// used for files the previous decoders don't detect.
+func RegisterDecoder(d Decoder) {
+	decoders = append(decoders, d)
+}
+
+func init() {
+	RegisterDecoder(wavDecoder{})
+	RegisterDecoder(flacDecoder{})
+	RegisterDecoder(mp3Decoder{})
+}
+
+// sourceFile is a file read by a decoder. It records the read failures, so
+// that they can be told apart from invalid audio data.
+type sourceFile struct {
+	file *os.File
+	err  error // first read or seek failure
+}
+
+func (f *sourceFile) Read(p []byte) (int, error) {
+	n, err := f.file.Read(p)
+	f.record(err)
+	return n, err
+}
+
+func (f *sourceFile) Seek(offset int64, whence int) (int64, error) {
+	n, err := f.file.Seek(offset, whence)
+	f.record(err)
+	return n, err
+}
+
+func (f *sourceFile) Close() error {
+	return f.file.Close()
+}
+
+func (f *sourceFile) record(err error) {
+	if err != nil && err != io.EOF && f.err == nil {
+		f.err = err
+	}
+}
+
+// decodeError returns the error to report for err, returned by a decoder
+// reading f: the read failure if there was one, ErrUnsupportedFormat errors
+// as they are, and ErrInvalidAudio for anything else.
+func (f *sourceFile) decodeError(err error) error {
+	name := filepath.Base(f.file.Name())
+	switch {
+	case f.err != nil:
+		return fmt.Errorf("failed to read %s: %w", name, f.err)
+	case errors.Is(err, ErrUnsupportedFormat):
+		return err
+	default:
+		return fmt.Errorf("%w: %s: %v", ErrInvalidAudio, name, err)
+	}
+}
+
+// openWithDecoder opens a file and returns the decoder detecting its format.
+// It returns ErrUnsupportedFormat if no decoder does.
+func openWithDecoder(filePath string) (*sourceFile, Decoder, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		file.Close()
+		return nil, nil, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	for _, d := range decoders {
+		if d.Detect(header[:n]) {
+			return &sourceFile{file: file}, d, nil
+		}
+	}
+
+	file.Close()
+	return nil, nil, fmt.Errorf("%w: %s", ErrUnsupportedFormat, filepath.Base(filePath))
+}
+
+// decodeChunkFrames is the number of frames read from a Stream at a time
+const decodeChunkFrames = 1 << 14
+
+// fileStream is a Stream decoding a file, which must be closed. Read errors
+// wrap ErrInvalidAudio, unless reading the file or running ffmpeg failed.
+type fileStream struct {
+	Stream
+	source *sourceFile // nil when decoding with ffmpeg
+	close  func() error
+}
+
+func (s *fileStream) Read(buf []float64) (int, error) {
+	n, err := s.Stream.Read(buf)
+	if err != nil && !errors.Is(err, io.EOF) && s.source != nil {
+		err = s.source.decodeError(err)
+	}
+	return n, err
+}
+
+func (s *fileStream) Close() error {
+	return s.close()
+}
+
+// openStream starts decoding an audio file. Files that no native decoder
+// supports are decoded with ffmpeg, if it's installed, which is killed if
+// ctx is done.
+func openStream(ctx context.Context, filePath string) (*fileStream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	source, decoder, err := openWithDecoder(filePath)
+	if err == nil {
+		stream, err := decoder.Open(source)
+		if err == nil {
+			return &fileStream{Stream: stream, source: source, close: source.Close}, nil
+		}
+		source.Close()
+		if err := source.decodeError(err); !errors.Is(err, ErrUnsupportedFormat) {
+			return nil, err
+		}
+	} else if !errors.Is(err, ErrUnsupportedFormat) {
+		return nil, err
+	}
+
+	return openFFmpegStream(ctx, filePath)
+}
+
+// DecodeFile decodes a whole audio file in memory, see openStream.
+// Decoding errors wrap ErrUnsupportedFormat or ErrInvalidAudio when the file
+// is at fault, other errors are failures to read the file or to run ffmpeg.
+func DecodeFile(ctx context.Context, filePath string) (*Audio, error) {
+	stream, err := openStream(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	audio := &Audio{Channels: stream.Channels(), SampleRate: stream.SampleRate()}
+	buf := make([]float64, decodeChunkFrames*audio.Channels)
+	for {
+		n, err := stream.Read(buf)
+		audio.Samples = append(audio.Samples, buf[:n]...)
+		if errors.Is(err, io.EOF) {
+			return audio, nil
+		}
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			return nil, fmt.Errorf("failed to decode %s: %w", filepath.Base(filePath), err)
+		}
+	}
+}
+
+// probeMetadata retrieves the metadata of a file with a native decoder,
+// in the layout ffprobe returns it.
+func probeMetadata(filePath string) (FFmpegMetadata, error) {
+	var metadata FFmpegMetadata
+
+	file, decoder, err := openWithDecoder(filePath)
+	if err != nil {
+		return metadata, err
+	}
+	defer file.Close()
+
+	info, err := decoder.Probe(file)
+	if err != nil {
+		return metadata, file.decodeError(err)
+	}
+
+	metadata.Format.Streams = 1
+	metadata.Format.FormFilename = filePath
+	metadata.Format.NbatName = info.Format
+	metadata.Format.Duration = strconv.FormatFloat(info.Duration, 'f', 6, 64)
+	metadata.Format.Tags = info.Tags
+	metadata.Streams = append(metadata.Streams, FFmpegStream{
+		CodecType:  "audio",
+		SampleRate: strconv.Itoa(info.SampleRate),
+		Channels:   info.Channels,
+		Duration:   metadata.Format.Duration,
+	})
+
+	return metadata, nil
+}
+
+// ffmpegSampleRate and ffmpegChannels are the format ffmpeg decodes to
+const (
+	ffmpegSampleRate = 44100
+	ffmpegChannels   = 2
+)
+
+// ffmpegStream decodes a file with ffmpeg, for formats no native decoder supports.
+type ffmpegStream struct {
+	pcm16Stream
+	cmd     *exec.Cmd
+	stderr  bytes.Buffer
+	waited  bool
+	waitErr error
+}
+
+func openFFmpegStream(ctx context.Context, filePath string) (*fileStream, error) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		reason := "no native decoder for its format"
+		if isMP4(filePath) {
+			reason = "AAC in M4A, the format of YouTube downloads, has no native decoder: install ffmpeg to decode it"
+		}
+		return nil, fmt.Errorf("%w: %s (%s)", ErrNoFFmpeg, filepath.Base(filePath), reason)
+	}
+
+	s := &ffmpegStream{}
+	s.cmd = exec.CommandContext(
+		ctx,
+		"ffmpeg",
+		"-v", "error",
+		"-i", filePath,
+		"-f", "s16le",
+		"-c:a", "pcm_s16le",
+		"-ar", fmt.Sprint(ffmpegSampleRate),
+		"-ac", fmt.Sprint(ffmpegChannels),
+		"-",
+	)
+	s.cmd.Stderr = &s.stderr
+
+	stdout, err := s.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ffmpeg: %v", err)
+	}
+	s.pcm16Stream = pcm16Stream{r: stdout, channels: ffmpegChannels, sampleRate: ffmpegSampleRate}
+
+	return &fileStream{Stream: s, close: s.close}, nil
+}
+
+// Read returns ffmpeg's error, if it failed, once its output has been read.
+// ffmpeg exiting with an error status means it couldn't decode the file.
+func (s *ffmpegStream) Read(buf []float64) (int, error) {
+	n, err := s.pcm16Stream.Read(buf)
+	if errors.Is(err, io.EOF) {
+		var exitErr *exec.ExitError
+		if err := s.wait(); errors.As(err, &exitErr) {
+			return 0, fmt.Errorf("%w: ffmpeg failed: %v, output %v", ErrInvalidAudio, err, s.stderr.String())
+		} else if err != nil {
+			return 0, fmt.Errorf("ffmpeg failed: %v", err)
+		}
+	}
+	return n, err
+}
+
+func (s *ffmpegStream) wait() error {
+	if !s.waited {
+		s.waited = true
+		s.waitErr = s.cmd.Wait()
+	}
+	return s.waitErr
+}
+
+// close kills ffmpeg if its output hasn't been read entirely.
+func (s *ffmpegStream) close() error {
+	if !s.waited {
+		s.cmd.Process.Kill()
+	}
+	s.wait()
+	return nil
+}
+
+// pcm16Stream decodes interleaved little-endian 16-bit PCM read from r.
+type pcm16Stream struct {
+	r          io.Reader
+	channels   int
+	sampleRate int
+	buf        []byte
+}
+
+func (s *pcm16Stream) Channels() int {
+	return s.channels
+}
+
+func (s *pcm16Stream) SampleRate() int {
+	return s.sampleRate
+}
+
+func (s *pcm16Stream) Read(buf []float64) (int, error) {
+	frameSize := s.channels * 2
+	n := len(buf) / s.channels * frameSize
+	if cap(s.buf) < n {
+		s.buf = make([]byte, n)
+	}
+
+	read, err := io.ReadFull(s.r, s.buf[:n])
+	read -= read % frameSize
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		// The stream ended, an incomplete last frame is dropped
+		err = nil
+		if read == 0 {
+			err = io.EOF
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < read/2; i++ {
+		buf[i] = float64(int16(binary.LittleEndian.Uint16(s.buf[i*2:]))) / 32768.0
+	}
+	return read / 2, nil
+}
+
+// isMP4 reports whether a file is an MP4 container, e.g. M4A audio.
+func isMP4(filePath string) bool {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return false
+	}
+	return string(header[4:8]) == "ftyp"
+}
+
+// wavDecoder decodes WAV files with PCM or IEEE float samples.
+type wavDecoder struct{}
+
+func (wavDecoder) Detect(header []byte) bool {
+	return len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "WAVE"
+}
+
+func (wavDecoder) Open(r io.ReadSeeker) (Stream, error) {
+	reader, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return wavStream{reader}, nil
+}
+
+// Probe reads the chunks preceding the data chunk, then seeks past it for the
+// tags following it. The data isn't read.
+func (wavDecoder) Probe(r io.ReadSeeker) (*Info, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	reader, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	reader.limitFrames(size)
+	readTrailingTags(r, reader.dataEnd(), reader.Tags)
+
+	return &Info{
+		Format:     "wav",
+		Channels:   reader.Channels,
+		SampleRate: reader.SampleRate,
+		Duration:   reader.Duration(),
+		Tags:       reader.Tags,
+	}, nil
+}
+
+// wavStream reads the interleaved samples of a WAV file.
+type wavStream struct {
+	r *Reader
+}
+
+func (s wavStream) Channels() int {
+	return s.r.Channels
+}
+
+func (s wavStream) SampleRate() int {
+	return s.r.SampleRate
+}
+
+func (s wavStream) Read(buf []float64) (int, error) {
+	samples, err := s.r.readFrames(len(buf) / s.r.Channels)
+	if err != nil {
+		return 0, err
+	}
+	return copy(buf, samples), nil
+}
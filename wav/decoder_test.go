@@ -0,0 +1,39 @@
+package wav
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestDecodeFileErrors(t *testing.T) {
+	// Formats without a native decoder need ffmpeg
+	t.Setenv("PATH", "")
+
+	tests := []struct {
+		name    string
+		file    []byte
+		wantErr error
+	}{
+		{"WAV without data", riff(fmtChunk(formatPCM, 1, 44100, 16, 0)), ErrInvalidAudio},
+		{"WAV with an invalid fmt chunk", riff(chunk("fmt ", []byte{1, 0}), chunk("data", pcm16(1))), ErrInvalidAudio},
+		{"corrupt FLAC", []byte("fLaC\x00\x00\x00\x22garbage"), ErrInvalidAudio},
+		{"unknown format", []byte("not audio at all"), ErrNoFFmpeg},
+		{"WAV format without a native decoder", riff(fmtChunk(2, 1, 44100, 4, 0), chunk("data", pcm16(1))), ErrNoFFmpeg},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeFile(context.Background(), writeTestFile(t, "audio", tt.file))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Failing to read the file isn't the file's fault
+	_, err := DecodeFile(context.Background(), "missing.wav")
+	if err == nil || errors.Is(err, ErrInvalidAudio) || errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatalf("got %v, want a read error", err)
+	}
+}
@@ -0,0 +1,88 @@
+package wav
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/mewkiz/flac"
+)
+
+// flacDecoder decodes FLAC files.
+type flacDecoder struct{}
+
+func (flacDecoder) Detect(header []byte) bool {
+	return len(header) >= 4 && string(header[:4]) == "fLaC"
+}
+
+func (flacDecoder) Open(r io.ReadSeeker) (Stream, error) {
+	stream, err := flac.New(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FLAC stream: %v", err)
+	}
+
+	return &flacStream{
+		stream:   stream,
+		channels: int(stream.Info.NChannels),
+		scale:    float64(int64(1) << (stream.Info.BitsPerSample - 1)),
+	}, nil
+}
+
+func (flacDecoder) Probe(r io.ReadSeeker) (*Info, error) {
+	stream, err := flac.New(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FLAC stream: %v", err)
+	}
+
+	info := stream.Info
+	return &Info{
+		Format:     "flac",
+		Channels:   int(info.NChannels),
+		SampleRate: int(info.SampleRate),
+		Duration:   float64(info.NSamples) / float64(info.SampleRate),
+		Tags:       readTags(r),
+	}, nil
+}
+
+// flacStream decodes a FLAC stream frame by frame.
+type flacStream struct {
+	stream   *flac.Stream
+	channels int
+	scale    float64
+	pending  []float64 // interleaved samples of the last frame not read yet
+}
+
+func (s *flacStream) Channels() int {
+	return s.channels
+}
+
+func (s *flacStream) SampleRate() int {
+	return int(s.stream.Info.SampleRate)
+}
+
+func (s *flacStream) Read(buf []float64) (int, error) {
+	for len(s.pending) == 0 {
+		frame, err := s.stream.ParseNext()
+		if errors.Is(err, io.EOF) {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, fmt.Errorf("invalid FLAC frame: %v", err)
+		}
+
+		if len(frame.Subframes) != s.channels {
+			return 0, fmt.Errorf("FLAC frame has %d channels, expected %d", len(frame.Subframes), s.channels)
+		}
+
+		s.pending = s.pending[:0]
+		for i := 0; i < int(frame.BlockSize); i++ {
+			for _, subframe := range frame.Subframes {
+				s.pending = append(s.pending, float64(subframe.Samples[i])/s.scale)
+			}
+		}
+	}
+
+	n := copy(buf[:len(buf)-len(buf)%s.channels], s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
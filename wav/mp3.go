@@ -0,0 +1,49 @@
+package wav
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/hajimehoshi/go-mp3"
+)
+
+// mp3Decoder decodes MPEG-1/2 Layer III files. go-mp3 always decodes to
+// 16-bit stereo.
+type mp3Decoder struct{}
+
+const (
+	mp3Channels      = 2
+	mp3BytesPerFrame = mp3Channels * 2
+)
+
+func (mp3Decoder) Detect(header []byte) bool {
+	if len(header) >= 3 && string(header[:3]) == "ID3" {
+		return true
+	}
+	// Frame sync: 11 set bits, followed by the Layer III bits
+	return len(header) >= 2 && header[0] == 0xFF && header[1]&0xE0 == 0xE0 && header[1]&0x06 == 0x02
+}
+
+func (mp3Decoder) Open(r io.ReadSeeker) (Stream, error) {
+	d, err := mp3.NewDecoder(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MP3 stream: %v", err)
+	}
+
+	return &pcm16Stream{r: d, channels: mp3Channels, sampleRate: d.SampleRate()}, nil
+}
+
+func (mp3Decoder) Probe(r io.ReadSeeker) (*Info, error) {
+	d, err := mp3.NewDecoder(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MP3 stream: %v", err)
+	}
+
+	return &Info{
+		Format:     "mp3",
+		Channels:   mp3Channels,
+		SampleRate: d.SampleRate(),
+		Duration:   float64(d.Length()/mp3BytesPerFrame) / float64(d.SampleRate()),
+		Tags:       readTags(r),
+	}, nil
+}
@@ -0,0 +1,236 @@
+package wav
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// maxHeaderChunkSize bounds the size of the chunks preceding the data chunk
+// that are read into memory (fmt and LIST), other chunks are skipped.
+const maxHeaderChunkSize = 1 << 20
+
+// Reader decodes the samples of a WAV file incrementally, so that files of
+// any length can be processed with bounded memory. Unlike ReadWavInfo it only
+// sees the tags of LIST/INFO chunks preceding the data chunk.
+type Reader struct {
+	SampleFormat
+	Tags map[string]string
+
+	r          io.Reader
+	closer     io.Closer
+	frameSize  int
+	dataOffset int64 // offset of the data chunk's samples in the file
+	dataSize   int64 // size of the data chunk, as declared in its header
+	remaining  int64 // bytes of the data chunk not read yet
+	numFrames  int
+	buf        []byte
+}
+
+// NewReader reads the chunks of a WAV stream up to the data chunk.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+
+	var header [12]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, fmt.Errorf("invalid WAV header format: %v", err)
+	}
+	if string(header[:4]) != "RIFF" || string(header[8:12]) != "WAVE" {
+		return nil, errors.New("invalid WAV header format")
+	}
+
+	reader := &Reader{r: br, Tags: map[string]string{}}
+	hasFormat := false
+	offset := int64(len(header))
+
+	for {
+		var chunkHeader [8]byte
+		if _, err := io.ReadFull(br, chunkHeader[:]); err != nil {
+			return nil, errors.New("invalid WAV file (no data chunk)")
+		}
+		id := string(chunkHeader[:4])
+		size := int64(binary.LittleEndian.Uint32(chunkHeader[4:8]))
+		offset += int64(len(chunkHeader))
+
+		if id == "data" {
+			if !hasFormat {
+				return nil, errors.New("invalid WAV file (no fmt chunk)")
+			}
+			reader.frameSize = reader.Channels * reader.BitsPerSample / 8
+			reader.dataOffset = offset
+			reader.dataSize = size
+			reader.remaining = size - size%int64(reader.frameSize)
+			reader.numFrames = int(reader.remaining / int64(reader.frameSize))
+			return reader, nil
+		}
+
+		// Chunks are padded to an even size
+		padded := size + size%2
+		offset += padded
+
+		if (id == "fmt " || id == "LIST") && size <= maxHeaderChunkSize {
+			body := make([]byte, padded)
+			if _, err := io.ReadFull(br, body); err != nil {
+				return nil, fmt.Errorf("invalid WAV %q chunk: %v", id, err)
+			}
+			body = body[:size]
+
+			if id == "fmt " && !hasFormat {
+				format, err := readFormat(body)
+				if err != nil {
+					return nil, err
+				}
+				reader.SampleFormat = format
+				hasFormat = true
+			} else if id == "LIST" && len(body) >= 4 && string(body[:4]) == "INFO" {
+				readInfoSubchunks(body[4:], reader.Tags)
+			}
+			continue
+		}
+
+		if _, err := io.CopyN(io.Discard, br, padded); err != nil {
+			return nil, fmt.Errorf("invalid WAV %q chunk: %v", id, err)
+		}
+	}
+}
+
+// OpenReader opens a WAV file for reading with a Reader. The reader must be closed.
+func OpenReader(filename string) (*Reader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	reader.closer = file
+
+	if stat, err := file.Stat(); err == nil {
+		reader.limitFrames(stat.Size())
+	}
+
+	return reader, nil
+}
+
+// limitFrames bounds the frames of the data chunk to the size of the file.
+// Recorders that never updated the data chunk size leave it too large, the
+// data then ends with the file.
+func (r *Reader) limitFrames(fileSize int64) {
+	maxFrames := (fileSize - r.dataOffset) / int64(r.frameSize)
+	if maxFrames < 0 {
+		maxFrames = 0
+	}
+	if int64(r.numFrames) > maxFrames {
+		r.numFrames = int(maxFrames)
+	}
+}
+
+// dataEnd returns the offset of the chunk following the data chunk.
+func (r *Reader) dataEnd() int64 {
+	return r.dataOffset + r.dataSize + r.dataSize%2
+}
+
+// readTrailingTags reads the tags of the LIST/INFO chunks from offset to the
+// end of r, e.g. the chunks following the data chunk. The walk stops at the
+// first malformed chunk.
+func readTrailingTags(r io.ReadSeeker, offset int64, tags map[string]string) {
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+
+	for {
+		var chunkHeader [8]byte
+		if _, err := io.ReadFull(r, chunkHeader[:]); err != nil {
+			return
+		}
+		id := string(chunkHeader[:4])
+		size := int64(binary.LittleEndian.Uint32(chunkHeader[4:8]))
+		padded := size + size%2
+
+		if id != "LIST" || size > maxHeaderChunkSize {
+			if _, err := r.Seek(padded, io.SeekCurrent); err != nil {
+				return
+			}
+			continue
+		}
+
+		body := make([]byte, size)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+		if len(body) >= 4 && string(body[:4]) == "INFO" {
+			readInfoSubchunks(body[4:], tags)
+		}
+		if _, err := r.Seek(padded-size, io.SeekCurrent); err != nil {
+			return
+		}
+	}
+}
+
+// NumSamples returns the number of samples per channel of the data chunk,
+// which is the number of samples ReadSamples returns in total.
+func (r *Reader) NumSamples() int {
+	return r.numFrames
+}
+
+// Duration returns the length of the audio in seconds.
+func (r *Reader) Duration() float64 {
+	return float64(r.numFrames) / float64(r.SampleRate)
+}
+
+// ReadSamples reads up to len(buf) samples, down-mixed to mono and in the
+// range [-1, 1]. It returns io.EOF once every sample has been read.
+func (r *Reader) ReadSamples(buf []float64) (int, error) {
+	samples, err := r.readFrames(len(buf))
+	if err != nil {
+		return 0, err
+	}
+	return copy(buf, downmix(samples, r.Channels)), nil
+}
+
+// readFrames reads up to frames frames, as interleaved samples in the range
+// [-1, 1]. It returns io.EOF once every frame has been read.
+func (r *Reader) readFrames(frames int) ([]float64, error) {
+	if r.remaining <= 0 {
+		return nil, io.EOF
+	}
+
+	n := int64(frames * r.frameSize)
+	if n > r.remaining {
+		n = r.remaining
+	}
+	if int64(cap(r.buf)) < n {
+		r.buf = make([]byte, n)
+	}
+
+	read, err := io.ReadFull(r.r, r.buf[:n])
+	r.remaining -= int64(read)
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		// The data chunk is truncated, drop the incomplete frame
+		r.remaining = 0
+		read -= read % r.frameSize
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if read == 0 {
+		return nil, io.EOF
+	}
+
+	return decodeSamples(r.buf[:read], r.AudioFormat, r.BitsPerSample)
+}
+
+// Close closes the file opened by OpenReader.
+func (r *Reader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
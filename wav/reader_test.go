@@ -0,0 +1,242 @@
+package wav
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+)
+
+// readerTestFiles are files the streaming reader and readWavInfo must read alike.
+func readerTestFiles() map[string][]byte {
+	tags := map[string]string{"title": "Title", "artist": "Artist"}
+	long := make([]int16, 10000)
+	for i := range long {
+		long[i] = int16(i*7 - 30000)
+	}
+
+	return map[string][]byte{
+		"16-bit PCM": riff(fmtChunk(formatPCM, 1, 44100, 16, 0), chunk("data", pcm16(long...))),
+		"stereo":     riff(fmtChunk(formatPCM, 2, 8000, 16, 0), chunk("data", pcm16(long...))),
+		"tags before and after the data": riff(
+			fmtChunk(formatPCM, 1, 44100, 16, 0),
+			infoChunk(map[string]string{"album": "Album"}),
+			chunk("data", pcm16(long[:99]...)),
+			infoChunk(tags),
+		),
+		"skipped chunks": riff(
+			chunk("junk", []byte{1, 2, 3}),
+			fmtChunk(formatFloat, 1, 44100, 32, 0),
+			chunk("fact", []byte{3, 0, 0, 0}),
+			chunk("data", float32s(0.25, -0.5, 1)),
+		),
+		"extensible 24-bit": riff(extensibleFmtChunk(formatPCM, 2, 48000, 24), chunk("data", bytes.Repeat([]byte{1, 2, 0x80}, 100))),
+		"odd-sized 8-bit":   riff(fmtChunk(formatPCM, 1, 8000, 8, 0), chunk("data", []byte{128, 192, 64}), infoChunk(tags)),
+		"truncated data chunk": append(riff(fmtChunk(formatPCM, 2, 44100, 16, 0)),
+			append([]byte("data\xff\xff\xff\x7f"), pcm16(long[:101]...)...)...),
+	}
+}
+
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+
+	filePath := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+func TestReaderMatchesReadWavInfo(t *testing.T) {
+	for name, file := range readerTestFiles() {
+		t.Run(name, func(t *testing.T) {
+			want, err := readWavInfo(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantSamples, err := WavBytesToSamples(want.Data, want.SampleFormat)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reader, err := OpenReader(writeTestFile(t, "test.wav", file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+
+			if reader.SampleFormat != want.SampleFormat {
+				t.Fatalf("got format %+v, want %+v", reader.SampleFormat, want.SampleFormat)
+			}
+			if reader.NumSamples() != len(wantSamples) || reader.Duration() != want.Duration {
+				t.Fatalf("got %d samples lasting %vs, want %d lasting %vs",
+					reader.NumSamples(), reader.Duration(), len(wantSamples), want.Duration)
+			}
+
+			var got []float64
+			for _, size := range []int{1, 3, 1000, 7} {
+				buf := make([]float64, size)
+				n, err := reader.ReadSamples(buf)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, buf[:n]...)
+			}
+			buf := make([]float64, 4096)
+			for {
+				n, err := reader.ReadSamples(buf)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, buf[:n]...)
+			}
+
+			assertSamples(t, got, wantSamples)
+		})
+	}
+}
+
+func TestReadWavInfoFile(t *testing.T) {
+	for name, file := range readerTestFiles() {
+		t.Run(name, func(t *testing.T) {
+			want, err := readWavInfo(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ReadWavInfo(writeTestFile(t, "test.wav", file))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.SampleFormat != want.SampleFormat || got.Duration != want.Duration || !bytes.Equal(got.Data, want.Data) {
+				t.Fatalf("got %+v with %d bytes, want %+v with %d bytes",
+					got.SampleFormat, len(got.Data), want.SampleFormat, len(want.Data))
+			}
+			assertTags(t, got.Tags, want.Tags)
+		})
+	}
+}
+
+func TestWavDecoderProbe(t *testing.T) {
+	for name, file := range readerTestFiles() {
+		t.Run(name, func(t *testing.T) {
+			want, err := readWavInfo(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := wavDecoder{}.Probe(bytes.NewReader(file))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if info.Channels != want.Channels || info.SampleRate != want.SampleRate || info.Duration != want.Duration {
+				t.Fatalf("got %+v, want %+v lasting %vs", info, want.SampleFormat, want.Duration)
+			}
+			assertTags(t, info.Tags, want.Tags)
+		})
+	}
+}
+
+func TestDecodeFileStreams(t *testing.T) {
+	for name, file := range readerTestFiles() {
+		t.Run(name, func(t *testing.T) {
+			want, err := readWavInfo(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantSamples, err := decodeSamples(want.Data, want.AudioFormat, want.BitsPerSample)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			audio, err := DecodeFile(context.Background(), writeTestFile(t, "test.wav", file))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if audio.Channels != want.Channels || audio.SampleRate != want.SampleRate {
+				t.Fatalf("got %d channels at %d Hz, want %+v", audio.Channels, audio.SampleRate, want.SampleFormat)
+			}
+			assertSamples(t, audio.Samples, wantSamples)
+		})
+	}
+}
+
+func TestStreamReadsWholeFrames(t *testing.T) {
+	file := riff(fmtChunk(formatPCM, 2, 44100, 16, 0), chunk("data", pcm16(1, 2, 3, 4, 5, 6)))
+
+	stream, err := wavDecoder{}.Open(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A buffer of 3 samples holds a single stereo frame
+	buf := make([]float64, 3)
+	for i := 0; i < 3; i++ {
+		if n, err := stream.Read(buf); n != 2 || err != nil {
+			t.Fatalf("read %d: got %d samples and %v, want 2 samples", i, n, err)
+		}
+	}
+	if n, err := stream.Read(buf); n != 0 || err != io.EOF {
+		t.Fatalf("got %d samples and %v, want io.EOF", n, err)
+	}
+}
+
+func TestReadPCMSamples(t *testing.T) {
+	long := make([]int16, 3*pcmBlockFrames+5)
+	for i := range long {
+		long[i] = int16(i*13 - 20000)
+	}
+
+	tests := []struct {
+		name          string
+		pcm           []byte
+		bitsPerSample int
+		channels      int
+	}{
+		{"16-bit mono over several blocks", pcm16(long...), 16, 1},
+		{"16-bit stereo", pcm16(long[:2*pcmBlockFrames+6]...), 16, 2},
+		{"8-bit", []byte{0, 128, 255}, 8, 1},
+		{"empty", nil, 16, 1},
+		{"incomplete frame", pcm16(1, 2, 3), 16, 2},
+		{"incomplete sample", []byte{1, 2, 3}, 16, 1},
+		{"unsupported format", pcm16(1, 2), 12, 1},
+		{"no channels", pcm16(1, 2), 16, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, wantErr := PCMBytesToSamples(tt.pcm, tt.bitsPerSample, tt.channels)
+
+			got, err := ReadPCMSamples(iotest.HalfReader(bytes.NewReader(tt.pcm)), tt.bitsPerSample, tt.channels)
+			if (err != nil) != (wantErr != nil) {
+				t.Fatalf("got error %v, want %v", err, wantErr)
+			}
+			assertSamples(t, got, want)
+		})
+	}
+}
+
+func assertTags(t *testing.T, got, want map[string]string) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("got tags %v, want %v", got, want)
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Fatalf("got tags %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package wav
+
+import "math"
+
+// resampleHalfTaps is half the length of the anti-aliasing filter applied
+// before downsampling. The filter spans 2*resampleHalfTaps+1 input frames.
+const resampleHalfTaps = 32
+
+// resampler converts interleaved samples to another sample rate chunk by
+// chunk, with the same result as converting them all at once. When
+// downsampling, the signal is first low-pass filtered below the new Nyquist
+// frequency, so that higher frequencies don't alias into the lower ones.
+// Samples are then linearly interpolated.
+type resampler struct {
+	channels int
+	inRate   int64
+	outRate  int64
+	taps     []float64 // anti-aliasing filter, nil unless downsampling
+
+	history  []float64 // input frames the filter still needs
+	filtered []float64 // filtered frames still needed by the interpolation
+	base     int64     // index of filtered[0] in the whole filtered signal
+	outFrame int64     // index of the next output frame
+}
+
+func newResampler(channels, inRate, outRate int) *resampler {
+	r := &resampler{channels: channels, inRate: int64(inRate), outRate: int64(outRate)}
+	if outRate < inRate {
+		r.taps = lowPassTaps(float64(outRate) / float64(inRate))
+		// The first frames are filtered as if the signal was preceded by silence
+		r.history = make([]float64, resampleHalfTaps*channels)
+	}
+	return r
+}
+
+// lowPassTaps returns a Blackman-windowed sinc filter passing the frequencies
+// below ratio times the Nyquist frequency. The cutoff leaves room for the
+// transition band of the filter, so it is attenuated at the new Nyquist frequency.
+func lowPassTaps(ratio float64) []float64 {
+	n := 2*resampleHalfTaps + 1
+	transition := 5.5 / float64(n) // width of the transition band of a Blackman window, in cycles per sample
+	cutoff := ratio/2 - transition/2
+	if cutoff < ratio/4 {
+		cutoff = ratio / 4
+	}
+
+	taps := make([]float64, n)
+	sum := 0.0
+	for i := range taps {
+		x := float64(i - resampleHalfTaps)
+		sinc := 2 * cutoff
+		if x != 0 {
+			sinc = math.Sin(2*math.Pi*cutoff*x) / (math.Pi * x)
+		}
+		window := 0.42 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n-1)) + 0.08*math.Cos(4*math.Pi*float64(i)/float64(n-1))
+		taps[i] = sinc * window
+		sum += taps[i]
+	}
+
+	// Unity gain for the frequencies that pass
+	for i := range taps {
+		taps[i] /= sum
+	}
+	return taps
+}
+
+// write resamples the next interleaved samples. The output lags behind the
+// input, the last frames are returned by flush.
+func (r *resampler) write(samples []float64) []float64 {
+	if r.inRate == r.outRate {
+		return samples
+	}
+	r.filtered = append(r.filtered, r.lowPass(samples, false)...)
+	return r.interpolate(false)
+}
+
+// flush returns the frames of the end of the signal.
+func (r *resampler) flush() []float64 {
+	if r.inRate == r.outRate {
+		return nil
+	}
+	r.filtered = append(r.filtered, r.lowPass(nil, true)...)
+	return r.interpolate(true)
+}
+
+// lowPass filters samples with the anti-aliasing filter. Each output frame
+// needs the resampleHalfTaps frames following it, so the output lags behind
+// the input until the signal is padded with silence on the final call.
+func (r *resampler) lowPass(samples []float64, final bool) []float64 {
+	if r.taps == nil {
+		return samples
+	}
+
+	r.history = append(r.history, samples...)
+	if final {
+		r.history = append(r.history, make([]float64, resampleHalfTaps*r.channels)...)
+	}
+
+	frames := len(r.history)/r.channels - 2*resampleHalfTaps
+	if frames <= 0 {
+		return nil
+	}
+
+	out := make([]float64, frames*r.channels)
+	for i := 0; i < frames; i++ {
+		window := r.history[i*r.channels:]
+		for c := 0; c < r.channels; c++ {
+			sum := 0.0
+			for k, tap := range r.taps {
+				sum += tap * window[k*r.channels+c]
+			}
+			out[i*r.channels+c] = sum
+		}
+	}
+
+	r.history = append(r.history[:0], r.history[frames*r.channels:]...)
+	return out
+}
+
+// interpolate computes the output frames between the filtered frames available.
+// Output frame j is at position j*inRate/outRate of the filtered signal.
+func (r *resampler) interpolate(final bool) []float64 {
+	var out []float64
+	end := r.base + int64(len(r.filtered)/r.channels)
+
+	for {
+		pos := r.outFrame * r.inRate
+		idx := pos / r.outRate
+		if idx >= end {
+			break
+		}
+		next := idx + 1
+		if next >= end {
+			if !final {
+				break
+			}
+			next = end - 1
+		}
+
+		frac := float64(pos%r.outRate) / float64(r.outRate)
+		s0 := r.filtered[(idx-r.base)*int64(r.channels):]
+		s1 := r.filtered[(next-r.base)*int64(r.channels):]
+		for c := 0; c < r.channels; c++ {
+			out = append(out, s0[c]+(s1[c]-s0[c])*frac)
+		}
+		r.outFrame++
+	}
+
+	// Drop the frames before the next output frame
+	drop := r.outFrame*r.inRate/r.outRate - r.base
+	if drop > end-r.base {
+		drop = end - r.base
+	}
+	if drop > 0 {
+		r.filtered = append(r.filtered[:0], r.filtered[drop*int64(r.channels):]...)
+		r.base += drop
+	}
+
+	return out
+}
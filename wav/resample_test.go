@@ -0,0 +1,88 @@
+package wav
+
+import (
+	"math"
+	"testing"
+)
+
+func tone(freq float64, sampleRate, frames, channels int) []float64 {
+	samples := make([]float64, frames*channels)
+	for i := 0; i < frames; i++ {
+		for c := 0; c < channels; c++ {
+			samples[i*channels+c] = 0.5 * math.Sin(2*math.Pi*freq*float64(i)/float64(sampleRate))
+		}
+	}
+	return samples
+}
+
+// rms returns the RMS of the first channel, leaving out the edges of the signal.
+func rms(samples []float64, channels int) float64 {
+	frames := len(samples) / channels
+	sum, n := 0.0, 0
+	for i := frames / 10; i < frames*9/10; i++ {
+		sum += samples[i*channels] * samples[i*channels]
+		n++
+	}
+	return math.Sqrt(sum / float64(n))
+}
+
+func TestResampleAttenuatesAliases(t *testing.T) {
+	tests := []struct {
+		name    string
+		freq    float64
+		wantMin float64
+		wantMax float64
+	}{
+		// 0.5 amplitude sine waves have an RMS of 0.354
+		{"passband", 1000, 0.34, 0.36},
+		{"above the new Nyquist frequency", 23000, 0, 0.01},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			audio := &Audio{Samples: tone(tt.freq, 48000, 48000, 1), Channels: 1, SampleRate: 48000}
+
+			resampled := audio.Resample(44100)
+			if resampled.SampleRate != 44100 {
+				t.Fatalf("got a sample rate of %d, want 44100", resampled.SampleRate)
+			}
+			if frames := len(resampled.Samples); frames < 44099 || frames > 44101 {
+				t.Fatalf("got %d frames, want 44100", frames)
+			}
+
+			if got := rms(resampled.Samples, 1); got < tt.wantMin || got > tt.wantMax {
+				t.Fatalf("got an RMS of %v, want between %v and %v", got, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestResamplerChunksMatchWholeSignal(t *testing.T) {
+	rates := []struct{ in, out int }{{48000, 44100}, {22050, 44100}, {96000, 44100}, {44100, 44100}}
+
+	for _, rate := range rates {
+		samples := tone(440, rate.in, rate.in/2, 2)
+		want := (&Audio{Samples: samples, Channels: 2, SampleRate: rate.in}).Resample(rate.out).Samples
+
+		r := newResampler(2, rate.in, rate.out)
+		var got []float64
+		for _, size := range []int{2, 1000, 6, 30000} {
+			if size > len(samples) {
+				size = len(samples)
+			}
+			got = append(got, r.write(samples[:size])...)
+			samples = samples[size:]
+		}
+		got = append(got, r.write(samples)...)
+		got = append(got, r.flush()...)
+
+		if len(got) != len(want) {
+			t.Fatalf("%d to %d Hz: got %d samples, want %d", rate.in, rate.out, len(got), len(want))
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("%d to %d Hz: sample %d: got %v, want %v", rate.in, rate.out, i, got[i], want[i])
+			}
+		}
+	}
+}
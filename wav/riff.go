@@ -0,0 +1,138 @@
+package wav
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Chunk is a RIFF chunk, identified by its four character code.
+type Chunk struct {
+	ID   string
+	Data []byte
+}
+
+// readChunks walks the chunks of a RIFF/WAVE file. Chunks are padded to an
+// even size, the padding byte isn't part of a chunk's data.
+// A data chunk whose size runs past the end of the file, as written by
+// recorders that never updated it, holds the rest of the file. Other
+// truncated chunks end the walk.
+func readChunks(data []byte) ([]Chunk, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, errors.New("invalid WAV header format")
+	}
+
+	var chunks []Chunk
+	rest := data[12:]
+	for len(rest) >= 8 {
+		id := string(rest[:4])
+		size := uint64(binary.LittleEndian.Uint32(rest[4:8]))
+		body := rest[8:]
+
+		if size > uint64(len(body)) {
+			if id == "data" {
+				chunks = append(chunks, Chunk{ID: id, Data: body})
+			}
+			break
+		}
+
+		chunks = append(chunks, Chunk{ID: id, Data: body[:size]})
+
+		next := size + size%2
+		if next > uint64(len(body)) {
+			break
+		}
+		rest = body[next:]
+	}
+
+	return chunks, nil
+}
+
+// readFormat parses a fmt chunk.
+func readFormat(chunk []byte) (SampleFormat, error) {
+	var format SampleFormat
+	if len(chunk) < 16 {
+		return format, errors.New("invalid WAV fmt chunk (too small)")
+	}
+
+	format.AudioFormat = int(binary.LittleEndian.Uint16(chunk[0:2]))
+	format.Channels = int(binary.LittleEndian.Uint16(chunk[2:4]))
+	format.SampleRate = int(binary.LittleEndian.Uint32(chunk[4:8]))
+	blockAlign := int(binary.LittleEndian.Uint16(chunk[12:14]))
+	format.BitsPerSample = int(binary.LittleEndian.Uint16(chunk[14:16]))
+
+	// WAVE_FORMAT_EXTENSIBLE stores the actual format in the first two
+	// bytes of the sub-format GUID
+	if format.AudioFormat == formatExtensible {
+		if len(chunk) < 40 {
+			return format, errors.New("invalid WAV fmt chunk (extensible format too small)")
+		}
+		format.AudioFormat = int(binary.LittleEndian.Uint16(chunk[24:26]))
+	}
+
+	if format.Channels < 1 || format.SampleRate < 1 {
+		return format, errors.New("invalid WAV header format")
+	}
+
+	// Samples are stored in whole bytes, e.g. 20-bit samples take 3 bytes
+	format.BitsPerSample = (format.BitsPerSample + 7) / 8 * 8
+	if blockAlign > 0 && blockAlign%format.Channels == 0 && blockAlign/format.Channels*8 > format.BitsPerSample {
+		format.BitsPerSample = blockAlign / format.Channels * 8
+	}
+
+	if !supportedSampleFormat(format.AudioFormat, format.BitsPerSample) {
+		return format, fmt.Errorf("%w: WAV audio format %d with %d bits per sample",
+			ErrUnsupportedFormat, format.AudioFormat, format.BitsPerSample)
+	}
+
+	return format, nil
+}
+
+func readWavInfo(data []byte) (*WavInfo, error) {
+	chunks, err := readChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &WavInfo{Tags: map[string]string{}}
+	var hasFormat, hasData bool
+
+	for _, chunk := range chunks {
+		switch chunk.ID {
+		case "fmt ":
+			if hasFormat {
+				continue
+			}
+			info.SampleFormat, err = readFormat(chunk.Data)
+			if err != nil {
+				return nil, err
+			}
+			hasFormat = true
+		case "data":
+			if hasData {
+				continue
+			}
+			info.Data = chunk.Data
+			hasData = true
+		case "LIST":
+			if len(chunk.Data) >= 4 && string(chunk.Data[:4]) == "INFO" {
+				readInfoSubchunks(chunk.Data[4:], info.Tags)
+			}
+		}
+	}
+
+	if !hasFormat {
+		return nil, errors.New("invalid WAV file (no fmt chunk)")
+	}
+	if !hasData {
+		return nil, errors.New("invalid WAV file (no data chunk)")
+	}
+
+	// Drop a trailing incomplete frame
+	frameSize := info.Channels * info.BitsPerSample / 8
+	info.Data = info.Data[:len(info.Data)-len(info.Data)%frameSize]
+
+	info.Duration = float64(len(info.Data)/frameSize) / float64(info.SampleRate)
+
+	return info, nil
+}
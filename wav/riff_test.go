@@ -0,0 +1,375 @@
+package wav
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+)
+
+// chunk encodes a RIFF chunk, padded to an even size.
+func chunk(id string, data []byte) []byte {
+	out := append([]byte(id), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+	out = append(out, data...)
+	if len(data)%2 != 0 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+// riff encodes a RIFF/WAVE file made of chunks.
+func riff(chunks ...[]byte) []byte {
+	body := []byte("WAVE")
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+	return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+// fmtChunk encodes a fmt chunk. blockAlign is computed when 0.
+func fmtChunk(audioFormat, channels, sampleRate, bitsPerSample, blockAlign int) []byte {
+	if blockAlign == 0 {
+		blockAlign = channels * bitsPerSample / 8
+	}
+	data := binary.LittleEndian.AppendUint16(nil, uint16(audioFormat))
+	data = binary.LittleEndian.AppendUint16(data, uint16(channels))
+	data = binary.LittleEndian.AppendUint32(data, uint32(sampleRate))
+	data = binary.LittleEndian.AppendUint32(data, uint32(sampleRate*blockAlign))
+	data = binary.LittleEndian.AppendUint16(data, uint16(blockAlign))
+	data = binary.LittleEndian.AppendUint16(data, uint16(bitsPerSample))
+	return chunk("fmt ", data)
+}
+
+// extensibleFmtChunk encodes a WAVE_FORMAT_EXTENSIBLE fmt chunk of subFormat.
+func extensibleFmtChunk(subFormat, channels, sampleRate, bitsPerSample int) []byte {
+	blockAlign := channels * bitsPerSample / 8
+	data := binary.LittleEndian.AppendUint16(nil, formatExtensible)
+	data = binary.LittleEndian.AppendUint16(data, uint16(channels))
+	data = binary.LittleEndian.AppendUint32(data, uint32(sampleRate))
+	data = binary.LittleEndian.AppendUint32(data, uint32(sampleRate*blockAlign))
+	data = binary.LittleEndian.AppendUint16(data, uint16(blockAlign))
+	data = binary.LittleEndian.AppendUint16(data, uint16(bitsPerSample))
+	data = binary.LittleEndian.AppendUint16(data, 22)                    // extension size
+	data = binary.LittleEndian.AppendUint16(data, uint16(bitsPerSample)) // valid bits
+	data = binary.LittleEndian.AppendUint32(data, 0)                     // channel mask
+	data = binary.LittleEndian.AppendUint16(data, uint16(subFormat))     // sub-format GUID
+	data = append(data, "\x00\x00\x00\x00\x10\x00\x80\x00\x00\xaa\x00\x38\x9b\x71"...)
+	return chunk("fmt ", data)
+}
+
+func infoChunk(tags map[string]string) []byte {
+	return encodeInfoTags(tags)
+}
+
+func pcm16(samples ...int16) []byte {
+	var data []byte
+	for _, sample := range samples {
+		data = binary.LittleEndian.AppendUint16(data, uint16(sample))
+	}
+	return data
+}
+
+func float32s(samples ...float32) []byte {
+	var data []byte
+	for _, sample := range samples {
+		data = binary.LittleEndian.AppendUint32(data, math.Float32bits(sample))
+	}
+	return data
+}
+
+func float64s(samples ...float64) []byte {
+	var data []byte
+	for _, sample := range samples {
+		data = binary.LittleEndian.AppendUint64(data, math.Float64bits(sample))
+	}
+	return data
+}
+
+func TestReadWavInfo(t *testing.T) {
+	tags := map[string]string{"title": "Title", "artist": "Artist"}
+
+	tests := []struct {
+		name        string
+		file        []byte
+		wantFormat  SampleFormat
+		wantSamples []float64 // mono
+		wantTags    map[string]string
+	}{
+		{
+			name:        "16-bit PCM",
+			file:        riff(fmtChunk(formatPCM, 1, 44100, 16, 0), chunk("data", pcm16(16384, -16384))),
+			wantFormat:  SampleFormat{AudioFormat: formatPCM, Channels: 1, SampleRate: 44100, BitsPerSample: 16},
+			wantSamples: []float64{0.5, -0.5},
+		},
+		{
+			name:        "stereo is down-mixed",
+			file:        riff(fmtChunk(formatPCM, 2, 8000, 16, 0), chunk("data", pcm16(16384, 0, -16384, -16384))),
+			wantFormat:  SampleFormat{AudioFormat: formatPCM, Channels: 2, SampleRate: 8000, BitsPerSample: 16},
+			wantSamples: []float64{0.25, -0.5},
+		},
+		{
+			name: "LIST/INFO before and after the data",
+			file: riff(
+				fmtChunk(formatPCM, 1, 44100, 16, 0),
+				infoChunk(map[string]string{"album": "Album"}),
+				chunk("data", pcm16(16384)),
+				infoChunk(tags),
+			),
+			wantFormat:  SampleFormat{AudioFormat: formatPCM, Channels: 1, SampleRate: 44100, BitsPerSample: 16},
+			wantSamples: []float64{0.5},
+			wantTags:    map[string]string{"title": "Title", "artist": "Artist", "album": "Album"},
+		},
+		{
+			name: "fact chunk",
+			file: riff(
+				fmtChunk(formatFloat, 1, 44100, 32, 0),
+				chunk("fact", binary.LittleEndian.AppendUint32(nil, 2)),
+				chunk("data", float32s(0.25, -1)),
+			),
+			wantFormat:  SampleFormat{AudioFormat: formatFloat, Channels: 1, SampleRate: 44100, BitsPerSample: 32},
+			wantSamples: []float64{0.25, -1},
+		},
+		{
+			name:        "WAVE_FORMAT_EXTENSIBLE",
+			file:        riff(extensibleFmtChunk(formatPCM, 1, 48000, 24), chunk("data", []byte{0, 0, 0x40, 0, 0, 0xc0})),
+			wantFormat:  SampleFormat{AudioFormat: formatPCM, Channels: 1, SampleRate: 48000, BitsPerSample: 24},
+			wantSamples: []float64{0.5, -0.5},
+		},
+		{
+			name:        "24-bit PCM",
+			file:        riff(fmtChunk(formatPCM, 1, 96000, 24, 0), chunk("data", []byte{0xff, 0xff, 0x7f, 0x00, 0x00, 0x80})),
+			wantFormat:  SampleFormat{AudioFormat: formatPCM, Channels: 1, SampleRate: 96000, BitsPerSample: 24},
+			wantSamples: []float64{8388607.0 / 8388608.0, -1},
+		},
+		{
+			name:        "20-bit samples in 3 bytes",
+			file:        riff(fmtChunk(formatPCM, 1, 44100, 20, 3), chunk("data", []byte{0, 0, 0x40})),
+			wantFormat:  SampleFormat{AudioFormat: formatPCM, Channels: 1, SampleRate: 44100, BitsPerSample: 24},
+			wantSamples: []float64{0.5},
+		},
+		{
+			name:        "32-bit PCM",
+			file:        riff(fmtChunk(formatPCM, 1, 44100, 32, 0), chunk("data", binary.LittleEndian.AppendUint32(nil, 1<<30))),
+			wantFormat:  SampleFormat{AudioFormat: formatPCM, Channels: 1, SampleRate: 44100, BitsPerSample: 32},
+			wantSamples: []float64{0.5},
+		},
+		{
+			name:        "64-bit float",
+			file:        riff(fmtChunk(formatFloat, 1, 44100, 64, 0), chunk("data", float64s(-0.125))),
+			wantFormat:  SampleFormat{AudioFormat: formatFloat, Channels: 1, SampleRate: 44100, BitsPerSample: 64},
+			wantSamples: []float64{-0.125},
+		},
+		{
+			name: "odd-sized chunks are padded",
+			file: riff(
+				chunk("junk", []byte{1, 2, 3}),
+				fmtChunk(formatPCM, 1, 8000, 8, 0),
+				chunk("data", []byte{128, 192, 64}),
+				infoChunk(tags),
+			),
+			wantFormat:  SampleFormat{AudioFormat: formatPCM, Channels: 1, SampleRate: 8000, BitsPerSample: 8},
+			wantSamples: []float64{0, 0.5, -0.5},
+			wantTags:    tags,
+		},
+		{
+			name: "truncated data chunk holds the rest of the file",
+			file: append(riff(fmtChunk(formatPCM, 1, 44100, 16, 0)),
+				append([]byte("data\xff\xff\xff\x7f"), pcm16(16384, -16384)...)...),
+			wantFormat:  SampleFormat{AudioFormat: formatPCM, Channels: 1, SampleRate: 44100, BitsPerSample: 16},
+			wantSamples: []float64{0.5, -0.5},
+		},
+		{
+			name:        "incomplete frames are dropped",
+			file:        riff(fmtChunk(formatPCM, 2, 44100, 16, 0), chunk("data", append(pcm16(16384, 16384), 1, 2, 3))),
+			wantFormat:  SampleFormat{AudioFormat: formatPCM, Channels: 2, SampleRate: 44100, BitsPerSample: 16},
+			wantSamples: []float64{0.5},
+		},
+		{
+			name: "truncated chunk after the data ends the walk",
+			file: append(riff(fmtChunk(formatPCM, 1, 44100, 16, 0), chunk("data", pcm16(16384))),
+				[]byte("LIST\xff\x00\x00\x00INFO")...),
+			wantFormat:  SampleFormat{AudioFormat: formatPCM, Channels: 1, SampleRate: 44100, BitsPerSample: 16},
+			wantSamples: []float64{0.5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := readWavInfo(tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if info.SampleFormat != tt.wantFormat {
+				t.Errorf("got format %+v, want %+v", info.SampleFormat, tt.wantFormat)
+			}
+
+			samples, err := WavBytesToSamples(info.Data, info.SampleFormat)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertSamples(t, samples, tt.wantSamples)
+
+			wantTags := tt.wantTags
+			if wantTags == nil {
+				wantTags = map[string]string{}
+			}
+			if len(info.Tags) != len(wantTags) {
+				t.Fatalf("got tags %v, want %v", info.Tags, wantTags)
+			}
+			for key, value := range wantTags {
+				if info.Tags[key] != value {
+					t.Errorf("got tags %v, want %v", info.Tags, wantTags)
+				}
+			}
+		})
+	}
+}
+
+func TestReadWavInfoErrors(t *testing.T) {
+	tests := []struct {
+		name            string
+		file            []byte
+		wantUnsupported bool
+	}{
+		{name: "empty", file: nil},
+		{name: "not RIFF", file: []byte("RIFX\x00\x00\x00\x00WAVE")},
+		{name: "not WAVE", file: []byte("RIFF\x00\x00\x00\x00AVI ")},
+		{name: "no fmt chunk", file: riff(chunk("data", pcm16(1)))},
+		{name: "no data chunk", file: riff(fmtChunk(formatPCM, 1, 44100, 16, 0))},
+		{name: "truncated fmt chunk", file: append(riff(), []byte("fmt \x10\x00\x00\x00\x01\x00")...)},
+		{name: "fmt chunk too small", file: riff(chunk("fmt ", []byte{1, 0, 1, 0}), chunk("data", pcm16(1)))},
+		{name: "no channels", file: riff(fmtChunk(formatPCM, 0, 44100, 16, 2), chunk("data", pcm16(1)))},
+		{name: "no sample rate", file: riff(fmtChunk(formatPCM, 1, 0, 16, 0), chunk("data", pcm16(1)))},
+		{name: "extensible fmt chunk too small", file: riff(fmtChunk(formatExtensible, 1, 44100, 16, 0), chunk("data", pcm16(1)))},
+		{name: "ADPCM", file: riff(fmtChunk(2, 1, 44100, 4, 0), chunk("data", pcm16(1))), wantUnsupported: true},
+		{name: "16-bit float", file: riff(fmtChunk(formatFloat, 1, 44100, 16, 0), chunk("data", pcm16(1))), wantUnsupported: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := readWavInfo(tt.file)
+			if err == nil {
+				t.Fatalf("got %+v, want an error", info)
+			}
+			if unsupported := errors.Is(err, ErrUnsupportedFormat); unsupported != tt.wantUnsupported {
+				t.Fatalf("got %v, want an unsupported format error: %v", err, tt.wantUnsupported)
+			}
+		})
+	}
+}
+
+func TestReadChunks(t *testing.T) {
+	file := riff(chunk("one ", []byte{1}), chunk("two ", []byte{2, 3}), chunk("data", []byte{4, 5, 6}))
+
+	chunks, err := readChunks(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Chunk{{"one ", []byte{1}}, {"two ", []byte{2, 3}}, {"data", []byte{4, 5, 6}}}
+	if len(chunks) != len(want) {
+		t.Fatalf("got %d chunks, want %d", len(chunks), len(want))
+	}
+	for i := range want {
+		if chunks[i].ID != want[i].ID || !bytes.Equal(chunks[i].Data, want[i].Data) {
+			t.Errorf("chunk %d: got %q %v, want %q %v", i, chunks[i].ID, chunks[i].Data, want[i].ID, want[i].Data)
+		}
+	}
+
+	// The padding byte of the last chunk may be missing
+	chunks, err = readChunks(file[:len(file)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != len(want) || !bytes.Equal(chunks[2].Data, want[2].Data) {
+		t.Fatalf("got %v without the last padding byte, want %v", chunks, want)
+	}
+}
+
+func assertSamples(t *testing.T, got, want []float64) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("got samples %v, want %v", got, want)
+	}
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 1e-9 {
+			t.Fatalf("got samples %v, want %v", got, want)
+		}
+	}
+}
+
+// fuzzSeeds are valid and malformed files the fuzz tests start from.
+func fuzzSeeds() [][]byte {
+	return [][]byte{
+		riff(fmtChunk(formatPCM, 1, 44100, 16, 0), chunk("data", pcm16(1, 2, 3))),
+		riff(fmtChunk(formatPCM, 2, 44100, 24, 0), infoChunk(map[string]string{"title": "Title"}), chunk("data", []byte{1, 2, 3, 4, 5, 6})),
+		riff(extensibleFmtChunk(formatFloat, 1, 48000, 32), chunk("fact", []byte{1, 0, 0, 0}), chunk("data", float32s(0.5))),
+		riff(chunk("junk", []byte{1}), fmtChunk(formatPCM, 1, 8000, 8, 0), chunk("data", []byte{1, 2, 3}), infoChunk(map[string]string{"artist": "Artist"})),
+		append(riff(fmtChunk(formatPCM, 1, 44100, 16, 0)), []byte("data\xff\xff\xff\xff\x01\x02\x03")...),
+		[]byte("RIFF\x00\x00\x00\x00WAVE"),
+	}
+}
+
+func FuzzReadChunks(f *testing.F) {
+	for _, seed := range fuzzSeeds() {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		chunks, err := readChunks(data)
+		if err != nil {
+			return
+		}
+
+		// Chunks follow each other in the file, after the RIFF header
+		offset := 12
+		for _, c := range chunks {
+			if len(c.ID) != 4 {
+				t.Fatalf("got chunk ID %q", c.ID)
+			}
+			start := offset + 8
+			if start+len(c.Data) > len(data) || !bytes.Equal(data[start:start+len(c.Data)], c.Data) {
+				t.Fatalf("chunk %q isn't the data following its header at %d", c.ID, offset)
+			}
+			offset = start + len(c.Data) + len(c.Data)%2
+		}
+	})
+}
+
+func FuzzReadWavInfo(f *testing.F) {
+	for _, seed := range fuzzSeeds() {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		info, err := readWavInfo(data)
+		if err != nil {
+			return
+		}
+
+		if info.Channels < 1 || info.SampleRate < 1 || !supportedSampleFormat(info.AudioFormat, info.BitsPerSample) {
+			t.Fatalf("got invalid format %+v", info.SampleFormat)
+		}
+
+		frameSize := info.Channels * info.BitsPerSample / 8
+		if len(info.Data)%frameSize != 0 {
+			t.Fatalf("got %d bytes of data, not a multiple of the frame size %d", len(info.Data), frameSize)
+		}
+
+		samples, err := WavBytesToSamples(info.Data, info.SampleFormat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(samples) != len(info.Data)/frameSize {
+			t.Fatalf("got %d samples from %d frames", len(samples), len(info.Data)/frameSize)
+		}
+		for _, sample := range samples {
+			if info.AudioFormat == formatPCM && (sample < -1 || sample > 1) {
+				t.Fatalf("got PCM sample %v out of range", sample)
+			}
+		}
+	})
+}
@@ -0,0 +1,183 @@
+package wav
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/dhowden/tag"
+)
+
+// infoTags maps the RIFF INFO chunk IDs to the keys ffprobe uses for them.
+var infoTags = map[string]string{
+	"INAM": "title",
+	"IART": "artist",
+	"IPRD": "album",
+	"ICMT": "comment",
+	"ICRD": "date",
+	"IGNR": "genre",
+}
+
+// readInfoSubchunks reads the tags of the body of a LIST/INFO chunk into tags.
+func readInfoSubchunks(body []byte, tags map[string]string) {
+	for len(body) >= 8 {
+		id := string(body[:4])
+		size := int(binary.LittleEndian.Uint32(body[4:8]))
+		if size < 0 || size > len(body)-8 {
+			return
+		}
+
+		if key, ok := infoTags[id]; ok {
+			value := body[8 : 8+size]
+			// Values are NUL terminated
+			if end := bytes.IndexByte(value, 0); end >= 0 {
+				value = value[:end]
+			}
+			tags[key] = string(value)
+		}
+
+		next := 8 + size + size%2
+		if next > len(body) {
+			return
+		}
+		body = body[next:]
+	}
+}
+
+// encodeInfoTags builds a LIST/INFO chunk holding the tags that have an INFO chunk ID.
+func encodeInfoTags(tags map[string]string) []byte {
+	ids := make([]string, 0, len(infoTags))
+	for id := range infoTags {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	body := []byte("INFO")
+	for _, id := range ids {
+		value, ok := tags[infoTags[id]]
+		if !ok || value == "" {
+			continue
+		}
+
+		data := append([]byte(value), 0)
+		body = append(body, id...)
+		body = binary.LittleEndian.AppendUint32(body, uint32(len(data)))
+		body = append(body, data...)
+		if len(data)%2 != 0 {
+			body = append(body, 0)
+		}
+	}
+
+	if len(body) == 4 {
+		return nil
+	}
+
+	chunk := []byte("LIST")
+	chunk = binary.LittleEndian.AppendUint32(chunk, uint32(len(body)))
+	return append(chunk, body...)
+}
+
+// WriteTags replaces the tags of a WAV file with the given ones, stored in a
+// LIST/INFO chunk after the audio data. Keys are the ones ffprobe uses,
+// e.g. title, artist and album. The audio data is copied to a new file
+// rather than read into memory.
+func WriteTags(filePath string, tags map[string]string) error {
+	reader, err := OpenReader(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to read WAV file: %v", err)
+	}
+	defer reader.Close()
+
+	tmpFile := filePath + ".tmp"
+	defer os.Remove(tmpFile)
+
+	f, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+
+	err = writeTaggedWav(f, reader, encodeInfoTags(tags))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write tags: %v", err)
+	}
+
+	return os.Rename(tmpFile, filePath)
+}
+
+// writeTaggedWav writes a WAV file with the audio data of reader, followed by
+// the trailer chunks, like writeWav.
+func writeTaggedWav(w io.Writer, reader *Reader, trailer []byte) error {
+	dataSize := int64(reader.NumSamples()) * int64(reader.frameSize)
+
+	bw := bufio.NewWriter(w)
+	err := writeWavHeader(bw, int(dataSize), reader.SampleRate, reader.Channels, reader.BitsPerSample, reader.AudioFormat, len(trailer))
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.CopyN(bw, reader.r, dataSize); err != nil {
+		return err
+	}
+
+	// Chunks are padded to an even size
+	if dataSize%2 != 0 {
+		if err := bw.WriteByte(0); err != nil {
+			return err
+		}
+	}
+
+	if _, err := bw.Write(trailer); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// readTags reads the ID3, Vorbis comment or MP4 tags of r, keyed like
+// ffprobe tags. Files without tags have no tags rather than an error.
+func readTags(r io.ReadSeeker) map[string]string {
+	tags := map[string]string{}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return tags
+	}
+
+	m, err := tag.ReadFrom(r)
+	if err != nil {
+		return tags
+	}
+
+	values := map[string]string{
+		"title":   m.Title(),
+		"artist":  m.Artist(),
+		"album":   m.Album(),
+		"genre":   m.Genre(),
+		"comment": m.Comment(),
+	}
+	if m.Year() > 0 {
+		values["date"] = strconv.Itoa(m.Year())
+	}
+	// ISRC has no accessor, it's stored in TSRC frames (ID3), ISRC comments
+	// (Vorbis) or isrc atoms (MP4)
+	for _, key := range []string{"TSRC", "ISRC", "isrc"} {
+		if isrc, ok := m.Raw()[key].(string); ok && isrc != "" {
+			values["isrc"] = isrc
+			break
+		}
+	}
+
+	for key, value := range values {
+		if value != "" {
+			tags[key] = value
+		}
+	}
+
+	return tags
+}
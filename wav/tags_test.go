@@ -0,0 +1,45 @@
+package wav
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestWriteTags(t *testing.T) {
+	tags := map[string]string{"title": "New title", "artist": "New artist", "album": "New album"}
+
+	for name, file := range readerTestFiles() {
+		t.Run(name, func(t *testing.T) {
+			filePath := writeTestFile(t, "test.wav", file)
+			if err := WriteTags(filePath, tags); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := os.ReadFile(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The file is the one writeWav would write from the whole data
+			info, err := readWavInfo(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want bytes.Buffer
+			err = writeWav(&want, info.Data, info.SampleRate, info.Channels, info.BitsPerSample, info.AudioFormat, encodeInfoTags(tags))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want.Bytes()) {
+				t.Fatalf("got a %d bytes file, want %d bytes", len(got), want.Len())
+			}
+
+			gotInfo, err := readWavInfo(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertTags(t, gotInfo.Tags, tags)
+		})
+	}
+}
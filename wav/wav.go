@@ -2,11 +2,13 @@ package wav
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"math"
 	"os"
 	"os/exec"
 )
@@ -28,9 +30,9 @@ type WavHeader struct {
 	Subchunk2Size uint32
 }
 
-func writeWavHeader(f *os.File, data []byte, sampleRate int, channels int, bitsPerSample int) error {
+func writeWavHeader(f io.Writer, dataSize int, sampleRate int, channels int, bitsPerSample int, audioFormat int, trailerSize int) error {
 	// Validate input
-	if len(data)%channels != 0 {
+	if dataSize%channels != 0 {
 		return errors.New("data size not divisible by channels")
 	}
 
@@ -38,16 +40,16 @@ func writeWavHeader(f *os.File, data []byte, sampleRate int, channels int, bitsP
 	subchunk1Size := uint32(16) // Assuming PCM format
 	bytesPerSample := bitsPerSample / 8
 	blockAlign := uint16(channels * bytesPerSample)
-	subchunk2Size := uint32(len(data))
+	subchunk2Size := uint32(dataSize)
 
 	// Build WAV header
 	header := WavHeader{
 		ChunkID:       [4]byte{'R', 'I', 'F', 'F'},
-		ChunkSize:     uint32(36 + len(data)),
+		ChunkSize:     uint32(36 + dataSize + dataSize%2 + trailerSize),
 		Format:        [4]byte{'W', 'A', 'V', 'E'},
 		Subchunk1ID:   [4]byte{'f', 'm', 't', ' '},
 		Subchunk1Size: subchunk1Size,
-		AudioFormat:   uint16(1), // PCM format
+		AudioFormat:   uint16(audioFormat),
 		NumChannels:   uint16(channels),
 		SampleRate:    uint32(sampleRate),
 		BytesPerSec:   uint32(sampleRate * channels * bytesPerSample),
@@ -62,13 +64,9 @@ func writeWavHeader(f *os.File, data []byte, sampleRate int, channels int, bitsP
 	return err
 }
 
-func WriteWavFile(filename string, data []byte, sampleRate int, channels int, bitsPerSample int) error {
-	f, err := os.Create(filename)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
+// writeWav writes a WAV file with the given sample data, followed by the
+// trailer chunks, if any.
+func writeWav(f io.Writer, data []byte, sampleRate int, channels int, bitsPerSample int, audioFormat int, trailer []byte) error {
 	if sampleRate <= 0 || channels <= 0 || bitsPerSample <= 0 {
 		return fmt.Errorf(
 			"values must be greater than zero (sampleRate: %d, channels: %d, bitsPerSample: %d)",
@@ -76,99 +74,225 @@ func WriteWavFile(filename string, data []byte, sampleRate int, channels int, bi
 		)
 	}
 
-	err = writeWavHeader(f, data, sampleRate, channels, bitsPerSample)
+	err := writeWavHeader(f, len(data), sampleRate, channels, bitsPerSample, audioFormat, len(trailer))
 	if err != nil {
 		return err
 	}
 
-	_, err = f.Write(data)
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+
+	// Chunks are padded to an even size
+	if len(data)%2 != 0 {
+		if _, err = f.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+
+	_, err = f.Write(trailer)
 	return err
 }
 
-// WavInfo defines a struct containing information extracted from the WAV header
+func WriteWavFile(filename string, data []byte, sampleRate int, channels int, bitsPerSample int) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return writeWav(f, data, sampleRate, channels, bitsPerSample, formatPCM, nil)
+}
+
+// WavInfo defines a struct containing information extracted from the WAV chunks
 type WavInfo struct {
-	Channels   int
-	SampleRate int
-	Data       []byte
-	Duration   float64
+	SampleFormat                   // from the fmt chunk
+	Data         []byte            // the data chunk, trimmed to whole frames
+	Duration     float64           // in seconds
+	Tags         map[string]string // LIST/INFO tags, keyed like ffprobe tags
+}
+
+// SampleFormat describes how the samples of the data chunk are encoded.
+type SampleFormat struct {
+	AudioFormat   int // formatPCM or formatFloat, WAVE_FORMAT_EXTENSIBLE is resolved to its sub-format
+	Channels      int
+	SampleRate    int
+	BitsPerSample int // size of the sample container, e.g. 32 for 24-bit samples stored in 4 bytes
 }
 
+// Audio formats of the fmt chunk
+const (
+	formatPCM        = 1
+	formatFloat      = 3
+	formatExtensible = 0xFFFE
+)
+
+// ReadWavInfo reads the format, samples and tags of a WAV file. Only the data
+// chunk is read into memory, use OpenReader to read the samples incrementally.
 func ReadWavInfo(filename string) (*WavInfo, error) {
-	data, err := ioutil.ReadFile(filename)
+	file, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
+	defer file.Close()
 
-	if len(data) < 44 {
-		return nil, errors.New("invalid WAV file size (too small)")
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
 	}
 
-	// Read header chunks
-	var header WavHeader
-	err = binary.Read(bytes.NewReader(data[:44]), binary.LittleEndian, &header)
+	reader, err := NewReader(file)
 	if err != nil {
 		return nil, err
 	}
+	reader.limitFrames(stat.Size())
 
-	if string(header.ChunkID[:]) != "RIFF" || string(header.Format[:]) != "WAVE" || header.AudioFormat != 1 {
-		return nil, errors.New("invalid WAV header format")
+	data := make([]byte, reader.numFrames*reader.frameSize)
+	if _, err := io.ReadFull(reader.r, data); err != nil {
+		return nil, fmt.Errorf("invalid WAV data chunk: %v", err)
 	}
+	readTrailingTags(file, reader.dataEnd(), reader.Tags)
 
-	// Extract information
-	info := &WavInfo{
-		Channels:   int(header.NumChannels),
-		SampleRate: int(header.SampleRate),
-		Data:       data[44:],
+	return &WavInfo{
+		SampleFormat: reader.SampleFormat,
+		Data:         data,
+		Duration:     reader.Duration(),
+		Tags:         reader.Tags,
+	}, nil
+}
+
+// WavBytesToSamples converts the data chunk of a .wav file to mono float64 samples
+// in the range [-1, 1]. Multi-channel audio is down-mixed by averaging the channels.
+func WavBytesToSamples(input []byte, format SampleFormat) ([]float64, error) {
+	if format.Channels < 1 {
+		return nil, fmt.Errorf("invalid number of channels: %d", format.Channels)
 	}
 
-	// Calculate audio duration (assuming data contains PCM data)
-	if header.BitsPerSample == 16 {
-		info.Duration = float64(len(info.Data)) / float64(int(header.NumChannels)*2*int(header.SampleRate))
-	} else {
-		return nil, errors.New("unsupported bits per sample format")
+	samples, err := decodeSamples(input, format.AudioFormat, format.BitsPerSample)
+	if err != nil {
+		return nil, err
 	}
 
-	return info, nil
+	if len(samples)%format.Channels != 0 {
+		return nil, errors.New("invalid input length")
+	}
+
+	return downmix(samples, format.Channels), nil
 }
 
-// WavBytesToFloat64 converts a slice of bytes from a .wav file to a slice of float64 samples
-func WavBytesToSamples(input []byte) ([]float64, error) {
-	if len(input)%2 != 0 {
-		return nil, errors.New("invalid input length")
+// PCMBytesToSamples converts interleaved little-endian PCM bytes to mono float64 samples
+// in the range [-1, 1]. Multi-channel audio is down-mixed by averaging the channels.
+func PCMBytesToSamples(input []byte, bitsPerSample, channels int) ([]float64, error) {
+	return WavBytesToSamples(input, SampleFormat{AudioFormat: formatPCM, Channels: channels, BitsPerSample: bitsPerSample})
+}
+
+// pcmBlockFrames is the number of frames ReadPCMSamples decodes at once.
+const pcmBlockFrames = 1 << 14
+
+// ReadPCMSamples reads interleaved little-endian PCM audio from r and converts
+// it like PCMBytesToSamples. The audio is decoded in blocks as it is read, so
+// that the PCM bytes are never held in memory as a whole.
+func ReadPCMSamples(r io.Reader, bitsPerSample, channels int) ([]float64, error) {
+	if channels < 1 {
+		return nil, fmt.Errorf("invalid number of channels: %d", channels)
+	}
+	if !supportedSampleFormat(formatPCM, bitsPerSample) {
+		return nil, fmt.Errorf("%w: audio format %d with %d bits per sample",
+			ErrUnsupportedFormat, formatPCM, bitsPerSample)
+	}
+
+	frameSize := channels * bitsPerSample / 8
+	buf := make([]byte, pcmBlockFrames*frameSize)
+	var samples []float64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n%frameSize != 0 {
+			return nil, errors.New("invalid input length")
+		}
+		if n > 0 {
+			block, decodeErr := decodeSamples(buf[:n], formatPCM, bitsPerSample)
+			if decodeErr != nil {
+				return nil, decodeErr
+			}
+			samples = append(samples, downmix(block, channels)...)
+		}
+
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return samples, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func supportedSampleFormat(audioFormat, bitsPerSample int) bool {
+	switch audioFormat {
+	case formatPCM:
+		return bitsPerSample == 8 || bitsPerSample == 16 || bitsPerSample == 24 || bitsPerSample == 32
+	case formatFloat:
+		return bitsPerSample == 32 || bitsPerSample == 64
+	}
+	return false
+}
+
+// decodeSamples converts little-endian sample bytes to float64 samples in the
+// range [-1, 1], keeping the channels interleaved.
+func decodeSamples(input []byte, audioFormat, bitsPerSample int) ([]float64, error) {
+	if !supportedSampleFormat(audioFormat, bitsPerSample) {
+		return nil, fmt.Errorf("%w: audio format %d with %d bits per sample",
+			ErrUnsupportedFormat, audioFormat, bitsPerSample)
 	}
 
-	numSamples := len(input) / 2
-	output := make([]float64, numSamples)
+	bytesPerSample := bitsPerSample / 8
+	if len(input)%bytesPerSample != 0 {
+		return nil, errors.New("invalid input length")
+	}
 
-	for i := 0; i < len(input); i += 2 {
-		// Interpret bytes as a 16-bit signed integer (little-endian)
-		sample := int16(binary.LittleEndian.Uint16(input[i : i+2]))
+	output := make([]float64, len(input)/bytesPerSample)
+	for i := range output {
+		b := input[i*bytesPerSample : (i+1)*bytesPerSample]
 
-		// Scale the sample to the range [-1, 1]
-		output[i/2] = float64(sample) / 32768.0
+		switch {
+		case audioFormat == formatFloat && bitsPerSample == 32:
+			output[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+		case audioFormat == formatFloat:
+			output[i] = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		case bitsPerSample == 8:
+			output[i] = (float64(b[0]) - 128) / 128.0 // 8-bit PCM is unsigned
+		case bitsPerSample == 16:
+			output[i] = float64(int16(binary.LittleEndian.Uint16(b))) / 32768.0
+		case bitsPerSample == 24:
+			output[i] = float64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)>>8) / 8388608.0
+		case bitsPerSample == 32:
+			output[i] = float64(int32(binary.LittleEndian.Uint32(b))) / 2147483648.0
+		}
 	}
 
 	return output, nil
 }
 
+// downmix averages the interleaved channels of samples into a single channel.
+func downmix(samples []float64, channels int) []float64 {
+	if channels == 1 {
+		return samples
+	}
+
+	mono := make([]float64, len(samples)/channels)
+	for i := range mono {
+		sum := 0.0
+		for _, sample := range samples[i*channels : (i+1)*channels] {
+			sum += sample
+		}
+		mono[i] = sum / float64(channels)
+	}
+	return mono
+}
+
 // FFmpegMetadata represents the metadata structure returned by ffprobe.
 type FFmpegMetadata struct {
-	Streams []struct {
-		Index         int               `json:"index"`
-		CodecName     string            `json:"codec_name"`
-		CodecLongName string            `json:"codec_long_name"`
-		CodecType     string            `json:"codec_type"`
-		SampleFmt     string            `json:"sample_fmt"`
-		SampleRate    string            `json:"sample_rate"`
-		Channels      int               `json:"channels"`
-		ChannelLayout string            `json:"channel_layout"`
-		BitsPerSample int               `json:"bits_per_sample"`
-		Duration      string            `json:"duration"`
-		BitRate       string            `json:"bit_rate"`
-		Disposition   map[string]int    `json:"disposition"`
-		Tags          map[string]string `json:"tags"`
-	} `json:"streams"`
-	Format struct {
+	Streams []FFmpegStream `json:"streams"`
+	Format  struct {
 		Streams        int               `json:"nb_streams"`
 		FormFilename   string            `json:"filename"`
 		NbatName       string            `json:"format_name"`
@@ -181,11 +305,38 @@ type FFmpegMetadata struct {
 	} `json:"format"`
 }
 
-// GetMetadata retrieves metadata from a file using ffprobe.
-func GetMetadata(filePath string) (FFmpegMetadata, error) {
+// FFmpegStream represents a stream in the metadata returned by ffprobe.
+type FFmpegStream struct {
+	Index         int               `json:"index"`
+	CodecName     string            `json:"codec_name"`
+	CodecLongName string            `json:"codec_long_name"`
+	CodecType     string            `json:"codec_type"`
+	SampleFmt     string            `json:"sample_fmt"`
+	SampleRate    string            `json:"sample_rate"`
+	Channels      int               `json:"channels"`
+	ChannelLayout string            `json:"channel_layout"`
+	BitsPerSample int               `json:"bits_per_sample"`
+	Duration      string            `json:"duration"`
+	BitRate       string            `json:"bit_rate"`
+	Disposition   map[string]int    `json:"disposition"`
+	Tags          map[string]string `json:"tags"`
+}
+
+// GetMetadata retrieves metadata from a file. Formats with a native decoder
+// are probed natively, other formats using ffprobe.
+func GetMetadata(ctx context.Context, filePath string) (FFmpegMetadata, error) {
+	metadata, err := probeMetadata(filePath)
+	if errors.Is(err, ErrUnsupportedFormat) {
+		return ffprobeMetadata(ctx, filePath)
+	}
+	return metadata, err
+}
+
+// ffprobeMetadata retrieves metadata from a file using ffprobe.
+func ffprobeMetadata(ctx context.Context, filePath string) (FFmpegMetadata, error) {
 	var metadata FFmpegMetadata
 
-	cmd := exec.Command("ffprobe", "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", filePath)
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", filePath)
 	var out bytes.Buffer
 	cmd.Stdout = &out
 	err := cmd.Run()